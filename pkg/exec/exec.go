@@ -3,104 +3,217 @@
 package exec
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
 	osexec "os/exec"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
 
-var testMode bool
+// Executor runs commands on the host. Code that runs commands should take an
+// Executor rather than calling os/exec directly, so that tests can substitute
+// a FakeExecutor.
+type Executor interface {
+	// LookPath looks for a program in $PATH and returns either the full
+	// path or an error
+	LookPath(program string) (string, error)
+	// Exec executes a command with the given arguments and returns either
+	// the combined stdout+stderr, or an error.
+	Exec(cmd string, args ...string) (string, error)
+	// ExecWithInput is like Exec, but also passes input to the command on
+	// stdin.
+	ExecWithInput(input string, cmd string, args ...string) (string, error)
+	// ExecWithTimeout is like ExecWithInput, but the command (and any
+	// processes it started) is killed, and a TimeoutError returned, if it
+	// has not completed within timeout. (0 means no timeout.)
+	ExecWithTimeout(timeout time.Duration, input string, cmd string, args ...string) (string, error)
+	// ExecWithCancel is like ExecWithTimeout, but the command is also
+	// killed, and a CanceledError returned, if cancel is closed before it
+	// completes. (If cancel is already closed, the command is not run.)
+	// A nil cancel is never closed.
+	ExecWithCancel(cancel <-chan struct{}, timeout time.Duration, input string, cmd string, args ...string) (string, error)
+}
 
-// LookPath looks for a program in $PATH and returns either the full path or an error
-func LookPath(program string) (string, error) {
-	if testMode {
-		return testModeLookPath(program)
-	}
+// ExitError is the error returned by Exec() when a command runs but exits with
+// a non-zero status
+type ExitError struct {
+	Cmd    string
+	Args   []string
+	Status int
+}
 
-	return osexec.LookPath(program)
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s failed: '%s %s': exit status %d", e.Cmd, e.Cmd, strings.Join(e.Args, " "), e.Status)
 }
 
-// Exec executes a command with the given arguments and returns either the
-// combined stdout+stdin, or an error.
-func Exec(cmd string, args ...string) (string, error) {
-	if testMode {
-		return testModeExec(cmd, args...)
-	}
+// TimeoutError is the error returned by ExecWithTimeout() when a command is
+// killed for running longer than its timeout
+type TimeoutError struct {
+	Cmd     string
+	Args    []string
+	Timeout time.Duration
+}
 
-	glog.V(5).Infof("[cmd] %s %s", cmd, strings.Join(args, " "))
-	out, err := osexec.Command(cmd, args...).CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("%s failed: '%s %s': %v", cmd, cmd, strings.Join(args, " "), err)
-	} else if glog.V(5) {
-		lines := strings.Split(string(out), "\n")
-		for i, line := range lines {
-			if i < len(lines)-1 || len(line) > 0 {
-				glog.V(5).Infof("[cmd]   => %s", line)
-			}
-		}
-	}
-	return string(out), err
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s failed: '%s %s': timed out after %v", e.Cmd, e.Cmd, strings.Join(e.Args, " "), e.Timeout)
 }
 
-// For testing
+// CanceledError is the error returned by ExecWithCancel() when a command is
+// killed (or not run) because its cancel channel was closed
+type CanceledError struct {
+	Cmd  string
+	Args []string
+}
 
-var testPrograms map[string]string
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("%s failed: '%s %s': canceled", e.Cmd, e.Cmd, strings.Join(e.Args, " "))
+}
 
-type TestResult struct {
-	command string
-	output  string
-	err     error
+// New returns an Executor that runs commands for real
+func New() Executor {
+	return executor{}
 }
 
-var testResults []TestResult
+type executor struct{}
 
-// SetTestMode turns on "test mode". In test mode, the output of LookPath() and
-// Exec() is determined by prior calls to AddTestProgram() and AddTestResult().
-func SetTestMode() {
-	testMode = true
-	testPrograms = make(map[string]string)
+func (executor) LookPath(program string) (string, error) {
+	return osexec.LookPath(program)
 }
 
-// AddTestProgram takes the full path to a program and allows that program to be
-// be found via LookPath().
-func AddTestProgram(path string) {
-	lastSlash := strings.LastIndex(path, "/")
-	basename := path[lastSlash+1:]
-	testPrograms[basename] = path
+func (e executor) Exec(cmd string, args ...string) (string, error) {
+	return e.ExecWithInput("", cmd, args...)
 }
 
-// AddTestResult tells exec to expect a call to Exec() with the given command
-// line, and to return the given output or error in response. You must call
-// AddTestResult() once for every time that Exec() will be called, in order.
-func AddTestResult(command string, output string, err error) {
-	testResults = append(testResults, TestResult{command, output, err})
+func (e executor) ExecWithInput(input string, cmd string, args ...string) (string, error) {
+	return e.ExecWithTimeout(0, input, cmd, args...)
 }
 
-func testModeLookPath(program string) (string, error) {
-	path, ok := testPrograms[program]
-	if !ok {
-		return "", fmt.Errorf("Not found: %s", program)
-	}
-	return path, nil
+func (e executor) ExecWithTimeout(timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	return e.ExecWithCancel(nil, timeout, input, cmd, args...)
+}
+
+// lockedBuffer is a bytes.Buffer that can be written and read concurrently
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
 }
 
-func testModeExec(cmd string, args ...string) (string, error) {
-	var command string
-	if len(args) > 0 {
-		command = cmd + " " + strings.Join(args, " ")
-	} else {
-		command = cmd
+func (executor) ExecWithCancel(cancel <-chan struct{}, timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	select {
+	case <-cancel:
+		return "", &CanceledError{Cmd: cmd, Args: args}
+	default:
+	}
+
+	glog.V(5).Infof("[cmd] %s %s", cmd, strings.Join(args, " "))
+	command := osexec.Command(cmd, args...)
+	// Run the command in its own process group, so that if it has to be
+	// killed, any processes it started can be killed along with it
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if input != "" {
+		if glog.V(5) {
+			for _, line := range strings.Split(strings.TrimSuffix(input, "\n"), "\n") {
+				glog.V(5).Infof("[cmd]   <= %s", line)
+			}
+		}
+		command.Stdin = strings.NewReader(input)
 	}
 
-	if len(testResults) == 0 {
-		panic(fmt.Sprintf("Ran out of testResults executing: %s", command))
+	// Collect the output through our own pipe rather than letting
+	// os/exec do it, since Wait() would otherwise also wait for any
+	// processes that the command left holding the pipe open
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: '%s %s': %v", cmd, cmd, strings.Join(args, " "), err)
 	}
+	defer r.Close()
+	command.Stdout = w
+	command.Stderr = w
+	err = command.Start()
+	w.Close()
+
+	var out lockedBuffer
+	if err == nil {
+		copied := make(chan struct{})
+		go func() {
+			io.Copy(&out, r)
+			close(copied)
+		}()
+		waited := make(chan error, 1)
+		go func() {
+			waited <- command.Wait()
+		}()
+
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
 
-	result := testResults[0]
-	testResults = testResults[1:]
-	if command != result.command {
-		panic(fmt.Sprintf("Wrong exec command: expected %v, got %v", result.command, command))
+		// Wait for the command to exit and for all of its output to be
+		// read, unless the timeout expires or cancel is closed first
+		var stopErr error
+		for stopErr == nil && (waited != nil || copied != nil) {
+			select {
+			case err = <-waited:
+				waited = nil
+			case <-copied:
+				copied = nil
+			case <-expired:
+				stopErr = &TimeoutError{Cmd: cmd, Args: args, Timeout: timeout}
+			case <-cancel:
+				stopErr = &CanceledError{Cmd: cmd, Args: args}
+			}
+		}
+		if stopErr != nil {
+			// Kill the command and anything it started
+			syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+			if waited != nil {
+				<-waited
+			}
+			err = stopErr
+		}
+	}
+	output := out.String()
+
+	switch err.(type) {
+	case nil:
+		if glog.V(5) {
+			lines := strings.Split(output, "\n")
+			for i, line := range lines {
+				if i < len(lines)-1 || len(line) > 0 {
+					glog.V(5).Infof("[cmd]   => %s", line)
+				}
+			}
+		}
+	case *TimeoutError, *CanceledError:
+	case *osexec.ExitError:
+		if status := err.(*osexec.ExitError).Sys().(syscall.WaitStatus); status.Exited() {
+			err = &ExitError{Cmd: cmd, Args: args, Status: status.ExitStatus()}
+		} else {
+			err = fmt.Errorf("%s failed: '%s %s': %v", cmd, cmd, strings.Join(args, " "), err)
+		}
+	default:
+		err = fmt.Errorf("%s failed: '%s %s': %v", cmd, cmd, strings.Join(args, " "), err)
 	}
-	return result.output, result.err
+	return output, err
 }
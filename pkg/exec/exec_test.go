@@ -4,83 +4,266 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
-func init() {
-	SetTestMode()
-	AddTestProgram("/bin/true")
-	AddTestProgram("/bin/echo")
-	AddTestProgram("/bin/false")
+func newFake() *FakeExecutor {
+	return NewFakeExecutor("/bin/true", "/bin/echo", "/bin/false", "/bin/cat")
 }
 
 func TestLookPath(t *testing.T) {
-	path, err := LookPath("true")
+	f := newFake()
+	path, err := f.LookPath("true")
 	if err != nil || path != "/bin/true" {
 		t.Fatalf("Unexpected LookPath failure: %s, %v", path, err)
 	}
-	path, err = LookPath("echo")
+	path, err = f.LookPath("echo")
 	if err != nil || path != "/bin/echo" {
 		t.Fatalf("Unexpected LookPath failure: %s, %v", path, err)
 	}
-	path, err = LookPath("false")
+	path, err = f.LookPath("false")
 	if err != nil || path != "/bin/false" {
 		t.Fatalf("Unexpected LookPath failure: %s, %v", path, err)
 	}
 
-	path, err = LookPath("missing")
+	path, err = f.LookPath("missing")
 	if err == nil {
 		t.Fatalf("Unexpected LookPath success: %s, %v", path, err)
 	}
 }
 
 func TestExecSuccess(t *testing.T) {
-	AddTestResult("/bin/true", "", nil)
-	AddTestResult("/bin/echo some args", "some args", nil)
+	f := newFake()
+	f.AddResult("/bin/true", "", nil)
+	f.AddResult("/bin/echo some args", "some args", nil)
 
-	out, err := Exec("/bin/true")
+	out, err := f.Exec("/bin/true")
 	if err != nil {
 		t.Fatalf("Unexpected error from command: %v", err)
 	}
-	out, err = Exec("/bin/echo", "some", "args")
+	out, err = f.Exec("/bin/echo", "some", "args")
 	if err != nil {
 		t.Fatalf("Unexpected error from command: %v", err)
 	}
 	if out != "some args" {
 		t.Fatalf("Unexpected output from command: %s", out)
 	}
+	if err = f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
 }
 
 func TestExecFailure(t *testing.T) {
-	AddTestResult("/bin/false", "", fmt.Errorf("Exit with status 1"))
+	f := newFake()
+	f.AddResult("/bin/false", "", fmt.Errorf("Exit with status 1"))
 
-	_, err := Exec("/bin/false")
+	_, err := f.Exec("/bin/false")
 	if err == nil {
 		t.Fatalf("Failed to get expected error")
 	}
 	if err.Error() != "Exit with status 1" {
 		t.Fatalf("Failed to get expected error: %v", err)
 	}
+	// An expected error is not a failure
+	if err = f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+}
+
+func TestExecWithInput(t *testing.T) {
+	f := newFake()
+	f.AddResultWithInput("/bin/cat", "some input\n", "some input\n", nil)
+
+	out, err := f.ExecWithInput("some input\n", "/bin/cat")
+	if err != nil {
+		t.Fatalf("Unexpected error from command: %v", err)
+	}
+	if out != "some input\n" {
+		t.Fatalf("Unexpected output from command: %s", out)
+	}
+}
+
+func TestExecWrongInput(t *testing.T) {
+	f := newFake()
+	f.AddResultWithInput("/bin/cat", "line 1\nexpected\nline 3\n", "", nil)
+	_, err := f.ExecWithInput("line 1\nunexpected\nline 3\n", "/bin/cat")
+	if err == nil {
+		t.Fatalf("Failed to get error due to wrong input")
+	}
+	expected := `wrong input for "/bin/cat" (-expected +actual):
+  line 1
+- expected
++ unexpected
+  line 3`
+	if err.Error() != expected {
+		t.Fatalf("Wrong error:\n%v\nexpected:\n%s", err, expected)
+	}
+	if err = f.Verify(); err == nil || !strings.Contains(err.Error(), "- expected") || !strings.Contains(err.Error(), "was not run: /bin/cat") {
+		t.Fatalf("Wrong error from Verify: %v", err)
+	}
 }
 
 func TestExecNoResults(t *testing.T) {
-	defer func() {
-		out := recover()
-		if !strings.HasPrefix(out.(string), "Ran out of testResults") {
-			t.Fatalf("panic()ed for wrong reason")
-		}
-	}()
-	Exec("/bin/true")
-	t.Fatalf("Failed to panic due to missing testResults")
+	f := newFake()
+	_, err := f.Exec("/bin/true")
+	if err == nil || !strings.Contains(err.Error(), "no more commands were expected") {
+		t.Fatalf("Wrong error due to missing results: %v", err)
+	}
+	if err = f.Verify(); err == nil {
+		t.Fatalf("Verify failed to report unexpected command")
+	}
 }
 
 func TestExecWrongResults(t *testing.T) {
-	defer func() {
-		out := recover()
-		if !strings.HasPrefix(out.(string), "Wrong exec command") {
-			t.Fatalf("panic()ed for wrong reason")
+	f := newFake()
+	f.AddResult("/bin/echo foo", "", nil)
+	_, err := f.Exec("/bin/echo", "bar")
+	if err == nil {
+		t.Fatalf("Failed to get error due to wrong command")
+	}
+	expected := `unexpected command (-expected +actual):
+- /bin/echo foo
++ /bin/echo bar`
+	if err.Error() != expected {
+		t.Fatalf("Wrong error:\n%v\nexpected:\n%s", err, expected)
+	}
+}
+
+func TestExecOrdering(t *testing.T) {
+	f := newFake()
+	f.AddResult("/bin/echo 1", "1", nil)
+	f.AddResult("/bin/echo 2", "2", nil)
+	f.AddResult("/bin/echo 3", "3", nil).AnyOrder()
+	f.AddResult("/bin/true", "", nil).AnyTimes()
+
+	// Ordered commands must be run in order
+	if _, err := f.Exec("/bin/echo", "2"); err == nil {
+		t.Fatalf("Unexpectedly ran command out of order")
+	}
+	// Unordered ones can run at any point, and AnyTimes() ones any
+	// number of times
+	for _, cmd := range []string{"/bin/true", "/bin/echo 1", "/bin/true", "/bin/echo 3", "/bin/echo 2"} {
+		args := strings.Split(cmd, " ")
+		if _, err := f.Exec(args[0], args[1:]...); err != nil {
+			t.Fatalf("Unexpected error from %q: %v", cmd, err)
 		}
+	}
+	if _, err := f.Exec("/bin/echo", "3"); err == nil {
+		t.Fatalf("Unexpectedly ran command too many times")
+	}
+
+	err := f.Verify()
+	if err == nil {
+		t.Fatalf("Verify failed to report errors")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 4 || lines[1] != "- /bin/echo 1" || lines[3] != `unexpected command "/bin/echo 3": no more commands were expected` {
+		t.Fatalf("Wrong errors from Verify:\n%v", err)
+	}
+}
+
+func TestExecPatterns(t *testing.T) {
+	f := newFake()
+	f.AddPatternResult(`/bin/echo [0-9]+`, "number", nil).Times(2)
+	f.AddPatternResult(`/bin/cat .*`, "", nil).WithInput("input\n")
+
+	for _, arg := range []string{"1", "23"} {
+		if out, err := f.Exec("/bin/echo", arg); err != nil || out != "number" {
+			t.Fatalf("Unexpected result from pattern: %q, %v", out, err)
+		}
+	}
+	if _, err := f.ExecWithInput("input\n", "/bin/cat", "-"); err != nil {
+		t.Fatalf("Unexpected error from pattern with input: %v", err)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+
+	// The pattern must match the whole command
+	f = newFake()
+	f.AddPatternResult(`/bin/echo [0-9]+`, "number", nil)
+	if _, err := f.Exec("/bin/echo", "12a"); err == nil {
+		t.Fatalf("Pattern unexpectedly matched")
+	}
+	if err := f.Verify(); err == nil || !strings.Contains(err.Error(), "was not run: //bin/echo [0-9]+/") {
+		t.Fatalf("Wrong error from Verify: %v", err)
+	}
+}
+
+func TestExecTimes(t *testing.T) {
+	f := newFake()
+	f.AddResult("/bin/true", "", nil).Times(3)
+	f.Exec("/bin/true")
+	if err := f.Verify(); err == nil || !strings.Contains(err.Error(), "ran 1 of 3 times") {
+		t.Fatalf("Wrong error from Verify: %v", err)
+	}
+}
+
+func TestExecReal(t *testing.T) {
+	e := New()
+	path, err := e.LookPath("cat")
+	if err != nil {
+		t.Skipf("cat is not installed: %v", err)
+	}
+	out, err := e.ExecWithInput("some input\n", path)
+	if err != nil || out != "some input\n" {
+		t.Fatalf("Unexpected result from %s: %q, %v", path, out, err)
+	}
+	if _, err = e.Exec(path, "/nonexistent"); err == nil {
+		t.Fatalf("Failed to get expected error")
+	}
+
+	start := time.Now()
+	_, err = e.ExecWithTimeout(10*time.Millisecond, "", "sleep", "10")
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Timeout != 10*time.Millisecond {
+		t.Fatalf("Expected TimeoutError, got %#v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Command was not killed at its timeout")
+	}
+	if _, err = e.ExecWithTimeout(5*time.Second, "", path, "/dev/null"); err != nil {
+		t.Fatalf("Unexpected error from command that finished before its timeout: %v", err)
+	}
+
+	// Processes started by the command are killed too, and don't keep
+	// ExecWithTimeout waiting for their output
+	start = time.Now()
+	_, err = e.ExecWithTimeout(100*time.Millisecond, "", "sh", "-c", "sleep 5; true")
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("Expected TimeoutError, got %#v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("Command's children were not killed at its timeout")
+	}
+	// Output from before the timeout is returned
+	out, err = e.ExecWithTimeout(5*time.Second, "", "sh", "-c", "echo started; sleep 5 >/dev/null 2>&1 & echo done")
+	if err != nil || out != "started\ndone\n" {
+		t.Fatalf("Unexpected result from command with background child: %q, %v", out, err)
+	}
+}
+
+func TestExecRealCancel(t *testing.T) {
+	e := New()
+	if _, err := e.LookPath("sleep"); err != nil {
+		t.Skipf("sleep is not installed: %v", err)
+	}
+
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cancel)
 	}()
-	AddTestResult("/bin/true", "", nil)
-	Exec("/bin/false")
-	t.Fatalf("Failed to panic due to wrong command")
+	start := time.Now()
+	_, err := e.ExecWithCancel(cancel, 0, "", "sh", "-c", "sleep 10; true")
+	if _, ok := err.(*CanceledError); !ok {
+		t.Fatalf("Expected CanceledError, got %#v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Command was not killed when canceled")
+	}
+
+	// Nothing is run once cancel is closed
+	if _, err := e.ExecWithCancel(cancel, 0, "", "/nonexistent"); err == nil || err.Error() != "/nonexistent failed: '/nonexistent ': canceled" {
+		t.Fatalf("Expected CanceledError, got %#v", err)
+	}
 }
@@ -0,0 +1,323 @@
+package exec
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeExecutor is an Executor for use in tests, which returns canned results
+// rather than running commands. Each test should create its own FakeExecutor,
+// declare the commands it expects with AddResult() and friends, and then call
+// Verify() at the end to check that exactly those commands were run.
+//
+// By default, expected commands must be run in the order they were added;
+// commands marked with AnyOrder() may instead be run at any point. If a command
+// doesn't match any expectation, ExecWithInput() returns an error (including a
+// diff against the command that was expected next), and Verify() will fail.
+type FakeExecutor struct {
+	lock     sync.Mutex
+	programs map[string]string
+	expected []*FakeCommand
+	errors   []string
+}
+
+// FakeCommand is a command expected by a FakeExecutor
+type FakeCommand struct {
+	// command is the expected command line, or the source of pattern
+	command string
+	pattern *regexp.Regexp
+	input   *string
+	output  string
+	err     error
+	hang    bool
+
+	ordered bool
+	// times is the number of times the command is expected, or -1 for any
+	// number of times
+	times int
+	count int
+}
+
+// NewFakeExecutor returns a new FakeExecutor, which will allow the indicated
+// programs (given as full paths) to be found by LookPath().
+func NewFakeExecutor(programs ...string) *FakeExecutor {
+	f := &FakeExecutor{programs: make(map[string]string)}
+	for _, path := range programs {
+		f.AddProgram(path)
+	}
+	return f
+}
+
+// AddProgram takes the full path to a program and allows that program to be
+// be found via LookPath().
+func (f *FakeExecutor) AddProgram(path string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	lastSlash := strings.LastIndex(path, "/")
+	basename := path[lastSlash+1:]
+	f.programs[basename] = path
+}
+
+// AddResult tells the executor to expect a call to Exec() with the given
+// command line, and to return the given output or error in response.
+func (f *FakeExecutor) AddResult(command string, output string, err error) *FakeCommand {
+	return f.AddResultWithInput(command, "", output, err)
+}
+
+// AddResultWithInput is like AddResult, but for a call to ExecWithInput() that
+// is expected to pass the given input to the command.
+func (f *FakeExecutor) AddResultWithInput(command string, input string, output string, err error) *FakeCommand {
+	return f.add(&FakeCommand{command: command, input: &input, output: output, err: err})
+}
+
+// AddPatternResult is like AddResult, but the command line is matched against
+// pattern, a regular expression which must match the entire command line.
+// Unless WithInput() is also used, any input is accepted.
+func (f *FakeExecutor) AddPatternResult(pattern string, output string, err error) *FakeCommand {
+	return f.add(&FakeCommand{command: pattern, pattern: regexp.MustCompile("^(?:" + pattern + ")$"), output: output, err: err})
+}
+
+func (f *FakeExecutor) add(c *FakeCommand) *FakeCommand {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	c.ordered = true
+	c.times = 1
+	f.expected = append(f.expected, c)
+	return c
+}
+
+// WithInput requires the command to be passed the given input
+func (c *FakeCommand) WithInput(input string) *FakeCommand {
+	c.input = &input
+	return c
+}
+
+// AnyOrder allows the command to be run at any point, rather than only after
+// the commands that were added before it.
+func (c *FakeCommand) AnyOrder() *FakeCommand {
+	c.ordered = false
+	return c
+}
+
+// Times expects the command to be run n times rather than once
+func (c *FakeCommand) Times(n int) *FakeCommand {
+	c.times = n
+	return c
+}
+
+// AnyTimes allows the command to be run any number of times (including none),
+// at any point.
+func (c *FakeCommand) AnyTimes() *FakeCommand {
+	c.times = -1
+	c.ordered = false
+	return c
+}
+
+// Hang makes the command behave as though it had hung: if it is run with a
+// timeout, it returns a TimeoutError (immediately); otherwise, if it is run
+// with a cancel channel, it blocks until that is closed and then returns a
+// CanceledError; and otherwise it returns an error, which Verify() will also
+// report.
+func (c *FakeCommand) Hang() *FakeCommand {
+	c.hang = true
+	return c
+}
+
+func (c *FakeCommand) String() string {
+	if c.pattern != nil {
+		return "/" + c.command + "/"
+	}
+	return c.command
+}
+
+func (c *FakeCommand) done() bool {
+	return c.times >= 0 && c.count >= c.times
+}
+
+func (c *FakeCommand) matchesCommand(command string) bool {
+	if c.pattern != nil {
+		return c.pattern.MatchString(command)
+	}
+	return c.command == command
+}
+
+func (c *FakeCommand) matches(command, input string) bool {
+	return c.matchesCommand(command) && (c.input == nil || *c.input == input)
+}
+
+// mismatch describes how command and input differ from c
+func (c *FakeCommand) mismatch(command, input string) string {
+	if c.matchesCommand(command) {
+		return fmt.Sprintf("wrong input for %q (-expected +actual):\n%s", command, diffLines(*c.input, input))
+	}
+	return fmt.Sprintf("unexpected command (-expected +actual):\n%s", diffLines(c.String(), command))
+}
+
+// LookPath returns the path of a program added with AddProgram()
+func (f *FakeExecutor) LookPath(program string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path, ok := f.programs[program]
+	if !ok {
+		return "", fmt.Errorf("Not found: %s", program)
+	}
+	return path, nil
+}
+
+// Exec returns the result of the matching expected command
+func (f *FakeExecutor) Exec(cmd string, args ...string) (string, error) {
+	return f.ExecWithInput("", cmd, args...)
+}
+
+// ExecWithInput returns the result of the matching expected command
+func (f *FakeExecutor) ExecWithInput(input string, cmd string, args ...string) (string, error) {
+	return f.ExecWithTimeout(0, input, cmd, args...)
+}
+
+// ExecWithTimeout returns the result of the matching expected command, or a
+// TimeoutError if the command was marked with Hang().
+func (f *FakeExecutor) ExecWithTimeout(timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	return f.ExecWithCancel(nil, timeout, input, cmd, args...)
+}
+
+// ExecWithCancel returns the result of the matching expected command, or a
+// CanceledError if cancel is already closed (in which case the command is not
+// considered to have been run). See Hang() for commands marked with it.
+func (f *FakeExecutor) ExecWithCancel(cancel <-chan struct{}, timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	select {
+	case <-cancel:
+		return "", &CanceledError{Cmd: cmd, Args: args}
+	default:
+	}
+	c, err := f.match(input, cmd, args)
+	if err != nil {
+		return "", err
+	}
+	if c.hang {
+		if timeout == 0 && cancel != nil {
+			<-cancel
+			return "", &CanceledError{Cmd: cmd, Args: args}
+		} else if timeout == 0 {
+			command := strings.Join(append([]string{cmd}, args...), " ")
+			msg := fmt.Sprintf("command would hang forever: %s", command)
+			f.lock.Lock()
+			f.errors = append(f.errors, msg)
+			f.lock.Unlock()
+			return "", fmt.Errorf("%s", msg)
+		}
+		return "", &TimeoutError{Cmd: cmd, Args: args, Timeout: timeout}
+	}
+	return c.output, c.err
+}
+
+// match finds and consumes the expected command matching input, cmd and args
+func (f *FakeExecutor) match(input string, cmd string, args []string) (*FakeCommand, error) {
+	command := strings.Join(append([]string{cmd}, args...), " ")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var next, firstUnordered *FakeCommand
+	for _, c := range f.expected {
+		if c.done() {
+			continue
+		}
+		if c.ordered {
+			if next != nil {
+				// must wait for next
+				continue
+			}
+			next = c
+		} else if firstUnordered == nil && c.times >= 0 {
+			firstUnordered = c
+		}
+		if c.matches(command, input) {
+			c.count++
+			return c, nil
+		}
+	}
+
+	var msg string
+	if next == nil {
+		next = firstUnordered
+	}
+	if next != nil {
+		msg = next.mismatch(command, input)
+	} else {
+		msg = fmt.Sprintf("unexpected command %q: no more commands were expected", command)
+	}
+	f.errors = append(f.errors, msg)
+	return nil, fmt.Errorf("%s", msg)
+}
+
+// Verify returns an error describing any unexpected commands that were run
+// and any expected commands that were not, or nil if there were none.
+func (f *FakeExecutor) Verify() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	msgs := append([]string{}, f.errors...)
+	for _, c := range f.expected {
+		if c.times >= 0 && c.count < c.times {
+			msg := fmt.Sprintf("expected command was not run: %s", c)
+			if c.times > 1 {
+				msg += fmt.Sprintf(" (ran %d of %d times)", c.count, c.times)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+}
+
+// diffLines returns a line-by-line diff of expected and actual, with removed
+// lines prefixed by "-", added lines prefixed by "+", and common lines
+// prefixed by " ".
+func diffLines(expected, actual string) string {
+	a := strings.Split(strings.TrimSuffix(expected, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(actual, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	return strings.Join(out, "\n")
+}
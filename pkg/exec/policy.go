@@ -0,0 +1,119 @@
+package exec
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Policy describes how an Executor created with WithPolicy() runs a command.
+// The zero Policy runs the command once, with no timeout.
+type Policy struct {
+	// Timeout is how long to let each attempt at running the command take,
+	// when the caller did not pass a timeout of its own. 0 means no timeout.
+	Timeout time.Duration
+
+	// Retries is the maximum number of times to retry the command after a
+	// transient failure. This should only be non-zero for commands that
+	// are safe to run again after they have partially or fully succeeded.
+	Retries int
+	// Backoff is how long to wait before the first retry; each further
+	// retry waits twice as long as the one before it
+	Backoff time.Duration
+
+	// Transient returns true if a command that failed with err, after
+	// outputting output, is worth retrying. If nil, IsTransient is used.
+	Transient func(output string, err error) bool
+}
+
+// IdempotentPolicy is a Policy for commands that can safely be killed and
+// re-run if they hang or fail transiently
+var IdempotentPolicy = Policy{
+	Timeout: 30 * time.Second,
+	Retries: 3,
+	Backoff: 500 * time.Millisecond,
+}
+
+// PolicyFunc returns the Policy to use when running cmd with args
+type PolicyFunc func(cmd string, args []string) Policy
+
+// transientMessages are error messages from commands which indicate a failure
+// that may go away if the command is retried
+var transientMessages = []string{
+	// ovs-vsctl/ovs-ofctl when ovsdb-server or ovs-vswitchd is restarting
+	"database connection failed",
+	"Connection refused",
+	// iptables when another process holds the xtables lock
+	"Another app is currently holding the xtables lock",
+}
+
+// IsTransient returns true if err is an ExitError from a command whose output
+// contains a known transient error message. (A TimeoutError is not considered
+// transient; a command that hung once will likely hang again.)
+func IsTransient(output string, err error) bool {
+	if _, ok := err.(*ExitError); ok {
+		for _, msg := range transientMessages {
+			if strings.Contains(output, msg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithPolicy returns an Executor that runs each command with execer according
+// to the Policy that policyFor returns for it.
+func WithPolicy(execer Executor, policyFor PolicyFunc) Executor {
+	return &policyExecutor{execer: execer, policyFor: policyFor}
+}
+
+type policyExecutor struct {
+	execer    Executor
+	policyFor PolicyFunc
+}
+
+func (p *policyExecutor) LookPath(program string) (string, error) {
+	return p.execer.LookPath(program)
+}
+
+func (p *policyExecutor) Exec(cmd string, args ...string) (string, error) {
+	return p.ExecWithTimeout(0, "", cmd, args...)
+}
+
+func (p *policyExecutor) ExecWithInput(input string, cmd string, args ...string) (string, error) {
+	return p.ExecWithTimeout(0, input, cmd, args...)
+}
+
+func (p *policyExecutor) ExecWithTimeout(timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	return p.ExecWithCancel(nil, timeout, input, cmd, args...)
+}
+
+// ExecWithCancel runs the command according to its policy. Closing cancel
+// kills the current attempt and prevents any further retries.
+func (p *policyExecutor) ExecWithCancel(cancel <-chan struct{}, timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	policy := p.policyFor(cmd, args)
+	if timeout == 0 {
+		timeout = policy.Timeout
+	}
+	transient := policy.Transient
+	if transient == nil {
+		transient = IsTransient
+	}
+
+	backoff := policy.Backoff
+	for attempt := 0; ; attempt++ {
+		out, err := p.execer.ExecWithCancel(cancel, timeout, input, cmd, args...)
+		if err == nil || attempt >= policy.Retries || !transient(out, err) {
+			return out, err
+		}
+
+		glog.V(2).Infof("Retrying %s in %v after transient error: %v", cmd, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-cancel:
+			return out, err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,186 @@
+package exec
+
+import (
+	"testing"
+	"time"
+)
+
+// testPolicy retries ovs-vsctl, and runs everything else with the zero Policy
+func testPolicy(cmd string, args []string) Policy {
+	if cmd != "ovs-vsctl" {
+		return Policy{}
+	}
+	return Policy{
+		Timeout: 10 * time.Millisecond,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	}
+}
+
+func TestPolicyRetry(t *testing.T) {
+	f := newFake()
+	ovsdbDown := "ovs-vsctl: unix:/var/run/openvswitch/db.sock: database connection failed (No such file or directory)\n"
+	f.AddResult("ovs-vsctl br-exists br0", ovsdbDown, &ExitError{Cmd: "ovs-vsctl", Args: []string{"br-exists", "br0"}, Status: 1})
+	f.AddResult("ovs-vsctl br-exists br0", "", nil)
+
+	e := WithPolicy(f, testPolicy)
+	if _, err := e.Exec("ovs-vsctl", "br-exists", "br0"); err != nil {
+		t.Fatalf("Unexpected error after retry: %v", err)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+
+	// Retries are limited
+	f = newFake()
+	f.AddResult("ovs-vsctl br-exists br0", ovsdbDown, &ExitError{Cmd: "ovs-vsctl", Args: []string{"br-exists", "br0"}, Status: 1}).Times(3)
+	e = WithPolicy(f, testPolicy)
+	out, err := e.Exec("ovs-vsctl", "br-exists", "br0")
+	if exitErr, ok := err.(*ExitError); !ok || exitErr.Status != 1 || out != ovsdbDown {
+		t.Fatalf("Unexpected result after exhausting retries: %q, %v", out, err)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+
+	// Other errors are not retried
+	f = newFake()
+	f.AddResult("ovs-vsctl br-exists br0", "", &ExitError{Cmd: "ovs-vsctl", Args: []string{"br-exists", "br0"}, Status: 2})
+	e = WithPolicy(f, testPolicy)
+	if _, err := e.Exec("ovs-vsctl", "br-exists", "br0"); err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+
+	// Commands whose policy doesn't allow retries are run only once, even
+	// after a transient error
+	f = newFake()
+	f.AddResult("ip link add lbr0 type bridge", "Connection refused\n", &ExitError{Cmd: "ip", Args: []string{"link", "add", "lbr0", "type", "bridge"}, Status: 2})
+	e = WithPolicy(f, testPolicy)
+	if _, err := e.Exec("ip", "link", "add", "lbr0", "type", "bridge"); err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+}
+
+func TestPolicyTimeout(t *testing.T) {
+	// A command that times out is not retried
+	f := newFake()
+	f.AddResult("ovs-vsctl show", "", nil).Hang()
+
+	e := WithPolicy(f, testPolicy)
+	_, err := e.Exec("ovs-vsctl", "show")
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Timeout != 10*time.Millisecond {
+		t.Fatalf("Expected TimeoutError, got %#v", err)
+	}
+	if err.Error() != "ovs-vsctl failed: 'ovs-vsctl show': timed out after 10ms" {
+		t.Fatalf("Wrong error message: %v", err)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+
+	// The caller's timeout overrides the policy's
+	f = newFake()
+	f.AddResult("ovs-vsctl show", "", nil).Hang()
+	e = WithPolicy(f, testPolicy)
+	_, err = e.ExecWithTimeout(time.Minute, "", "ovs-vsctl", "show")
+	if timeoutErr, ok := err.(*TimeoutError); !ok || timeoutErr.Timeout != time.Minute {
+		t.Fatalf("Expected TimeoutError, got %#v", err)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+
+	// Commands with the zero Policy get no timeout
+	f = newFake()
+	f.AddResult("openshift-sdn-docker-setup.sh lbr0 1450", "", nil).Hang()
+	e = WithPolicy(f, testPolicy)
+	if _, err = e.Exec("openshift-sdn-docker-setup.sh", "lbr0", "1450"); err == nil {
+		t.Fatalf("Unexpected success")
+	} else if _, ok := err.(*TimeoutError); ok {
+		t.Fatalf("Command without a timeout timed out")
+	}
+	if err := f.Verify(); err == nil {
+		t.Fatalf("Verify did not report command that would hang")
+	}
+}
+
+func TestPolicyCancel(t *testing.T) {
+	ovsdbDown := "ovs-vsctl: unix:/var/run/openvswitch/db.sock: database connection failed (No such file or directory)\n"
+	exitErr := &ExitError{Cmd: "ovs-vsctl", Args: []string{"br-exists", "br0"}, Status: 1}
+	policy := func(cmd string, args []string) Policy {
+		return Policy{Retries: 3, Backoff: time.Hour}
+	}
+
+	// Canceling during the backoff stops the retries
+	f := newFake()
+	f.AddResult("ovs-vsctl br-exists br0", ovsdbDown, exitErr)
+	e := WithPolicy(f, policy)
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+	if _, err := e.ExecWithCancel(cancel, 0, "", "ovs-vsctl", "br-exists", "br0"); err != exitErr {
+		t.Fatalf("Expected the last error after canceling, got %#v", err)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+
+	// Canceling kills a hung command
+	f = newFake()
+	f.AddResult("ovs-vsctl show", "", nil).Hang()
+	e = WithPolicy(f, policy)
+	cancel = make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(cancel)
+	}()
+	if _, err := e.ExecWithCancel(cancel, 0, "", "ovs-vsctl", "show"); err == nil {
+		t.Fatalf("Unexpected success")
+	} else if _, ok := err.(*CanceledError); !ok {
+		t.Fatalf("Expected CanceledError, got %#v", err)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	exitErr := &ExitError{Cmd: "iptables", Status: 4}
+	for _, tc := range []struct {
+		output    string
+		err       error
+		transient bool
+	}{
+		{"Another app is currently holding the xtables lock. Perhaps you want to use the -w option?\n", exitErr, true},
+		{"iptables: Bad rule (does a matching rule exist in that chain?).\n", exitErr, false},
+		{"", &TimeoutError{Cmd: "iptables"}, false},
+		{"", &CanceledError{Cmd: "iptables"}, false},
+		{"database connection failed", nil, false},
+	} {
+		if IsTransient(tc.output, tc.err) != tc.transient {
+			t.Fatalf("Expected IsTransient(%q, %v) to be %v", tc.output, tc.err, tc.transient)
+		}
+	}
+}
+
+func TestPolicyReal(t *testing.T) {
+	e := WithPolicy(New(), func(cmd string, args []string) Policy {
+		return Policy{Timeout: 10 * time.Millisecond}
+	})
+	path, err := e.LookPath("sleep")
+	if err != nil {
+		t.Skipf("sleep is not installed: %v", err)
+	}
+	_, err = e.Exec(path, "10")
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("Expected TimeoutError, got %#v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package exec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A recording is a plain-text transcript of the commands run by an Executor,
+// which can be replayed with NewReplayer(). It looks like:
+//
+//	# comment
+//	@ ovs-ofctl /usr/bin/ovs-ofctl
+//	$ ovs-ofctl -O OpenFlow13 add-flows br0 -
+//	< table=0, priority=0, actions=drop
+//
+//	$ ovs-vsctl br-exists br0
+//	! exit status 2
+//
+// "@" lines record the result of LookPath() (with no path if the program was
+// not found). Each "$" line starts a command, followed by "<" lines giving its
+// input, ">" lines giving its output, and an optional "!" line giving its
+// error ("exit status N", "timeout <duration>", "canceled", or any other error
+// message).
+// A "\" line means that the preceding input or output did not end with a
+// newline.
+
+// NewRecorder returns an Executor that runs commands with execer, and writes
+// a recording of each command and its result to w.
+func NewRecorder(execer Executor, w io.Writer) Executor {
+	r := &recorder{
+		execer: execer,
+		w:      w,
+		paths:  make(map[string]bool),
+	}
+	r.write("# openshift-sdn command recording\n")
+	return r
+}
+
+type recorder struct {
+	execer Executor
+
+	lock  sync.Mutex
+	w     io.Writer
+	paths map[string]bool
+}
+
+func (r *recorder) write(data string) {
+	if _, err := io.WriteString(r.w, data); err != nil {
+		glog.Warningf("Could not write command recording: %v", err)
+	}
+}
+
+func (r *recorder) LookPath(program string) (string, error) {
+	path, err := r.execer.LookPath(program)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.paths[program] {
+		r.paths[program] = true
+		r.write(strings.TrimSpace("@ "+program+" "+path) + "\n")
+	}
+	return path, err
+}
+
+func (r *recorder) Exec(cmd string, args ...string) (string, error) {
+	return r.ExecWithInput("", cmd, args...)
+}
+
+func (r *recorder) ExecWithInput(input string, cmd string, args ...string) (string, error) {
+	return r.ExecWithTimeout(0, input, cmd, args...)
+}
+
+func (r *recorder) ExecWithTimeout(timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	return r.ExecWithCancel(nil, timeout, input, cmd, args...)
+}
+
+func (r *recorder) ExecWithCancel(cancel <-chan struct{}, timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	out, err := r.execer.ExecWithCancel(cancel, timeout, input, cmd, args...)
+
+	record := "\n$ " + strings.Join(append([]string{cmd}, args...), " ") + "\n"
+	record += recordLines("<", input)
+	record += recordLines(">", out)
+	switch e := err.(type) {
+	case nil:
+	case *ExitError:
+		record += fmt.Sprintf("! exit status %d\n", e.Status)
+	case *TimeoutError:
+		record += fmt.Sprintf("! timeout %v\n", e.Timeout)
+	case *CanceledError:
+		record += "! canceled\n"
+	default:
+		record += "! " + strings.Replace(err.Error(), "\n", " ", -1) + "\n"
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.write(record)
+	return out, err
+}
+
+func recordLines(prefix, data string) string {
+	if data == "" {
+		return ""
+	}
+	var record string
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		record += prefix + " " + line + "\n"
+	}
+	if !strings.HasSuffix(data, "\n") {
+		record += "\\\n"
+	}
+	return record
+}
+
+// NewReplayer reads a recording written by NewRecorder() and returns a
+// FakeExecutor that expects the recorded commands to be run again in the same
+// order, returning the recorded results. Since the recorder writes commands
+// in the order they complete, code that runs commands concurrently may not
+// replay reliably.
+func NewReplayer(r io.Reader) (*FakeExecutor, error) {
+	f := NewFakeExecutor()
+
+	var cmd *FakeCommand
+	var input, output string
+	var last *string
+	flush := func() {
+		if cmd != nil {
+			f.AddResultWithInput(cmd.command, input, output, cmd.err)
+		}
+		cmd = nil
+		input, output = "", ""
+		last = nil
+	}
+
+	reader := bufio.NewReader(r)
+	for lineno := 1; ; lineno++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if line == "" {
+				break
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '@' {
+			words := strings.Fields(line[1:])
+			if len(words) == 2 {
+				f.AddProgram(words[1])
+			} else if len(words) != 1 {
+				return nil, fmt.Errorf("line %d: bad program line %q", lineno, line)
+			}
+			continue
+		}
+		if line[0] == '$' {
+			flush()
+			cmd = &FakeCommand{command: strings.TrimPrefix(line[1:], " ")}
+			continue
+		}
+
+		if cmd == nil {
+			return nil, fmt.Errorf("line %d: %q is not part of a command", lineno, line)
+		}
+		switch line[0] {
+		case '<', '>':
+			if cmd.err != nil {
+				return nil, fmt.Errorf("line %d: %q follows command error", lineno, line)
+			}
+			if line[0] == '<' {
+				if output != "" {
+					return nil, fmt.Errorf("line %d: input %q follows output", lineno, line)
+				}
+				last = &input
+			} else {
+				last = &output
+			}
+			*last += strings.TrimPrefix(line[1:], " ") + "\n"
+		case '\\':
+			if last == nil || !strings.HasSuffix(*last, "\n") {
+				return nil, fmt.Errorf("line %d: %q does not follow input or output", lineno, line)
+			}
+			*last = strings.TrimSuffix(*last, "\n")
+		case '!':
+			if cmd.err != nil {
+				return nil, fmt.Errorf("line %d: command has multiple errors", lineno)
+			}
+			msg := strings.TrimPrefix(line[1:], " ")
+			words := strings.Split(cmd.command, " ")
+			switch {
+			case strings.HasPrefix(msg, "exit status "):
+				status, err := strconv.Atoi(strings.TrimPrefix(msg, "exit status "))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad exit status %q", lineno, line)
+				}
+				cmd.err = &ExitError{Cmd: words[0], Args: words[1:], Status: status}
+			case msg == "canceled":
+				cmd.err = &CanceledError{Cmd: words[0], Args: words[1:]}
+			case strings.HasPrefix(msg, "timeout "):
+				timeout, err := time.ParseDuration(strings.TrimPrefix(msg, "timeout "))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad timeout %q", lineno, line)
+				}
+				cmd.err = &TimeoutError{Cmd: words[0], Args: words[1:], Timeout: timeout}
+			default:
+				cmd.err = errors.New(msg)
+			}
+			last = nil
+		default:
+			return nil, fmt.Errorf("line %d: unrecognized line %q", lineno, line)
+		}
+	}
+	flush()
+	return f, nil
+}
@@ -0,0 +1,150 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	f := newFake()
+	f.AddResult("/bin/echo foo", "foo\n", nil)
+	f.AddResultWithInput("/bin/cat", "line 1\nline 2", "line 1\nline 2", nil)
+	f.AddResult("/bin/false", "", &ExitError{Cmd: "/bin/false", Status: 1})
+	f.AddResult("/bin/echo bar", "partial output", fmt.Errorf("something\nbad"))
+
+	var buf bytes.Buffer
+	r := NewRecorder(f, &buf)
+	run := func(e Executor) []string {
+		var results []string
+		for _, program := range []string{"echo", "cat", "missing", "echo"} {
+			path, err := e.LookPath(program)
+			results = append(results, fmt.Sprintf("%s %v", path, err != nil))
+		}
+		out, err := e.Exec("/bin/echo", "foo")
+		results = append(results, fmt.Sprintf("%q %v", out, err))
+		out, err = e.ExecWithInput("line 1\nline 2", "/bin/cat")
+		results = append(results, fmt.Sprintf("%q %v", out, err))
+		out, err = e.Exec("/bin/false")
+		if _, ok := err.(*ExitError); !ok {
+			t.Fatalf("Expected ExitError, got %#v", err)
+		}
+		results = append(results, fmt.Sprintf("%q %v", out, err))
+		out, err = e.Exec("/bin/echo", "bar")
+		results = append(results, fmt.Sprintf("%q %v", out, err))
+		return results
+	}
+
+	recorded := run(r)
+	if err := f.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+	expected := `# openshift-sdn command recording
+@ echo /bin/echo
+@ cat /bin/cat
+@ missing
+
+$ /bin/echo foo
+> foo
+
+$ /bin/cat
+< line 1
+< line 2
+\
+> line 1
+> line 2
+\
+
+$ /bin/false
+! exit status 1
+
+$ /bin/echo bar
+> partial output
+\
+! something bad
+`
+	if buf.String() != expected {
+		t.Fatalf("Wrong recording (-expected +actual):\n%s", diffLines(expected, buf.String()))
+	}
+
+	replay, err := NewReplayer(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("Unexpected error from NewReplayer: %v", err)
+	}
+	replayed := run(replay)
+	if err := replay.Verify(); err != nil {
+		t.Fatalf("Unexpected error from Verify: %v", err)
+	}
+	// The replayed "something bad" error loses its newline
+	recorded[len(recorded)-1] = strings.Replace(recorded[len(recorded)-1], "\n", " ", -1)
+	if strings.Join(recorded, "\n") != strings.Join(replayed, "\n") {
+		t.Fatalf("Replay did not match recording (-recorded +replayed):\n%s", diffLines(strings.Join(recorded, "\n"), strings.Join(replayed, "\n")))
+	}
+
+	// Commands must be replayed in order
+	replay, _ = NewReplayer(strings.NewReader(buf.String()))
+	if _, err := replay.Exec("/bin/false"); err == nil {
+		t.Fatalf("Unexpectedly replayed command out of order")
+	}
+}
+
+func TestRecordReplayTimeout(t *testing.T) {
+	f := newFake()
+	f.AddResult("ovs-ofctl dump-flows br0", "", &TimeoutError{Cmd: "ovs-ofctl", Args: []string{"dump-flows", "br0"}, Timeout: 30 * time.Second})
+	f.AddResult("ovs-ofctl dump-ports br0", "", &CanceledError{Cmd: "ovs-ofctl", Args: []string{"dump-ports", "br0"}})
+
+	var buf bytes.Buffer
+	r := NewRecorder(f, &buf)
+	_, timeoutErr := r.Exec("ovs-ofctl", "dump-flows", "br0")
+	_, canceledErr := r.Exec("ovs-ofctl", "dump-ports", "br0")
+	if !strings.Contains(buf.String(), "! timeout 30s\n") || !strings.Contains(buf.String(), "! canceled\n") {
+		t.Fatalf("Wrong recording:\n%s", buf.String())
+	}
+
+	replay, err := NewReplayer(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("Unexpected error from NewReplayer: %v", err)
+	}
+	if _, err := replay.Exec("ovs-ofctl", "dump-flows", "br0"); !reflect.DeepEqual(err, timeoutErr) {
+		t.Fatalf("Expected %#v, got %#v", timeoutErr, err)
+	}
+	if _, err := replay.Exec("ovs-ofctl", "dump-ports", "br0"); !reflect.DeepEqual(err, canceledErr) {
+		t.Fatalf("Expected %#v, got %#v", canceledErr, err)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	for _, recording := range []string{
+		"> output without command\n",
+		"$ /bin/cat\n> output\n< input after output\n",
+		"$ /bin/false\n! exit status one\n",
+		"$ /bin/sleep 10\n! timeout forever\n",
+		"$ /bin/false\n! exit status 1\n! exit status 2\n",
+		"$ /bin/true\n\\\n",
+		"$ /bin/true\n? what\n",
+		"@ true /bin/true extra\n",
+	} {
+		if _, err := NewReplayer(strings.NewReader(recording)); err == nil {
+			t.Fatalf("Unexpectedly parsed bad recording %q", recording)
+		}
+	}
+}
+
+func TestRecordReal(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewRecorder(New(), &buf)
+	path, err := e.LookPath("false")
+	if err != nil {
+		t.Skipf("false is not installed: %v", err)
+	}
+	_, err = e.Exec(path)
+	if exitErr, ok := err.(*ExitError); !ok || exitErr.Status != 1 {
+		t.Fatalf("Expected exit status 1, got %v", err)
+	}
+	if !strings.HasSuffix(buf.String(), "\n$ "+path+"\n! exit status 1\n") {
+		t.Fatalf("Wrong recording:\n%s", buf.String())
+	}
+}
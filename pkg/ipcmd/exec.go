@@ -0,0 +1,314 @@
+package ipcmd
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/openshift-sdn/pkg/exec"
+)
+
+var addressRegexp *regexp.Regexp
+
+func init() {
+	addressRegexp = regexp.MustCompile("inet ([0-9.]*/[0-9]*) ")
+}
+
+// execBackend implements the Transaction operations by running "ip"
+type execBackend struct {
+	execer exec.Executor
+	// netns is the path of the network namespace to run "ip" in (with
+	// nsenter), or "" for the current namespace
+	netns string
+}
+
+func (b execBackend) exec(args []string) (string, error) {
+	ipcmdPath, err := b.execer.LookPath("ip")
+	if err != nil {
+		return "", fmt.Errorf("ip is not installed")
+	}
+	if b.netns == "" {
+		return b.execer.Exec(ipcmdPath, args...)
+	}
+
+	nsenterPath, err := b.execer.LookPath("nsenter")
+	if err != nil {
+		return "", fmt.Errorf("nsenter is not installed")
+	}
+	return b.execer.Exec(nsenterPath, append([]string{"--net=" + b.netns, "--", ipcmdPath}, args...)...)
+}
+
+func (b execBackend) run(args []string) error {
+	_, err := b.exec(args)
+	return err
+}
+
+func (b execBackend) addLink(link string, args []string) error {
+	return b.run(append([]string{"link", "add", link}, args...))
+}
+
+func (b execBackend) deleteLink(link string) error {
+	return b.run([]string{"link", "del", link})
+}
+
+func (b execBackend) setLink(link string, args []string) error {
+	return b.run(append([]string{"link", "set", link}, args...))
+}
+
+func (b execBackend) getLink(link string) (*Link, error) {
+	l, peer, master, err := b.getLinkNoLookup(link)
+	if err != nil {
+		return nil, err
+	}
+
+	// "ip link" shows the names of the peer and master, if they're in the
+	// same namespace, so we need to look up their indexes.
+	if peer != "" {
+		peerLink, _, _, err := b.getLinkNoLookup(peer)
+		if err != nil {
+			return nil, err
+		}
+		l.PeerIndex = peerLink.Index
+	}
+	if master != "" {
+		masterLink, _, _, err := b.getLinkNoLookup(master)
+		if err != nil {
+			return nil, err
+		}
+		l.MasterIndex = masterLink.Index
+	}
+	return l, nil
+}
+
+func (b execBackend) getLinkNoLookup(link string) (*Link, string, string, error) {
+	out, err := b.exec([]string{"-o", "link", "show", "dev", link})
+	if err != nil {
+		return nil, "", "", err
+	}
+	return parseLinkLine(out)
+}
+
+// parseLinkLine parses the output of "ip -o link show dev ...". If the link
+// has a peer or master in the same namespace, their names are returned.
+func parseLinkLine(line string) (l *Link, peer string, master string, err error) {
+	// "ip -o" uses "\" to separate what would otherwise be separate lines
+	fields := strings.Fields(strings.Replace(line, "\\", " ", -1))
+	if len(fields) < 3 {
+		return nil, "", "", fmt.Errorf("could not parse link %q", line)
+	}
+
+	l = &Link{}
+	if l.Index, err = strconv.Atoi(strings.TrimSuffix(fields[0], ":")); err != nil {
+		return nil, "", "", fmt.Errorf("could not parse link %q", line)
+	}
+	l.Name = strings.TrimSuffix(fields[1], ":")
+	if at := strings.Index(l.Name, "@"); at != -1 {
+		// "eth0@if6" if the peer is in another namespace, else
+		// "vlinuxbr@vovsbr"
+		peer = l.Name[at+1:]
+		l.Name = l.Name[:at]
+		if index, err := strconv.Atoi(strings.TrimPrefix(peer, "if")); err == nil && strings.HasPrefix(peer, "if") {
+			l.PeerIndex = index
+			peer = ""
+		}
+	}
+	for _, flag := range strings.Split(strings.Trim(fields[2], "<>"), ",") {
+		if flag == "UP" {
+			l.Up = true
+		}
+	}
+
+	for i := 3; i+1 < len(fields); i++ {
+		value := fields[i+1]
+		switch fields[i] {
+		case "mtu":
+			l.MTU, err = strconv.Atoi(value)
+		case "qlen":
+			l.TxQueueLen, err = strconv.Atoi(value)
+		case "master":
+			master = value
+		case "link/ether":
+			l.HardwareAddr, err = net.ParseMAC(value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, "", "", fmt.Errorf("could not parse link %q: invalid %s", line, fields[i])
+		}
+		i++
+	}
+	return l, peer, master, nil
+}
+
+func (b execBackend) addAddress(link, cidr string, args []string) error {
+	return b.run(append([]string{"addr", "add", cidr, "dev", link}, args...))
+}
+
+func (b execBackend) deleteAddress(link, cidr string, args []string) error {
+	return b.run(append([]string{"addr", "del", cidr, "dev", link}, args...))
+}
+
+func (b execBackend) getAddresses(link string) ([]string, error) {
+	out, err := b.exec([]string{"addr", "show", "dev", link})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := addressRegexp.FindAllStringSubmatch(out, -1)
+	addrs := make([]string, len(matches))
+	for i, match := range matches {
+		addrs[i] = match[1]
+	}
+	return addrs, nil
+}
+
+func (b execBackend) addRoute(link, cidr string, args []string) error {
+	return b.run(append([]string{"route", "add", cidr, "dev", link}, args...))
+}
+
+func (b execBackend) deleteRoute(link, cidr string, args []string) error {
+	return b.run(append([]string{"route", "del", cidr, "dev", link}, args...))
+}
+
+func (b execBackend) getRoutes(link string) ([]string, error) {
+	out, err := b.exec([]string{"route", "show", "dev", link})
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(out, "\n")
+	return lines[:len(lines)-1], nil
+}
+
+func (b execBackend) addSlave(link, slave string) error {
+	return b.run([]string{"link", "set", slave, "master", link})
+}
+
+func (b execBackend) deleteSlave(slave string) error {
+	return b.run([]string{"link", "set", slave, "nomaster"})
+}
+
+func (b execBackend) listAddresses(link string) ([]Address, error) {
+	out, err := b.exec([]string{"-o", "addr", "show", "dev", link})
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []Address{}
+	for _, line := range strings.Split(out, "\n") {
+		if addr := parseAddressLine(line); addr != nil {
+			addrs = append(addrs, *addr)
+		}
+	}
+	return addrs, nil
+}
+
+// parseAddressLine parses a line of "ip -o addr show" output, returning nil
+// if it does not describe an IPv4 or IPv6 address
+func parseAddressLine(line string) *Address {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "inet" && fields[i] != "inet6" {
+			continue
+		}
+		ip, ipnet, err := parseCIDR(fields[i+1])
+		if err != nil {
+			return nil
+		}
+		prefixLen, _ := ipnet.Mask.Size()
+		addr := &Address{Family: ipToFamily(ip), IP: ip, PrefixLen: prefixLen, Scope: "global"}
+		for j := i + 2; j+1 < len(fields); j++ {
+			if fields[j] == "scope" {
+				addr.Scope = fields[j+1]
+				break
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+func (b execBackend) listRoutes(link string) ([]Route, error) {
+	routes := []Route{}
+	for _, family := range []Family{FamilyIPv4, FamilyIPv6} {
+		out, err := b.exec([]string{fmt.Sprintf("-%d", family), "route", "show", "table", "all", "dev", link})
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			route, err := parseRouteLine(line, family)
+			if err != nil {
+				return nil, err
+			}
+			if route != nil {
+				routes = append(routes, *route)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// Route types that "ip route show" prefixes non-unicast routes with
+var routeTypes = map[string]bool{
+	"local": true, "broadcast": true, "multicast": true, "anycast": true, "nat": true,
+	"unreachable": true, "prohibit": true, "blackhole": true, "throw": true,
+}
+
+// parseRouteLine parses a line of "ip route show" output for the given family,
+// returning nil if it is empty or does not describe a unicast route
+func parseRouteLine(line string, family Family) (*Route, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "unicast" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 || routeTypes[fields[0]] {
+		return nil, nil
+	}
+
+	route := &Route{Family: family, Protocol: "boot", Scope: "global", Table: RouteTableMain}
+	_, dst, err := parseCIDR(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse route %q: %v", line, err)
+	}
+	if fields[0] != "default" {
+		route.Dst = dst
+	}
+
+	for i := 1; i+1 < len(fields); i++ {
+		value := fields[i+1]
+		switch fields[i] {
+		case "via":
+			if value == "inet" || value == "inet6" {
+				// "via inet6 fe80::1"
+				if i+2 >= len(fields) {
+					continue
+				}
+				i++
+				value = fields[i+1]
+			}
+			route.Gateway = parseIP(value)
+		case "proto":
+			route.Protocol = value
+		case "scope":
+			route.Scope = value
+		case "src":
+			route.Src = parseIP(value)
+		case "metric":
+			route.Metric, err = strconv.Atoi(value)
+		case "table":
+			route.Table, err = lookupRouteTable(value)
+		case "dev", "pref", "expires", "mtu", "advmss", "hoplimit", "realms", "error":
+		default:
+			// a flag like "linkdown" or "onlink"
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse route %q: invalid %s", line, fields[i])
+		}
+		i++
+	}
+
+	return route, nil
+}
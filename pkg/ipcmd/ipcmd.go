@@ -1,129 +1,436 @@
-// Package ipcmd provides a wrapper around the "ip" command.
+// Package ipcmd provides a wrapper around the "ip" command, or the equivalent
+// netlink operations.
 package ipcmd
 
 import (
 	"fmt"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/golang/glog"
 
 	"github.com/openshift/openshift-sdn/pkg/exec"
 )
 
-var addressRegexp *regexp.Regexp
+// Backend identifies the mechanism that a Transaction uses to make its changes
+type Backend string
+
+const (
+	// ExecBackend runs the "ip" command
+	ExecBackend Backend = "exec"
+	// NetlinkBackend talks to the kernel directly over netlink (Linux
+	// only). Operations whose arguments it does not understand are passed
+	// to the ExecBackend instead.
+	NetlinkBackend Backend = "netlink"
+)
+
+var (
+	backendLock    sync.Mutex
+	defaultBackend Backend
+)
 
 func init() {
-	addressRegexp = regexp.MustCompile("inet ([0-9.]*/[0-9]*) ")
+	if netlinkSupported {
+		defaultBackend = NetlinkBackend
+	} else {
+		defaultBackend = ExecBackend
+	}
+}
+
+// SetBackend sets the backend used by subsequently-created transactions
+func SetBackend(backend Backend) error {
+	switch backend {
+	case ExecBackend:
+	case NetlinkBackend:
+		if !netlinkSupported {
+			return fmt.Errorf("netlink backend is not supported on this platform")
+		}
+	default:
+		return fmt.Errorf("unknown ipcmd backend %q", backend)
+	}
+
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	defaultBackend = backend
+	return nil
+}
+
+// GetBackend returns the backend used by newly-created transactions
+func GetBackend() Backend {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	return defaultBackend
+}
+
+// backend implements the operations of a Transaction on a single link. The
+// args are in the syntax accepted by the corresponding "ip" command.
+type backend interface {
+	addLink(link string, args []string) error
+	deleteLink(link string) error
+	setLink(link string, args []string) error
+	addAddress(link, cidr string, args []string) error
+	deleteAddress(link, cidr string, args []string) error
+	getAddresses(link string) ([]string, error)
+	listAddresses(link string) ([]Address, error)
+	addRoute(link, cidr string, args []string) error
+	deleteRoute(link, cidr string, args []string) error
+	getRoutes(link string) ([]string, error)
+	listRoutes(link string) ([]Route, error)
+	getLink(link string) (*Link, error)
+	addSlave(link, slave string) error
+	deleteSlave(slave string) error
+}
+
+func newBackend(b Backend, execer exec.Executor, netns string) backend {
+	eb := execBackend{execer: execer, netns: netns}
+	if b == NetlinkBackend {
+		return newNetlinkBackend(eb)
+	}
+	return eb
 }
 
 type Transaction struct {
+	link    string
+	err     error
+	backend backend
+
+	// undo holds the operations that will undo the transaction's
+	// successful operations, in the order they were recorded
+	undo []undoOp
+	// created is true if the transaction created its link
+	created bool
+}
+
+// undoOp is an operation that undoes an earlier operation
+type undoOp struct {
+	// link is the link the operation modifies
 	link string
-	err  error
+	// desc describes the operation, in "ip" syntax
+	desc string
+	do   func() error
 }
 
-// NewTransaction begins a new transaction for a given interface. If an error
-// occurs at any step in the transaction, it will be recorded until
-// EndTransaction(), and any further calls on the transaction will be ignored.
-func NewTransaction(link string) *Transaction {
-	return &Transaction{link: link}
+// NewTransaction begins a new transaction for a given interface, running "ip"
+// (if needed) via execer. If an error occurs at any step in the transaction,
+// it will be recorded until EndTransaction(), and any further calls on the
+// transaction will be ignored. Alternatively, the transaction can be ended
+// with Rollback(), to undo its changes.
+func NewTransaction(execer exec.Executor, link string) *Transaction {
+	return &Transaction{link: link, backend: newBackend(GetBackend(), execer, "")}
 }
 
-func (tx *Transaction) exec(args []string) (string, error) {
-	if tx.err != nil {
-		return "", tx.err
-	}
+// NewNetNSTransaction begins a new transaction for a given interface in the
+// network namespace at the path netns (eg, "/proc/1234/ns/net"; see
+// PIDNetNS()). It is otherwise the same as NewTransaction().
+func NewNetNSTransaction(execer exec.Executor, netns, link string) *Transaction {
+	return &Transaction{link: link, backend: newBackend(GetBackend(), execer, netns)}
+}
 
-	ipcmdPath, err := exec.LookPath("ip")
-	if err != nil {
-		tx.err = fmt.Errorf("ip is not installed")
-		return "", tx.err
-	}
+// PIDNetNS returns the path of the network namespace of the process pid, for
+// use with NewNetNSTransaction().
+func PIDNetNS(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
 
-	var output string
-	output, tx.err = exec.Exec(ipcmdPath, args...)
-	return output, tx.err
+// addUndo records an operation to run from Rollback()
+func (tx *Transaction) addUndo(link string, do func() error, desc ...string) {
+	var words []string
+	for _, word := range desc {
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	tx.undo = append(tx.undo, undoOp{link: link, desc: strings.Join(words, " "), do: do})
 }
 
 // AddLink creates the interface associated with the transaction, optionally
-// with additional properties.
+// with additional properties. Rollback() will delete it again.
 func (tx *Transaction) AddLink(args ...string) {
-	tx.exec(append([]string{"link", "add", tx.link}, args...))
+	if tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.addLink(tx.link, args); tx.err == nil {
+		tx.created = true
+		link := tx.link
+		tx.addUndo(link, func() error { return tx.backend.deleteLink(link) }, "link del", link)
+	}
 }
 
 // DeleteLink deletes the interface associated with the transaction. (It is an
-// error if the interface does not exist.)
+// error if the interface does not exist.) This cannot be undone by Rollback().
 func (tx *Transaction) DeleteLink() {
-	tx.exec([]string{"link", "del", tx.link})
+	if tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.deleteLink(tx.link); tx.err == nil {
+		// Earlier changes to the link can no longer be undone
+		undo := tx.undo[:0]
+		for _, op := range tx.undo {
+			if op.link != tx.link {
+				undo = append(undo, op)
+			}
+		}
+		tx.undo = undo
+		tx.created = false
+	}
 }
 
-// SetLink sets the indicated properties on the interface.
+// SetLink sets the indicated properties on the interface. Rollback() will
+// restore the previous state of the link, mtu, and txqueuelen, but not other
+// properties.
 func (tx *Transaction) SetLink(args ...string) {
-	tx.exec(append([]string{"link", "set", tx.link}, args...))
+	if tx.err != nil {
+		return
+	}
+	var old *Link
+	if !tx.created {
+		if old, tx.err = tx.backend.getLink(tx.link); tx.err != nil {
+			return
+		}
+	}
+	if tx.err = tx.backend.setLink(tx.link, args); tx.err == nil && old != nil {
+		if inverse := inverseLinkArgs(args, old); len(inverse) > 0 {
+			link := tx.link
+			tx.addUndo(link, func() error { return tx.backend.setLink(link, inverse) }, "link set", link, strings.Join(inverse, " "))
+		}
+	}
+}
+
+// inverseLinkArgs returns the SetLink() arguments that would restore old after
+// SetLink(args...)
+func inverseLinkArgs(args []string, old *Link) []string {
+	var inverse []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "up", "down":
+			if old.Up {
+				inverse = append(inverse, "up")
+			} else {
+				inverse = append(inverse, "down")
+			}
+		case "mtu":
+			inverse = append(inverse, "mtu", strconv.Itoa(old.MTU))
+			i++
+		case "txqueuelen", "txqlen":
+			inverse = append(inverse, "txqueuelen", strconv.Itoa(old.TxQueueLen))
+			i++
+		case "master", "netns", "address", "name", "alias":
+			// can't be undone
+			i++
+		}
+	}
+	return inverse
+}
+
+// GetLink returns information about the interface. Since this function has a
+// return value, it also returns an error immediately if an error occurs.
+func (tx *Transaction) GetLink() (*Link, error) {
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	var link *Link
+	link, tx.err = tx.backend.getLink(tx.link)
+	return link, tx.err
 }
 
 // AddAddress adds an address to the interface.
 func (tx *Transaction) AddAddress(cidr string, args ...string) {
-	tx.exec(append([]string{"addr", "add", cidr, "dev", tx.link}, args...))
+	if tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.addAddress(tx.link, cidr, args); tx.err == nil && !tx.created {
+		link := tx.link
+		tx.addUndo(link, func() error { return tx.backend.deleteAddress(link, cidr, nil) }, "addr del", cidr, "dev", link)
+	}
 }
 
 // DeleteAddress deletes an address from the interface. (It is an error if the
 // address does not exist.)
 func (tx *Transaction) DeleteAddress(cidr string, args ...string) {
-	tx.exec(append([]string{"addr", "del", cidr, "dev", tx.link}, args...))
+	if tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.deleteAddress(tx.link, cidr, args); tx.err == nil {
+		link := tx.link
+		tx.addUndo(link, func() error { return tx.backend.addAddress(link, cidr, args) }, "addr add", cidr, "dev", link, strings.Join(args, " "))
+	}
 }
 
-// GetAddresses returns the IPv4 addresses associated with the interface. Since
-// this function has a return value, it also returns an error immediately if an
-// error occurs.
+// GetAddresses returns the IPv4 addresses associated with the interface (as an
+// array of CIDR strings). Since this function has a return value, it also
+// returns an error immediately if an error occurs. (See also ListAddresses().)
 func (tx *Transaction) GetAddresses() ([]string, error) {
-	out, err := tx.exec(append([]string{"addr", "show", "dev", tx.link}))
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	var addrs []string
+	addrs, tx.err = tx.backend.getAddresses(tx.link)
+	return addrs, tx.err
+}
+
+// ListAddresses returns the IPv4 and IPv6 addresses associated with the
+// interface. Since this function has a return value, it also returns an error
+// immediately if an error occurs.
+func (tx *Transaction) ListAddresses() ([]Address, error) {
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	var addrs []Address
+	addrs, tx.err = tx.backend.listAddresses(tx.link)
+	return addrs, tx.err
+}
+
+// FindAddress returns the interface's address that exactly matches cidr
+// (including the prefix length), or nil if it has no such address. Since this
+// function has a return value, it also returns an error immediately if an
+// error occurs.
+func (tx *Transaction) FindAddress(cidr string) (*Address, error) {
+	if _, _, err := parseCIDR(cidr); err != nil && tx.err == nil {
+		tx.err = err
+	}
+	addrs, err := tx.ListAddresses()
 	if err != nil {
 		return nil, err
 	}
-
-	matches := addressRegexp.FindAllStringSubmatch(out, -1)
-	addrs := make([]string, len(matches))
-	for i, match := range matches {
-		addrs[i] = match[1]
+	for _, addr := range addrs {
+		if addr.Matches(cidr) {
+			return &addr, nil
+		}
 	}
-	return addrs, nil
+	return nil, nil
 }
 
 // AddRoute adds a route to the interface.
 func (tx *Transaction) AddRoute(cidr string, args ...string) {
-	tx.exec(append([]string{"route", "add", cidr, "dev", tx.link}, args...))
+	if tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.addRoute(tx.link, cidr, args); tx.err == nil && !tx.created {
+		link := tx.link
+		tx.addUndo(link, func() error { return tx.backend.deleteRoute(link, cidr, args) }, "route del", cidr, "dev", link, strings.Join(args, " "))
+	}
 }
 
 // DeleteRoute deletes a route from the interface. (It is an error if the route
 // does not exist.)
 func (tx *Transaction) DeleteRoute(cidr string, args ...string) {
-	tx.exec(append([]string{"route", "del", cidr, "dev", tx.link}, args...))
+	if tx.err != nil {
+		return
+	}
+	var routes []Route
+	if routes, tx.err = tx.backend.listRoutes(tx.link); tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.deleteRoute(tx.link, cidr, args); tx.err != nil {
+		return
+	}
+	for _, route := range routes {
+		if route.Matches(cidr) && route.Table == RouteTableMain {
+			link := tx.link
+			inverse := routeArgs(route)
+			tx.addUndo(link, func() error { return tx.backend.addRoute(link, cidr, inverse) }, "route add", cidr, "dev", link, strings.Join(inverse, " "))
+			break
+		}
+	}
 }
 
-// GetRoutes returns the IPv4 routes associated with the interface (as an array
-// of route descriptions in the format output by "ip route show"). Since this
+// routeArgs returns the AddRoute() arguments to recreate route
+func routeArgs(route Route) []string {
+	var args []string
+	if route.Gateway != nil {
+		args = append(args, "via", route.Gateway.String())
+	}
+	if route.Protocol != "" && route.Protocol != "boot" {
+		args = append(args, "proto", route.Protocol)
+	}
+	if route.Scope != "" && route.Scope != "global" {
+		args = append(args, "scope", route.Scope)
+	}
+	if route.Src != nil {
+		args = append(args, "src", route.Src.String())
+	}
+	if route.Metric != 0 {
+		args = append(args, "metric", strconv.Itoa(route.Metric))
+	}
+	return args
+}
+
+// GetRoutes returns the IPv4 routes in the main routing table associated with
+// the interface (as an array of route descriptions in the format output by "ip
+// route show"). Since this function has a return value, it also returns an
+// error immediately if an error occurs. (See also ListRoutes().)
+func (tx *Transaction) GetRoutes() ([]string, error) {
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	var routes []string
+	routes, tx.err = tx.backend.getRoutes(tx.link)
+	return routes, tx.err
+}
+
+// ListRoutes returns the IPv4 and IPv6 unicast routes, in all routing tables,
+// that go through the interface. Since this function has a return value, it
+// also returns an error immediately if an error occurs.
+func (tx *Transaction) ListRoutes() ([]Route, error) {
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	var routes []Route
+	routes, tx.err = tx.backend.listRoutes(tx.link)
+	return routes, tx.err
+}
+
+// FindRoutes returns the interface's routes whose destination is exactly cidr
+// (see Route.Matches()), or an empty array if there are none. Since this
 // function has a return value, it also returns an error immediately if an error
 // occurs.
-func (tx *Transaction) GetRoutes() ([]string, error) {
-	out, err := tx.exec(append([]string{"route", "show", "dev", tx.link}))
+func (tx *Transaction) FindRoutes(cidr string) ([]Route, error) {
+	if _, _, err := parseCIDR(cidr); err != nil && tx.err == nil {
+		tx.err = err
+	}
+	routes, err := tx.ListRoutes()
 	if err != nil {
 		return nil, err
 	}
-
-	lines := strings.Split(out, "\n")
-	return lines[:len(lines)-1], nil
+	matching := []Route{}
+	for _, route := range routes {
+		if route.Matches(cidr) {
+			matching = append(matching, route)
+		}
+	}
+	return matching, nil
 }
 
 // AddSlave adds the indicated slave interface to the bridge, bond, or team
 // interface associated with the transaction.
 func (tx *Transaction) AddSlave(slave string) {
-	tx.exec([]string{"link", "set", slave, "master", tx.link})
+	if tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.addSlave(tx.link, slave); tx.err == nil {
+		tx.addUndo(slave, func() error { return tx.backend.deleteSlave(slave) }, "link set", slave, "nomaster")
+	}
 }
 
-// AddSlave remotes the indicated slave interface from the bridge, bond, or team
-// interface associated with the transaction. (No error occurs if the interface
-// is not actually a slave of the transaction interface.)
+// DeleteSlave removes the indicated slave interface from the bridge, bond, or
+// team interface associated with the transaction. (No error occurs if the
+// interface is not actually a slave of the transaction interface.)
 func (tx *Transaction) DeleteSlave(slave string) {
-	tx.exec([]string{"link", "set", slave, "nomaster"})
+	if tx.err != nil {
+		return
+	}
+	var old *Link
+	if old, tx.err = tx.backend.getLink(slave); tx.err != nil {
+		return
+	}
+	if tx.err = tx.backend.deleteSlave(slave); tx.err != nil {
+		return
+	}
+	if master, err := tx.backend.getLink(tx.link); err == nil && old.MasterIndex == master.Index {
+		link := tx.link
+		tx.addUndo(slave, func() error { return tx.backend.addSlave(link, slave) }, "link set", slave, "master", link)
+	}
 }
 
 // IgnoreError causes any error on the transaction to be discarded, in case you
@@ -135,9 +442,31 @@ func (tx *Transaction) IgnoreError() {
 
 // EndTransaction ends a transaction and returns any error that occurred during
 // the transaction. You should not use the transaction again after calling this
-// function.
+// function, except to call Rollback(), if a later step in a larger operation
+// fails.
 func (tx *Transaction) EndTransaction() error {
 	err := tx.err
 	tx.err = nil
 	return err
 }
+
+// Rollback ends a transaction like EndTransaction(), but first undoes each of
+// its successful operations, in reverse order. (This is done on a best-effort
+// basis; some operations, such as DeleteLink(), cannot be undone.) It returns
+// the first error that occurred while undoing, if any, not any error that
+// occurred during the transaction itself. Rollback() may also be called after
+// EndTransaction().
+func (tx *Transaction) Rollback() error {
+	var err error
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		op := tx.undo[i]
+		glog.V(5).Infof("Rolling back: ip %s", op.desc)
+		if undoErr := op.do(); undoErr != nil && err == nil {
+			err = fmt.Errorf("could not roll back (ip %s): %v", op.desc, undoErr)
+		}
+	}
+	tx.undo = nil
+	tx.created = false
+	tx.err = nil
+	return err
+}
@@ -7,25 +7,26 @@ import (
 	"github.com/openshift/openshift-sdn/pkg/exec"
 )
 
-func normalSetup() {
-	exec.SetTestMode()
-	exec.AddTestProgram("/sbin/ip")
+func normalSetup() *exec.FakeExecutor {
+	SetBackend(ExecBackend)
+	return exec.NewFakeExecutor("/sbin/ip")
 }
 
-func missingSetup() {
-	exec.SetTestMode()
+func missingSetup() *exec.FakeExecutor {
+	SetBackend(ExecBackend)
+	return exec.NewFakeExecutor()
 }
 
 func TestGetAddresses(t *testing.T) {
-	normalSetup()
-	exec.AddTestResult("/sbin/ip addr show dev lo", `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN group default 
+	fexec := normalSetup()
+	fexec.AddResult("/sbin/ip addr show dev lo", `1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN group default 
     link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00
     inet 127.0.0.1/8 scope host lo
        valid_lft forever preferred_lft forever
     inet6 ::1/128 scope host 
        valid_lft forever preferred_lft forever
 `, nil)
-	itx := NewTransaction("lo")
+	itx := NewTransaction(fexec, "lo")
 	addrs, err := itx.GetAddresses()
 	if err != nil {
 		t.Fatalf("Failed to get addresses for 'lo': %v", err)
@@ -41,14 +42,14 @@ func TestGetAddresses(t *testing.T) {
 		t.Fatalf("Transaction unexpectedly returned error: %v", err)
 	}
 
-	exec.AddTestResult("/sbin/ip addr show dev eth0", `2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc pfifo_fast state UP group default qlen 1000
+	fexec.AddResult("/sbin/ip addr show dev eth0", `2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc pfifo_fast state UP group default qlen 1000
     link/ether aa:bb:cc:dd:ee:ff brd ff:ff:ff:ff:ff:ff
     inet 192.168.1.10/24 brd 192.168.1.255 scope global dynamic eth0
        valid_lft 81296sec preferred_lft 81296sec
     inet 192.168.1.152/24 brd 192.168.1.255 scope global dynamic eth0
        valid_lft 81296sec preferred_lft 81296sec
 `, nil)
-	itx = NewTransaction("eth0")
+	itx = NewTransaction(fexec, "eth0")
 	addrs, err = itx.GetAddresses()
 	if err != nil {
 		t.Fatalf("Failed to get addresses for 'eth0': %v", err)
@@ -64,8 +65,8 @@ func TestGetAddresses(t *testing.T) {
 		t.Fatalf("Transaction unexpectedly returned error: %v", err)
 	}
 
-	exec.AddTestResult("/sbin/ip addr show dev wlan0", "", fmt.Errorf("Device \"%s\" does not exist", "wlan0"))
-	itx = NewTransaction("wlan0")
+	fexec.AddResult("/sbin/ip addr show dev wlan0", "", fmt.Errorf("Device \"%s\" does not exist", "wlan0"))
+	itx = NewTransaction(fexec, "wlan0")
 	addrs, err = itx.GetAddresses()
 	if err == nil {
 		t.Fatalf("Allegedly got addresses for non-existent link: %v", addrs)
@@ -74,6 +75,10 @@ func TestGetAddresses(t *testing.T) {
 	if err == nil {
 		t.Fatalf("Transaction unexpectedly returned no error")
 	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
 }
 
 func TestGetRoutes(t *testing.T) {
@@ -82,9 +87,9 @@ func TestGetRoutes(t *testing.T) {
 		l2 = "1.2.3.4 via 192.168.1.1  proto static  metric 10 "
 		l3 = "192.168.1.0/24  proto kernel  scope link  src 192.168.1.15 "
 	)
-	normalSetup()
-	exec.AddTestResult("/sbin/ip route show dev wlp3s0", l1+"\n"+l2+"\n"+l3+"\n", nil)
-	itx := NewTransaction("wlp3s0")
+	fexec := normalSetup()
+	fexec.AddResult("/sbin/ip route show dev wlp3s0", l1+"\n"+l2+"\n"+l3+"\n", nil)
+	itx := NewTransaction(fexec, "wlp3s0")
 	routes, err := itx.GetRoutes()
 	if err != nil {
 		t.Fatalf("Failed to get routes for 'wlp3s0': %v", err)
@@ -106,8 +111,8 @@ func TestGetRoutes(t *testing.T) {
 		t.Fatalf("Transaction unexpectedly returned error: %v", err)
 	}
 
-	exec.AddTestResult("/sbin/ip route show dev wlan0", "", fmt.Errorf("Device \"%s\" does not exist", "wlan0"))
-	itx = NewTransaction("wlan0")
+	fexec.AddResult("/sbin/ip route show dev wlan0", "", fmt.Errorf("Device \"%s\" does not exist", "wlan0"))
+	itx = NewTransaction(fexec, "wlan0")
 	routes, err = itx.GetRoutes()
 	if err == nil {
 		t.Fatalf("Allegedly got routes for non-existent link: %v", routes)
@@ -116,21 +121,25 @@ func TestGetRoutes(t *testing.T) {
 	if err == nil {
 		t.Fatalf("Transaction unexpectedly returned no error")
 	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
 }
 
 func TestErrorHandling(t *testing.T) {
-	normalSetup()
-	exec.AddTestResult("/sbin/ip link del dummy0", "", fmt.Errorf("Device \"%s\" does not exist", "dummy0"))
-	itx := NewTransaction("dummy0")
+	fexec := normalSetup()
+	fexec.AddResult("/sbin/ip link del dummy0", "", fmt.Errorf("Device \"%s\" does not exist", "dummy0"))
+	itx := NewTransaction(fexec, "dummy0")
 	itx.DeleteLink()
 	err := itx.EndTransaction()
 	if err == nil {
 		t.Fatalf("Failed to get expected error")
 	}
 
-	exec.AddTestResult("/sbin/ip link del dummy0", "", fmt.Errorf("Device \"%s\" does not exist", "dummy0"))
-	exec.AddTestResult("/sbin/ip link add dummy0 type dummy", "", nil)
-	itx = NewTransaction("dummy0")
+	fexec.AddResult("/sbin/ip link del dummy0", "", fmt.Errorf("Device \"%s\" does not exist", "dummy0"))
+	fexec.AddResult("/sbin/ip link add dummy0 type dummy", "", nil)
+	itx = NewTransaction(fexec, "dummy0")
 	itx.DeleteLink()
 	itx.IgnoreError()
 	itx.AddLink("type", "dummy")
@@ -139,9 +148,9 @@ func TestErrorHandling(t *testing.T) {
 		t.Fatalf("Unexpectedly got error after IgnoreError(): %v", err)
 	}
 
-	exec.AddTestResult("/sbin/ip link add dummy0 type dummy", "", fmt.Errorf("RTNETLINK answers: Operation not permitted"))
+	fexec.AddResult("/sbin/ip link add dummy0 type dummy", "", fmt.Errorf("RTNETLINK answers: Operation not permitted"))
 	// other commands do not get run due to previous error
-	itx = NewTransaction("dummy0")
+	itx = NewTransaction(fexec, "dummy0")
 	itx.AddLink("type", "dummy")
 	itx.SetLink("up")
 	itx.DeleteLink()
@@ -149,11 +158,15 @@ func TestErrorHandling(t *testing.T) {
 	if err == nil {
 		t.Fatalf("Failed to get expected error")
 	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
 }
 
 func TestIPMissing(t *testing.T) {
-	missingSetup()
-	itx := NewTransaction("dummy0")
+	fexec := missingSetup()
+	itx := NewTransaction(fexec, "dummy0")
 	itx.AddLink("type", "dummy")
 	err := itx.EndTransaction()
 	if err == nil {
@@ -163,3 +176,240 @@ func TestIPMissing(t *testing.T) {
 		t.Fatalf("Got wrong error: %v", err)
 	}
 }
+
+func TestListAddresses(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/sbin/ip -o addr show dev eth0", `2: eth0    inet 192.168.1.15/24 brd 192.168.1.255 scope global dynamic eth0\       valid_lft 85994sec preferred_lft 85994sec
+2: eth0    inet 192.168.1.16/24 scope global secondary eth0\       valid_lft forever preferred_lft forever
+2: eth0    inet6 fd00:1:2:3::15/64 scope global \       valid_lft forever preferred_lft forever
+2: eth0    inet6 fe80::42:acff:fe11:2/64 scope link \       valid_lft forever preferred_lft forever
+`, nil)
+	itx := NewTransaction(fexec, "eth0")
+	addrs, err := itx.ListAddresses()
+	if err != nil {
+		t.Fatalf("Failed to list addresses for 'eth0': %v", err)
+	}
+	expected := []string{
+		"inet 192.168.1.15/24 global",
+		"inet 192.168.1.16/24 global",
+		"inet6 fd00:1:2:3::15/64 global",
+		"inet6 fe80::42:acff:fe11:2/64 link",
+	}
+	if len(addrs) != len(expected) {
+		t.Fatalf("'eth0' has unexpected addresses %v", addrs)
+	}
+	for i := range addrs {
+		if str := fmt.Sprintf("%s %s %s", addrs[i].Family, addrs[i].String(), addrs[i].Scope); str != expected[i] {
+			t.Fatalf("Unexpected address %d: got %q, expected %q", i, str, expected[i])
+		}
+	}
+
+	fexec.AddResult("/sbin/ip -o addr show dev eth0", "2: eth0    inet 10.1.0.1/16 scope global eth0\n", nil)
+	addr, err := itx.FindAddress("10.1.0.1/24")
+	if err != nil || addr != nil {
+		t.Fatalf("Unexpectedly found address %v (%v)", addr, err)
+	}
+	fexec.AddResult("/sbin/ip -o addr show dev eth0", "2: eth0    inet 10.1.0.1/16 scope global eth0\n", nil)
+	addr, err = itx.FindAddress("10.1.0.1/16")
+	if err != nil || addr == nil || addr.String() != "10.1.0.1/16" {
+		t.Fatalf("Failed to find address (got %v, %v)", addr, err)
+	}
+
+	addr, err = itx.FindAddress("10.1.0.1/33")
+	if err == nil {
+		t.Fatalf("Unexpectedly got no error for bad CIDR")
+	}
+	if err = itx.EndTransaction(); err == nil {
+		t.Fatalf("Transaction unexpectedly returned no error")
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestListRoutes(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/sbin/ip -4 route show table all dev tun0", `10.1.0.0/16 proto kernel scope link
+10.1.0.0/24 proto kernel scope link src 10.1.0.1 linkdown
+172.30.0.0/16 scope link
+default via 10.1.0.254 metric 100 table 10
+broadcast 10.1.0.0 table local proto kernel scope link src 10.1.0.1
+local 10.1.0.1 table local proto kernel scope host src 10.1.0.1
+`, nil)
+	fexec.AddResult("/sbin/ip -6 route show table all dev tun0", `fd00:10:1::/64 proto kernel metric 256 pref medium
+fe80::/64 proto kernel metric 256 pref medium
+default via fe80::1 proto ra metric 1024 expires 1788sec hoplimit 64 pref medium
+local fe80::42:acff:fe11:2 table local proto kernel metric 0 pref medium
+multicast ff00::/8 table local proto kernel metric 256 pref medium
+`, nil)
+	itx := NewTransaction(fexec, "tun0")
+	routes, err := itx.ListRoutes()
+	if err != nil {
+		t.Fatalf("Failed to list routes for 'tun0': %v", err)
+	}
+	expected := []string{
+		"inet 10.1.0.0/16 proto kernel scope link",
+		"inet 10.1.0.0/24 proto kernel scope link src 10.1.0.1",
+		"inet 172.30.0.0/16 scope link",
+		"inet default via 10.1.0.254 metric 100 table 10",
+		"inet6 fd00:10:1::/64 proto kernel metric 256",
+		"inet6 fe80::/64 proto kernel metric 256",
+		"inet6 default via fe80::1 proto ra metric 1024",
+	}
+	if len(routes) != len(expected) {
+		t.Fatalf("'tun0' has unexpected routes %v", routes)
+	}
+	for i := range routes {
+		if str := routes[i].Family.String() + " " + routes[i].String(); str != expected[i] {
+			t.Fatalf("Unexpected route %d: got %q, expected %q", i, str, expected[i])
+		}
+	}
+	if err = itx.EndTransaction(); err != nil {
+		t.Fatalf("Transaction unexpectedly returned error: %v", err)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestFindRoutes(t *testing.T) {
+	const (
+		v4 = "10.1.0.0/16 proto kernel scope link\n10.1.0.0/24 proto kernel scope link src 10.1.0.1\n"
+		v6 = "fd00:10:1::/64 proto kernel metric 256 pref medium\n"
+	)
+	fexec := normalSetup()
+
+	for _, tc := range []struct {
+		cidr  string
+		found string
+	}{
+		{"10.1.0.0/24", "10.1.0.0/24 proto kernel scope link src 10.1.0.1"},
+		{"10.1.0.0/16", "10.1.0.0/16 proto kernel scope link"},
+		{"10.1.0.0/23", ""},
+		{"10.1.0.0", ""},
+		{"fd00:10:1::/64", "fd00:10:1::/64 proto kernel metric 256"},
+		{"fd00:10:1::/48", ""},
+	} {
+		fexec.AddResult("/sbin/ip -4 route show table all dev tun0", v4, nil)
+		fexec.AddResult("/sbin/ip -6 route show table all dev tun0", v6, nil)
+		itx := NewTransaction(fexec, "tun0")
+		routes, err := itx.FindRoutes(tc.cidr)
+		if err != nil {
+			t.Fatalf("Unexpected error finding %s: %v", tc.cidr, err)
+		}
+		if tc.found == "" && len(routes) != 0 {
+			t.Fatalf("Unexpectedly found route %s for %s", routes[0].String(), tc.cidr)
+		} else if tc.found != "" && (len(routes) != 1 || routes[0].String() != tc.found) {
+			t.Fatalf("Unexpected result for %s: %v", tc.cidr, routes)
+		}
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestGetLink(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddProgram("/usr/bin/nsenter")
+	fexec.AddResult("/usr/bin/nsenter --net=/proc/1234/ns/net -- /sbin/ip -o link show dev eth0",
+		`5: eth0@if6: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1450 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 0a:58:0a:80:00:05 brd ff:ff:ff:ff:ff:ff link-netnsid 0
+`, nil)
+	itx := NewNetNSTransaction(fexec, PIDNetNS(1234), "eth0")
+	link, err := itx.GetLink()
+	if err != nil {
+		t.Fatalf("Failed to get link: %v", err)
+	}
+	if link.Name != "eth0" || link.Index != 5 || link.PeerIndex != 6 || link.MTU != 1450 || link.TxQueueLen != 1000 || !link.Up || link.HardwareAddr.String() != "0a:58:0a:80:00:05" {
+		t.Fatalf("Unexpected link %#v", link)
+	}
+
+	fexec.AddResult("/sbin/ip -o link show dev vlinuxbr", `7: vlinuxbr@vovsbr: <BROADCAST,MULTICAST> mtu 1450 qdisc noop master lbr0 state DOWN mode DEFAULT group default qlen 0\    link/ether 9e:60:1c:37:53:2e brd ff:ff:ff:ff:ff:ff
+`, nil)
+	fexec.AddResult("/sbin/ip -o link show dev vovsbr", `6: vovsbr@vlinuxbr: <BROADCAST,MULTICAST> mtu 1450 qdisc noop state DOWN mode DEFAULT group default qlen 1000\    link/ether 2a:0f:4d:0e:1e:0a brd ff:ff:ff:ff:ff:ff
+`, nil)
+	fexec.AddResult("/sbin/ip -o link show dev lbr0", `4: lbr0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1450 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 2a:0f:4d:0e:1e:0a brd ff:ff:ff:ff:ff:ff
+`, nil)
+	itx = NewTransaction(fexec, "vlinuxbr")
+	link, err = itx.GetLink()
+	if err != nil {
+		t.Fatalf("Failed to get link: %v", err)
+	}
+	if link.Index != 7 || link.PeerIndex != 6 || link.MasterIndex != 4 || link.Up {
+		t.Fatalf("Unexpected link %#v", link)
+	}
+	if err = itx.EndTransaction(); err != nil {
+		t.Fatalf("Transaction unexpectedly returned error: %v", err)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	fexec := normalSetup()
+	// A new link is deleted, without undoing the changes made to it first
+	fexec.AddResult("/sbin/ip link add lbr0 type bridge", "", nil)
+	fexec.AddResult("/sbin/ip addr add 10.1.0.1/24 dev lbr0", "", nil)
+	fexec.AddResult("/sbin/ip link set lbr0 up", "", nil)
+	fexec.AddResult("/sbin/ip link set vlinuxbr master lbr0", "", nil)
+	fexec.AddResult("/sbin/ip link set vlinuxbr nomaster", "", nil)
+	fexec.AddResult("/sbin/ip link del lbr0", "", nil)
+	itx := NewTransaction(fexec, "lbr0")
+	itx.AddLink("type", "bridge")
+	itx.AddAddress("10.1.0.1/24")
+	itx.SetLink("up")
+	itx.AddSlave("vlinuxbr")
+	if err := itx.Rollback(); err != nil {
+		t.Fatalf("Rollback unexpectedly returned error: %v", err)
+	}
+
+	// Changes to an existing link are undone individually
+	fexec.AddResult("/sbin/ip -o link show dev tun0", `5: tun0: <BROADCAST,MULTICAST> mtu 1500 qdisc noop state DOWN mode DEFAULT group default qlen 1000\    link/ether 2a:0f:4d:0e:1e:0a brd ff:ff:ff:ff:ff:ff
+`, nil)
+	fexec.AddResult("/sbin/ip link set tun0 mtu 1450 up", "", nil)
+	fexec.AddResult("/sbin/ip addr add 10.1.0.1/16 dev tun0", "", nil)
+	fexec.AddResult("/sbin/ip -4 route show table all dev tun0", `10.1.0.0/16 proto kernel scope link src 10.1.0.1
+172.30.0.0/16 via 10.1.0.254 metric 100
+`, nil)
+	fexec.AddResult("/sbin/ip -6 route show table all dev tun0", "", nil)
+	fexec.AddResult("/sbin/ip route del 172.30.0.0/16 dev tun0", "", nil)
+	fexec.AddResult("/sbin/ip route add 172.30.0.0/16 dev tun0 proto static", "", fmt.Errorf("RTNETLINK answers: File exists"))
+	fexec.AddResult("/sbin/ip route add 172.30.0.0/16 dev tun0 via 10.1.0.254 metric 100", "", nil)
+	fexec.AddResult("/sbin/ip addr del 10.1.0.1/16 dev tun0", "", nil)
+	fexec.AddResult("/sbin/ip link set tun0 mtu 1500 down", "", nil)
+	itx = NewTransaction(fexec, "tun0")
+	itx.SetLink("mtu", "1450", "up")
+	itx.AddAddress("10.1.0.1/16")
+	itx.DeleteRoute("172.30.0.0/16")
+	itx.AddRoute("172.30.0.0/16", "proto", "static")
+	if err := itx.EndTransaction(); err == nil {
+		t.Fatalf("Failed to get expected error")
+	}
+	if err := itx.Rollback(); err != nil {
+		t.Fatalf("Rollback unexpectedly returned error: %v", err)
+	}
+
+	// Errors while rolling back are returned
+	fexec.AddResult("/sbin/ip link add vlinuxbr type veth peer name vovsbr", "", nil)
+	fexec.AddResult("/sbin/ip link del vlinuxbr", "", fmt.Errorf("Device \"%s\" does not exist", "vlinuxbr"))
+	itx = NewTransaction(fexec, "vlinuxbr")
+	itx.AddLink("type", "veth", "peer", "name", "vovsbr")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("Transaction unexpectedly returned error: %v", err)
+	}
+	if err := itx.Rollback(); err == nil {
+		t.Fatalf("Failed to get expected error")
+	}
+	// Rolling back again does nothing
+	if err := itx.Rollback(); err != nil {
+		t.Fatalf("Second rollback unexpectedly returned error: %v", err)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
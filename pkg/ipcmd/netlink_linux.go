@@ -0,0 +1,790 @@
+package ipcmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+const netlinkSupported = true
+
+// netlinkBackend implements the Transaction operations with rtnetlink
+// requests. It understands the subset of "ip" arguments that openshift-sdn
+// uses; operations with any other arguments are passed to the exec backend.
+type netlinkBackend struct {
+	// netns is the path of the network namespace to operate in, or ""
+	// for the current namespace
+	netns    string
+	fallback execBackend
+}
+
+func newNetlinkBackend(fallback execBackend) backend {
+	return &netlinkBackend{netns: fallback.netns, fallback: fallback}
+}
+
+// errNotSupported is returned when an operation's arguments can't be handled
+// by the netlink backend
+var errNotSupported = errors.New("not supported by the netlink backend")
+
+// Netlink attribute types that the syscall package does not define
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	vethInfoPeer = 1
+	iflaNetNsFd  = 28
+)
+
+var nativeEndian binary.ByteOrder
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// linkSettings holds the parsed arguments of "ip link add" or "ip link set"
+type linkSettings struct {
+	kind     string
+	mtu      int
+	txqlen   int
+	up       bool
+	down     bool
+	master   string
+	nomaster bool
+	netns    string
+	peer     string
+	peerMTU  int
+}
+
+// parseLinkArgs parses the arguments to AddLink() (if add is true) or
+// SetLink()
+func parseLinkArgs(args []string, add bool) (*linkSettings, error) {
+	s := &linkSettings{mtu: -1, txqlen: -1, peerMTU: -1}
+	for i := 0; i < len(args); i++ {
+		var value string
+		switch args[i] {
+		case "type", "mtu", "txqueuelen", "txqlen", "master", "netns", "peer":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("missing value for %q", args[i])
+			}
+			value = args[i+1]
+		}
+
+		var err error
+		switch {
+		case args[i] == "type" && add:
+			s.kind = value
+		case args[i] == "mtu":
+			s.mtu, err = strconv.Atoi(value)
+		case args[i] == "txqueuelen" || args[i] == "txqlen":
+			s.txqlen, err = strconv.Atoi(value)
+		case args[i] == "up" && !add:
+			s.up = true
+			continue
+		case args[i] == "down" && !add:
+			s.down = true
+			continue
+		case args[i] == "master" && !add:
+			s.master = value
+		case args[i] == "nomaster" && !add:
+			s.nomaster = true
+			continue
+		case args[i] == "netns" && !add:
+			s.netns = value
+		case args[i] == "peer" && add && s.kind == "veth":
+			// Everything after "peer" applies to the peer
+			return s, parsePeerArgs(s, args[i+1:])
+		default:
+			return nil, errNotSupported
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for %q", value, args[i])
+		}
+		i++
+	}
+	return s, nil
+}
+
+func parsePeerArgs(s *linkSettings, args []string) error {
+	for i := 0; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "name":
+			s.peer = args[i+1]
+		case "mtu":
+			mtu, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return fmt.Errorf("invalid value %q for %q", args[i+1], args[i])
+			}
+			s.peerMTU = mtu
+		default:
+			return errNotSupported
+		}
+	}
+	if len(args)%2 != 0 || s.peer == "" {
+		return errNotSupported
+	}
+	return nil
+}
+
+func (b *netlinkBackend) addLink(link string, args []string) error {
+	s, err := parseLinkArgs(args, true)
+	if err == errNotSupported {
+		logFallback("link add", link, args)
+		return b.fallback.addLink(link, args)
+	} else if err != nil {
+		return fmt.Errorf("could not add link %s: %v", link, err)
+	}
+
+	msg := [][]byte{ifInfoMsg(0, 0, 0), nlAttrString(syscall.IFLA_IFNAME, link)}
+	msg = append(msg, s.attrs()...)
+	if s.kind != "" {
+		info := [][]byte{nlAttrString(iflaInfoKind, s.kind)}
+		if s.peer != "" {
+			peer := [][]byte{ifInfoMsg(0, 0, 0), nlAttrString(syscall.IFLA_IFNAME, s.peer)}
+			if s.peerMTU != -1 {
+				peer = append(peer, nlAttrUint32(syscall.IFLA_MTU, uint32(s.peerMTU)))
+			}
+			info = append(info, nlAttrNested(iflaInfoData, nlAttrNested(vethInfoPeer, peer...)))
+		}
+		msg = append(msg, nlAttrNested(syscall.IFLA_LINKINFO, info...))
+	}
+
+	_, err = b.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK, msg...)
+	if err != nil {
+		return fmt.Errorf("could not add link %s: %v", link, err)
+	}
+	return nil
+}
+
+// attrs returns the IFLA attributes for the settings that are common to "ip
+// link add" and "ip link set"
+func (s *linkSettings) attrs() [][]byte {
+	var attrs [][]byte
+	if s.mtu != -1 {
+		attrs = append(attrs, nlAttrUint32(syscall.IFLA_MTU, uint32(s.mtu)))
+	}
+	if s.txqlen != -1 {
+		attrs = append(attrs, nlAttrUint32(syscall.IFLA_TXQLEN, uint32(s.txqlen)))
+	}
+	return attrs
+}
+
+func (b *netlinkBackend) deleteLink(link string) error {
+	index, err := b.linkIndex(link)
+	if err == nil {
+		_, err = b.request(syscall.RTM_DELLINK, syscall.NLM_F_ACK, ifInfoMsg(index, 0, 0))
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete link %s: %v", link, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) setLink(link string, args []string) error {
+	s, err := parseLinkArgs(args, false)
+	if err == errNotSupported {
+		logFallback("link set", link, args)
+		return b.fallback.setLink(link, args)
+	} else if err != nil {
+		return fmt.Errorf("could not set link %s: %v", link, err)
+	}
+
+	if err = b.modifyLink(link, s); err != nil {
+		return fmt.Errorf("could not set link %s: %v", link, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) modifyLink(link string, s *linkSettings) error {
+	index, err := b.linkIndex(link)
+	if err != nil {
+		return err
+	}
+
+	var flags, change uint32
+	if s.up {
+		flags, change = syscall.IFF_UP, syscall.IFF_UP
+	} else if s.down {
+		flags, change = 0, syscall.IFF_UP
+	}
+	msg := [][]byte{ifInfoMsg(index, flags, change)}
+	msg = append(msg, s.attrs()...)
+	if s.master != "" {
+		master, err := b.linkIndex(s.master)
+		if err != nil {
+			return err
+		}
+		msg = append(msg, nlAttrUint32(syscall.IFLA_MASTER, uint32(master)))
+	} else if s.nomaster {
+		msg = append(msg, nlAttrUint32(syscall.IFLA_MASTER, 0))
+	}
+	if s.netns != "" {
+		// Like "ip link set ... netns", accept a PID, a path, or the
+		// name of a namespace in /var/run/netns
+		if pid, err := strconv.Atoi(s.netns); err == nil {
+			msg = append(msg, nlAttrUint32(syscall.IFLA_NET_NS_PID, uint32(pid)))
+		} else {
+			path := s.netns
+			if !strings.Contains(path, "/") {
+				path = "/var/run/netns/" + path
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			msg = append(msg, nlAttrUint32(iflaNetNsFd, uint32(f.Fd())))
+		}
+	}
+
+	_, err = b.request(syscall.RTM_NEWLINK, syscall.NLM_F_ACK, msg...)
+	return err
+}
+
+func (b *netlinkBackend) addSlave(link, slave string) error {
+	if err := b.modifyLink(slave, &linkSettings{mtu: -1, txqlen: -1, master: link}); err != nil {
+		return fmt.Errorf("could not add %s to %s: %v", slave, link, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) deleteSlave(slave string) error {
+	if err := b.modifyLink(slave, &linkSettings{mtu: -1, txqlen: -1, nomaster: true}); err != nil {
+		return fmt.Errorf("could not remove %s from its master: %v", slave, err)
+	}
+	return nil
+}
+
+func ipFamily(ip net.IP) uint8 {
+	if len(ip) == net.IPv4len {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+func (b *netlinkBackend) addAddress(link, cidr string, args []string) error {
+	if len(args) != 0 {
+		logFallback("addr add "+cidr+" dev", link, args)
+		return b.fallback.addAddress(link, cidr, args)
+	}
+	if err := b.modifyAddress(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, link, cidr); err != nil {
+		return fmt.Errorf("could not add address %s to %s: %v", cidr, link, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) deleteAddress(link, cidr string, args []string) error {
+	if len(args) != 0 {
+		logFallback("addr del "+cidr+" dev", link, args)
+		return b.fallback.deleteAddress(link, cidr, args)
+	}
+	if err := b.modifyAddress(syscall.RTM_DELADDR, 0, link, cidr); err != nil {
+		return fmt.Errorf("could not delete address %s from %s: %v", cidr, link, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) modifyAddress(msgType, flags uint16, link, cidr string) error {
+	ip, ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	index, err := b.linkIndex(link)
+	if err != nil {
+		return err
+	}
+
+	prefixLen, _ := ipnet.Mask.Size()
+	msg := ifAddrMsg(ipFamily(ip), uint8(prefixLen), index)
+	_, err = b.request(msgType, flags|syscall.NLM_F_ACK, msg,
+		nlAttr(syscall.IFA_LOCAL, ip),
+		nlAttr(syscall.IFA_ADDRESS, ip))
+	return err
+}
+
+func (b *netlinkBackend) getAddresses(link string) ([]string, error) {
+	addrs, err := b.listAddresses(link)
+	if err != nil {
+		return nil, err
+	}
+	strs := []string{}
+	for _, addr := range addrs {
+		if addr.Family == FamilyIPv4 {
+			strs = append(strs, addr.String())
+		}
+	}
+	return strs, nil
+}
+
+func (b *netlinkBackend) listAddresses(link string) ([]Address, error) {
+	index, err := b.linkIndex(link)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := b.request(syscall.RTM_GETADDR, syscall.NLM_F_DUMP, ifAddrMsg(syscall.AF_UNSPEC, 0, 0))
+	if err != nil {
+		return nil, fmt.Errorf("could not get addresses of %s: %v", link, err)
+	}
+
+	addrs := []Address{}
+	for _, reply := range replies {
+		if len(reply) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		family, prefixLen, scope := reply[0], reply[1], reply[3]
+		if int32(nativeEndian.Uint32(reply[4:8])) != index {
+			continue
+		}
+		attrs := parseAttrs(reply[syscall.SizeofIfAddrmsg:])
+		ip, ok := attrs[syscall.IFA_LOCAL]
+		if !ok {
+			ip = attrs[syscall.IFA_ADDRESS]
+		}
+		addr := Address{
+			IP:        net.IP(ip),
+			PrefixLen: int(prefixLen),
+			Scope:     routeName(routeScopes, scope),
+		}
+		switch family {
+		case syscall.AF_INET:
+			addr.Family = FamilyIPv4
+		case syscall.AF_INET6:
+			addr.Family = FamilyIPv6
+		default:
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// routeSettings holds the parsed arguments of "ip route add" or "ip route
+// del". The protocol and scope are -1 if unspecified.
+type routeSettings struct {
+	protocol int
+	scope    int
+	src      net.IP
+	via      net.IP
+	metric   int
+}
+
+func parseRouteArgs(args []string) (*routeSettings, error) {
+	s := &routeSettings{protocol: -1, scope: -1, metric: -1}
+	if len(args)%2 != 0 {
+		return nil, errNotSupported
+	}
+	for i := 0; i < len(args); i += 2 {
+		var err error
+		value := args[i+1]
+		switch args[i] {
+		case "proto", "protocol":
+			s.protocol, err = lookupRouteName(routeProtocols, value)
+		case "scope":
+			s.scope, err = lookupRouteName(routeScopes, value)
+		case "src":
+			if s.src = net.ParseIP(value); s.src == nil {
+				err = fmt.Errorf("invalid IP")
+			}
+		case "via":
+			if s.via = net.ParseIP(value); s.via == nil {
+				err = fmt.Errorf("invalid IP")
+			}
+		case "metric", "preference", "priority":
+			s.metric, err = strconv.Atoi(value)
+		default:
+			return nil, errNotSupported
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for %q", value, args[i])
+		}
+	}
+	return s, nil
+}
+
+func (b *netlinkBackend) addRoute(link, cidr string, args []string) error {
+	s, err := parseRouteArgs(args)
+	if err == errNotSupported {
+		logFallback("route add "+cidr+" dev", link, args)
+		return b.fallback.addRoute(link, cidr, args)
+	}
+	if err == nil {
+		// Same defaults as "ip route add"
+		if s.protocol == -1 {
+			s.protocol = syscall.RTPROT_BOOT
+		}
+		if s.scope == -1 {
+			if s.via == nil {
+				s.scope = syscall.RT_SCOPE_LINK
+			} else {
+				s.scope = syscall.RT_SCOPE_UNIVERSE
+			}
+		}
+		err = b.modifyRoute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, syscall.RTN_UNICAST, link, cidr, s)
+	}
+	if err != nil {
+		return fmt.Errorf("could not add route %s to %s: %v", cidr, link, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) deleteRoute(link, cidr string, args []string) error {
+	s, err := parseRouteArgs(args)
+	if err == errNotSupported {
+		logFallback("route del "+cidr+" dev", link, args)
+		return b.fallback.deleteRoute(link, cidr, args)
+	}
+	if err == nil {
+		// Like "ip route del", match any protocol and scope unless
+		// specified
+		if s.protocol == -1 {
+			s.protocol = 0
+		}
+		if s.scope == -1 {
+			s.scope = syscall.RT_SCOPE_NOWHERE
+		}
+		err = b.modifyRoute(syscall.RTM_DELROUTE, 0, 0, link, cidr, s)
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete route %s from %s: %v", cidr, link, err)
+	}
+	return nil
+}
+
+func (b *netlinkBackend) modifyRoute(msgType, flags uint16, routeType uint8, link, cidr string, s *routeSettings) error {
+	_, dst, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	index, err := b.linkIndex(link)
+	if err != nil {
+		return err
+	}
+
+	family := ipFamily(dst.IP)
+	dstLen, _ := dst.Mask.Size()
+	msg := [][]byte{rtMsg(family, uint8(dstLen), uint8(s.protocol), uint8(s.scope), routeType)}
+	if dstLen != 0 {
+		msg = append(msg, nlAttr(syscall.RTA_DST, dst.IP))
+	}
+	msg = append(msg, nlAttrUint32(syscall.RTA_OIF, uint32(index)))
+	for _, attr := range []struct {
+		attrType uint16
+		ip       net.IP
+	}{{syscall.RTA_GATEWAY, s.via}, {syscall.RTA_PREFSRC, s.src}} {
+		if attr.ip == nil {
+			continue
+		}
+		ip := attr.ip
+		if family == syscall.AF_INET {
+			if ip = ip.To4(); ip == nil {
+				return fmt.Errorf("%s is not an IPv4 address", attr.ip)
+			}
+		}
+		msg = append(msg, nlAttr(attr.attrType, ip))
+	}
+	if s.metric != -1 {
+		msg = append(msg, nlAttrUint32(syscall.RTA_PRIORITY, uint32(s.metric)))
+	}
+
+	_, err = b.request(msgType, flags|syscall.NLM_F_ACK, msg...)
+	return err
+}
+
+func (b *netlinkBackend) getRoutes(link string) ([]string, error) {
+	routes, err := b.listRoutes(link)
+	if err != nil {
+		return nil, err
+	}
+	strs := []string{}
+	for _, route := range routes {
+		if route.Family == FamilyIPv4 && route.Table == RouteTableMain {
+			strs = append(strs, route.String())
+		}
+	}
+	return strs, nil
+}
+
+func (b *netlinkBackend) listRoutes(link string) ([]Route, error) {
+	index, err := b.linkIndex(link)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := b.request(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, rtMsg(syscall.AF_UNSPEC, 0, 0, 0, 0))
+	if err != nil {
+		return nil, fmt.Errorf("could not get routes of %s: %v", link, err)
+	}
+
+	routes := []Route{}
+	for _, reply := range replies {
+		if len(reply) < syscall.SizeofRtMsg {
+			continue
+		}
+		family, dstLen, protocol, scope, routeType := reply[0], reply[1], reply[5], reply[6], reply[7]
+		if routeType != syscall.RTN_UNICAST || nativeEndian.Uint32(reply[8:12])&syscall.RTM_F_CLONED != 0 {
+			continue
+		}
+		attrs := parseAttrs(reply[syscall.SizeofRtMsg:])
+		oif, ok := attrs[syscall.RTA_OIF]
+		if !ok || len(oif) < 4 || int32(nativeEndian.Uint32(oif)) != index {
+			continue
+		}
+
+		route := Route{
+			Protocol: routeName(routeProtocols, protocol),
+			Scope:    routeName(routeScopes, scope),
+			Table:    int(reply[4]),
+		}
+		switch family {
+		case syscall.AF_INET:
+			route.Family = FamilyIPv4
+		case syscall.AF_INET6:
+			route.Family = FamilyIPv6
+		default:
+			continue
+		}
+		if dst, ok := attrs[syscall.RTA_DST]; ok {
+			route.Dst = &net.IPNet{IP: net.IP(dst), Mask: net.CIDRMask(int(dstLen), len(dst)*8)}
+		}
+		if gw, ok := attrs[syscall.RTA_GATEWAY]; ok {
+			route.Gateway = net.IP(gw)
+		}
+		if src, ok := attrs[syscall.RTA_PREFSRC]; ok {
+			route.Src = net.IP(src)
+		}
+		if metric, ok := attrs[syscall.RTA_PRIORITY]; ok && len(metric) >= 4 {
+			route.Metric = int(nativeEndian.Uint32(metric))
+		}
+		if table, ok := attrs[syscall.RTA_TABLE]; ok && len(table) >= 4 {
+			route.Table = int(nativeEndian.Uint32(table))
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func logFallback(command, link string, args []string) {
+	glog.V(5).Infof("netlink backend can't handle 'ip %s %s %s'; running ip instead", command, link, strings.Join(args, " "))
+}
+
+// linkIndex returns the interface index of link
+func (b *netlinkBackend) linkIndex(link string) (int32, error) {
+	l, err := b.getLink(link)
+	if err != nil {
+		return 0, err
+	}
+	return int32(l.Index), nil
+}
+
+func (b *netlinkBackend) getLink(link string) (*Link, error) {
+	replies, err := b.request(syscall.RTM_GETLINK, 0, ifInfoMsg(0, 0, 0), nlAttrString(syscall.IFLA_IFNAME, link))
+	if err == syscall.ENODEV {
+		return nil, fmt.Errorf("Device \"%s\" does not exist", link)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get link %s: %v", link, err)
+	}
+	if len(replies) != 1 || len(replies[0]) < syscall.SizeofIfInfomsg {
+		return nil, fmt.Errorf("could not get link %s: unexpected reply", link)
+	}
+
+	reply := replies[0]
+	l := &Link{
+		Name:  link,
+		Index: int(int32(nativeEndian.Uint32(reply[4:8]))),
+		Up:    nativeEndian.Uint32(reply[8:12])&syscall.IFF_UP != 0,
+	}
+	for attrType, data := range parseAttrs(reply[syscall.SizeofIfInfomsg:]) {
+		if attrType == syscall.IFLA_ADDRESS {
+			l.HardwareAddr = net.HardwareAddr(data)
+			continue
+		}
+		if len(data) < 4 {
+			continue
+		}
+		value := int(nativeEndian.Uint32(data))
+		switch attrType {
+		case syscall.IFLA_MTU:
+			l.MTU = value
+		case syscall.IFLA_TXQLEN:
+			l.TxQueueLen = value
+		case syscall.IFLA_MASTER:
+			l.MasterIndex = value
+		case syscall.IFLA_LINK:
+			if value != l.Index {
+				l.PeerIndex = value
+			}
+		}
+	}
+	return l, nil
+}
+
+// Message encoding
+
+func ifInfoMsg(index int32, flags, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	nativeEndian.PutUint32(b[8:12], flags)
+	nativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+func ifAddrMsg(family, prefixLen uint8, index int32) []byte {
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = prefixLen
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+func rtMsg(family, dstLen, protocol, scope, routeType uint8) []byte {
+	b := make([]byte, syscall.SizeofRtMsg)
+	b[0] = family
+	b[1] = dstLen
+	b[4] = syscall.RT_TABLE_MAIN
+	b[5] = protocol
+	b[6] = scope
+	b[7] = routeType
+	return b
+}
+
+func nlAlign(length int) int {
+	return (length + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+}
+
+func nlAttr(attrType uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	b := make([]byte, nlAlign(length))
+	nativeEndian.PutUint16(b[0:2], uint16(length))
+	nativeEndian.PutUint16(b[2:4], attrType)
+	copy(b[syscall.SizeofRtAttr:], data)
+	return b
+}
+
+func nlAttrString(attrType uint16, value string) []byte {
+	return nlAttr(attrType, append([]byte(value), 0))
+}
+
+func nlAttrUint32(attrType uint16, value uint32) []byte {
+	data := make([]byte, 4)
+	nativeEndian.PutUint32(data, value)
+	return nlAttr(attrType, data)
+}
+
+// nlAttrNested returns an attribute containing the given attributes (or, for
+// VETH_INFO_PEER, a header followed by attributes).
+func nlAttrNested(attrType uint16, children ...[]byte) []byte {
+	var data []byte
+	for _, child := range children {
+		data = append(data, child...)
+	}
+	return nlAttr(attrType, data)
+}
+
+// parseAttrs parses a sequence of attributes. (If an attribute occurs more
+// than once, the last one wins.)
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(nativeEndian.Uint16(b[0:2]))
+		attrType := nativeEndian.Uint16(b[2:4])
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+		attrs[attrType] = b[syscall.SizeofRtAttr:length]
+		if nlAlign(length) >= len(b) {
+			break
+		}
+		b = b[nlAlign(length):]
+	}
+	return attrs
+}
+
+// socket opens a netlink socket in the backend's network namespace. (The
+// socket continues to operate in that namespace regardless of what thread uses
+// it later.)
+func (b *netlinkBackend) socket() (int, error) {
+	var fd int
+	err := withNetNS(b.netns, func() error {
+		var err error
+		fd, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+		if err != nil {
+			return os.NewSyscallError("socket", err)
+		}
+		return nil
+	})
+	return fd, err
+}
+
+// request sends an rtnetlink request made up of the concatenation of
+// data, and returns the data of the reply messages. If flags includes
+// NLM_F_ACK, it waits for the acknowledgement; if it includes NLM_F_DUMP, it
+// waits for the end of the dump.
+func (b *netlinkBackend) request(msgType, flags uint16, data ...[]byte) ([][]byte, error) {
+	fd, err := b.socket()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	const seq = 1
+	msg := make([]byte, syscall.NLMSG_HDRLEN)
+	for _, d := range data {
+		msg = append(msg, d...)
+	}
+	nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:6], msgType)
+	nativeEndian.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST)
+	nativeEndian.PutUint32(msg[8:12], seq)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("short netlink error message")
+				}
+				if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return replies, nil
+			default:
+				replies = append(replies, append([]byte(nil), m.Data...))
+				if flags&syscall.NLM_F_DUMP == 0 && flags&syscall.NLM_F_ACK == 0 {
+					return replies, nil
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package ipcmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/openshift/openshift-sdn/pkg/exec"
+)
+
+// netlinkSetup moves the test's thread into a new, empty network namespace
+// and selects the netlink backend, and returns an Executor for any commands
+// that the backend falls back to. The thread is never unlocked, so it exits
+// along with the test's goroutine rather than being reused in the wrong
+// namespace.
+func netlinkSetup(t *testing.T) exec.Executor {
+	if os.Geteuid() != 0 {
+		t.Skip("must be root to create a network namespace")
+	}
+
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skipf("could not create network namespace: %v", err)
+	}
+	if err := SetBackend(NetlinkBackend); err != nil {
+		t.Fatalf("unexpected error selecting netlink backend: %v", err)
+	}
+	return exec.New()
+}
+
+func TestNetlinkLinks(t *testing.T) {
+	execer := netlinkSetup(t)
+
+	itx := NewTransaction(execer, "lbr0")
+	itx.AddLink("type", "bridge")
+	itx.SetLink("up")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error creating bridge: %v", err)
+	}
+
+	itx = NewTransaction(execer, "vlinuxbr")
+	itx.AddLink("mtu", "1450", "type", "veth", "peer", "name", "vovsbr", "mtu", "1450")
+	itx.SetLink("up")
+	itx.SetLink("txqueuelen", "0")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error creating veth: %v", err)
+	}
+
+	itx = NewTransaction(execer, "lbr0")
+	itx.AddSlave("vlinuxbr")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error adding slave: %v", err)
+	}
+
+	bridge, err := NewTransaction(execer, "lbr0").GetLink()
+	if err != nil {
+		t.Fatalf("unexpected error getting bridge info: %v", err)
+	}
+	if !bridge.Up {
+		t.Fatalf("bridge is not up")
+	}
+	veth, err := NewTransaction(execer, "vlinuxbr").GetLink()
+	if err != nil {
+		t.Fatalf("unexpected error getting veth info: %v", err)
+	}
+	if veth.MTU != 1450 || veth.TxQueueLen != 0 || !veth.Up {
+		t.Fatalf("veth has wrong settings: %#v", veth)
+	}
+	if veth.MasterIndex != bridge.Index {
+		t.Fatalf("veth has master %d, expected %d", veth.MasterIndex, bridge.Index)
+	}
+	peer, err := NewTransaction(execer, "vovsbr").GetLink()
+	if err != nil {
+		t.Fatalf("unexpected error getting veth peer info: %v", err)
+	}
+	if peer.MTU != 1450 || peer.Up || peer.PeerIndex != veth.Index || veth.PeerIndex != peer.Index {
+		t.Fatalf("veth peer has wrong settings: %#v", peer)
+	}
+
+	itx = NewTransaction(execer, "lbr0")
+	itx.DeleteSlave("vlinuxbr")
+	itx.SetLink("down")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error removing slave: %v", err)
+	}
+	if veth, err = NewTransaction(execer, "vlinuxbr").GetLink(); err != nil || veth.MasterIndex != 0 {
+		t.Fatalf("veth still has master (%v)", err)
+	}
+
+	itx = NewTransaction(execer, "vlinuxbr")
+	itx.DeleteLink()
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error deleting veth: %v", err)
+	}
+	if _, err = NewTransaction(execer, "vovsbr").GetLink(); err == nil {
+		t.Fatalf("veth peer was not deleted with veth")
+	}
+
+	itx = NewTransaction(execer, "vlinuxbr")
+	itx.DeleteLink()
+	if err := itx.EndTransaction(); err == nil {
+		t.Fatalf("unexpectedly deleted non-existent link")
+	}
+
+	itx = NewTransaction(execer, "lbr0")
+	itx.AddLink("type", "bridge")
+	if err := itx.EndTransaction(); err == nil {
+		t.Fatalf("unexpectedly re-created existing link")
+	}
+}
+
+func TestNetlinkAddresses(t *testing.T) {
+	execer := netlinkSetup(t)
+
+	itx := NewTransaction(execer, "tun0")
+	itx.AddLink("type", "bridge")
+	itx.AddAddress("10.1.0.1/24")
+	itx.AddAddress("10.1.1.1/24")
+	itx.SetLink("up")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	itx = NewTransaction(execer, "tun0")
+	addrs, err := itx.GetAddresses()
+	if err != nil {
+		t.Fatalf("unexpected error getting addresses: %v", err)
+	}
+	if strings.Join(addrs, " ") != "10.1.0.1/24 10.1.1.1/24" {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+
+	itx.DeleteAddress("10.1.1.1/24")
+	addrs, err = itx.GetAddresses()
+	if err != nil {
+		t.Fatalf("unexpected error getting addresses: %v", err)
+	}
+	if strings.Join(addrs, " ") != "10.1.0.1/24" {
+		t.Fatalf("unexpected addresses after delete %v", addrs)
+	}
+
+	itx.DeleteAddress("10.1.1.1/24")
+	if _, err = itx.GetAddresses(); err == nil {
+		t.Fatalf("transaction did not latch error from deleting non-existent address")
+	}
+	itx.IgnoreError()
+	itx.AddAddress("10.1.2.1/24")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error after IgnoreError(): %v", err)
+	}
+
+	itx = NewTransaction(execer, "tun1")
+	if addrs, err = itx.GetAddresses(); err == nil {
+		t.Fatalf("allegedly got addresses for non-existent link: %v", addrs)
+	}
+	if err := itx.EndTransaction(); err == nil {
+		t.Fatalf("transaction unexpectedly returned no error")
+	}
+}
+
+func TestNetlinkRoutes(t *testing.T) {
+	execer := netlinkSetup(t)
+
+	itx := NewTransaction(execer, "tun0")
+	itx.AddLink("type", "bridge")
+	itx.SetLink("up")
+	itx.AddAddress("10.1.0.1/24")
+	itx.AddRoute("10.0.0.0/8", "proto", "kernel", "scope", "link")
+	itx.AddRoute("172.30.0.0/16")
+	itx.AddRoute("192.168.0.0/16", "via", "10.1.0.254", "metric", "10")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	itx = NewTransaction(execer, "tun0")
+	routes, err := itx.GetRoutes()
+	if err != nil {
+		t.Fatalf("unexpected error getting routes: %v", err)
+	}
+	expected := []string{
+		"10.0.0.0/8 proto kernel scope link",
+		"10.1.0.0/24 proto kernel scope link src 10.1.0.1",
+		"172.30.0.0/16 scope link",
+		"192.168.0.0/16 via 10.1.0.254 metric 10",
+	}
+	if strings.Join(routes, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected routes:\n%s\nexpected:\n%s", strings.Join(routes, "\n"), strings.Join(expected, "\n"))
+	}
+
+	itx.DeleteRoute("10.0.0.0/8")
+	itx.DeleteRoute("192.168.0.0/16")
+	routes, err = itx.GetRoutes()
+	if err != nil {
+		t.Fatalf("unexpected error getting routes: %v", err)
+	}
+	if len(routes) != 2 || routes[1] != "172.30.0.0/16 scope link" {
+		t.Fatalf("unexpected routes after delete: %v", routes)
+	}
+
+	itx.DeleteRoute("10.0.0.0/8")
+	if err := itx.EndTransaction(); err == nil {
+		t.Fatalf("unexpectedly deleted non-existent route")
+	}
+}
+
+func TestNetlinkFallback(t *testing.T) {
+	// Arguments that the netlink backend doesn't understand are passed to
+	// "ip" before anything is sent over netlink, so this doesn't need a
+	// network namespace.
+	if err := SetBackend(NetlinkBackend); err != nil {
+		t.Fatalf("unexpected error selecting netlink backend: %v", err)
+	}
+	fexec := exec.NewFakeExecutor("/sbin/ip")
+	fexec.AddResult("/sbin/ip link add vxlan0 type vxlan id 42", "", nil)
+	fexec.AddResult("/sbin/ip addr add 10.1.0.1/24 dev tun0 scope link", "", nil)
+	fexec.AddResult("/sbin/ip route add 10.1.0.0/16 dev tun0 table 10", "", fmt.Errorf("RTNETLINK answers: File exists"))
+
+	itx := NewTransaction(fexec, "vxlan0")
+	itx.AddLink("type", "vxlan", "id", "42")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	itx = NewTransaction(fexec, "tun0")
+	itx.AddAddress("10.1.0.1/24", "scope", "link")
+	itx.AddRoute("10.1.0.0/16", "table", "10")
+	itx.SetLink("up")
+	if err := itx.EndTransaction(); err == nil {
+		t.Fatalf("transaction did not return error from fallback")
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestNetlinkListAddressesAndRoutes(t *testing.T) {
+	execer := netlinkSetup(t)
+
+	itx := NewTransaction(execer, "tun0")
+	itx.AddLink("type", "bridge")
+	itx.SetLink("up")
+	itx.AddAddress("10.1.0.1/24")
+	itx.AddAddress("fd00:10:1::1/64")
+	itx.AddRoute("10.1.0.0/16", "proto", "kernel", "scope", "link")
+	itx.AddRoute("fd00:10::/48", "metric", "50")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	itx = NewTransaction(execer, "tun0")
+	addr, err := itx.FindAddress("fd00:10:1::1/64")
+	if err != nil || addr == nil {
+		t.Fatalf("could not find IPv6 address (%v)", err)
+	}
+	if addr.Family != FamilyIPv6 || addr.Scope != "global" {
+		t.Fatalf("unexpected address %#v", addr)
+	}
+	if addr, err = itx.FindAddress("10.1.0.1/16"); err != nil || addr != nil {
+		t.Fatalf("unexpectedly found address %v (%v)", addr, err)
+	}
+	if addrs, err := itx.GetAddresses(); err != nil || len(addrs) != 1 {
+		t.Fatalf("GetAddresses() returned unexpected result %v (%v)", addrs, err)
+	}
+
+	routes, err := itx.FindRoutes("10.1.0.0/24")
+	if err != nil || len(routes) != 1 {
+		t.Fatalf("unexpected result %v (%v)", routes, err)
+	}
+	if routes[0].String() != "10.1.0.0/24 proto kernel scope link src 10.1.0.1" || routes[0].Table != RouteTableMain {
+		t.Fatalf("unexpected route %#v", routes[0])
+	}
+	routes, err = itx.FindRoutes("fd00:10::/48")
+	if err != nil || len(routes) != 1 {
+		t.Fatalf("unexpected result %v (%v)", routes, err)
+	}
+	if routes[0].Family != FamilyIPv6 || routes[0].Metric != 50 {
+		t.Fatalf("unexpected route %#v", routes[0])
+	}
+
+	// Deleting by an exact match removes only that route
+	itx.DeleteRoute(routes[0].DstString())
+	itx.DeleteRoute("10.1.0.0/16")
+	if routes, err = itx.FindRoutes("10.1.0.0/24"); err != nil || len(routes) != 1 {
+		t.Fatalf("wrong route deleted: %v (%v)", routes, err)
+	}
+	if routes, err = itx.FindRoutes("fd00:10::/48"); err != nil || len(routes) != 0 {
+		t.Fatalf("route not deleted: %v (%v)", routes, err)
+	}
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// newTestNetNS creates a new network namespace and returns its path. The
+// namespace is held open by a locked thread until the returned function is
+// called.
+func newTestNetNS(t *testing.T) (string, func()) {
+	pathCh := make(chan string)
+	errCh := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		// Never unlocked; the thread exits with the goroutine
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			errCh <- err
+			return
+		}
+		pathCh <- fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid())
+		<-done
+	}()
+
+	select {
+	case path := <-pathCh:
+		return path, func() { close(done) }
+	case err := <-errCh:
+		t.Fatalf("could not create network namespace: %v", err)
+		return "", nil
+	}
+}
+
+func TestNetlinkNetNS(t *testing.T) {
+	execer := netlinkSetup(t)
+	podNetNS, cleanup := newTestNetNS(t)
+	defer cleanup()
+
+	itx := NewTransaction(execer, "veth1")
+	itx.AddLink("type", "veth", "peer", "name", "eth0")
+	itx.SetLink("up")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error creating veth: %v", err)
+	}
+	itx = NewTransaction(execer, "eth0")
+	itx.SetLink("netns", podNetNS)
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error moving veth peer: %v", err)
+	}
+	if _, err := NewTransaction(execer, "eth0").GetLink(); err == nil {
+		t.Fatalf("veth peer is still in original namespace")
+	}
+	veth, err := NewTransaction(execer, "veth1").GetLink()
+	if err != nil {
+		t.Fatalf("unexpected error getting veth: %v", err)
+	}
+
+	itx = NewNetNSTransaction(execer, podNetNS, "eth0")
+	itx.SetLink("up")
+	itx.AddAddress("10.1.0.2/24")
+	itx.AddRoute("10.0.0.0/8", "proto", "kernel", "scope", "link", "src", "10.1.0.2")
+	link, err := itx.GetLink()
+	if err != nil {
+		t.Fatalf("unexpected error configuring pod interface: %v", err)
+	}
+	if link.PeerIndex != veth.Index || len(link.HardwareAddr) != 6 || !link.Up {
+		t.Fatalf("unexpected pod link %#v", link)
+	}
+	routes, err := itx.FindRoutes("10.0.0.0/8")
+	if err != nil || len(routes) != 1 || routes[0].String() != "10.0.0.0/8 proto kernel scope link src 10.1.0.2" {
+		t.Fatalf("unexpected routes %v (%v)", routes, err)
+	}
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The original namespace is unaffected
+	if routes, err = NewTransaction(execer, "veth1").FindRoutes("10.0.0.0/8"); err != nil || len(routes) != 0 {
+		t.Fatalf("route was added in the wrong namespace: %v (%v)", routes, err)
+	}
+
+	itx = NewNetNSTransaction(execer, "/proc/0/ns/net", "eth0")
+	itx.SetLink("up")
+	if err := itx.EndTransaction(); err == nil {
+		t.Fatalf("unexpectedly succeeded in non-existent namespace")
+	}
+}
+
+func TestNetlinkRollback(t *testing.T) {
+	execer := netlinkSetup(t)
+
+	itx := NewTransaction(execer, "lbr0")
+	itx.AddLink("type", "bridge")
+	itx.AddAddress("10.1.0.1/24")
+	itx.SetLink("mtu", "1400", "up")
+	itx.AddRoute("10.1.1.0/24")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error creating bridge: %v", err)
+	}
+	itx.Rollback()
+	itx.Rollback()
+	if _, err := NewTransaction(execer, "lbr0").GetLink(); err == nil {
+		t.Fatalf("bridge was not deleted by rollback")
+	}
+
+	itx = NewTransaction(execer, "tun0")
+	itx.AddLink("type", "bridge")
+	itx.AddAddress("10.1.0.1/16")
+	itx.SetLink("up")
+	itx.AddRoute("172.30.0.0/16", "scope", "link")
+	if err := itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error creating link: %v", err)
+	}
+
+	itx = NewTransaction(execer, "tun0")
+	itx.SetLink("mtu", "1400")
+	itx.DeleteRoute("172.30.0.0/16")
+	itx.AddAddress("10.2.0.1/16")
+	itx.AddRoute("10.3.0.0/16", "via", "10.1.0.254")
+	if err := itx.Rollback(); err != nil {
+		t.Fatalf("unexpected error rolling back: %v", err)
+	}
+
+	itx = NewTransaction(execer, "tun0")
+	link, err := itx.GetLink()
+	if err != nil {
+		t.Fatalf("unexpected error getting link: %v", err)
+	}
+	if !link.Up || link.MTU != 1500 {
+		t.Fatalf("link settings were not restored: %#v", link)
+	}
+	if addr, err := itx.FindAddress("10.2.0.1/16"); err != nil || addr != nil {
+		t.Fatalf("added address was not removed: %v (%v)", addr, err)
+	}
+	routes, err := itx.FindRoutes("172.30.0.0/16")
+	if err != nil || len(routes) != 1 || routes[0].Scope != "link" {
+		t.Fatalf("deleted route was not restored: %v (%v)", routes, err)
+	}
+	if routes, err = itx.FindRoutes("10.3.0.0/16"); err != nil || len(routes) != 0 {
+		t.Fatalf("added route was not removed: %v (%v)", routes, err)
+	}
+	if err = itx.EndTransaction(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package ipcmd
+
+const netlinkSupported = false
+
+func newNetlinkBackend(fallback execBackend) backend {
+	return fallback
+}
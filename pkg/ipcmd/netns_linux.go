@@ -0,0 +1,80 @@
+package ipcmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// setns(2) system call numbers, which the syscall package does not define on
+// all architectures
+var setnsSyscall = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"ppc64":   350,
+	"ppc64le": 350,
+	"s390x":   339,
+}
+
+func setns(f *os.File) error {
+	trap, ok := setnsSyscall[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("setns is not supported on %s", runtime.GOARCH)
+	}
+	_, _, errno := syscall.RawSyscall(trap, f.Fd(), syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return os.NewSyscallError("setns", errno)
+	}
+	return nil
+}
+
+// withNetNS calls f with the calling thread in the network namespace at the
+// path netns (or in the current namespace if netns is ""). f must not start
+// any goroutines of its own.
+func withNetNS(netns string, f func() error) error {
+	if netns == "" {
+		return f()
+	}
+
+	target, err := os.Open(netns)
+	if err != nil {
+		return fmt.Errorf("could not open network namespace: %v", err)
+	}
+	defer target.Close()
+
+	// Do the work in a new goroutine, with its thread locked, so that if we
+	// can't get the thread back into the original namespace we can park the
+	// goroutine forever rather than let the thread be reused in the wrong
+	// namespace. (Go 1.10 and later destroy a thread whose goroutine exits
+	// while locked, but older releases return it to the scheduler.)
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("could not open current network namespace: %v", err)
+			return
+		}
+		defer orig.Close()
+
+		if err := setns(target); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("could not enter network namespace %s: %v", netns, err)
+			return
+		}
+		errCh <- f()
+		if err := setns(orig); err != nil {
+			glog.Errorf("Could not return to original network namespace; leaking a thread: %v", err)
+			select {}
+		}
+		runtime.UnlockOSThread()
+	}()
+	return <-errCh
+}
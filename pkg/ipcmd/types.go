@@ -0,0 +1,251 @@
+package ipcmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Family is an IP address family
+type Family int
+
+const (
+	FamilyIPv4 Family = 4
+	FamilyIPv6 Family = 6
+)
+
+func (f Family) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "inet"
+	case FamilyIPv6:
+		return "inet6"
+	}
+	return fmt.Sprintf("Family(%d)", int(f))
+}
+
+func ipToFamily(ip net.IP) Family {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// Routing table IDs
+const (
+	RouteTableMain  = 254
+	RouteTableLocal = 255
+)
+
+// Link describes a network interface
+type Link struct {
+	Name         string
+	Index        int
+	MTU          int
+	TxQueueLen   int
+	HardwareAddr net.HardwareAddr
+	Up           bool
+	// MasterIndex is the interface index of the bridge (or bond, etc) that
+	// the link is a slave of, or 0
+	MasterIndex int
+	// PeerIndex is the interface index of the link's peer (eg, the other
+	// end of a veth pair), or 0. The peer may be in a different network
+	// namespace.
+	PeerIndex int
+}
+
+// Address is an IPv4 or IPv6 address assigned to an interface
+type Address struct {
+	Family Family
+	// IP is the address and PrefixLen is the length of the prefix of its
+	// subnet (eg, 10.1.0.1 and 24)
+	IP        net.IP
+	PrefixLen int
+	// Scope is the scope of the address ("global", "link", "host", etc)
+	Scope string
+}
+
+// String returns the address in CIDR notation
+func (a Address) String() string {
+	return fmt.Sprintf("%s/%d", a.IP, a.PrefixLen)
+}
+
+// Matches returns true if the address is exactly cidr (including the prefix
+// length). A plain IP address matches only a /32 (or /128) address.
+func (a Address) Matches(cidr string) bool {
+	ip, ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	prefixLen, _ := ipnet.Mask.Size()
+	return a.IP.Equal(ip) && a.PrefixLen == prefixLen && a.Family == ipToFamily(ip)
+}
+
+// Route is an IPv4 or IPv6 unicast route through an interface
+type Route struct {
+	Family Family
+	// Dst is the destination of the route, or nil for the default route
+	Dst *net.IPNet
+	// Gateway is the next hop, or nil if the destination is directly
+	// reachable on the link
+	Gateway net.IP
+	// Src is the preferred source address, or nil if not set
+	Src net.IP
+	// Protocol is the origin of the route ("kernel", "boot", "static", etc,
+	// or a number)
+	Protocol string
+	// Scope is the scope of the destination ("global", "link", "host",
+	// etc)
+	Scope  string
+	Metric int
+	// Table is the ID of the routing table the route is in (usually
+	// RouteTableMain)
+	Table int
+}
+
+// DstString returns the route's destination in the format used by "ip route"
+func (r Route) DstString() string {
+	if r.Dst == nil {
+		return "default"
+	}
+	if ones, bits := r.Dst.Mask.Size(); ones == bits {
+		return r.Dst.IP.String()
+	}
+	return r.Dst.String()
+}
+
+// String returns the route in the format used by "ip route show dev ..."
+func (r Route) String() string {
+	parts := []string{r.DstString()}
+	if r.Gateway != nil {
+		parts = append(parts, "via", r.Gateway.String())
+	}
+	if r.Protocol != "" && r.Protocol != "boot" {
+		parts = append(parts, "proto", r.Protocol)
+	}
+	if r.Scope != "" && r.Scope != "global" {
+		parts = append(parts, "scope", r.Scope)
+	}
+	if r.Src != nil {
+		parts = append(parts, "src", r.Src.String())
+	}
+	if r.Metric != 0 {
+		parts = append(parts, "metric", strconv.Itoa(r.Metric))
+	}
+	if r.Table != 0 && r.Table != RouteTableMain {
+		parts = append(parts, "table", routeTableName(r.Table))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Matches returns true if the route's destination is exactly cidr (so
+// "10.1.0.0/16" does not match a route to "10.1.0.0/24" or vice versa). cidr
+// may also be a plain IP address, which matches only a host route, or
+// "default", which matches only an IPv4 default route.
+func (r Route) Matches(cidr string) bool {
+	_, ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	if r.Family != ipToFamily(ipnet.IP) {
+		return false
+	}
+	dstLen, _ := ipnet.Mask.Size()
+	if r.Dst == nil {
+		return dstLen == 0
+	}
+	ones, _ := r.Dst.Mask.Size()
+	return ones == dstLen && r.Dst.IP.Equal(ipnet.IP)
+}
+
+// parseCIDR parses an address or route destination, which may be a plain IP
+// address (meaning a single-address CIDR) or "default"
+func parseCIDR(cidr string) (net.IP, *net.IPNet, error) {
+	if cidr == "default" {
+		cidr = "0.0.0.0/0"
+	} else if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid address %q", cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		ipnet.IP = ipnet.IP.To4()
+	}
+	return ip, ipnet, nil
+}
+
+// parseIP parses an IP address, returning IPv4 addresses in their 4-byte form
+func parseIP(str string) net.IP {
+	ip := net.ParseIP(str)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Names used by "ip" for route protocols, scopes, and tables
+var (
+	routeProtocols = map[string]uint8{
+		"redirect": 1,
+		"kernel":   2,
+		"boot":     3,
+		"static":   4,
+	}
+	routeScopes = map[string]uint8{
+		"global":  0,
+		"site":    200,
+		"link":    253,
+		"host":    254,
+		"nowhere": 255,
+	}
+	routeTables = map[string]int{
+		"default": 253,
+		"main":    RouteTableMain,
+		"local":   RouteTableLocal,
+	}
+)
+
+func lookupRouteName(names map[string]uint8, name string) (int, error) {
+	if value, ok := names[name]; ok {
+		return int(value), nil
+	}
+	value, err := strconv.ParseUint(name, 0, 8)
+	return int(value), err
+}
+
+func routeName(names map[string]uint8, value uint8) string {
+	for name, v := range names {
+		if v == value {
+			return name
+		}
+	}
+	return strconv.Itoa(int(value))
+}
+
+func routeTableName(table int) string {
+	for name, id := range routeTables {
+		if id == table {
+			return name
+		}
+	}
+	return strconv.Itoa(table)
+}
+
+func lookupRouteTable(name string) (int, error) {
+	if id, ok := routeTables[name]; ok {
+		return id, nil
+	}
+	return strconv.Atoi(name)
+}
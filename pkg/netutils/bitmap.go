@@ -0,0 +1,247 @@
+package netutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// bitmap is a fixed-size set of bits. As well as the bits themselves, it keeps
+// track of which words of the bitmap are full and which are non-empty, so that
+// it can quickly find clear bits and check ranges for set bits.
+type bitmap struct {
+	size  uint
+	count uint
+	words []uint64
+	// full and nonEmpty have a bit set for each word of words that has all
+	// of its bits set, or any of its bits set, respectively
+	full     []uint64
+	nonEmpty []uint64
+}
+
+func newBitmap(size uint) *bitmap {
+	nwords := (size + 63) / 64
+	b := &bitmap{
+		size:     size,
+		words:    make([]uint64, nwords),
+		full:     make([]uint64, (nwords+63)/64),
+		nonEmpty: make([]uint64, (nwords+63)/64),
+	}
+	// The bits past the end of the bitmap are permanently set, so that
+	// findClear never returns them
+	if size%64 != 0 {
+		b.words[nwords-1] = ^uint64(0) << (size % 64)
+		b.update(nwords - 1)
+	}
+	return b
+}
+
+func (b *bitmap) get(i uint) bool {
+	return b.words[i/64]&(1<<(i%64)) != 0
+}
+
+func (b *bitmap) set(i uint) {
+	if !b.get(i) {
+		b.words[i/64] |= 1 << (i % 64)
+		b.count++
+		b.update(i / 64)
+	}
+}
+
+func (b *bitmap) clear(i uint) {
+	if b.get(i) {
+		b.words[i/64] &^= 1 << (i % 64)
+		b.count--
+		b.update(i / 64)
+	}
+}
+
+// update updates the summary bits for word w
+func (b *bitmap) update(w uint) {
+	bit := uint64(1) << (w % 64)
+	if b.words[w] == ^uint64(0) {
+		b.full[w/64] |= bit
+	} else {
+		b.full[w/64] &^= bit
+	}
+	if b.words[w] != 0 {
+		b.nonEmpty[w/64] |= bit
+	} else {
+		b.nonEmpty[w/64] &^= bit
+	}
+}
+
+// deBruijn64 and deBruijn64Tab implement trailingZeros64, as in math/bits
+// (which is not available in the Go version this builds with)
+const deBruijn64 = 0x03f79d71b4ca8b09
+
+var deBruijn64Tab = [64]byte{
+	0, 1, 56, 2, 57, 49, 28, 3, 61, 58, 42, 50, 38, 29, 17, 4,
+	62, 47, 59, 36, 45, 43, 51, 22, 53, 39, 33, 30, 24, 18, 12, 5,
+	63, 55, 48, 27, 60, 41, 37, 16, 46, 35, 44, 21, 52, 32, 23, 11,
+	54, 26, 40, 15, 34, 20, 31, 10, 25, 14, 19, 9, 13, 8, 7, 6,
+}
+
+// trailingZeros64 returns the number of trailing zero bits in x; the result
+// is 64 for x == 0
+func trailingZeros64(x uint64) uint {
+	if x == 0 {
+		return 64
+	}
+	// x & -x leaves only the lowest set bit of x
+	return uint(deBruijn64Tab[(x&-x)*deBruijn64>>(64-6)])
+}
+
+// nextSummaryWord returns the index of the first word in [w, end) whose bit in
+// summary is equal to want, or end if there is none
+func nextSummaryWord(summary []uint64, want bool, w, end uint) uint {
+	for w < end {
+		s := summary[w/64]
+		if !want {
+			s = ^s
+		}
+		s &= ^uint64(0) << (w % 64)
+		if s != 0 {
+			w = w/64*64 + trailingZeros64(s)
+			break
+		}
+		w = (w/64 + 1) * 64
+	}
+	if w > end {
+		return end
+	}
+	return w
+}
+
+// findClear returns the first clear bit in [start, end)
+func (b *bitmap) findClear(start, end uint) (uint, bool) {
+	for start < end {
+		w := start / 64
+		clear := ^b.words[w] & (^uint64(0) << (start % 64))
+		if clear != 0 {
+			i := w*64 + trailingZeros64(clear)
+			return i, i < end
+		}
+		start = nextSummaryWord(b.full, false, w+1, uint(len(b.words))) * 64
+	}
+	return 0, false
+}
+
+// findSet returns the first set bit in [start, end)
+func (b *bitmap) findSet(start, end uint) (uint, bool) {
+	for start < end {
+		w := start / 64
+		set := b.words[w] & (^uint64(0) << (start % 64))
+		if set != 0 {
+			i := w*64 + trailingZeros64(set)
+			return i, i < end
+		}
+		start = nextSummaryWord(b.nonEmpty, true, w+1, uint(len(b.words))) * 64
+	}
+	return 0, false
+}
+
+// nextClear returns the first clear bit at or after start, wrapping around to
+// the start of the bitmap if necessary
+func (b *bitmap) nextClear(start uint) (uint, bool) {
+	if b.count == b.size {
+		return 0, false
+	}
+	if start >= b.size {
+		start = 0
+	}
+	if i, ok := b.findClear(start, b.size); ok {
+		return i, true
+	}
+	return b.findClear(0, start)
+}
+
+// anySet returns true if any of the n bits starting at start are set
+func (b *bitmap) anySet(start, n uint) bool {
+	_, found := b.findSet(start, start+n)
+	return found
+}
+
+// appendRuns appends the set bits of b to buf, as the number of runs of set
+// bits followed by the gap before and the length of each run, all as uvarints
+func (b *bitmap) appendRuns(buf []byte) []byte {
+	var runs []uint
+	var last uint
+	for i := uint(0); i < b.size; {
+		start, ok := b.findSet(i, b.size)
+		if !ok {
+			break
+		}
+		end, ok := b.findClear(start, b.size)
+		if !ok {
+			end = b.size
+		}
+		runs = append(runs, start-last, end-start)
+		last, i = end, end
+	}
+
+	buf = appendUvarint(buf, uint(len(runs)/2))
+	for _, n := range runs {
+		buf = appendUvarint(buf, n)
+	}
+	return buf
+}
+
+// readRuns sets the bits described by data written by appendRuns
+func (b *bitmap) readRuns(r *bytes.Reader) error {
+	nruns, err := readUvarint(r)
+	if err != nil {
+		return err
+	}
+	var i uint
+	for ; nruns > 0; nruns-- {
+		gap, err := readUvarint(r)
+		if err != nil {
+			return err
+		}
+		length, err := readUvarint(r)
+		if err != nil {
+			return err
+		}
+		if i+gap+length > b.size || length == 0 {
+			return fmt.Errorf("bad run of %d bits at %d", length, i+gap)
+		}
+		for i += gap; length > 0; length-- {
+			b.set(i)
+			i++
+		}
+	}
+	return nil
+}
+
+func appendUvarint(buf []byte, n uint) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	len := binary.PutUvarint(tmp[:], uint64(n))
+	return append(buf, tmp[:len]...)
+}
+
+func readUvarint(r *bytes.Reader) (uint, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("truncated snapshot")
+	}
+	return uint(n), nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint(len(s)))
+	return append(buf, s...)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := readUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint(r.Len()) {
+		return "", fmt.Errorf("truncated snapshot")
+	}
+	s := make([]byte, n)
+	r.Read(s)
+	return string(s), nil
+}
@@ -0,0 +1,94 @@
+package netutils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+	b := newBitmap(200)
+	for i := uint(0); i < 130; i++ {
+		b.set(i)
+	}
+	b.clear(70)
+	if i, ok := b.nextClear(0); !ok || i != 70 {
+		t.Fatalf("Expected bit 70 to be clear, got %d %v", i, ok)
+	}
+	if i, ok := b.nextClear(71); !ok || i != 130 {
+		t.Fatalf("Expected bit 130 to be clear, got %d %v", i, ok)
+	}
+	for i := uint(130); i < 200; i++ {
+		b.set(i)
+	}
+	if i, ok := b.nextClear(71); !ok || i != 70 {
+		t.Fatalf("Expected nextClear to wrap to bit 70, got %d %v", i, ok)
+	}
+	b.set(70)
+	if _, ok := b.nextClear(0); ok || b.count != 200 {
+		t.Fatalf("Expected full bitmap, count is %d", b.count)
+	}
+
+	b = newBitmap(256)
+	b.set(200)
+	for _, tc := range []struct {
+		start, n uint
+		set      bool
+	}{
+		{0, 256, true},
+		{0, 128, false},
+		{192, 64, true},
+		{128, 72, false},
+		{200, 1, true},
+		{201, 55, false},
+	} {
+		if b.anySet(tc.start, tc.n) != tc.set {
+			t.Fatalf("Expected anySet(%d, %d) to be %v", tc.start, tc.n, tc.set)
+		}
+	}
+}
+
+func TestBitmapRuns(t *testing.T) {
+	b := newBitmap(1 << 20)
+	for _, run := range [][2]uint{{0, 3}, {64, 200}, {1000, 1}, {1<<20 - 10, 10}} {
+		for i := run[0]; i < run[0]+run[1]; i++ {
+			b.set(i)
+		}
+	}
+	buf := b.appendRuns(nil)
+	if len(buf) > 16 {
+		t.Fatalf("Expected compact encoding, got %d bytes", len(buf))
+	}
+
+	restored := newBitmap(1 << 20)
+	if err := restored.readRuns(bytes.NewReader(buf)); err != nil {
+		t.Fatalf("Unexpected error from readRuns: %v", err)
+	}
+	if restored.count != b.count {
+		t.Fatalf("Expected %d bits set, got %d", b.count, restored.count)
+	}
+	for i := range b.words {
+		if b.words[i] != restored.words[i] {
+			t.Fatalf("Restored bitmap differs at word %d", i)
+		}
+	}
+
+	if err := newBitmap(1000).readRuns(bytes.NewReader(buf)); err == nil {
+		t.Fatalf("Unexpectedly read runs past end of bitmap")
+	}
+	if err := newBitmap(1 << 20).readRuns(bytes.NewReader(buf[:len(buf)-1])); err == nil {
+		t.Fatalf("Unexpectedly read truncated runs")
+	}
+}
+
+func TestTrailingZeros64(t *testing.T) {
+	if n := trailingZeros64(0); n != 64 {
+		t.Fatalf("Expected 64 trailing zeros in 0, got %d", n)
+	}
+	for i := uint(0); i < 64; i++ {
+		for _, x := range []uint64{1 << i, ^uint64(0) << i, 0x8000000000000000 | 1<<i} {
+			if n := trailingZeros64(x); n != i {
+				t.Fatalf("Expected %d trailing zeros in %#x, got %d", i, x, n)
+			}
+		}
+	}
+}
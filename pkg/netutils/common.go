@@ -21,8 +21,13 @@ func Uint32ToIP(u uint32) net.IP {
 
 // Generate the default gateway IP Address for a subnet
 func GenerateDefaultGateway(sna *net.IPNet) net.IP {
-	ip := sna.IP.To4()
-	return net.IPv4(ip[0], ip[1], ip[2], ip[3]|0x1)
+	if ip := sna.IP.To4(); ip != nil {
+		return net.IPv4(ip[0], ip[1], ip[2], ip[3]|0x1)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, sna.IP.To16())
+	ip[net.IPv6len-1] |= 0x1
+	return ip
 }
 
 // Return Host IP Networks
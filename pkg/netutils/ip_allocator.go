@@ -0,0 +1,204 @@
+package netutils
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// maxIPAllocatorHostBits limits the number of addresses an IPAllocator
+// manages; in a larger network, only the first 2^maxIPAllocatorHostBits
+// addresses are allocated
+const maxIPAllocatorHostBits = 16
+
+// IPAllocator allocates individual IP addresses from a network. The network
+// address, the network's default gateway (as returned by
+// GenerateDefaultGateway) and, for IPv4, the broadcast address are reserved
+// and never allocated.
+type IPAllocator struct {
+	network *net.IPNet
+	// allocated has a bit set for each allocated or reserved address, by
+	// offset from the network address
+	allocated *bitmap
+	// reserved are the ranges of offsets of the reserved addresses
+	reserved []offsetRange
+	// next is the offset to start looking for a free address at, so that
+	// released addresses aren't handed out again straight away
+	next uint
+}
+
+// offsetRange is a range of offsets, from first to last inclusive
+type offsetRange struct {
+	first uint
+	last  uint
+}
+
+// NewIPAllocator returns an IPAllocator for network (in CIDR notation), with the
+// addresses in inUse already allocated. It returns an error if network is too
+// small to allocate from, or if any of inUse can't be allocated.
+func NewIPAllocator(network string, inUse []string) (*IPAllocator, error) {
+	return NewIPAllocatorWithReserved(network, nil, inUse)
+}
+
+// NewIPAllocatorWithReserved is like NewIPAllocator, but the addresses in the
+// reserved subnets (in CIDR notation) are never allocated. The reserved subnets
+// must be within network.
+func NewIPAllocatorWithReserved(network string, reserved []string, inUse []string) (*IPAllocator, error) {
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse network address: %q", network)
+	}
+	ones, bits := ipnet.Mask.Size()
+	hostBits := uint(bits - ones)
+	if hostBits < 2 {
+		return nil, fmt.Errorf("Network %s is too small to allocate addresses from", ipnet)
+	}
+	size := uint(1) << hostBits
+	if hostBits > maxIPAllocatorHostBits {
+		size = 1 << maxIPAllocatorHostBits
+	}
+
+	ipa := &IPAllocator{network: ipnet, allocated: newBitmap(size)}
+	ipa.reserve(0, 0)
+	gateway := ipa.offset(GenerateDefaultGateway(ipnet))
+	ipa.reserve(gateway, gateway)
+	if ipnet.IP.To4() != nil && hostBits <= maxIPAllocatorHostBits {
+		ipa.reserve(size-1, size-1)
+	}
+
+	for _, subnet := range reserved {
+		_, rnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse reserved subnet: %q", subnet)
+		}
+		rones, rbits := rnet.Mask.Size()
+		if rbits != bits || rones < ones || !ipnet.Contains(rnet.IP) {
+			return nil, fmt.Errorf("Reserved subnet %s doesn't belong to network %s", rnet, ipnet)
+		}
+		// Only the part of the subnet within the first size addresses
+		// needs reserving
+		first := ipa.offset(rnet.IP)
+		if first == size {
+			continue
+		}
+		last := size - 1
+		if rHostBits := uint(rbits - rones); rHostBits < maxIPAllocatorHostBits && first+(1<<rHostBits)-1 < last {
+			last = first + (1 << rHostBits) - 1
+		}
+		ipa.reserve(first, last)
+	}
+
+	for _, addr := range inUse {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("Failed to parse IP address: %q", addr)
+		}
+		if err := ipa.AllocateIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	return ipa, nil
+}
+
+// reserve reserves the offsets from first to last inclusive
+func (ipa *IPAllocator) reserve(first, last uint) {
+	for offset := first; offset <= last; offset++ {
+		ipa.allocated.set(offset)
+	}
+	ipa.reserved = append(ipa.reserved, offsetRange{first: first, last: last})
+}
+
+func (ipa *IPAllocator) isReserved(offset uint) bool {
+	for _, r := range ipa.reserved {
+		if offset >= r.first && offset <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize returns ip in the same form (4 or 16 bytes) as the network address
+func (ipa *IPAllocator) normalize(ip net.IP) net.IP {
+	if len(ipa.network.IP) == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// offset returns the offset of ip from the network address, which must
+// contain it
+func (ipa *IPAllocator) offset(ip net.IP) uint {
+	offset := new(big.Int).Sub(new(big.Int).SetBytes(ipa.normalize(ip)), new(big.Int).SetBytes(ipa.network.IP))
+	if offset.Sign() < 0 || offset.BitLen() > 64 || offset.Uint64() >= uint64(ipa.allocated.size) {
+		return ipa.allocated.size
+	}
+	return uint(offset.Uint64())
+}
+
+func (ipa *IPAllocator) ip(offset uint) net.IP {
+	ipInt := new(big.Int).SetBytes(ipa.network.IP)
+	ipInt.Add(ipInt, new(big.Int).SetUint64(uint64(offset)))
+	ip := make(net.IP, len(ipa.network.IP))
+	b := ipInt.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// checkIP returns the offset of ip, or an error if ip can't be allocated
+// from ipa
+func (ipa *IPAllocator) checkIP(ip net.IP) (uint, error) {
+	if ipa.normalize(ip) == nil || !ipa.network.Contains(ip) {
+		return 0, fmt.Errorf("Provided IP %s doesn't belong to network %s", ip, ipa.network)
+	}
+	offset := ipa.offset(ip)
+	if offset == ipa.allocated.size {
+		return 0, fmt.Errorf("Provided IP %s is beyond the first %d addresses of network %s", ip, ipa.allocated.size, ipa.network)
+	}
+	if ipa.isReserved(offset) {
+		return 0, fmt.Errorf("Provided IP %s is reserved.", ip)
+	}
+	return offset, nil
+}
+
+func (ipa *IPAllocator) GetIP() (net.IP, error) {
+	i, ok := ipa.allocated.nextClear(ipa.next)
+	if !ok {
+		return nil, fmt.Errorf("No IP addresses available in network %s.", ipa.network)
+	}
+
+	ipa.allocated.set(i)
+	ipa.next = i + 1
+	return ipa.ip(i), nil
+}
+
+// AllocateIP allocates the particular address ip
+func (ipa *IPAllocator) AllocateIP(ip net.IP) error {
+	offset, err := ipa.checkIP(ip)
+	if err != nil {
+		return err
+	}
+	if ipa.allocated.get(offset) {
+		return fmt.Errorf("Provided IP %s is already allocated.", ip)
+	}
+
+	ipa.allocated.set(offset)
+	return nil
+}
+
+func (ipa *IPAllocator) ReleaseIP(ip net.IP) error {
+	offset, err := ipa.checkIP(ip)
+	if err != nil {
+		return err
+	}
+	if !ipa.allocated.get(offset) {
+		return fmt.Errorf("Provided IP %s is already available.", ip)
+	}
+
+	ipa.allocated.clear(offset)
+	return nil
+}
+
+// Free returns the number of addresses that are available to be allocated
+func (ipa *IPAllocator) Free() uint {
+	return ipa.allocated.size - ipa.allocated.count
+}
@@ -0,0 +1,176 @@
+package netutils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllocateIP(t *testing.T) {
+	ipa, err := NewIPAllocator("10.1.2.0/29", []string{"10.1.2.3"})
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+
+	// 10.1.2.0, 10.1.2.1 (the gateway) and 10.1.2.7 are reserved
+	for _, expected := range []string{"10.1.2.2", "10.1.2.4", "10.1.2.5", "10.1.2.6"} {
+		ip, err := ipa.GetIP()
+		if err != nil {
+			t.Fatal("Failed to get IP: ", err)
+		}
+		if ip.String() != expected {
+			t.Fatalf("Expected IP %s, got %s", expected, ip)
+		}
+	}
+	if ip, err := ipa.GetIP(); err == nil {
+		t.Fatalf("Unexpectedly succeeded in allocating IP %s from full network", ip)
+	}
+
+	if err := ipa.ReleaseIP(net.ParseIP("10.1.2.4")); err != nil {
+		t.Fatal("Failed to release IP: ", err)
+	}
+	if err := ipa.ReleaseIP(net.ParseIP("10.1.2.4")); err == nil {
+		t.Fatalf("Unexpectedly succeeded in releasing IP twice")
+	}
+	for _, reserved := range []string{"10.1.2.0", "10.1.2.1", "10.1.2.7"} {
+		if err := ipa.ReleaseIP(net.ParseIP(reserved)); err == nil {
+			t.Fatalf("Unexpectedly succeeded in releasing reserved IP %s", reserved)
+		}
+		if err := ipa.AllocateIP(net.ParseIP(reserved)); err == nil {
+			t.Fatalf("Unexpectedly succeeded in allocating reserved IP %s", reserved)
+		}
+	}
+	if err := ipa.ReleaseIP(net.ParseIP("10.1.3.4")); err == nil {
+		t.Fatalf("Unexpectedly succeeded in releasing IP from another network")
+	}
+
+	ip, err := ipa.GetIP()
+	if err != nil {
+		t.Fatal("Failed to get IP: ", err)
+	}
+	if ip.String() != "10.1.2.4" {
+		t.Fatalf("Expected IP 10.1.2.4, got %s", ip)
+	}
+
+	if err := ipa.ReleaseIP(net.ParseIP("10.1.2.3")); err != nil {
+		t.Fatal("Failed to release IP: ", err)
+	}
+	if err := ipa.AllocateIP(net.ParseIP("10.1.2.3")); err != nil {
+		t.Fatal("Failed to allocate IP: ", err)
+	}
+	if err := ipa.AllocateIP(net.ParseIP("10.1.2.3")); err == nil {
+		t.Fatalf("Unexpectedly succeeded in allocating IP twice")
+	}
+	if free := ipa.Free(); free != 0 {
+		t.Fatalf("Expected no free IPs, got %d", free)
+	}
+}
+
+func TestAllocateIPNoReuse(t *testing.T) {
+	ipa, err := NewIPAllocator("10.1.2.0/24", nil)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+
+	ip, err := ipa.GetIP()
+	if err != nil {
+		t.Fatal("Failed to get IP: ", err)
+	}
+	if err := ipa.ReleaseIP(ip); err != nil {
+		t.Fatal("Failed to release IP: ", err)
+	}
+	// Released addresses are only reused once the others have been used
+	for i := 0; i < 252; i++ {
+		next, err := ipa.GetIP()
+		if err != nil {
+			t.Fatal("Failed to get IP: ", err)
+		}
+		if next.Equal(ip) {
+			t.Fatalf("Unexpectedly reused IP %s after %d allocations", ip, i)
+		}
+	}
+	next, err := ipa.GetIP()
+	if err != nil {
+		t.Fatal("Failed to get IP: ", err)
+	}
+	if !next.Equal(ip) {
+		t.Fatalf("Expected IP %s, got %s", ip, next)
+	}
+}
+
+func TestAllocateIPv6(t *testing.T) {
+	ipa, err := NewIPAllocator("fd00:10:1:3::/64", nil)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+
+	ip, err := ipa.GetIP()
+	if err != nil {
+		t.Fatal("Failed to get IP: ", err)
+	}
+	if ip.String() != "fd00:10:1:3::2" {
+		t.Fatalf("Expected IP fd00:10:1:3::2, got %s", ip)
+	}
+	if err := ipa.AllocateIP(net.ParseIP("fd00:10:1:3::1")); err == nil {
+		t.Fatalf("Unexpectedly succeeded in allocating the gateway IP")
+	}
+	if err := ipa.AllocateIP(net.ParseIP("fd00:10:1:3::1:0")); err == nil {
+		t.Fatalf("Unexpectedly succeeded in allocating IP beyond the managed range")
+	}
+	if free := ipa.Free(); free != 1<<16-3 {
+		t.Fatalf("Expected %d free IPs, got %d", 1<<16-3, free)
+	}
+}
+
+func TestAllocateIPReserved(t *testing.T) {
+	ipa, err := NewIPAllocatorWithReserved("10.1.2.0/29", []string{"10.1.2.2/31", "10.1.2.6/32"}, nil)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+	if free := ipa.Free(); free != 2 {
+		t.Fatalf("Expected 2 free IPs, got %d", free)
+	}
+	for _, expected := range []string{"10.1.2.4", "10.1.2.5"} {
+		ip, err := ipa.GetIP()
+		if err != nil || ip.String() != expected {
+			t.Fatalf("Expected IP %s, got %v %v", expected, ip, err)
+		}
+	}
+	if ip, err := ipa.GetIP(); err == nil {
+		t.Fatalf("Unexpectedly allocated IP %s", ip)
+	}
+	if err := ipa.AllocateIP(net.ParseIP("10.1.2.3")); err == nil {
+		t.Fatalf("Unexpectedly allocated reserved IP")
+	}
+	if err := ipa.ReleaseIP(net.ParseIP("10.1.2.6")); err == nil {
+		t.Fatalf("Unexpectedly released reserved IP")
+	}
+
+	// Only the part of a reserved subnet that the allocator manages is
+	// reserved
+	ipa, err = NewIPAllocatorWithReserved("10.0.0.0/8", []string{"10.0.128.0/17", "10.128.0.0/9"}, nil)
+	if err != nil {
+		t.Fatal("Failed to initialize IP allocator: ", err)
+	}
+	if free := ipa.Free(); free != 1<<15-2 {
+		t.Fatalf("Expected %d free IPs, got %d", 1<<15-2, free)
+	}
+
+	for _, reserved := range []string{"10.1.3.0/24", "10.1.0.0/16", "10.1.2.0", "fd00::/64"} {
+		if _, err := NewIPAllocatorWithReserved("10.1.2.0/24", []string{reserved}, nil); err == nil {
+			t.Fatalf("Unexpectedly accepted reserved subnet %q", reserved)
+		}
+	}
+}
+
+func TestAllocateIPInvalid(t *testing.T) {
+	for _, network := range []string{"10.1.2.3", "10.1.2.0/31"} {
+		if _, err := NewIPAllocator(network, nil); err == nil {
+			t.Fatalf("Unexpectedly succeeded in initializing IP allocator for %q", network)
+		}
+	}
+	for _, inUse := range []string{"10.1.2.1", "10.1.3.2", "bob"} {
+		if _, err := NewIPAllocator("10.1.2.0/24", []string{inUse}); err == nil {
+			t.Fatalf("Unexpectedly succeeded in initializing IP allocator with IP %q in use", inUse)
+		}
+	}
+}
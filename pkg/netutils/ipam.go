@@ -0,0 +1,189 @@
+package netutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// HostLocalIPAM allocates IP addresses from a network to owners identified by
+// strings (eg, pods), and records each allocation as a file in a directory so
+// that allocations survive restarts. Each file is named after an allocated
+// address and contains the ID of its owner.
+type HostLocalIPAM struct {
+	lock      sync.Mutex
+	dir       string
+	allocator *IPAllocator
+	// owners maps each owner to its address
+	owners map[string]net.IP
+}
+
+// NewHostLocalIPAM returns a HostLocalIPAM that allocates from network and
+// records its allocations in dir, which is created if it doesn't exist.
+// Allocations already recorded in dir are loaded, except for those that are
+// not valid for network (eg, because the network has changed), which are
+// discarded.
+func NewHostLocalIPAM(network string, dir string) (*HostLocalIPAM, error) {
+	return NewHostLocalIPAMWithReserved(network, nil, dir)
+}
+
+// NewHostLocalIPAMWithReserved is like NewHostLocalIPAM, but the addresses in
+// the reserved subnets are never allocated (and recorded allocations of them
+// are discarded).
+func NewHostLocalIPAMWithReserved(network string, reserved []string, dir string) (*HostLocalIPAM, error) {
+	allocator, err := NewIPAllocatorWithReserved(network, reserved, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create IPAM directory %q: %v", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read IPAM directory %q: %v", dir, err)
+	}
+
+	ipam := &HostLocalIPAM{dir: dir, allocator: allocator, owners: make(map[string]net.IP)}
+	for _, file := range files {
+		ip := net.ParseIP(file.Name())
+		if ip == nil || !file.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(ipam.path(ip))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read IPAM allocation %q: %v", ipam.path(ip), err)
+		}
+		owner := strings.TrimSpace(string(data))
+
+		if other, ok := ipam.owners[owner]; ok {
+			err = fmt.Errorf("%q already has IP %s", owner, other)
+		} else {
+			err = allocator.AllocateIP(ip)
+		}
+		if err != nil {
+			glog.Warningf("Discarding IPAM allocation of %s to %q: %v", ip, owner, err)
+			if err := os.Remove(ipam.path(ip)); err != nil {
+				glog.Warningf("Failed to remove IPAM allocation %q: %v", ipam.path(ip), err)
+			}
+			continue
+		}
+		ipam.owners[owner] = allocator.normalize(ip)
+	}
+	return ipam, nil
+}
+
+func (ipam *HostLocalIPAM) path(ip net.IP) string {
+	return filepath.Join(ipam.dir, ip.String())
+}
+
+// Network returns the network that ipam allocates from
+func (ipam *HostLocalIPAM) Network() *net.IPNet {
+	return ipam.allocator.network
+}
+
+// record writes the allocation of ip to owner to disk
+func (ipam *HostLocalIPAM) record(owner string, ip net.IP) error {
+	f, err := os.OpenFile(ipam.path(ip), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to record IPAM allocation of %s to %q: %v", ip, owner, err)
+	}
+	_, err = f.WriteString(owner)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(ipam.path(ip))
+		return fmt.Errorf("Failed to record IPAM allocation of %s to %q: %v", ip, owner, err)
+	}
+	return nil
+}
+
+// Allocate allocates an address to owner, or returns the address already
+// allocated to it
+func (ipam *HostLocalIPAM) Allocate(owner string) (net.IP, error) {
+	ipam.lock.Lock()
+	defer ipam.lock.Unlock()
+
+	if ip, ok := ipam.owners[owner]; ok {
+		return ip, nil
+	}
+	ip, err := ipam.allocator.GetIP()
+	if err != nil {
+		return nil, err
+	}
+	if err := ipam.record(owner, ip); err != nil {
+		ipam.allocator.ReleaseIP(ip)
+		return nil, err
+	}
+	ipam.owners[owner] = ip
+	return ip, nil
+}
+
+// AllocateIP allocates the particular address ip to owner. It is not an error
+// if ip is already allocated to owner.
+func (ipam *HostLocalIPAM) AllocateIP(owner string, ip net.IP) error {
+	ipam.lock.Lock()
+	defer ipam.lock.Unlock()
+
+	if other, ok := ipam.owners[owner]; ok {
+		if other.Equal(ip) {
+			return nil
+		}
+		return fmt.Errorf("%q already has IP %s", owner, other)
+	}
+	if err := ipam.allocator.AllocateIP(ip); err != nil {
+		return err
+	}
+	if err := ipam.record(owner, ip); err != nil {
+		ipam.allocator.ReleaseIP(ip)
+		return err
+	}
+	ipam.owners[owner] = ipam.allocator.normalize(ip)
+	return nil
+}
+
+// Release releases the address allocated to owner, if any
+func (ipam *HostLocalIPAM) Release(owner string) error {
+	ipam.lock.Lock()
+	defer ipam.lock.Unlock()
+
+	ip, ok := ipam.owners[owner]
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(ipam.path(ip)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove IPAM allocation of %s to %q: %v", ip, owner, err)
+	}
+	delete(ipam.owners, owner)
+	return ipam.allocator.ReleaseIP(ip)
+}
+
+// Get returns the address allocated to owner, if any
+func (ipam *HostLocalIPAM) Get(owner string) (net.IP, bool) {
+	ipam.lock.Lock()
+	defer ipam.lock.Unlock()
+
+	ip, ok := ipam.owners[owner]
+	return ip, ok
+}
+
+// Allocations returns the current allocations, by owner
+func (ipam *HostLocalIPAM) Allocations() map[string]net.IP {
+	ipam.lock.Lock()
+	defer ipam.lock.Unlock()
+
+	allocations := make(map[string]net.IP, len(ipam.owners))
+	for owner, ip := range ipam.owners {
+		allocations[owner] = ip
+	}
+	return allocations
+}
@@ -0,0 +1,114 @@
+package netutils
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostLocalIPAM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ipam, err := NewHostLocalIPAM("10.1.2.0/24", dir)
+	if err != nil {
+		t.Fatal("Failed to initialize IPAM: ", err)
+	}
+	ip1, err := ipam.Allocate("ns/pod1")
+	if err != nil {
+		t.Fatal("Failed to allocate IP: ", err)
+	}
+	if ip1.String() != "10.1.2.2" {
+		t.Fatalf("Expected IP 10.1.2.2, got %s", ip1)
+	}
+	ip, err := ipam.Allocate("ns/pod1")
+	if err != nil {
+		t.Fatal("Failed to allocate IP: ", err)
+	}
+	if !ip.Equal(ip1) {
+		t.Fatalf("Expected repeated allocation to return %s, got %s", ip1, ip)
+	}
+	if err := ipam.AllocateIP("ns/pod2", net.ParseIP("10.1.2.10")); err != nil {
+		t.Fatal("Failed to allocate IP: ", err)
+	}
+	if err := ipam.AllocateIP("ns/pod3", net.ParseIP("10.1.2.10")); err == nil {
+		t.Fatalf("Unexpectedly succeeded in allocating IP twice")
+	}
+	if err := ipam.AllocateIP("ns/pod3", net.ParseIP("10.1.2.1")); err == nil {
+		t.Fatalf("Unexpectedly succeeded in allocating the gateway IP")
+	}
+	ip3, err := ipam.Allocate("ns/pod3")
+	if err != nil {
+		t.Fatal("Failed to allocate IP: ", err)
+	}
+
+	// Allocations are reloaded, and bad allocations discarded
+	if err := ioutil.WriteFile(filepath.Join(dir, "10.1.3.5"), []byte("ns/other-network"), 0644); err != nil {
+		t.Fatal("Failed to write file: ", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "10.1.2.1"), []byte("ns/gateway"), 0644); err != nil {
+		t.Fatal("Failed to write file: ", err)
+	}
+	ipam, err = NewHostLocalIPAM("10.1.2.0/24", dir)
+	if err != nil {
+		t.Fatal("Failed to initialize IPAM: ", err)
+	}
+	allocations := ipam.Allocations()
+	expected := map[string]string{"ns/pod1": ip1.String(), "ns/pod2": "10.1.2.10", "ns/pod3": ip3.String()}
+	if len(allocations) != len(expected) {
+		t.Fatalf("Expected allocations %v, got %v", expected, allocations)
+	}
+	for owner, ip := range expected {
+		if allocations[owner].String() != ip {
+			t.Fatalf("Expected allocations %v, got %v", expected, allocations)
+		}
+	}
+	for _, name := range []string{"10.1.3.5", "10.1.2.1"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected bad allocation %s to be removed", name)
+		}
+	}
+
+	if err := ipam.Release("ns/pod1"); err != nil {
+		t.Fatal("Failed to release IP: ", err)
+	}
+	if err := ipam.Release("ns/pod1"); err != nil {
+		t.Fatal("Failed to release IP twice: ", err)
+	}
+	if _, ok := ipam.Get("ns/pod1"); ok {
+		t.Fatalf("Unexpectedly found IP of released pod")
+	}
+	ipam, err = NewHostLocalIPAM("10.1.2.0/24", dir)
+	if err != nil {
+		t.Fatal("Failed to initialize IPAM: ", err)
+	}
+	if _, ok := ipam.Get("ns/pod1"); ok {
+		t.Fatalf("Unexpectedly found IP of released pod after reloading")
+	}
+	if ip, ok := ipam.Get("ns/pod2"); !ok || ip.String() != "10.1.2.10" {
+		t.Fatalf("Expected ns/pod2 to have IP 10.1.2.10, got %v", ip)
+	}
+
+	// Allocations in a reserved subnet are discarded
+	ipam, err = NewHostLocalIPAMWithReserved("10.1.2.0/24", []string{"10.1.2.8/29"}, dir)
+	if err != nil {
+		t.Fatal("Failed to initialize IPAM: ", err)
+	}
+	if ip, ok := ipam.Get("ns/pod2"); ok {
+		t.Fatalf("Unexpectedly found IP %s in reserved subnet", ip)
+	}
+
+	// When the network changes, the old allocations are discarded
+	ipam, err = NewHostLocalIPAM("10.1.4.0/24", dir)
+	if err != nil {
+		t.Fatal("Failed to initialize IPAM: ", err)
+	}
+	if allocations := ipam.Allocations(); len(allocations) != 0 {
+		t.Fatalf("Expected no allocations after network change, got %v", allocations)
+	}
+}
@@ -1,54 +1,166 @@
 package netutils
 
 import (
+	"bytes"
 	"fmt"
+
+	"github.com/golang/glog"
 )
 
+// netIDSnapshotVersion identifies the format written by Snapshot()
+const netIDSnapshotVersion = 1
+
 type NetIDAllocator struct {
 	min      uint
 	max      uint
-	allocMap map[uint]bool
+	reserved []NetIDRange
+	// allocated has a bit set for each allocated or reserved net id,
+	// offset by min
+	allocated *bitmap
+}
+
+// NetIDRange is a named range of net ids, from Min to Max inclusive
+type NetIDRange struct {
+	Name string
+	Min  uint
+	Max  uint
 }
 
 func NewNetIDAllocator(min uint, max uint, inUse []uint) (*NetIDAllocator, error) {
+	return NewNetIDAllocatorWithReserved(min, max, nil, inUse)
+}
+
+// NewNetIDAllocatorWithReserved is like NewNetIDAllocator, but the net ids in
+// reserved are never allocated. The reserved ranges must be within [min, max]
+// and must not overlap each other. Net ids in inUse that fall in a reserved
+// range are ignored (with a warning), since they will never be allocated
+// anyway.
+func NewNetIDAllocatorWithReserved(min uint, max uint, reserved []NetIDRange, inUse []uint) (*NetIDAllocator, error) {
 	if max <= min {
 		return nil, fmt.Errorf("Min should be lesser than max value (Min: %d, Max: %d)", min, max)
 	}
 
-	amap := make(map[uint]bool)
+	nia := &NetIDAllocator{min: min, max: max, allocated: newBitmap(max - min + 1)}
+	for _, r := range reserved {
+		if r.Min > r.Max || r.Min < min || r.Max > max {
+			return nil, fmt.Errorf("Reserved net id range %q [%d, %d] doesn't belong to range: [%d, %d]", r.Name, r.Min, r.Max, min, max)
+		}
+		if other := nia.reservedRange(r.Min, r.Max); other != nil {
+			return nil, fmt.Errorf("Reserved net id range %q [%d, %d] overlaps reserved range %q", r.Name, r.Min, r.Max, other.Name)
+		}
+		for netid := r.Min; netid <= r.Max; netid++ {
+			nia.allocated.set(netid - min)
+		}
+		nia.reserved = append(nia.reserved, r)
+	}
+
 	for _, netid := range inUse {
 		if netid < min || netid > max {
 			return nil, fmt.Errorf("Provided net id doesn't belong to range: [%d, %d]", min, max)
 		}
-		amap[netid] = true
+		if r := nia.reservedRange(netid, netid); r != nil {
+			glog.Warningf("Provided net id %d is in reserved range %q", netid, r.Name)
+			continue
+		}
+		nia.allocated.set(netid - min)
 	}
 
-	return &NetIDAllocator{min: min, max: max, allocMap: amap}, nil
+	return nia, nil
 }
 
-func (nia *NetIDAllocator) GetNetID() (uint, error) {
-	var i uint
-	for i = nia.min; i <= nia.max; i++ {
-		taken, found := nia.allocMap[i]
-		if !found || !taken {
-			nia.allocMap[i] = true
-			return i, nil
+// reservedRange returns the reserved range overlapping [min, max], or nil
+func (nia *NetIDAllocator) reservedRange(min, max uint) *NetIDRange {
+	for i := range nia.reserved {
+		if nia.reserved[i].Min <= max && min <= nia.reserved[i].Max {
+			return &nia.reserved[i]
 		}
 	}
+	return nil
+}
+
+func (nia *NetIDAllocator) GetNetID() (uint, error) {
+	i, ok := nia.allocated.nextClear(0)
+	if !ok {
+		return 0, fmt.Errorf("No NetIDs available.")
+	}
 
-	return 0, fmt.Errorf("No NetIDs available.")
+	nia.allocated.set(i)
+	return nia.min + i, nil
 }
 
 func (nia *NetIDAllocator) ReleaseNetID(netid uint) error {
 	if nia.min > netid || nia.max < netid {
 		return fmt.Errorf("Provided net id %d doesn't belong to the given range [%d, %d]", netid, nia.min, nia.max)
 	}
+	if r := nia.reservedRange(netid, netid); r != nil {
+		return fmt.Errorf("Provided net id %d is in reserved range %q.", netid, r.Name)
+	}
 
-	taken, found := nia.allocMap[netid]
-	if !found || !taken {
+	if !nia.allocated.get(netid - nia.min) {
 		return fmt.Errorf("Provided net id %d is already available.", netid)
 	}
 
-	nia.allocMap[netid] = false
+	nia.allocated.clear(netid - nia.min)
 	return nil
 }
+
+// Snapshot returns a compact serialization of nia's range, reserved ranges and
+// allocated net ids, which can be passed to RestoreNetIDAllocator
+func (nia *NetIDAllocator) Snapshot() []byte {
+	buf := []byte{'N', netIDSnapshotVersion}
+	buf = appendUvarint(buf, nia.min)
+	buf = appendUvarint(buf, nia.max)
+	buf = appendUvarint(buf, uint(len(nia.reserved)))
+	for _, r := range nia.reserved {
+		buf = appendString(buf, r.Name)
+		buf = appendUvarint(buf, r.Min)
+		buf = appendUvarint(buf, r.Max)
+	}
+	return nia.allocated.appendRuns(buf)
+}
+
+// RestoreNetIDAllocator returns a NetIDAllocator in the state recorded by
+// Snapshot
+func RestoreNetIDAllocator(snapshot []byte) (*NetIDAllocator, error) {
+	if len(snapshot) < 2 || snapshot[0] != 'N' || snapshot[1] != netIDSnapshotVersion {
+		return nil, fmt.Errorf("Invalid net id allocator snapshot")
+	}
+
+	r := bytes.NewReader(snapshot[2:])
+	min, err := readUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid net id allocator snapshot: %v", err)
+	}
+	max, err := readUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid net id allocator snapshot: %v", err)
+	}
+	nreserved, err := readUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid net id allocator snapshot: %v", err)
+	}
+	reserved := make([]NetIDRange, 0)
+	for ; nreserved > 0; nreserved-- {
+		var rr NetIDRange
+		if rr.Name, err = readString(r); err == nil {
+			if rr.Min, err = readUvarint(r); err == nil {
+				rr.Max, err = readUvarint(r)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid net id allocator snapshot: %v", err)
+		}
+		reserved = append(reserved, rr)
+	}
+	nia, err := NewNetIDAllocatorWithReserved(min, max, reserved, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := nia.allocated.readRuns(r); err != nil {
+		return nil, fmt.Errorf("Invalid net id allocator snapshot: %v", err)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("Invalid net id allocator snapshot: trailing data")
+	}
+	return nia, nil
+}
@@ -0,0 +1,145 @@
+package netutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAllocateNetID(t *testing.T) {
+	nia, err := NewNetIDAllocator(10, 13, []uint{11})
+	if err != nil {
+		t.Fatal("Failed to initialize net id allocator: ", err)
+	}
+
+	for _, expected := range []uint{10, 12, 13} {
+		netid, err := nia.GetNetID()
+		if err != nil {
+			t.Fatal("Failed to get net id: ", err)
+		}
+		if netid != expected {
+			t.Fatalf("Expected net id %d, got %d", expected, netid)
+		}
+	}
+	if _, err := nia.GetNetID(); err == nil {
+		t.Fatalf("Unexpectedly succeeded in allocating net id from full range")
+	}
+
+	if err := nia.ReleaseNetID(12); err != nil {
+		t.Fatal("Failed to release net id: ", err)
+	}
+	if err := nia.ReleaseNetID(12); err == nil {
+		t.Fatalf("Unexpectedly succeeded in releasing net id twice")
+	}
+	if err := nia.ReleaseNetID(14); err == nil {
+		t.Fatalf("Unexpectedly succeeded in releasing out-of-range net id")
+	}
+	if netid, err := nia.GetNetID(); err != nil || netid != 12 {
+		t.Fatalf("Expected to get released net id 12, got %d %v", netid, err)
+	}
+
+	if _, err := NewNetIDAllocator(10, 13, []uint{14}); err == nil {
+		t.Fatalf("Unexpectedly accepted out-of-range net id")
+	}
+}
+
+func TestNetIDAllocatorSnapshot(t *testing.T) {
+	// The full VNID range
+	nia, err := NewNetIDAllocator(10, (1<<24)-1, nil)
+	if err != nil {
+		t.Fatal("Failed to initialize net id allocator: ", err)
+	}
+	for i := 0; i < 10000; i++ {
+		if _, err := nia.GetNetID(); err != nil {
+			t.Fatal("Failed to get net id: ", err)
+		}
+	}
+	for _, netid := range []uint{15, 500, 501, 9000} {
+		if err := nia.ReleaseNetID(netid); err != nil {
+			t.Fatal("Failed to release net id: ", err)
+		}
+	}
+
+	snapshot := nia.Snapshot()
+	if len(snapshot) > 32 {
+		t.Fatalf("Expected compact snapshot, got %d bytes", len(snapshot))
+	}
+	restored, err := RestoreNetIDAllocator(snapshot)
+	if err != nil {
+		t.Fatal("Failed to restore net id allocator: ", err)
+	}
+	for _, expected := range []uint{15, 500, 501, 9000, 10010} {
+		netid, err := restored.GetNetID()
+		if err != nil || netid != expected {
+			t.Fatalf("Expected net id %d from restored allocator, got %d %v", expected, netid, err)
+		}
+	}
+	if err := restored.ReleaseNetID(10009); err != nil {
+		t.Fatal("Failed to release net id allocated before snapshot: ", err)
+	}
+
+	for _, bad := range [][]byte{nil, snapshot[:len(snapshot)-1], append(snapshot, 0), {'S', 1}} {
+		if _, err := RestoreNetIDAllocator(bad); err == nil {
+			t.Fatalf("Unexpectedly restored bad snapshot %v", bad)
+		}
+	}
+}
+
+func TestAllocateNetIDReserved(t *testing.T) {
+	reserved := []NetIDRange{
+		{Name: "internal", Min: 1, Max: 9},
+		{Name: "legacy", Min: 12, Max: 13},
+	}
+	nia, err := NewNetIDAllocatorWithReserved(1, 15, reserved, []uint{10})
+	if err != nil {
+		t.Fatal("Failed to initialize net id allocator: ", err)
+	}
+
+	for _, expected := range []uint{11, 14, 15} {
+		netid, err := nia.GetNetID()
+		if err != nil || netid != expected {
+			t.Fatalf("Expected net id %d, got %d %v", expected, netid, err)
+		}
+	}
+	if _, err := nia.GetNetID(); err == nil {
+		t.Fatalf("Unexpectedly allocated reserved net id")
+	}
+	if err := nia.ReleaseNetID(12); err == nil || !strings.Contains(err.Error(), `"legacy"`) {
+		t.Fatalf("Expected error releasing reserved net id, got %v", err)
+	}
+
+	restored, err := RestoreNetIDAllocator(nia.Snapshot())
+	if err != nil {
+		t.Fatal("Failed to restore net id allocator: ", err)
+	}
+	if err := restored.ReleaseNetID(5); err == nil {
+		t.Fatalf("Restored allocator released reserved net id")
+	}
+	if err := restored.ReleaseNetID(14); err != nil {
+		t.Fatal("Failed to release net id: ", err)
+	}
+
+	// An in-use net id in a reserved range is ignored
+	nia, err = NewNetIDAllocatorWithReserved(1, 15, reserved, []uint{10, 12})
+	if err != nil {
+		t.Fatal("Failed to initialize net id allocator with in-use reserved net id: ", err)
+	}
+	for _, expected := range []uint{11, 14, 15} {
+		netid, err := nia.GetNetID()
+		if err != nil || netid != expected {
+			t.Fatalf("Expected net id %d, got %d %v", expected, netid, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		reserved []NetIDRange
+		inUse    []uint
+	}{
+		{[]NetIDRange{{Name: "outside", Min: 10, Max: 20}}, nil},
+		{[]NetIDRange{{Name: "backwards", Min: 5, Max: 4}}, nil},
+		{[]NetIDRange{{Name: "a", Min: 2, Max: 5}, {Name: "b", Min: 5, Max: 6}}, nil},
+	} {
+		if _, err := NewNetIDAllocatorWithReserved(1, 15, tc.reserved, tc.inUse); err == nil {
+			t.Fatalf("Unexpectedly accepted reserved ranges %v with in-use net ids %v", tc.reserved, tc.inUse)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package netutils
+
+import (
+	"fmt"
+	"net"
+)
+
+// Node address types that a NodeIPPolicy can prefer
+const (
+	NodeInternalIP = "InternalIP"
+	NodeExternalIP = "ExternalIP"
+)
+
+// NodeAddress is an address of a node, with its address type (if known)
+type NodeAddress struct {
+	Type    string
+	Address string
+}
+
+// NodeIPPolicy chooses which of a node's addresses the SDN uses as its node IP
+type NodeIPPolicy struct {
+	addressTypes []string
+	cidrs        []*net.IPNet
+	iface        string
+}
+
+// NewNodeIPPolicy returns a NodeIPPolicy that prefers addresses of the given
+// types, in order, and that only accepts addresses within one of cidrs (if
+// any are given) and assigned to the interface iface (if it is not "").
+func NewNodeIPPolicy(addressTypes []string, cidrs []string, iface string) (*NodeIPPolicy, error) {
+	policy := &NodeIPPolicy{iface: iface}
+	for _, addressType := range addressTypes {
+		if addressType != NodeInternalIP && addressType != NodeExternalIP {
+			return nil, fmt.Errorf("Invalid node address type %q (must be %q or %q)", addressType, NodeInternalIP, NodeExternalIP)
+		}
+		policy.addressTypes = append(policy.addressTypes, addressType)
+	}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse node IP network %q", cidr)
+		}
+		policy.cidrs = append(policy.cidrs, ipnet)
+	}
+	return policy, nil
+}
+
+// Interface returns the name of the interface the policy requires the node IP
+// to be assigned to, or ""
+func (policy *NodeIPPolicy) Interface() string {
+	return policy.iface
+}
+
+// typeRank returns the position of addressType in the policy's preferences
+func (policy *NodeIPPolicy) typeRank(addressType string) int {
+	for i, preferred := range policy.addressTypes {
+		if addressType == preferred {
+			return i
+		}
+	}
+	return len(policy.addressTypes)
+}
+
+// ChooseNodeIP returns the address in addresses that best matches the policy.
+// Addresses of preferred types are chosen over others, and otherwise earlier
+// addresses are chosen over later ones. If interfaceIPs is not nil, it lists the
+// IPs of the policy's interface, and addresses not in it are rejected; if it is
+// nil then the policy's interface is not checked.
+func (policy *NodeIPPolicy) ChooseNodeIP(addresses []NodeAddress, interfaceIPs []net.IP) (string, error) {
+	for rank := 0; rank <= len(policy.addressTypes); rank++ {
+		for _, addr := range addresses {
+			if policy.typeRank(addr.Type) != rank {
+				continue
+			}
+			ip := net.ParseIP(addr.Address)
+			// Skip hostnames, and loopback and non IPv4 addrs
+			if ip == nil || ip.IsLoopback() || ip.To4() == nil {
+				continue
+			}
+			if policy.matches(ip, interfaceIPs) {
+				return ip.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("No node address matches the node IP policy")
+}
+
+func (policy *NodeIPPolicy) matches(ip net.IP, interfaceIPs []net.IP) bool {
+	if len(policy.cidrs) > 0 {
+		found := false
+		for _, cidr := range policy.cidrs {
+			if cidr.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if policy.iface != "" && interfaceIPs != nil {
+		for _, ifaceIP := range interfaceIPs {
+			if ifaceIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// GetInterfaceIPs returns the IPv4 addresses of the named interface
+func GetInterfaceIPs(ifaceName string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find interface %q: %v", ifaceName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get addresses of interface %q: %v", ifaceName, err)
+	}
+
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err == nil && ip.To4() != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// ValidateLocalIP checks that ip is on one of hostIPNets (as returned by
+// GetHostIPNetworks), and so can be reached directly from the node's own
+// interfaces
+func ValidateLocalIP(ip string, hostIPNets []*net.IPNet) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("Failed to parse node IP %q", ip)
+	}
+	for _, ipNet := range hostIPNets {
+		if ipNet.Contains(parsed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Node IP %s is not on any of the node's networks", ip)
+}
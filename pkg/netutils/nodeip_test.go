@@ -0,0 +1,71 @@
+package netutils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestChooseNodeIP(t *testing.T) {
+	addresses := []NodeAddress{
+		{Type: "Hostname", Address: "node1.example.com"},
+		{Type: NodeExternalIP, Address: "192.168.1.5"},
+		{Type: NodeInternalIP, Address: "127.0.0.1"},
+		{Type: NodeInternalIP, Address: "10.0.0.5"},
+		{Type: NodeInternalIP, Address: "172.16.0.5"},
+	}
+	eth1 := []net.IP{net.ParseIP("172.16.0.5")}
+
+	for _, tc := range []struct {
+		addressTypes []string
+		cidrs        []string
+		iface        string
+		interfaceIPs []net.IP
+		expected     string
+	}{
+		{nil, nil, "", nil, "192.168.1.5"},
+		{[]string{NodeInternalIP}, nil, "", nil, "10.0.0.5"},
+		{[]string{NodeInternalIP, NodeExternalIP}, []string{"192.168.0.0/16", "172.16.0.0/12"}, "", nil, "172.16.0.5"},
+		{[]string{NodeExternalIP}, []string{"10.0.0.0/8"}, "", nil, "10.0.0.5"},
+		{nil, nil, "eth1", eth1, "172.16.0.5"},
+		// The interface is ignored when its IPs aren't known
+		{nil, nil, "eth1", nil, "192.168.1.5"},
+		{nil, []string{"10.0.0.0/8"}, "eth1", eth1, ""},
+		{nil, []string{"127.0.0.0/8"}, "", nil, ""},
+	} {
+		policy, err := NewNodeIPPolicy(tc.addressTypes, tc.cidrs, tc.iface)
+		if err != nil {
+			t.Fatalf("Unexpected error creating policy: %v", err)
+		}
+		ip, err := policy.ChooseNodeIP(addresses, tc.interfaceIPs)
+		if tc.expected == "" {
+			if err == nil {
+				t.Fatalf("Expected no match for %+v, got %s", tc, ip)
+			}
+		} else if err != nil || ip != tc.expected {
+			t.Fatalf("Expected %s for %+v, got %q %v", tc.expected, tc, ip, err)
+		}
+	}
+
+	if _, err := NewNodeIPPolicy([]string{"Hostname"}, nil, ""); err == nil {
+		t.Fatalf("Unexpectedly accepted Hostname address type")
+	}
+	if _, err := NewNodeIPPolicy(nil, []string{"10.0.0.0"}, ""); err == nil {
+		t.Fatalf("Unexpectedly accepted bad CIDR")
+	}
+}
+
+func TestValidateLocalIP(t *testing.T) {
+	_, net1, _ := net.ParseCIDR("10.0.0.0/24")
+	_, net2, _ := net.ParseCIDR("172.16.0.0/16")
+	hostIPNets := []*net.IPNet{net1, net2}
+
+	if err := ValidateLocalIP("172.16.3.4", hostIPNets); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := ValidateLocalIP("10.0.1.1", hostIPNets); err == nil {
+		t.Fatalf("Unexpectedly validated unreachable IP")
+	}
+	if err := ValidateLocalIP("bogus", hostIPNets); err == nil {
+		t.Fatalf("Unexpectedly validated bad IP")
+	}
+}
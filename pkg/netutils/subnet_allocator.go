@@ -1,34 +1,194 @@
 package netutils
 
 import (
+	"bytes"
 	"fmt"
+	"math/big"
 	"net"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
 )
 
+// maxSubnetBits is the largest number of subnet bits (ie, the log2 of the
+// number of subnets) that a SubnetAllocator supports. Each range keeps a bitmap
+// with a bit per subnet, so this bounds the allocator's memory use.
+const maxSubnetBits = 24
+
+// subnetSnapshotVersion identifies the format written by Snapshot()
+const subnetSnapshotVersion = 1
+
 type SubnetAllocator struct {
-	network    *net.IPNet
+	ranges []*subnetRange
+}
+
+// SubnetRange describes a network for a SubnetAllocator to allocate subnets
+// from, and the number of host bits in each subnet allocated from it
+type SubnetRange struct {
+	Network  string
+	HostBits uint
+	// Excluded lists subnets of Network that must never be allocated (eg,
+	// because they are routed elsewhere)
+	Excluded []string
+}
+
+type subnetRange struct {
+	network *net.IPNet
+	// hostBits, subnetBits and rotate describe the range's default-sized
+	// subnets; see layout()
 	hostBits   uint
-	leftShift  uint
-	leftMask   uint32
-	rightShift uint
-	rightMask  uint32
+	subnetBits uint
+	rotate     uint
 	next       uint32
-	allocMap   map[string]bool
+	// excluded are the subnets of the range that can't be allocated
+	excluded []*net.IPNet
+	// slots has a bit set for each default-sized subnet of the range
+	// (indexed by address) that overlaps an allocated subnet. order holds
+	// the same bits indexed by subnet number instead, to find the next free
+	// subnet quickly; if rotate is 0 the two are the same.
+	slots *bitmap
+	order *bitmap
+	// allocMap records the allocated subnets that are not of the default
+	// size, and used records, for each block within a default-sized subnet
+	// that contains smaller allocated subnets, how many it contains.
+	allocMap map[string]bool
+	used     map[string]int
 }
 
+// NewSubnetAllocator returns a SubnetAllocator that allocates subnets with
+// hostBits host bits out of network, which may be either an IPv4 or IPv6 CIDR.
+// inUse lists subnets that have already been allocated.
 func NewSubnetAllocator(network string, hostBits uint, inUse []string) (*SubnetAllocator, error) {
+	return NewMultiSubnetAllocator([]SubnetRange{{Network: network, HostBits: hostBits}}, inUse)
+}
+
+// NewMultiSubnetAllocator returns a SubnetAllocator that allocates subnets from
+// each of ranges in turn, moving on to the next range once a range is full.
+// The ranges must not overlap. inUse lists subnets that have already been
+// allocated.
+func NewMultiSubnetAllocator(ranges []SubnetRange, inUse []string) (*SubnetAllocator, error) {
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("No networks to allocate subnets from.")
+	}
+
+	sna := &SubnetAllocator{}
+	for _, r := range ranges {
+		if _, err := sna.addRange(r); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, netStr := range inUse {
+		_, nIp, err := net.ParseCIDR(netStr)
+		if err != nil {
+			glog.Warningf("Failed to parse network address: %q", netStr)
+			continue
+		}
+		sr := sna.rangeFor(nIp)
+		if sr == nil {
+			glog.Warningf("Provided subnet %s doesn't belong to network %s", nIp, sna)
+			continue
+		}
+		if sr.isExcluded(nIp) {
+			glog.Warningf("Provided subnet %s overlaps an excluded subnet", nIp)
+		} else if sr.isFree(nIp) {
+			sr.allocate(nIp)
+		} else {
+			glog.Warningf("Provided subnet %s overlaps another subnet", nIp)
+		}
+	}
+	return sna, nil
+}
+
+// addRange adds a range to sna, which must not overlap its existing ranges
+func (sna *SubnetAllocator) addRange(r SubnetRange) (*subnetRange, error) {
+	sr, err := newSubnetRange(r.Network, r.HostBits)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range sna.ranges {
+		if other.network.Contains(sr.network.IP) || sr.network.Contains(other.network.IP) {
+			return nil, fmt.Errorf("Network %s overlaps network %s", sr.network, other.network)
+		}
+	}
+	for _, excluded := range r.Excluded {
+		if err := sr.exclude(excluded); err != nil {
+			return nil, err
+		}
+	}
+	sna.ranges = append(sna.ranges, sr)
+	return sr, nil
+}
+
+func newSubnetRange(network string, hostBits uint) (*subnetRange, error) {
 	_, netIP, err := net.ParseCIDR(network)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse network address: %q", network)
 	}
 
-	netMaskSize, _ := netIP.Mask.Size()
-	if hostBits > (32 - uint(netMaskSize)) {
-		return nil, fmt.Errorf("Subnet capacity cannot be larger than number of networks available.")
+	sr := &subnetRange{
+		network:  netIP,
+		hostBits: hostBits,
+		next:     0,
+		allocMap: make(map[string]bool),
+		used:     make(map[string]int),
+	}
+	sr.subnetBits, sr.rotate, err = sr.layout(hostBits)
+	if err != nil {
+		return nil, err
 	}
-	subnetBits := 32 - uint(netMaskSize) - hostBits
+	sr.slots = newBitmap(1 << sr.subnetBits)
+	sr.order = sr.slots
+	if sr.rotate != 0 {
+		sr.order = newBitmap(1 << sr.subnetBits)
+	}
+	return sr, nil
+}
 
-	// In the simple case, the subnet part of the 32-bit IP address is just the subnet
+// exclude marks the subnet excluded of sr as permanently allocated
+func (sr *subnetRange) exclude(excluded string) error {
+	_, ipnet, err := net.ParseCIDR(excluded)
+	if err != nil {
+		return fmt.Errorf("Failed to parse excluded network address: %q", excluded)
+	}
+	netMaskSize, _ := sr.network.Mask.Size()
+	maskSize, _ := ipnet.Mask.Size()
+	if !sr.network.Contains(ipnet.IP) || maskSize < netMaskSize {
+		return fmt.Errorf("Excluded subnet %s doesn't belong to network %s", ipnet, sr.network)
+	}
+	if !sr.isFree(ipnet) {
+		return fmt.Errorf("Excluded subnet %s overlaps another excluded subnet", ipnet)
+	}
+	sr.allocate(ipnet)
+	sr.excluded = append(sr.excluded, ipnet)
+	return nil
+}
+
+// isExcluded returns true if ipnet overlaps any of sr's excluded subnets
+func (sr *subnetRange) isExcluded(ipnet *net.IPNet) bool {
+	for _, excluded := range sr.excluded {
+		if excluded.Contains(ipnet.IP) || ipnet.Contains(excluded.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// layout returns the number of subnet bits in subnets of sr with hostBits host
+// bits, and the number of bits to rotate subnet numbers left by before turning
+// them into addresses.
+func (sr *subnetRange) layout(hostBits uint) (subnetBits uint, rotate uint, err error) {
+	netMaskSize, addrBits := sr.network.Mask.Size()
+	if hostBits > (uint(addrBits) - uint(netMaskSize)) {
+		return 0, 0, fmt.Errorf("Subnet capacity cannot be larger than number of networks available.")
+	}
+	subnetBits = uint(addrBits) - uint(netMaskSize) - hostBits
+	if subnetBits > maxSubnetBits {
+		return 0, 0, fmt.Errorf("Network %s has too many subnets of size /%d (more than 2^%d)", sr.network, addrBits-int(hostBits), maxSubnetBits)
+	}
+
+	// In the simple case, the subnet part of the IP address is just the subnet
 	// number shifted hostBits to the left. However, if hostBits isn't a multiple of
 	// 8, then it can be difficult to distinguish the subnet part and the host part
 	// visually. (Eg, given network="10.1.0.0/16" and hostBits=6, then "10.1.0.50" and
@@ -41,84 +201,448 @@ func NewSubnetAllocator(network string, hostBits uint, inUse []string) (*SubnetA
 	// 10.1.255.0/26 (just like we would with /24s in the hostBits=8 case), and only
 	// if we use up all of those subnets do we start allocating 10.1.0.64/26,
 	// 10.1.1.64/26, etc.
-	var leftShift, rightShift uint
-	var leftMask, rightMask uint32
-	if hostBits%8 != 0 && ((hostBits-1)/8 != (hostBits+subnetBits-1)/8) {
-		leftShift = 8 - (hostBits % 8)
-		leftMask = uint32(1)<<(32-uint(netMaskSize)) - 1
-		rightShift = subnetBits - leftShift
-		rightMask = (uint32(1)<<leftShift - 1) << hostBits
+	//
+	// IPv6 addresses aren't written as octets, so we don't bother there.
+	if addrBits == 32 && hostBits%8 != 0 && ((hostBits-1)/8 != (hostBits+subnetBits-1)/8) {
+		rotate = 8 - (hostBits % 8)
+	}
+	return subnetBits, rotate, nil
+}
+
+// rotateLeft rotates the low width bits of n left by count bits
+func rotateLeft(n uint64, width, count uint) uint64 {
+	if count == 0 {
+		return n
+	}
+	return ((n << count) | (n >> (width - count))) & (uint64(1)<<width - 1)
+}
+
+// subnet returns the subnet with the given subnet number, out of the subnets
+// with hostBits host bits (and the given layout)
+func (sr *subnetRange) subnet(hostBits, subnetBits, rotate uint, n uint32) *net.IPNet {
+	rotated := rotateLeft(uint64(n), subnetBits, rotate)
+
+	base := sr.network.IP
+	if ip4 := base.To4(); ip4 != nil {
+		base = ip4
+	}
+	ipInt := new(big.Int).SetBytes(base)
+	ipInt.Or(ipInt, new(big.Int).Lsh(new(big.Int).SetUint64(rotated), hostBits))
+
+	ip := make(net.IP, len(base))
+	ipBytes := ipInt.Bytes()
+	copy(ip[len(ip)-len(ipBytes):], ipBytes)
+
+	netMaskSize, addrBits := sr.network.Mask.Size()
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(netMaskSize+int(subnetBits), addrBits)}
+}
+
+// slot returns the index (in sr.slots) of the default-sized subnet containing ip
+func (sr *subnetRange) slot(ip net.IP) uint {
+	base := sr.network.IP
+	if ip4 := base.To4(); ip4 != nil {
+		base, ip = ip4, ip.To4()
 	} else {
-		leftShift = 0
-		leftMask = 0xFFFFFFFF
-		rightShift = 0
-		rightMask = 0
+		base, ip = base.To16(), ip.To16()
 	}
+	offset := new(big.Int).Sub(new(big.Int).SetBytes(ip), new(big.Int).SetBytes(base))
+	return uint(offset.Rsh(offset, sr.hostBits).Uint64())
+}
 
-	amap := make(map[string]bool)
-	for _, netStr := range inUse {
-		_, nIp, err := net.ParseCIDR(netStr)
-		if err != nil {
-			fmt.Println("Failed to parse network address: ", netStr)
-			continue
+// markSlots sets or clears count bits of sr.slots starting at slot, and the
+// corresponding bits of sr.order
+func (sr *subnetRange) markSlots(slot, count uint, allocated bool) {
+	for i := slot; i < slot+count; i++ {
+		n := uint(rotateLeft(uint64(i), sr.subnetBits, sr.subnetBits-sr.rotate))
+		if allocated {
+			sr.slots.set(i)
+			sr.order.set(n)
+		} else {
+			sr.slots.clear(i)
+			sr.order.clear(n)
 		}
-		if !netIP.Contains(nIp.IP) {
-			fmt.Println("Provided subnet doesn't belong to network: ", nIp)
-			continue
+	}
+}
+
+// hostBitsOf returns the number of host bits in ipnet
+func hostBitsOf(ipnet *net.IPNet) uint {
+	maskSize, addrBits := ipnet.Mask.Size()
+	return uint(addrBits - maskSize)
+}
+
+// blocks returns the keys of the blocks of sr that contain ipnet, from the block
+// with fromMaskSize bits of mask down to ipnet itself
+func (sr *subnetRange) blocks(ipnet *net.IPNet, fromMaskSize int) []string {
+	maskSize, addrBits := ipnet.Mask.Size()
+	keys := make([]string, 0, maskSize-fromMaskSize+1)
+	for size := fromMaskSize; size <= maskSize; size++ {
+		mask := net.CIDRMask(size, addrBits)
+		block := &net.IPNet{IP: ipnet.IP.Mask(mask), Mask: mask}
+		keys = append(keys, block.String())
+	}
+	return keys
+}
+
+// slotMaskSize returns the mask size of sr's default-sized subnets
+func (sr *subnetRange) slotMaskSize() int {
+	netMaskSize, _ := sr.network.Mask.Size()
+	return netMaskSize + int(sr.subnetBits)
+}
+
+// isFree returns true if ipnet doesn't overlap any allocated subnet
+func (sr *subnetRange) isFree(ipnet *net.IPNet) bool {
+	hostBits, slot := hostBitsOf(ipnet), sr.slot(ipnet.IP)
+	if hostBits >= sr.hostBits {
+		return !sr.slots.anySet(slot, 1<<(hostBits-sr.hostBits))
+	}
+	if !sr.slots.get(slot) {
+		return true
+	}
+
+	// The default-sized subnet containing ipnet is in use; if it's not by
+	// smaller subnets then it's entirely allocated
+	keys := sr.blocks(ipnet, sr.slotMaskSize())
+	if sr.used[keys[0]] == 0 {
+		return false
+	}
+	for _, key := range keys {
+		if sr.allocMap[key] {
+			return false
 		}
-		amap[nIp.String()] = true
 	}
-	return &SubnetAllocator{
-		network:    netIP,
-		hostBits:   hostBits,
-		leftShift:  leftShift,
-		leftMask:   leftMask,
-		rightShift: rightShift,
-		rightMask:  rightMask,
-		next:       0,
-		allocMap:   amap,
-	}, nil
+	return sr.used[keys[len(keys)-1]] == 0
+}
+
+// inUse returns true if any subnet overlapping the block of sr with maskSize
+// bits of mask containing ip is allocated
+func (sr *subnetRange) inUse(ip net.IP, maskSize int) bool {
+	slotMaskSize := sr.slotMaskSize()
+	if maskSize > slotMaskSize {
+		mask := net.CIDRMask(maskSize, 8*len(sr.network.Mask))
+		block := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		return sr.used[block.String()] > 0
+	}
+	count := uint(1) << uint(slotMaskSize-maskSize)
+	return sr.slots.anySet(sr.slot(ip)&^(count-1), count)
+}
+
+func (sr *subnetRange) allocate(ipnet *net.IPNet) {
+	hostBits, slot := hostBitsOf(ipnet), sr.slot(ipnet.IP)
+	if hostBits >= sr.hostBits {
+		sr.markSlots(slot, 1<<(hostBits-sr.hostBits), true)
+		if hostBits > sr.hostBits {
+			sr.allocMap[ipnet.String()] = true
+		}
+		return
+	}
+
+	sr.markSlots(slot, 1, true)
+	keys := sr.blocks(ipnet, sr.slotMaskSize())
+	sr.allocMap[keys[len(keys)-1]] = true
+	for _, key := range keys {
+		sr.used[key]++
+	}
+}
+
+func (sr *subnetRange) release(ipnet *net.IPNet) error {
+	if sr.isExcluded(ipnet) {
+		return fmt.Errorf("Provided subnet %v is excluded from allocation.", ipnet)
+	}
+
+	hostBits, slot := hostBitsOf(ipnet), sr.slot(ipnet.IP)
+	switch {
+	case hostBits == sr.hostBits:
+		if !sr.slots.get(slot) || sr.used[ipnet.String()] > 0 || sr.inLargerSubnet(ipnet) {
+			return fmt.Errorf("Provided subnet %v is already available.", ipnet)
+		}
+		sr.markSlots(slot, 1, false)
+
+	case hostBits > sr.hostBits:
+		if !sr.allocMap[ipnet.String()] {
+			return fmt.Errorf("Provided subnet %v is already available.", ipnet)
+		}
+		delete(sr.allocMap, ipnet.String())
+		sr.markSlots(slot, 1<<(hostBits-sr.hostBits), false)
+
+	default:
+		keys := sr.blocks(ipnet, sr.slotMaskSize())
+		if !sr.allocMap[keys[len(keys)-1]] {
+			return fmt.Errorf("Provided subnet %v is already available.", ipnet)
+		}
+		delete(sr.allocMap, keys[len(keys)-1])
+		for _, key := range keys {
+			if sr.used[key]--; sr.used[key] == 0 {
+				delete(sr.used, key)
+			}
+		}
+		if sr.used[keys[0]] == 0 {
+			sr.markSlots(slot, 1, false)
+		}
+	}
+	return nil
+}
+
+// inLargerSubnet returns true if ipnet is part of an allocated subnet larger
+// than the default size
+func (sr *subnetRange) inLargerSubnet(ipnet *net.IPNet) bool {
+	netMaskSize, _ := sr.network.Mask.Size()
+	keys := sr.blocks(ipnet, netMaskSize)
+	for _, key := range keys[:len(keys)-1] {
+		if sr.allocMap[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeFor returns the range that ipnet belongs to, or nil
+func (sna *SubnetAllocator) rangeFor(ipnet *net.IPNet) *subnetRange {
+	for _, sr := range sna.ranges {
+		if sr.network.Contains(ipnet.IP) {
+			return sr
+		}
+	}
+	return nil
 }
 
 func (sna *SubnetAllocator) GetNetwork() (*net.IPNet, error) {
-	var (
-		numSubnets    uint32
-		numSubnetBits uint
-	)
-	baseipu := IPToUint32(sna.network.IP)
-	netMaskSize, _ := sna.network.Mask.Size()
-	numSubnetBits = 32 - uint(netMaskSize) - sna.hostBits
-	numSubnets = 1 << numSubnetBits
-
-	var i uint32
-	for i = 0; i < numSubnets; i++ {
-		n := (i + sna.next) % numSubnets
-		shifted := n << sna.hostBits
-		ipu := baseipu | ((shifted << sna.leftShift) & sna.leftMask) | ((shifted >> sna.rightShift) & sna.rightMask)
-		genIp := Uint32ToIP(ipu)
-		genSubnet := &net.IPNet{IP: genIp, Mask: net.CIDRMask(int(numSubnetBits)+netMaskSize, 32)}
-		if !sna.allocMap[genSubnet.String()] {
-			sna.allocMap[genSubnet.String()] = true
-			sna.next = n + 1
+	for _, sr := range sna.ranges {
+		if genSubnet := sr.getNetwork(); genSubnet != nil {
 			return genSubnet, nil
 		}
 	}
-
-	sna.next = 0
 	return nil, fmt.Errorf("No subnets available.")
 }
 
+// getNetwork allocates and returns a subnet from sr, or nil if sr is full
+func (sr *subnetRange) getNetwork() *net.IPNet {
+	n, ok := sr.order.nextClear(uint(sr.next))
+	if !ok {
+		sr.next = 0
+		return nil
+	}
+
+	genSubnet := sr.subnet(sr.hostBits, sr.subnetBits, sr.rotate, uint32(n))
+	sr.allocate(genSubnet)
+	sr.next = uint32(n + 1)
+	return genSubnet
+}
+
+// GetNetworkWithHostBits is like GetNetwork, but allocates a subnet with
+// hostBits host bits rather than the default size for its network. Subnets of
+// non-default sizes are allocated from the free space that is most closely
+// surrounded by already-allocated subnets, to keep as much of the network as
+// possible available for larger subnets.
+func (sna *SubnetAllocator) GetNetworkWithHostBits(hostBits uint) (*net.IPNet, error) {
+	var err error
+	for _, sr := range sna.ranges {
+		var genSubnet *net.IPNet
+		if hostBits == sr.hostBits {
+			genSubnet = sr.getNetwork()
+		} else {
+			genSubnet, err = sr.getNetworkWithHostBits(hostBits)
+		}
+		if genSubnet != nil {
+			return genSubnet, nil
+		}
+	}
+	if err != nil && len(sna.ranges) == 1 {
+		return nil, err
+	}
+	return nil, fmt.Errorf("No subnets with %d host bits available.", hostBits)
+}
+
+// getNetworkWithHostBits allocates and returns a subnet with hostBits host bits
+// from sr, or nil if there is no room for one
+func (sr *subnetRange) getNetworkWithHostBits(hostBits uint) (*net.IPNet, error) {
+	subnetBits, rotate, err := sr.layout(hostBits)
+	if err != nil {
+		return nil, err
+	}
+	netMaskSize, _ := sr.network.Mask.Size()
+	bestFit := netMaskSize + int(subnetBits) - 1
+
+	var best *net.IPNet
+	bestDepth := -1
+	numSubnets := uint64(1) << subnetBits
+	for i := uint64(0); i < numSubnets; i++ {
+		genSubnet := sr.subnet(hostBits, subnetBits, rotate, uint32(i))
+		if !sr.isFree(genSubnet) {
+			continue
+		}
+		// Find the smallest block containing genSubnet that has
+		// allocated subnets in it
+		depth := -1
+		for size := bestFit; size >= netMaskSize; size-- {
+			if sr.inUse(genSubnet.IP, size) {
+				depth = size
+				break
+			}
+		}
+		if best == nil || depth > bestDepth {
+			best, bestDepth = genSubnet, depth
+		}
+		if bestDepth == bestFit || bestDepth == -1 {
+			// can't do better
+			break
+		}
+	}
+	if best != nil {
+		sr.allocate(best)
+	}
+	return best, nil
+}
+
 func (sna *SubnetAllocator) ReleaseNetwork(ipnet *net.IPNet) error {
-	if !sna.network.Contains(ipnet.IP) {
-		return fmt.Errorf("Provided subnet %v doesn't belong to the network %v.", ipnet, sna.network)
+	sr := sna.rangeFor(ipnet)
+	if sr == nil {
+		return fmt.Errorf("Provided subnet %v doesn't belong to the network %v.", ipnet, sna)
 	}
 
-	ipnetStr := ipnet.String()
-	if !sna.allocMap[ipnetStr] {
-		return fmt.Errorf("Provided subnet %v is already available.", ipnet)
+	return sr.release(ipnet)
+}
+
+// String returns the allocator's networks, separated by commas
+func (sna *SubnetAllocator) String() string {
+	networks := make([]string, 0, len(sna.ranges))
+	for _, sr := range sna.ranges {
+		networks = append(networks, sr.network.String())
 	}
+	return strings.Join(networks, ",")
+}
 
-	sna.allocMap[ipnetStr] = false
+// Snapshot returns a compact serialization of sna's networks and allocated
+// subnets, which can be passed to RestoreSubnetAllocator
+func (sna *SubnetAllocator) Snapshot() []byte {
+	buf := []byte{'S', subnetSnapshotVersion}
+	buf = appendUvarint(buf, uint(len(sna.ranges)))
+	for _, sr := range sna.ranges {
+		buf = appendString(buf, sr.network.String())
+		buf = appendUvarint(buf, sr.hostBits)
+		buf = appendUvarint(buf, uint(len(sr.excluded)))
+		for _, excluded := range sr.excluded {
+			buf = appendString(buf, excluded.String())
+		}
+		buf = appendUvarint(buf, uint(sr.next))
 
-	return nil
+		// Default-sized subnets are recorded as a bitmap, and others
+		// individually. Excluded subnets are recreated from the list above.
+		others := make([]string, 0, len(sr.allocMap))
+		defaults := newBitmap(sr.slots.size)
+		for i, ok := sr.slots.findSet(0, sr.slots.size); ok; i, ok = sr.slots.findSet(i+1, sr.slots.size) {
+			defaults.set(i)
+		}
+		for key := range sr.allocMap {
+			_, ipnet, _ := net.ParseCIDR(key)
+			if !sr.isExcluded(ipnet) {
+				others = append(others, key)
+			}
+			hostBits, slot := hostBitsOf(ipnet), sr.slot(ipnet.IP)
+			count := uint(1)
+			if hostBits > sr.hostBits {
+				count = 1 << (hostBits - sr.hostBits)
+			}
+			for i := slot; i < slot+count; i++ {
+				defaults.clear(i)
+			}
+		}
+		sort.Strings(others)
+
+		buf = defaults.appendRuns(buf)
+		buf = appendUvarint(buf, uint(len(others)))
+		for _, key := range others {
+			buf = appendString(buf, key)
+		}
+	}
+	return buf
+}
+
+// RestoreSubnetAllocator returns a SubnetAllocator in the state recorded by
+// Snapshot
+func RestoreSubnetAllocator(snapshot []byte) (*SubnetAllocator, error) {
+	if len(snapshot) < 2 || snapshot[0] != 'S' || snapshot[1] != subnetSnapshotVersion {
+		return nil, fmt.Errorf("Invalid subnet allocator snapshot")
+	}
+	sna, err := restoreSubnetAllocator(bytes.NewReader(snapshot[2:]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid subnet allocator snapshot: %v", err)
+	}
+	return sna, nil
+}
+
+func restoreSubnetAllocator(r *bytes.Reader) (*SubnetAllocator, error) {
+	nranges, err := readUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if nranges == 0 {
+		return nil, fmt.Errorf("no networks")
+	}
+
+	sna := &SubnetAllocator{}
+	for ; nranges > 0; nranges-- {
+		network, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		hostBits, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		nexcluded, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		excluded := make([]string, 0)
+		for ; nexcluded > 0; nexcluded-- {
+			subnet, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			excluded = append(excluded, subnet)
+		}
+		sr, err := sna.addRange(SubnetRange{Network: network, HostBits: hostBits, Excluded: excluded})
+		if err != nil {
+			return nil, err
+		}
+		next, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if next > sr.slots.size {
+			return nil, fmt.Errorf("bad next subnet %d for %s", next, network)
+		}
+		sr.next = uint32(next)
+
+		defaults := newBitmap(sr.slots.size)
+		if err := defaults.readRuns(r); err != nil {
+			return nil, err
+		}
+		for i, ok := defaults.findSet(0, defaults.size); ok; i, ok = defaults.findSet(i+1, defaults.size) {
+			sr.markSlots(i, 1, true)
+		}
+
+		nothers, err := readUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		for ; nothers > 0; nothers-- {
+			key, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			_, ipnet, err := net.ParseCIDR(key)
+			if err != nil || ipnet.String() != key || !sr.network.Contains(ipnet.IP) {
+				return nil, fmt.Errorf("bad subnet %q for %s", key, network)
+			}
+			if hostBitsOf(ipnet) == sr.hostBits || !sr.isFree(ipnet) {
+				return nil, fmt.Errorf("bad subnet %q for %s", key, network)
+			}
+			sr.allocate(ipnet)
+		}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("trailing data")
+	}
+	return sna, nil
 }
@@ -3,6 +3,7 @@ package netutils
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -230,3 +231,318 @@ func TestGenerateGateway(t *testing.T) {
 		t.Fatalf("Did not get expected gateway IP Address (gatewayIP=%s)", gatewayIP.String())
 	}
 }
+
+func TestAllocateSubnetIPv6(t *testing.T) {
+	sna, err := NewSubnetAllocator("fd00:10:1::/48", 64, []string{"fd00:10:1:1::/64"})
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	for _, expected := range []string{"fd00:10:1::/64", "fd00:10:1:2::/64", "fd00:10:1:3::/64"} {
+		sn, err := sna.GetNetwork()
+		if err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+		if sn.String() != expected {
+			t.Fatalf("Did not get expected subnet (expected=%s, sn=%s)", expected, sn.String())
+		}
+	}
+
+	gatewayIP := GenerateDefaultGateway(&net.IPNet{IP: net.ParseIP("fd00:10:1:3::"), Mask: net.CIDRMask(64, 128)})
+	if gatewayIP.String() != "fd00:10:1:3::1" {
+		t.Fatalf("Did not get expected gateway IP Address (gatewayIP=%s)", gatewayIP.String())
+	}
+
+	_, releaseSn, _ := net.ParseCIDR("fd00:10:1:2::/64")
+	if err := sna.ReleaseNetwork(releaseSn); err != nil {
+		t.Fatal("Failed to release the subnet: ", err)
+	}
+	_, otherSn, _ := net.ParseCIDR("fd00:10:2::/64")
+	if err := sna.ReleaseNetwork(otherSn); err == nil {
+		t.Fatalf("Unexpectedly released subnet from another network")
+	}
+}
+
+// A /126 split into /127s, and a network with too many subnets
+func TestAllocateSubnetIPv6Exhaust(t *testing.T) {
+	sna, err := NewSubnetAllocator("fd00:10:1:2::/126", 1, nil)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	for _, expected := range []string{"fd00:10:1:2::/127", "fd00:10:1:2::2/127"} {
+		sn, err := sna.GetNetwork()
+		if err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+		if sn.String() != expected {
+			t.Fatalf("Did not get expected subnet (expected=%s, sn=%s)", expected, sn.String())
+		}
+	}
+	if sn, err := sna.GetNetwork(); err == nil {
+		t.Fatalf("Unexpectedly succeeded in getting network (sn=%s)", sn.String())
+	}
+
+	if _, err := NewSubnetAllocator("fd00::/16", 64, nil); err == nil {
+		t.Fatalf("Unexpectedly created allocator with 2^48 subnets")
+	}
+}
+
+func TestAllocateSubnetMultipleNetworks(t *testing.T) {
+	ranges := []SubnetRange{
+		{Network: "10.1.0.0/23", HostBits: 8},
+		{Network: "10.2.0.0/22", HostBits: 9},
+	}
+	sna, err := NewMultiSubnetAllocator(ranges, []string{"10.1.1.0/24", "10.2.2.0/23", "10.3.0.0/24"})
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	for _, expected := range []string{"10.1.0.0/24", "10.2.0.0/23"} {
+		sn, err := sna.GetNetwork()
+		if err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+		if sn.String() != expected {
+			t.Fatalf("Did not get expected subnet (expected=%s, sn=%s)", expected, sn.String())
+		}
+	}
+	if sn, err := sna.GetNetwork(); err == nil {
+		t.Fatalf("Unexpectedly succeeded in getting network (sn=%s)", sn.String())
+	}
+
+	// Released subnets in earlier networks are reused first
+	_, releaseSn, _ := net.ParseCIDR("10.2.2.0/23")
+	if err := sna.ReleaseNetwork(releaseSn); err != nil {
+		t.Fatal("Failed to release the subnet: ", err)
+	}
+	_, releaseSn, _ = net.ParseCIDR("10.1.1.0/24")
+	if err := sna.ReleaseNetwork(releaseSn); err != nil {
+		t.Fatal("Failed to release the subnet: ", err)
+	}
+	for _, expected := range []string{"10.1.1.0/24", "10.2.2.0/23"} {
+		sn, err := sna.GetNetwork()
+		if err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+		if sn.String() != expected {
+			t.Fatalf("Did not get expected subnet (expected=%s, sn=%s)", expected, sn.String())
+		}
+	}
+
+	_, otherSn, _ := net.ParseCIDR("10.3.0.0/24")
+	if err := sna.ReleaseNetwork(otherSn); err == nil || !strings.Contains(err.Error(), "10.1.0.0/23,10.2.0.0/22") {
+		t.Fatalf("Wrong error releasing subnet from another network: %v", err)
+	}
+
+	ranges = append(ranges, SubnetRange{Network: "10.2.2.0/24", HostBits: 4})
+	if _, err := NewMultiSubnetAllocator(ranges, nil); err == nil {
+		t.Fatalf("Unexpectedly created allocator with overlapping networks")
+	}
+}
+
+func TestAllocateSubnetMixedSizes(t *testing.T) {
+	sna, err := NewSubnetAllocator("10.1.0.0/16", 8, []string{"10.1.0.0/24", "10.1.2.128/25"})
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	for _, tc := range []struct {
+		hostBits uint
+		expected string
+	}{
+		// Default-sized subnets are allocated in the usual order,
+		// skipping any that overlap other subnets
+		{8, "10.1.1.0/24"},
+		{8, "10.1.3.0/24"},
+		// Small subnets go in the gaps between allocated subnets
+		{6, "10.1.2.0/26"},
+		{6, "10.1.2.64/26"},
+		{4, "10.1.4.0/28"},
+		{4, "10.1.4.16/28"},
+		// Large subnets go wherever they fit
+		{10, "10.1.8.0/22"},
+		{8, "10.1.5.0/24"},
+		{8, "10.1.6.0/24"},
+		{8, "10.1.7.0/24"},
+		{8, "10.1.12.0/24"},
+	} {
+		sn, err := sna.GetNetworkWithHostBits(tc.hostBits)
+		if err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+		if sn.String() != tc.expected {
+			t.Fatalf("Did not get expected subnet (expected=%s, sn=%s)", tc.expected, sn.String())
+		}
+	}
+
+	// Released space can be reused by subnets of other sizes, but the
+	// allocator prefers to fill in next to 10.1.12.0/24 rather than
+	// splitting 10.1.8.0/22
+	_, releaseSn, _ := net.ParseCIDR("10.1.8.0/22")
+	if err := sna.ReleaseNetwork(releaseSn); err != nil {
+		t.Fatal("Failed to release the subnet: ", err)
+	}
+	_, releaseSn, _ = net.ParseCIDR("10.1.8.0/24")
+	if err := sna.ReleaseNetwork(releaseSn); err == nil {
+		t.Fatalf("Unexpectedly released part of a subnet")
+	}
+	for _, expected := range []string{"10.1.14.0/23", "10.1.8.0/22"} {
+		_, expectedSn, _ := net.ParseCIDR(expected)
+		maskSize, _ := expectedSn.Mask.Size()
+		sn, err := sna.GetNetworkWithHostBits(uint(32 - maskSize))
+		if err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+		if sn.String() != expected {
+			t.Fatalf("Did not get expected subnet (expected=%s, sn=%s)", expected, sn.String())
+		}
+	}
+
+	if _, err := sna.GetNetworkWithHostBits(17); err == nil {
+		t.Fatalf("Unexpectedly allocated subnet larger than the network")
+	}
+}
+
+func TestAllocateSubnetMixedSizesExhaust(t *testing.T) {
+	sna, err := NewSubnetAllocator("10.1.0.0/22", 8, nil)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	for _, hostBits := range []uint{7, 8, 9} {
+		if _, err := sna.GetNetworkWithHostBits(hostBits); err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+	}
+	// 128 addresses are left, but not 256 in a row
+	if sn, err := sna.GetNetworkWithHostBits(8); err == nil {
+		t.Fatalf("Unexpectedly succeeded in getting network (sn=%s)", sn.String())
+	}
+	if sn, err := sna.GetNetwork(); err == nil {
+		t.Fatalf("Unexpectedly succeeded in getting network (sn=%s)", sn.String())
+	}
+	sn, err := sna.GetNetworkWithHostBits(7)
+	if err != nil {
+		t.Fatal("Failed to get network: ", err)
+	}
+	if sn.String() != "10.1.0.128/25" {
+		t.Fatalf("Did not get expected subnet (sn=%s)", sn.String())
+	}
+}
+
+func TestSubnetAllocatorSnapshot(t *testing.T) {
+	ranges := []SubnetRange{
+		{Network: "10.1.0.0/16", HostBits: 6},
+		{Network: "fd00:10:1::/48", HostBits: 64},
+	}
+	sna, err := NewMultiSubnetAllocator(ranges, []string{"10.1.0.0/26", "10.1.2.0/27", "10.1.4.0/24", "fd00:10:1:1::/64"})
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := sna.GetNetwork(); err != nil {
+			t.Fatal("Failed to get network: ", err)
+		}
+	}
+	_, ipnet, _ := net.ParseCIDR("10.1.50.0/26")
+	if err := sna.ReleaseNetwork(ipnet); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+
+	snapshot := sna.Snapshot()
+	restored, err := RestoreSubnetAllocator(snapshot)
+	if err != nil {
+		t.Fatal("Failed to restore subnet allocator: ", err)
+	}
+	if restored.String() != sna.String() {
+		t.Fatalf("Restored allocator has networks %s, expected %s", restored, sna)
+	}
+	if string(restored.Snapshot()) != string(snapshot) {
+		t.Fatalf("Snapshot of restored allocator differs from original")
+	}
+
+	// Both allocators now make the same allocations, including of the
+	// released subnet once the range wraps around
+	for i := 0; i < 2000; i++ {
+		hostBits := uint(6)
+		if i%500 == 0 {
+			hostBits = 5
+		}
+		expected, err1 := sna.GetNetworkWithHostBits(hostBits)
+		actual, err2 := restored.GetNetworkWithHostBits(hostBits)
+		if fmt.Sprintf("%v %v", expected, err1) != fmt.Sprintf("%v %v", actual, err2) {
+			t.Fatalf("Restored allocator gave %v %v, expected %v %v", actual, err2, expected, err1)
+		}
+	}
+
+	// Subnets allocated before the snapshot can be released
+	for _, subnet := range []string{"10.1.2.0/27", "10.1.4.0/24", "10.1.1.0/26", "fd00:10:1:1::/64"} {
+		_, ipnet, _ := net.ParseCIDR(subnet)
+		if err := restored.ReleaseNetwork(ipnet); err != nil {
+			t.Fatalf("Failed to release %s from restored allocator: %v", subnet, err)
+		}
+	}
+
+	for _, bad := range [][]byte{nil, snapshot[:len(snapshot)-1], append(snapshot, 0), {'N', 1}} {
+		if _, err := RestoreSubnetAllocator(bad); err == nil {
+			t.Fatalf("Unexpectedly restored bad snapshot %v", bad)
+		}
+	}
+}
+
+func TestAllocateSubnetExcluded(t *testing.T) {
+	ranges := []SubnetRange{
+		{Network: "10.1.0.0/20", HostBits: 8, Excluded: []string{"10.1.0.0/23", "10.1.3.0/24", "10.1.8.0/21"}},
+	}
+	sna, err := NewMultiSubnetAllocator(ranges, []string{"10.1.0.0/24", "10.1.2.0/24"})
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	for _, expected := range []string{"10.1.4.0/24", "10.1.5.0/24", "10.1.6.0/24", "10.1.7.0/24"} {
+		sn, err := sna.GetNetwork()
+		if err != nil || sn.String() != expected {
+			t.Fatalf("Expected subnet %s, got %v %v", expected, sn, err)
+		}
+	}
+	if sn, err := sna.GetNetwork(); err == nil {
+		t.Fatalf("Unexpectedly allocated excluded subnet %s", sn)
+	}
+	if sn, err := sna.GetNetworkWithHostBits(7); err == nil {
+		t.Fatalf("Unexpectedly allocated excluded subnet %s", sn)
+	}
+
+	for _, subnet := range []string{"10.1.0.0/24", "10.1.3.0/24", "10.1.8.0/24", "10.1.8.0/21"} {
+		_, ipnet, _ := net.ParseCIDR(subnet)
+		if err := sna.ReleaseNetwork(ipnet); err == nil || !strings.Contains(err.Error(), "excluded") {
+			t.Fatalf("Expected error releasing excluded subnet %s, got %v", subnet, err)
+		}
+	}
+	_, ipnet, _ := net.ParseCIDR("10.1.2.0/24")
+	if err := sna.ReleaseNetwork(ipnet); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+
+	restored, err := RestoreSubnetAllocator(sna.Snapshot())
+	if err != nil {
+		t.Fatal("Failed to restore subnet allocator: ", err)
+	}
+	if sn, err := restored.GetNetwork(); err != nil || sn.String() != "10.1.2.0/24" {
+		t.Fatalf("Expected subnet 10.1.2.0/24 from restored allocator, got %v %v", sn, err)
+	}
+	_, ipnet, _ = net.ParseCIDR("10.1.9.0/24")
+	if err := restored.ReleaseNetwork(ipnet); err == nil {
+		t.Fatalf("Restored allocator released excluded subnet")
+	}
+
+	for _, excluded := range [][]string{
+		{"10.2.0.0/24"},
+		{"10.0.0.0/8"},
+		{"10.1.0.0/22", "10.1.2.0/23"},
+		{"bogus"},
+	} {
+		ranges[0].Excluded = excluded
+		if _, err := NewMultiSubnetAllocator(ranges, nil); err == nil {
+			t.Fatalf("Unexpectedly accepted excluded subnets %v", excluded)
+		}
+	}
+}
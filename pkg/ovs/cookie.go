@@ -0,0 +1,91 @@
+package ovs
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// OwnerType identifies the kind of object that a flow was installed for. It is
+// stored in the top byte of the flow's cookie; the remaining 56 bits are a
+// hash of the owner's ID.
+type OwnerType uint8
+
+const (
+	OwnerUnknown OwnerType = iota
+	OwnerPod
+	OwnerHostSubnet
+	OwnerService
+)
+
+const (
+	// CookieOwnerTypeMask selects just the OwnerType part of a cookie
+	CookieOwnerTypeMask uint64 = 0xff00000000000000
+	// CookieExactMask matches a cookie exactly
+	CookieExactMask uint64 = 0xffffffffffffffff
+
+	cookieOwnerTypeShift = 56
+)
+
+// NewCookie returns a flow cookie for flows owned by the object of the given
+// type and ID. (Eg, OwnerPod and the pod's "namespace/name".)
+func NewCookie(owner OwnerType, id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return uint64(owner)<<cookieOwnerTypeShift | h.Sum64()&^CookieOwnerTypeMask
+}
+
+// OwnerTypeCookie returns a cookie that, together with CookieOwnerTypeMask,
+// matches all flows owned by objects of the given type.
+func OwnerTypeCookie(owner OwnerType) uint64 {
+	return uint64(owner) << cookieOwnerTypeShift
+}
+
+// CookieOwnerType returns the OwnerType encoded in a cookie
+func CookieOwnerType(cookie uint64) OwnerType {
+	return OwnerType(cookie >> cookieOwnerTypeShift)
+}
+
+func (t OwnerType) String() string {
+	switch t {
+	case OwnerUnknown:
+		return "unknown"
+	case OwnerPod:
+		return "pod"
+	case OwnerHostSubnet:
+		return "hostsubnet"
+	case OwnerService:
+		return "service"
+	}
+	return fmt.Sprintf("OwnerType(%d)", uint8(t))
+}
+
+// Owner returns the OwnerType recorded in the flow's cookie
+func (f *Flow) Owner() OwnerType {
+	return CookieOwnerType(f.Cookie)
+}
+
+// ListFlowsByCookie returns the flows on the bridge whose cookies match cookie
+// in the bits selected by mask. (Use CookieExactMask to find the flows for a
+// single owner, or OwnerTypeCookie() and CookieOwnerTypeMask to find the flows
+// for all owners of a given type.)
+func (tx *Transaction) ListFlowsByCookie(cookie, mask uint64) ([]*Flow, error) {
+	flows, err := tx.ListFlows()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make([]*Flow, 0, len(flows))
+	for _, flow := range flows {
+		if flow.Cookie&mask == cookie&mask {
+			matching = append(matching, flow)
+		}
+	}
+	return matching, nil
+}
+
+// DeleteFlowsByCookie deletes the flows on the bridge whose cookies match
+// cookie in the bits selected by mask. The flows are not actually deleted until
+// EndTransaction(). This cannot be undone by Rollback().
+func (tx *Transaction) DeleteFlowsByCookie(cookie, mask uint64) {
+	tx.DeleteFlows("cookie=0x%x/0x%x", cookie, mask)
+}
@@ -0,0 +1,52 @@
+package ovs
+
+import (
+	"testing"
+)
+
+func TestCookies(t *testing.T) {
+	pod := NewCookie(OwnerPod, "default/nginx")
+	if pod != NewCookie(OwnerPod, "default/nginx") {
+		t.Fatalf("Cookies are not stable")
+	}
+	if CookieOwnerType(pod) != OwnerPod || pod&CookieOwnerTypeMask != OwnerTypeCookie(OwnerPod) {
+		t.Fatalf("Wrong owner type in cookie 0x%x", pod)
+	}
+	if pod == NewCookie(OwnerPod, "default/nginx2") {
+		t.Fatalf("Cookie does not depend on owner ID")
+	}
+	if NewCookie(OwnerService, "default/nginx") == pod {
+		t.Fatalf("Cookie does not depend on owner type")
+	}
+	if flow := NewFlow(0, 0).WithCookie(NewCookie(OwnerHostSubnet, "node1")); flow.Owner() != OwnerHostSubnet || flow.Owner().String() != "hostsubnet" {
+		t.Fatalf("Wrong flow owner %v", flow.Owner())
+	}
+}
+
+func TestCookieFlows(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", `OFPST_FLOW reply (OF1.3) (xid=0x2):
+ cookie=0x0, duration=20.1s, table=0, n_packets=0, n_bytes=0, priority=0 actions=drop
+ cookie=0x1000000000000aa, duration=20.1s, table=2, n_packets=0, n_bytes=0, priority=100,ip,in_port=5,nw_src=10.1.2.3 actions=goto_table:3
+ cookie=0x1000000000000bb, duration=20.1s, table=2, n_packets=0, n_bytes=0, priority=100,ip,in_port=6,nw_src=10.1.2.4 actions=goto_table:3
+ cookie=0x2000000000000aa, duration=20.1s, table=1, n_packets=0, n_bytes=0, priority=100,tun_src=192.168.1.5 actions=goto_table:5
+`, nil)
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "delete cookie=0x1000000000000aa/0xffffffffffffffff\n", "", nil)
+
+	otx := NewTransaction(fexec, "br0")
+	flows, err := otx.ListFlowsByCookie(OwnerTypeCookie(OwnerPod), CookieOwnerTypeMask)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(flows) != 2 || flows[0].Cookie != 0x1000000000000aa || flows[1].Cookie != 0x1000000000000bb {
+		t.Fatalf("Wrong flows: %v", flows)
+	}
+	otx.DeleteFlowsByCookie(0x1000000000000aa, CookieExactMask)
+	if err = otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
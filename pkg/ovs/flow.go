@@ -0,0 +1,384 @@
+package ovs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPriority is the priority of a flow that doesn't specify one
+const DefaultPriority = 32768
+
+// Flow is an OpenFlow flow, as understood by ovs-ofctl.
+type Flow struct {
+	Table    int
+	Priority int
+	Cookie   uint64
+
+	Match   []MatchField
+	Actions []Action
+
+	// Statistics; these are only filled in for flows returned from
+	// ListFlows() and are ignored by String().
+	Duration time.Duration
+	NPackets uint64
+	NBytes   uint64
+}
+
+// MatchField is a single field of a flow's match. Protocol shorthands (such
+// as "ip" or "arp") have an empty Value.
+type MatchField struct {
+	Name  string
+	Value string
+}
+
+// Action is a single flow action. Arg is empty for actions that take no
+// argument (such as "drop"); actions that use parenthesized syntax (such as
+// "resubmit(,5)") have the parentheses included in Arg.
+type Action struct {
+	Name string
+	Arg  string
+}
+
+// Protocol is a protocol shorthand for use with Flow.Protocol()
+type Protocol string
+
+const (
+	ProtocolIP   Protocol = "ip"
+	ProtocolARP  Protocol = "arp"
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolUDP  Protocol = "udp"
+	ProtocolICMP Protocol = "icmp"
+)
+
+// Names of registers and fields for use in Move(), Load() and SetField()
+const (
+	FieldReg0   = "NXM_NX_REG0[]"
+	FieldTunID  = "NXM_NX_TUN_ID[0..31]"
+	FieldTunDst = "tun_dst"
+	FieldEthDst = "eth_dst"
+)
+
+var knownProtocols = map[string]bool{
+	"ip": true, "arp": true, "tcp": true, "udp": true, "icmp": true, "sctp": true,
+	"ipv6": true, "tcp6": true, "udp6": true, "icmp6": true, "rarp": true,
+}
+
+var knownMatchFields = map[string]bool{
+	"in_port": true, "dl_src": true, "dl_dst": true, "dl_type": true, "dl_vlan": true,
+	"eth_src": true, "eth_dst": true, "eth_type": true,
+	"nw_src": true, "nw_dst": true, "nw_proto": true, "nw_tos": true, "nw_ttl": true,
+	"ip_src": true, "ip_dst": true, "ip_proto": true,
+	"tp_src": true, "tp_dst": true,
+	"arp_spa": true, "arp_tpa": true, "arp_sha": true, "arp_tha": true, "arp_op": true,
+	"tun_id": true, "tun_src": true, "tun_dst": true,
+	"reg0": true, "reg1": true, "reg2": true, "reg3": true,
+	"reg4": true, "reg5": true, "reg6": true, "reg7": true,
+	"metadata": true, "ct_state": true, "ct_zone": true, "ct_mark": true,
+}
+
+var knownActions = map[string]bool{
+	"output": true, "goto_table": true, "drop": true, "move": true, "load": true,
+	"set_field": true, "note": true, "resubmit": true, "normal": true, "local": true,
+	"in_port": true, "controller": true, "learn": true, "ct": true,
+	"mod_dl_src": true, "mod_dl_dst": true, "mod_nw_src": true, "mod_nw_dst": true,
+	"set_tunnel": true, "write_metadata": true, "flood": true, "all": true,
+}
+
+// NewFlow returns a new Flow with no match fields and no actions
+func NewFlow(table, priority int) *Flow {
+	return &Flow{Table: table, Priority: priority}
+}
+
+// WithCookie sets the flow's cookie
+func (f *Flow) WithCookie(cookie uint64) *Flow {
+	f.Cookie = cookie
+	return f
+}
+
+// MatchOn adds an arbitrary match field. Prefer the more specific methods.
+func (f *Flow) MatchOn(name, value string) *Flow {
+	f.Match = append(f.Match, MatchField{Name: name, Value: value})
+	return f
+}
+
+// Protocol matches on a protocol shorthand such as ProtocolIP
+func (f *Flow) Protocol(proto Protocol) *Flow {
+	return f.MatchOn(string(proto), "")
+}
+
+// InPort matches on the OpenFlow port the packet arrived on
+func (f *Flow) InPort(port uint) *Flow {
+	return f.MatchOn("in_port", strconv.FormatUint(uint64(port), 10))
+}
+
+// NwSrc matches on the IP (or ARP) source address or CIDR
+func (f *Flow) NwSrc(addr string) *Flow {
+	return f.MatchOn("nw_src", addr)
+}
+
+// NwDst matches on the IP (or ARP) destination address or CIDR
+func (f *Flow) NwDst(addr string) *Flow {
+	return f.MatchOn("nw_dst", addr)
+}
+
+// ArpSha matches on the ARP source hardware address
+func (f *Flow) ArpSha(mac string) *Flow {
+	return f.MatchOn("arp_sha", mac)
+}
+
+// TpDst matches on the TCP/UDP destination port
+func (f *Flow) TpDst(port int) *Flow {
+	return f.MatchOn("tp_dst", strconv.Itoa(port))
+}
+
+// TunSrc matches on the VXLAN tunnel source IP
+func (f *Flow) TunSrc(addr string) *Flow {
+	return f.MatchOn("tun_src", addr)
+}
+
+// Reg0 matches on the value of register 0 (the VNID)
+func (f *Flow) Reg0(value uint) *Flow {
+	return f.MatchOn("reg0", strconv.FormatUint(uint64(value), 10))
+}
+
+// Do appends actions to the flow
+func (f *Flow) Do(actions ...Action) *Flow {
+	f.Actions = append(f.Actions, actions...)
+	return f
+}
+
+// Output returns an action that outputs to an OpenFlow port
+func Output(port uint) Action {
+	return Action{Name: "output", Arg: strconv.FormatUint(uint64(port), 10)}
+}
+
+// GotoTable returns an action that continues processing in another table
+func GotoTable(table int) Action {
+	return Action{Name: "goto_table", Arg: strconv.Itoa(table)}
+}
+
+// Drop returns an action that drops the packet
+func Drop() Action {
+	return Action{Name: "drop"}
+}
+
+// Move returns an action that copies the value of one field to another
+func Move(src, dst string) Action {
+	return Action{Name: "move", Arg: src + "->" + dst}
+}
+
+// Load returns an action that loads a value into a field
+func Load(value uint64, dst string) Action {
+	return Action{Name: "load", Arg: fmt.Sprintf("%d->%s", value, dst)}
+}
+
+// SetField returns an action that sets a field to a value
+func SetField(value, field string) Action {
+	return Action{Name: "set_field", Arg: value + "->" + field}
+}
+
+// Note returns an action that does nothing but records some bytes
+func Note(data ...byte) Action {
+	hex := make([]string, len(data))
+	for i, b := range data {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return Action{Name: "note", Arg: strings.Join(hex, ".")}
+}
+
+// NoteBytes returns the bytes recorded by the flow's first "note" action, or
+// nil if it has none. (Note that OVS pads notes with 0s when dumping flows.)
+func (f *Flow) NoteBytes() []byte {
+	for _, action := range f.Actions {
+		if action.Name != "note" {
+			continue
+		}
+		var data []byte
+		for _, hex := range strings.Split(action.Arg, ".") {
+			b, err := strconv.ParseUint(hex, 16, 8)
+			if err != nil {
+				return nil
+			}
+			data = append(data, byte(b))
+		}
+		return data
+	}
+	return nil
+}
+
+// FindMatch returns the value of the named match field, and whether it is
+// present.
+func (f *Flow) FindMatch(name string) (string, bool) {
+	for _, field := range f.Match {
+		if field.Name == name {
+			return field.Value, true
+		}
+	}
+	return "", false
+}
+
+func (a Action) String() string {
+	if a.Arg == "" {
+		return a.Name
+	} else if strings.HasPrefix(a.Arg, "(") {
+		return a.Name + a.Arg
+	}
+	return a.Name + ":" + a.Arg
+}
+
+func (m MatchField) String() string {
+	if m.Value == "" {
+		return m.Name
+	}
+	return m.Name + "=" + m.Value
+}
+
+// String returns the flow in the syntax accepted by "ovs-ofctl add-flow".
+func (f *Flow) String() string {
+	parts := []string{fmt.Sprintf("table=%d", f.Table), fmt.Sprintf("priority=%d", f.Priority)}
+	if f.Cookie != 0 {
+		parts = append(parts, fmt.Sprintf("cookie=0x%x", f.Cookie))
+	}
+	for _, m := range f.Match {
+		parts = append(parts, m.String())
+	}
+
+	actions := make([]string, len(f.Actions))
+	for i, a := range f.Actions {
+		actions[i] = a.String()
+	}
+	if len(actions) == 0 {
+		actions = []string{"drop"}
+	}
+	parts = append(parts, "actions="+strings.Join(actions, ","))
+	return strings.Join(parts, ", ")
+}
+
+// MatchString returns just the table and match fields of the flow, in the
+// syntax accepted by "ovs-ofctl del-flows".
+func (f *Flow) MatchString() string {
+	parts := []string{fmt.Sprintf("table=%d", f.Table)}
+	for _, m := range f.Match {
+		parts = append(parts, m.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Validate checks that the flow only uses known match fields and actions
+func (f *Flow) Validate() error {
+	if f.Table < 0 || f.Table > 254 {
+		return fmt.Errorf("invalid table %d in flow %q", f.Table, f.String())
+	}
+	if f.Priority < 0 || f.Priority > 65535 {
+		return fmt.Errorf("invalid priority %d in flow %q", f.Priority, f.String())
+	}
+	for _, m := range f.Match {
+		if m.Value == "" {
+			if !knownProtocols[m.Name] {
+				return fmt.Errorf("unknown protocol %q in flow %q", m.Name, f.String())
+			}
+		} else if !knownMatchFields[m.Name] {
+			return fmt.Errorf("unknown match field %q in flow %q", m.Name, f.String())
+		}
+	}
+	for _, a := range f.Actions {
+		if !knownActions[a.Name] {
+			return fmt.Errorf("unknown action %q in flow %q", a.Name, f.String())
+		}
+	}
+	return nil
+}
+
+// ParseFlow parses a flow in either the syntax accepted by "ovs-ofctl
+// add-flow" or the syntax output by "ovs-ofctl dump-flows".
+func ParseFlow(line string) (*Flow, error) {
+	f := &Flow{Priority: DefaultPriority}
+
+	idx := strings.Index(line, "actions=")
+	if idx == -1 {
+		return nil, fmt.Errorf("no actions in flow %q", line)
+	}
+	matchPart := line[:idx]
+	actionPart := strings.TrimSpace(line[idx+len("actions="):])
+
+	for _, token := range strings.FieldsFunc(matchPart, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name := token
+		value := ""
+		if eq := strings.Index(token, "="); eq != -1 {
+			name = token[:eq]
+			value = token[eq+1:]
+		}
+
+		var err error
+		switch name {
+		case "table":
+			f.Table, err = strconv.Atoi(value)
+		case "priority":
+			f.Priority, err = strconv.Atoi(value)
+		case "cookie":
+			f.Cookie, err = strconv.ParseUint(value, 0, 64)
+		case "duration":
+			var secs float64
+			secs, err = strconv.ParseFloat(strings.TrimSuffix(value, "s"), 64)
+			f.Duration = time.Duration(secs * float64(time.Second))
+		case "n_packets":
+			f.NPackets, err = strconv.ParseUint(value, 10, 64)
+		case "n_bytes":
+			f.NBytes, err = strconv.ParseUint(value, 10, 64)
+		case "idle_age", "hard_age", "idle_timeout", "hard_timeout", "importance",
+			"send_flow_rem", "check_overlap", "reset_counts", "no_packet_counts", "no_byte_counts":
+			// ignored
+		default:
+			f.Match = append(f.Match, MatchField{Name: name, Value: value})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in flow %q", name, line)
+		}
+	}
+
+	for _, action := range splitActions(actionPart) {
+		if action == "" {
+			continue
+		}
+		var a Action
+		colon := strings.Index(action, ":")
+		paren := strings.Index(action, "(")
+		if paren != -1 && (colon == -1 || paren < colon) {
+			a = Action{Name: action[:paren], Arg: action[paren:]}
+		} else if colon != -1 {
+			a = Action{Name: action[:colon], Arg: action[colon+1:]}
+		} else {
+			a = Action{Name: action}
+		}
+		f.Actions = append(f.Actions, a)
+	}
+	if len(f.Actions) == 0 {
+		return nil, fmt.Errorf("no actions in flow %q", line)
+	}
+
+	return f, nil
+}
+
+// splitActions splits an action list on commas that are not nested inside
+// parentheses or brackets.
+func splitActions(actions string) []string {
+	var result []string
+	depth := 0
+	start := 0
+	for i, c := range actions {
+		switch c {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				result = append(result, strings.TrimSpace(actions[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(result, strings.TrimSpace(actions[start:]))
+}
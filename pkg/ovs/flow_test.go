@@ -0,0 +1,179 @@
+package ovs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlowString(t *testing.T) {
+	tests := []struct {
+		flow     *Flow
+		expected string
+	}{
+		{
+			flow:     NewFlow(0, 200).InPort(1).Protocol(ProtocolARP).NwSrc("10.1.0.0/16").NwDst("10.1.2.0/24").Do(Move(FieldTunID, FieldReg0), GotoTable(1)),
+			expected: "table=0, priority=200, in_port=1, arp, nw_src=10.1.0.0/16, nw_dst=10.1.2.0/24, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1",
+		},
+		{
+			flow:     NewFlow(4, 100).Protocol(ProtocolTCP).NwDst("172.30.0.1").TpDst(443).Reg0(12).Do(Output(2)),
+			expected: "table=4, priority=100, tcp, nw_dst=172.30.0.1, tp_dst=443, reg0=12, actions=output:2",
+		},
+		{
+			flow:     NewFlow(8, 100).Protocol(ProtocolIP).NwDst("10.1.3.0/24").Do(Move(FieldReg0, FieldTunID), SetField("192.168.1.5", FieldTunDst), Output(1)),
+			expected: "table=8, priority=100, ip, nw_dst=10.1.3.0/24, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:192.168.1.5->tun_dst,output:1",
+		},
+		{
+			flow:     NewFlow(2, 100).WithCookie(0x1234).InPort(5).Protocol(ProtocolIP).NwSrc("10.1.2.3").Do(Load(12, FieldReg0), GotoTable(3)),
+			expected: "table=2, priority=100, cookie=0x1234, in_port=5, ip, nw_src=10.1.2.3, actions=load:12->NXM_NX_REG0[],goto_table:3",
+		},
+		{
+			flow:     NewFlow(253, 0).Do(Note(0x01, 0x02)),
+			expected: "table=253, priority=0, actions=note:01.02",
+		},
+		{
+			flow:     NewFlow(1, 0),
+			expected: "table=1, priority=0, actions=drop",
+		},
+	}
+
+	for i, test := range tests {
+		if err := test.flow.Validate(); err != nil {
+			t.Fatalf("(%d) unexpected validation error: %v", i, err)
+		}
+		str := test.flow.String()
+		if str != test.expected {
+			t.Fatalf("(%d) wrong flow string:\nexpected %s\ngot      %s", i, test.expected, str)
+		}
+
+		parsed, err := ParseFlow(str)
+		if err != nil {
+			t.Fatalf("(%d) could not parse %q: %v", i, str, err)
+		}
+		if len(test.flow.Actions) == 0 {
+			test.flow.Actions = []Action{Drop()}
+		}
+		if !reflect.DeepEqual(parsed, test.flow) {
+			t.Fatalf("(%d) flow did not round trip:\nexpected %#v\ngot      %#v", i, test.flow, parsed)
+		}
+	}
+}
+
+func TestFlowMatchString(t *testing.T) {
+	flow := NewFlow(8, 100).Protocol(ProtocolIP).NwDst("10.1.3.0/24").Do(Output(1))
+	if str := flow.MatchString(); str != "table=8, ip, nw_dst=10.1.3.0/24" {
+		t.Fatalf("Wrong match string %q", str)
+	}
+}
+
+func TestFlowValidate(t *testing.T) {
+	bad := []*Flow{
+		NewFlow(0, 100).MatchOn("nw_sr", "10.1.0.0/16").Do(Drop()),
+		NewFlow(0, 100).MatchOn("ipp", "").Do(Drop()),
+		NewFlow(0, 100).Do(Action{Name: "goto"}),
+		NewFlow(255, 100),
+		NewFlow(0, 70000),
+	}
+	for i, flow := range bad {
+		if err := flow.Validate(); err == nil {
+			t.Fatalf("(%d) unexpectedly validated %q", i, flow.String())
+		}
+	}
+}
+
+func TestParseDumpedFlow(t *testing.T) {
+	flow, err := ParseFlow(" cookie=0x3, duration=13267.277s, table=7, n_packets=788539827, n_bytes=506520926762, idle_age=1, priority=100,reg0=0xc,ip,nw_dst=192.168.2.2 actions=output:3")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing flow: %v", err)
+	}
+	expected := &Flow{
+		Table:    7,
+		Priority: 100,
+		Cookie:   3,
+		Match: []MatchField{
+			{Name: "reg0", Value: "0xc"},
+			{Name: "ip"},
+			{Name: "nw_dst", Value: "192.168.2.2"},
+		},
+		Actions:  []Action{Output(3)},
+		Duration: 13267277 * time.Millisecond,
+		NPackets: 788539827,
+		NBytes:   506520926762,
+	}
+	if !reflect.DeepEqual(flow, expected) {
+		t.Fatalf("Wrong parse:\nexpected %#v\ngot      %#v", expected, flow)
+	}
+
+	flow, err = ParseFlow(" cookie=0x0, duration=4.5s, table=253, n_packets=0, n_bytes=0, actions=note:01.01.00.00.00.00")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing flow: %v", err)
+	}
+	if flow.Priority != DefaultPriority {
+		t.Fatalf("Wrong default priority %d", flow.Priority)
+	}
+	if note := flow.NoteBytes(); !reflect.DeepEqual(note, []byte{1, 1, 0, 0, 0, 0}) {
+		t.Fatalf("Wrong note bytes %v", note)
+	}
+
+	flow, err = ParseFlow("table=0, priority=10, actions=learn(table=9,NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[],output:NXM_OF_IN_PORT[]),resubmit(,9)")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing flow: %v", err)
+	}
+	if len(flow.Actions) != 2 || flow.Actions[0].Name != "learn" || flow.Actions[1] != (Action{Name: "resubmit", Arg: "(,9)"}) {
+		t.Fatalf("Wrong actions %#v", flow.Actions)
+	}
+
+	if _, err = ParseFlow("table=0, priority=10"); err == nil {
+		t.Fatalf("Unexpectedly parsed flow with no actions")
+	}
+	if _, err = ParseFlow("table=zero, actions=drop"); err == nil {
+		t.Fatalf("Unexpectedly parsed flow with bad table")
+	}
+}
+
+func TestListFlows(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", `OFPST_FLOW reply (OF1.3) (xid=0x2):
+ cookie=0x0, duration=13271.779s, table=0, n_packets=0, n_bytes=0, priority=100,ip,nw_dst=192.168.1.0/24 actions=set_field:0a:7b:e6:19:11:cf->eth_dst,output:2
+ cookie=0x0, duration=13271.776s, table=0, n_packets=1, n_bytes=42, priority=100,arp,arp_tpa=192.168.1.0/24 actions=set_field:10.19.17.34->tun_dst,output:1
+`, nil)
+
+	otx := NewTransaction(fexec, "br0")
+	flows, err := otx.ListFlows()
+	otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("Unexpected number of flows (%d)", len(flows))
+	}
+	if flows[1].NBytes != 42 || flows[1].Actions[0] != SetField("10.19.17.34", FieldTunDst) {
+		t.Fatalf("Unexpected flow %#v", flows[1])
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestAddFlows(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "add table=0, priority=0, actions=drop\n", "", nil)
+
+	otx := NewTransaction(fexec, "br0")
+	otx.AddFlows(NewFlow(0, 0).Do(Drop()))
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Invalid flows are caught before anything is run
+	otx = NewTransaction(fexec, "br0")
+	otx.AddFlows(NewFlow(0, 0).Do(Drop()), NewFlow(0, 100).MatchOn("nw_sr", "10.1.0.0/16"))
+	if err := otx.EndTransaction(); err == nil {
+		t.Fatalf("Unexpectedly succeeded in adding invalid flow")
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
@@ -1,105 +1,572 @@
-// Package ovs provides a wrapper around ovs-vsctl and ovs-ofctl
+// Package ovs provides a wrapper around ovsdb-server and ovs-ofctl
 package ovs
 
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
 
 	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/ovs/ovsdbproto"
 )
 
 type Transaction struct {
-	bridge string
-	err    error
+	execer   exec.Executor
+	bridge   string
+	err      error
+	db       *ovsdbClient
+	flowMods []string
+
+	// flowUndo holds the inverse of each queued flow modification (or ""
+	// if it cannot be undone)
+	flowUndo []string
+	// undo holds the functions that will undo the transaction's applied
+	// changes, in the order they were recorded
+	undo []func()
+	// created is true if the transaction created its bridge
+	created bool
 }
 
-// NewTransaction begins a new OVS transaction for a given bridge. If an error
-// occurs at any step in the transaction, it will be recorded until
-// EndTransaction(), and any further calls on the transaction will be ignored.
-func NewTransaction(bridge string) *Transaction {
-	return &Transaction{bridge: bridge}
+// NewTransaction begins a new OVS transaction for a given bridge, running
+// ovs-ofctl and other commands via execer. If an error occurs at any step in
+// the transaction, it will be recorded until EndTransaction(), and any further
+// calls on the transaction will be ignored. Alternatively, the transaction can
+// be ended with Rollback(), to undo its changes.
+//
+// Bridge and port operations take effect immediately, but flow operations are
+// queued and then applied all at once by EndTransaction().
+func NewTransaction(execer exec.Executor, bridge string) *Transaction {
+	return &Transaction{execer: execer, bridge: bridge}
 }
 
-func (tx *Transaction) exec(cmd string, args ...string) (string, error) {
+func (tx *Transaction) exec(input string, cmd string, args ...string) (string, error) {
 	if tx.err != nil {
 		return "", tx.err
 	}
 
-	cmdpath, err := exec.LookPath(cmd)
+	cmdpath, err := tx.execer.LookPath(cmd)
 	if err != nil {
 		tx.err = fmt.Errorf("OVS is not installed")
 		return "", tx.err
 	}
 
 	var output string
-	output, tx.err = exec.Exec(cmdpath, args...)
+	output, tx.err = tx.execer.ExecWithInput(input, cmdpath, args...)
 	return output, tx.err
 }
 
-func (tx *Transaction) vsctlExec(args ...string) (string, error) {
-	return tx.exec("ovs-vsctl", args...)
+// ovsdbTransact runs ops as a single OVSDB transaction, connecting to
+// ovsdb-server first if necessary.
+func (tx *Transaction) ovsdbTransact(ops ...ovsdbOp) ([]ovsdbResult, error) {
+	if tx.err != nil {
+		return nil, tx.err
+	}
+
+	if tx.db == nil {
+		tx.db, tx.err = dialOVSDB(getOVSDBSocket())
+		if tx.err != nil {
+			return nil, tx.err
+		}
+	}
+
+	var results []ovsdbResult
+	results, tx.err = tx.db.transact(ops...)
+	return results, tx.err
+}
+
+// How long to wait for ovs-vswitchd to apply a configuration change
+var vswitchdTimeout = 10 * time.Second
+
+// ovsdbReconfigure runs ops as a single OVSDB transaction (like ovsdbTransact)
+// and then waits for ovs-vswitchd to apply the new configuration, so that
+// newly-created bridges and ports can be used immediately afterward. (This is
+// what ovs-vsctl does by default.)
+func (tx *Transaction) ovsdbReconfigure(ops ...ovsdbOp) {
+	ops = append(ops,
+		opMutate("Open_vSwitch", where(), mutation("next_cfg", "+=", 1)),
+		opSelect("Open_vSwitch", where(), "next_cfg"),
+	)
+	results, err := tx.ovsdbTransact(ops...)
+	if err != nil {
+		return
+	}
+	rows := results[len(results)-1].Rows
+	if len(rows) != 1 {
+		tx.err = fmt.Errorf("unexpected OVSDB reply: expected 1 Open_vSwitch row, got %d", len(rows))
+		return
+	}
+	nextCfg := rows[0].Int("next_cfg")
+
+	deadline := time.Now().Add(vswitchdTimeout)
+	for {
+		results, err = tx.ovsdbTransact(opSelect("Open_vSwitch", where(), "cur_cfg"))
+		if err != nil {
+			return
+		}
+		if rows = results[0].Rows; len(rows) == 1 && rows[0].Int("cur_cfg") >= nextCfg {
+			return
+		}
+		if time.Now().After(deadline) {
+			tx.err = fmt.Errorf("timed out waiting for ovs-vswitchd to apply configuration change")
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// lookupRow returns the UUID of the row in table with the given name, or ""
+// if there is no such row.
+func (tx *Transaction) lookupRow(table, name string) ovsdbUUID {
+	results, err := tx.ovsdbTransact(opSelect(table, where(cond("name", "==", name)), "_uuid"))
+	if err != nil || len(results[0].Rows) == 0 {
+		return ""
+	}
+	return results[0].Rows[0].UUID()
+}
+
+// ovsdb columns which are not string-valued. (Any column referred to with
+// "column:key" syntax is a string-to-string map.)
+var (
+	ovsdbIntegerColumns = map[string]bool{
+		"ofport_request":         true,
+		"ingress_policing_rate":  true,
+		"ingress_policing_burst": true,
+		"mtu_request":            true,
+	}
+	ovsdbSetColumns = map[string]bool{
+		"protocols": true,
+	}
+)
+
+// parseProperties converts a list of properties as would be passed to
+// "ovs-vsctl set" ("column=value" or "column:key=value") to an OVSDB row.
+func parseProperties(properties []string) (map[string]interface{}, error) {
+	row := make(map[string]interface{})
+	maps := make(map[string]map[string]string)
+	for _, prop := range properties {
+		eq := strings.Index(prop, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("invalid property %q", prop)
+		}
+		column := strings.Replace(prop[:eq], "-", "_", -1)
+		value := strings.Trim(prop[eq+1:], `"`)
+
+		if colon := strings.Index(column, ":"); colon != -1 {
+			key := column[colon+1:]
+			column = column[:colon]
+			if maps[column] == nil {
+				maps[column] = make(map[string]string)
+			}
+			maps[column][key] = value
+			continue
+		}
+
+		if ovsdbIntegerColumns[column] {
+			var n int
+			if _, err := fmt.Sscanf(value, "%d", &n); err != nil {
+				return nil, fmt.Errorf("invalid integer value in property %q", prop)
+			}
+			row[column] = n
+		} else if ovsdbSetColumns[column] {
+			elems := []interface{}{}
+			for _, elem := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if elem = strings.TrimSpace(elem); elem != "" {
+					elems = append(elems, elem)
+				}
+			}
+			row[column] = ovsdbproto.Set(elems...)
+		} else {
+			row[column] = value
+		}
+	}
+	for column, m := range maps {
+		row[column] = ovsdbproto.Map(m)
+	}
+	return row, nil
 }
 
 func (tx *Transaction) ofctlExec(args ...string) (string, error) {
 	args = append([]string{"-O", "OpenFlow13"}, args...)
-	return tx.exec("ovs-ofctl", args...)
+	return tx.exec("", "ovs-ofctl", args...)
+}
+
+// Bridges that have been found to not support bundles. We don't bother trying
+// bundles on them again until they are reconfigured by AddBridge() or
+// EnsureBridge(), which may enable OpenFlow 1.4 on them.
+var (
+	bundlesUnsupported     = make(map[string]bool)
+	bundlesUnsupportedLock sync.Mutex
+)
+
+func setBundlesUnsupported(bridge string, unsupported bool) {
+	bundlesUnsupportedLock.Lock()
+	defer bundlesUnsupportedLock.Unlock()
+	if unsupported {
+		bundlesUnsupported[bridge] = true
+	} else {
+		delete(bundlesUnsupported, bridge)
+	}
+}
+
+// Error messages indicating that the problem with a bundle was the bundle
+// itself rather than its contents: either ovs-ofctl is too old to know about
+// bundles, or the bridge does not have OpenFlow 1.4 enabled, or the switch
+// does not implement bundle messages.
+var bundleUnsupportedErrors = []string{
+	"unrecognized option '--bundle'",
+	"version negotiation failed",
+	"OFPBRC_BAD_TYPE",
+	"OFPBRC_BAD_VERSION",
+}
+
+func isBundleUnsupported(output string) bool {
+	for _, msg := range bundleUnsupportedErrors {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// queueFlowMod queues a flow modification, along with its inverse (or "" if
+// it cannot be undone)
+func (tx *Transaction) queueFlowMod(mod, inverse string) {
+	tx.flowMods = append(tx.flowMods, mod)
+	tx.flowUndo = append(tx.flowUndo, inverse)
+}
+
+// commitFlows applies the queued flow modifications, and records the inverse
+// of the ones that were applied so that Rollback() can undo them.
+func (tx *Transaction) commitFlows() {
+	flowMods, flowUndo := tx.flowMods, tx.flowUndo
+	tx.flowMods, tx.flowUndo = nil, nil
+	if tx.err != nil || len(flowMods) == 0 {
+		return
+	}
+
+	applied := tx.applyFlowMods(flowMods)
+	if tx.created {
+		// Rollback() will delete the bridge, and the flows along with it
+		return
+	}
+	var inverse []string
+	for i := applied - 1; i >= 0; i-- {
+		if flowUndo[i] != "" {
+			inverse = append(inverse, flowUndo[i])
+		}
+	}
+	if len(inverse) > 0 {
+		tx.undo = append(tx.undo, func() { tx.applyFlowMods(inverse) })
+	}
+}
+
+// applyFlowMods applies flowMods to the bridge and returns the number that were
+// applied. If possible, they are sent as a single OpenFlow 1.4 bundle, so that
+// either all of them take effect or none do. Otherwise they are applied one by
+// one, stopping at the first error.
+func (tx *Transaction) applyFlowMods(flowMods []string) int {
+	if tx.err != nil {
+		return 0
+	}
+
+	bundlesUnsupportedLock.Lock()
+	tryBundle := !bundlesUnsupported[tx.bridge]
+	bundlesUnsupportedLock.Unlock()
+
+	if tryBundle {
+		input := strings.Join(flowMods, "\n") + "\n"
+		output, err := tx.exec(input, "ovs-ofctl", "-O", "OpenFlow14", "--bundle", "add-flows", tx.bridge, "-")
+		if err == nil {
+			return len(flowMods)
+		} else if !isBundleUnsupported(output) {
+			return 0
+		}
+
+		glog.Warningf("Bridge %s does not support OpenFlow bundles; flow changes will not be atomic: %s", tx.bridge, strings.TrimSpace(output))
+		setBundlesUnsupported(tx.bridge, true)
+		tx.err = nil
+	}
+
+	for i, mod := range flowMods {
+		if strings.HasPrefix(mod, "delete_strict ") {
+			tx.ofctlExec("del-flows", "--strict", tx.bridge, strings.TrimPrefix(mod, "delete_strict "))
+		} else if strings.HasPrefix(mod, "delete ") {
+			tx.ofctlExec("del-flows", tx.bridge, strings.TrimPrefix(mod, "delete "))
+		} else {
+			tx.ofctlExec("add-flow", tx.bridge, strings.TrimPrefix(mod, "add "))
+		}
+		if tx.err != nil {
+			return i
+		}
+	}
+	return len(flowMods)
+}
+
+// selectColumns returns the current values of the named columns of the row in
+// table with the given name, for restoring later with opUpdate. Columns with
+// no value are returned as empty sets.
+func (tx *Transaction) selectColumns(table, name string, columns map[string]interface{}) map[string]interface{} {
+	names := make([]string, 0, len(columns))
+	for column := range columns {
+		names = append(names, column)
+	}
+	results, err := tx.ovsdbTransact(opSelect(table, where(cond("name", "==", name)), names...))
+	if err != nil || len(results[0].Rows) == 0 {
+		return nil
+	}
+	old := make(map[string]interface{}, len(names))
+	for _, column := range names {
+		if value, ok := results[0].Rows[0][column]; ok {
+			old[column] = value
+		} else {
+			old[column] = ovsdbproto.Set()
+		}
+	}
+	return old
 }
 
 // AddBridge creates the bridge associated with the transaction, optionally setting
 // properties on it (as with "ovs-vsctl set Bridge ..."). If the bridge already
-// existed, it will be destroyed and recreated.
+// existed, it will be destroyed and recreated. Rollback() will delete the
+// bridge, but cannot restore a bridge that was destroyed.
 func (tx *Transaction) AddBridge(properties ...string) {
-	args := []string{"--if-exists", "del-br", tx.bridge, "--", "add-br", tx.bridge}
-	if len(properties) > 0 {
-		args = append(args, "--", "set", "Bridge", tx.bridge)
-		args = append(args, properties...)
+	row, err := parseProperties(properties)
+	if err != nil {
+		if tx.err == nil {
+			tx.err = err
+		}
+		return
+	}
+
+	ops := []ovsdbOp{}
+	old := tx.lookupRow("Bridge", tx.bridge)
+	if old != "" {
+		// The old Bridge, Port, and Interface rows will be garbage-collected
+		ops = append(ops, opMutate("Open_vSwitch", where(), mutation("bridges", "delete", old)))
+	}
+
+	row["name"] = tx.bridge
+	row["ports"] = ovsdbNamedUUID("port")
+	ops = append(ops,
+		opInsert("Interface", map[string]interface{}{"name": tx.bridge, "type": "internal"}, "iface"),
+		opInsert("Port", map[string]interface{}{"name": tx.bridge, "interfaces": ovsdbNamedUUID("iface")}, "port"),
+		opInsert("Bridge", row, "bridge"),
+		opMutate("Open_vSwitch", where(), mutation("bridges", "insert", ovsdbNamedUUID("bridge"))),
+	)
+	tx.ovsdbReconfigure(ops...)
+	if tx.err == nil {
+		// Any earlier changes were lost along with the old bridge
+		tx.undo = nil
+		if old == "" {
+			tx.undo = append(tx.undo, tx.DeleteBridge)
+		}
+		tx.created = true
+		setBundlesUnsupported(tx.bridge, false)
+	}
+}
+
+// EnsureBridge creates the bridge associated with the transaction if it does
+// not already exist, like AddBridge. If it does exist, then its properties are
+// updated in place, leaving its ports and flows intact. (In particular, this
+// can be used to enable OpenFlow 1.4, and thus bundles, on a bridge that was
+// created with only older protocols.)
+func (tx *Transaction) EnsureBridge(properties ...string) {
+	row, err := parseProperties(properties)
+	if err != nil {
+		if tx.err == nil {
+			tx.err = err
+		}
+		return
+	}
+
+	if tx.lookupRow("Bridge", tx.bridge) == "" {
+		if tx.err == nil {
+			tx.AddBridge(properties...)
+		}
+		return
+	}
+	if len(row) > 0 {
+		old := tx.selectColumns("Bridge", tx.bridge, row)
+		tx.ovsdbReconfigure(opUpdate("Bridge", where(cond("name", "==", tx.bridge)), row))
+		if tx.err == nil {
+			setBundlesUnsupported(tx.bridge, false)
+			if !tx.created {
+				tx.undo = append(tx.undo, func() {
+					tx.ovsdbReconfigure(opUpdate("Bridge", where(cond("name", "==", tx.bridge)), old))
+				})
+			}
+		}
 	}
-	tx.vsctlExec(args...)
 }
 
 // DeleteBridge deletes the bridge associated with the transaction. (It is an
-// error if the bridge does not exist.)
+// error if the bridge does not exist.) This cannot be undone by Rollback().
 func (tx *Transaction) DeleteBridge() {
-	tx.vsctlExec("del-br", tx.bridge)
+	uuid := tx.lookupRow("Bridge", tx.bridge)
+	if uuid == "" {
+		if tx.err == nil {
+			tx.err = fmt.Errorf("no bridge named %s", tx.bridge)
+		}
+		return
+	}
+	tx.ovsdbReconfigure(opMutate("Open_vSwitch", where(), mutation("bridges", "delete", uuid)))
 }
 
 // AddPort adds an interface to the bridge, requesting the indicated port
 // number, and optionally setting properties on it (as with "ovs-vsctl set
-// Interface ...").
+// Interface ..."). Rollback() will remove the port again, but cannot restore
+// a port that it replaced.
 func (tx *Transaction) AddPort(port string, ofport uint, properties ...string) {
-	args := []string{"--if-exists", "del-port", port, "--", "add-port", tx.bridge, port, "--", "set", "Interface", port, fmt.Sprintf("ofport_request=%d", ofport)}
-	if len(properties) > 0 {
-		args = append(args, properties...)
+	row, err := parseProperties(properties)
+	if err != nil {
+		if tx.err == nil {
+			tx.err = err
+		}
+		return
+	}
+
+	bridge := tx.lookupRow("Bridge", tx.bridge)
+	if bridge == "" {
+		if tx.err == nil {
+			tx.err = fmt.Errorf("no bridge named %s", tx.bridge)
+		}
+		return
+	}
+
+	ops := []ovsdbOp{}
+	old := tx.lookupRow("Port", port)
+	if old != "" {
+		// The port may be on any bridge; the old Port and Interface rows
+		// will be garbage-collected.
+		ops = append(ops, opMutate("Bridge", where(), mutation("ports", "delete", old)))
+	}
+
+	row["name"] = port
+	row["ofport_request"] = ofport
+	ops = append(ops,
+		opInsert("Interface", row, "iface"),
+		opInsert("Port", map[string]interface{}{"name": port, "interfaces": ovsdbNamedUUID("iface")}, "port"),
+		opMutate("Bridge", where(cond("_uuid", "==", bridge)), mutation("ports", "insert", ovsdbNamedUUID("port"))),
+	)
+	tx.ovsdbReconfigure(ops...)
+	if tx.err == nil && old == "" && !tx.created {
+		tx.undo = append(tx.undo, func() { tx.DeletePort(port) })
+	}
+}
+
+// EnsurePort adds an interface to the bridge, like AddPort, unless it is
+// already attached to the bridge with the indicated port number, in which case
+// its properties are just updated in place.
+func (tx *Transaction) EnsurePort(port string, ofport uint, properties ...string) {
+	row, err := parseProperties(properties)
+	if err != nil {
+		if tx.err == nil {
+			tx.err = err
+		}
+		return
+	}
+
+	results, err := tx.ovsdbTransact(
+		opSelect("Bridge", where(cond("name", "==", tx.bridge)), "ports"),
+		opSelect("Port", where(cond("name", "==", port)), "_uuid"),
+		opSelect("Interface", where(cond("name", "==", port)), "ofport"),
+	)
+	if err != nil {
+		return
+	}
+	if len(results[0].Rows) == 0 {
+		tx.err = fmt.Errorf("no bridge named %s", tx.bridge)
+		return
+	}
+
+	attached := false
+	if len(results[1].Rows) == 1 && len(results[2].Rows) == 1 && results[2].Rows[0].Int("ofport") == int(ofport) {
+		uuid := results[1].Rows[0].UUID()
+		for _, p := range results[0].Rows[0].UUIDs("ports") {
+			if p == uuid {
+				attached = true
+				break
+			}
+		}
+	}
+	if !attached {
+		tx.AddPort(port, ofport, properties...)
+		return
+	}
+	if len(row) > 0 {
+		old := tx.selectColumns("Interface", port, row)
+		tx.ovsdbReconfigure(opUpdate("Interface", where(cond("name", "==", port)), row))
+		if tx.err == nil && !tx.created {
+			tx.undo = append(tx.undo, func() {
+				tx.ovsdbReconfigure(opUpdate("Interface", where(cond("name", "==", port)), old))
+			})
+		}
 	}
-	tx.vsctlExec(args...)
 }
 
 // DeletePort removes an interface from the bridge. (It is an error if the
-// interface is not currently a bridge port.)
+// interface is not currently a bridge port.) This cannot be undone by
+// Rollback().
 func (tx *Transaction) DeletePort(port string) {
-	tx.vsctlExec("del-port", port)
+	uuid := tx.lookupRow("Port", port)
+	if uuid == "" {
+		if tx.err == nil {
+			tx.err = fmt.Errorf("no port named %s", port)
+		}
+		return
+	}
+	tx.ovsdbReconfigure(opMutate("Bridge", where(), mutation("ports", "delete", uuid)))
 }
 
 // AddFlow adds a flow to the bridge. The arguments are passed to fmt.Sprintf().
+// The flow is not actually added until EndTransaction(). Rollback() will
+// delete the flow again (if it can be parsed), but cannot restore a flow that
+// it replaced.
 func (tx *Transaction) AddFlow(flow string, args ...interface{}) {
 	if len(args) > 0 {
 		flow = fmt.Sprintf(flow, args...)
 	}
-	tx.ofctlExec("add-flow", tx.bridge, flow)
+	if tx.err == nil {
+		inverse := ""
+		if parsed, err := ParseFlow(flow); err == nil {
+			inverse = "delete_strict " + parsed.strictMatchString()
+		}
+		tx.queueFlowMod("add "+flow, inverse)
+	}
+}
+
+// AddFlows adds flows to the bridge, like AddFlow. It is an error if any of
+// the flows fails Validate().
+func (tx *Transaction) AddFlows(flows ...*Flow) {
+	for _, flow := range flows {
+		if tx.err != nil {
+			return
+		}
+		if tx.err = flow.Validate(); tx.err == nil {
+			tx.queueFlowMod("add "+flow.String(), "delete_strict "+flow.strictMatchString())
+		}
+	}
 }
 
 // DeleteFlows deletes all matching flows from the bridge. The arguments are
-// passed to fmt.Sprintf().
+// passed to fmt.Sprintf(). The flows are not actually deleted until
+// EndTransaction(). This cannot be undone by Rollback().
 func (tx *Transaction) DeleteFlows(flow string, args ...interface{}) {
 	if len(args) > 0 {
 		flow = fmt.Sprintf(flow, args...)
 	}
-	tx.ofctlExec("del-flows", tx.bridge, flow)
+	if tx.err == nil {
+		tx.queueFlowMod("delete "+flow, "")
+	}
 }
 
 // DumpFlows dumps the flow table for the bridge and returns it as an array of
 // strings, one per flow. Since this function has a return value, it also
-// returns an error immediately if an error occurs.
+// returns an error immediately if an error occurs. Flow changes that are
+// still queued in the transaction are not reflected in the output.
 func (tx *Transaction) DumpFlows() ([]string, error) {
 	out, err := tx.ofctlExec("dump-flows", tx.bridge)
 	if err != nil {
@@ -116,11 +583,70 @@ func (tx *Transaction) DumpFlows() ([]string, error) {
 	return flows, nil
 }
 
-// EndTransaction ends an OVS transaction and returns any error that occurred
-// during the transaction. You should not use the transaction again after
-// calling this function.
+// ListFlows dumps the flow table for the bridge, like DumpFlows, and parses it
+// into Flows.
+func (tx *Transaction) ListFlows() ([]*Flow, error) {
+	lines, err := tx.DumpFlows()
+	if err != nil {
+		return nil, err
+	}
+
+	flows := make([]*Flow, 0, len(lines))
+	for _, line := range lines {
+		flow, err := ParseFlow(line)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, flow)
+	}
+	return flows, nil
+}
+
+// EndTransaction ends an OVS transaction, applying any queued flow changes,
+// and returns any error that occurred during the transaction. If an error
+// occurred, none of the queued flow changes will have been applied (unless the
+// bridge does not support OpenFlow bundles, in which case the changes before
+// the failing one will have been applied). You should not use the transaction
+// again after calling this function, except to call Rollback(), if a later
+// step in a larger operation fails.
 func (tx *Transaction) EndTransaction() error {
+	tx.commitFlows()
+	tx.closeDB()
 	err := tx.err
 	tx.err = nil
 	return err
 }
+
+// Rollback ends an OVS transaction like EndTransaction(), but instead of
+// applying the queued flow changes it discards them, and then undoes the
+// bridge, port, and flow changes that have already been applied, in reverse
+// order. (This is done on a best-effort basis; some operations, such as
+// DeleteBridge(), cannot be undone.) It returns the first error that occurred
+// while undoing, if any, not any error that occurred during the transaction
+// itself. Rollback() may also be called after EndTransaction().
+func (tx *Transaction) Rollback() error {
+	tx.flowMods, tx.flowUndo = nil, nil
+	undo := tx.undo
+	tx.undo = nil
+
+	var err error
+	for i := len(undo) - 1; i >= 0; i-- {
+		tx.err = nil
+		undo[i]()
+		if tx.err != nil && err == nil {
+			err = fmt.Errorf("could not roll back changes to %s: %v", tx.bridge, tx.err)
+		}
+	}
+	tx.undo = nil
+	tx.created = false
+	tx.closeDB()
+	tx.err = nil
+	return err
+}
+
+func (tx *Transaction) closeDB() {
+	if tx.db != nil {
+		tx.db.close()
+		tx.db = nil
+	}
+}
@@ -2,52 +2,142 @@ package ovs
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/ovs/ovsdbproto"
+	"github.com/openshift/openshift-sdn/pkg/ovs/ovstest"
 )
 
-func normalSetup() {
-	exec.SetTestMode()
-	exec.AddTestProgram("/usr/bin/ovs-ofctl")
-	exec.AddTestProgram("/usr/bin/ovs-vsctl")
+func normalSetup() *exec.FakeExecutor {
+	bundlesUnsupported = make(map[string]bool)
+	return exec.NewFakeExecutor("/usr/bin/ovs-ofctl", "/usr/bin/ovs-vsctl")
 }
 
-func missingSetup() {
-	exec.SetTestMode()
+func missingSetup() *exec.FakeExecutor {
+	return exec.NewFakeExecutor()
 }
 
 func TestTransactionSuccess(t *testing.T) {
-	normalSetup()
-	exec.AddTestResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 flow1", "", nil)
-	exec.AddTestResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 flow2", "", nil)
+	fexec := normalSetup()
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "add flow1\nadd flow2\ndelete flow3\n", "", nil)
 
-	otx := NewTransaction("br0")
+	otx := NewTransaction(fexec, "br0")
 	otx.AddFlow("flow1")
 	otx.AddFlow("flow2")
+	otx.DeleteFlows("flow3")
 	err := otx.EndTransaction()
 	if err != nil {
 		t.Fatalf("Unexpected error from command: %v", err)
 	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
 }
 
 func TestTransactionFailure(t *testing.T) {
-	normalSetup()
-	exec.AddTestResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 flow1", "", fmt.Errorf("Something bad happened"))
+	fexec := normalSetup()
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "add flow1\nadd flow2\n", "ovs-ofctl: -:2: flow2: unknown keyword flow2\n", fmt.Errorf("Something bad happened"))
 
-	otx := NewTransaction("br0")
+	otx := NewTransaction(fexec, "br0")
 	otx.AddFlow("flow1")
 	otx.AddFlow("flow2")
 	err := otx.EndTransaction()
 	if err == nil {
 		t.Fatalf("Failed to get expected error")
 	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestTransactionNoBundles(t *testing.T) {
+	server := ovsdbSetup(t)
+	defer server.Close()
+	fexec := normalSetup()
+
+	// An OpenFlow 1.3-only bridge, as created by older versions
+	otx := NewTransaction(fexec, "br0")
+	otx.AddBridge("protocols=OpenFlow13")
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error from AddBridge: %v", err)
+	}
+
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "add flow1\ndelete flow2\n", "ovs-ofctl: br0: failed to connect to socket (version negotiation failed (we support version 0x05, peer supports version 0x04))\n", fmt.Errorf("Exit status 1"))
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 flow1", "", nil)
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 del-flows br0 flow2", "", nil)
+
+	otx = NewTransaction(fexec, "br0")
+	otx.AddFlow("flow1")
+	otx.DeleteFlows("flow2")
+	err := otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from command: %v", err)
+	}
+
+	// Once we know bundles don't work, we don't try them again
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 flow3", "", fmt.Errorf("Something bad happened"))
+
+	otx = NewTransaction(fexec, "br0")
+	otx.AddFlow("flow3")
+	otx.AddFlow("flow4")
+	err = otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Failed to get expected error")
+	}
+
+	// ...but only on that bridge
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br1 -", "add flow5\n", "", nil)
+
+	otx = NewTransaction(fexec, "br1")
+	otx.AddFlow("flow5")
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from command: %v", err)
+	}
+
+	// and only until the bridge is reconfigured
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "add flow6\n", "", nil)
+
+	otx = NewTransaction(fexec, "br0")
+	otx.EnsureBridge("protocols=OpenFlow13,OpenFlow14")
+	otx.AddFlow("flow6")
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	br := server.Lookup("Bridge", "br0")
+	if !reflect.DeepEqual(ovsdbproto.SetElements(br["protocols"]), []interface{}{"OpenFlow13", "OpenFlow14"}) {
+		t.Fatalf("Bridge has wrong protocols: %v", br["protocols"])
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestTransactionNoFlows(t *testing.T) {
+	fexec := normalSetup()
+
+	otx := NewTransaction(fexec, "br0")
+	err := otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from empty transaction: %v", err)
+	}
 }
 
 func TestDumpFlows(t *testing.T) {
-	normalSetup()
-	exec.AddTestResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", `OFPST_FLOW reply (OF1.3) (xid=0x2):
+	fexec := normalSetup()
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", `OFPST_FLOW reply (OF1.3) (xid=0x2):
  cookie=0x0, duration=13271.779s, table=0, n_packets=0, n_bytes=0, priority=100,ip,nw_dst=192.168.1.0/24 actions=set_field:0a:7b:e6:19:11:cf->eth_dst,output:2
  cookie=0x0, duration=13271.776s, table=0, n_packets=1, n_bytes=42, priority=100,arp,arp_tpa=192.168.1.0/24 actions=set_field:10.19.17.34->tun_dst,output:1
  cookie=0x3, duration=13267.277s, table=0, n_packets=788539827, n_bytes=506520926762, priority=100,ip,nw_dst=192.168.2.2 actions=output:3
@@ -57,7 +147,7 @@ func TestDumpFlows(t *testing.T) {
  cookie=0x0, duration=13284.67s, table=0, n_packets=782815611, n_bytes=179416494325, priority=50 actions=output:2
 `, nil)
 
-	otx := NewTransaction("br0")
+	otx := NewTransaction(fexec, "br0")
 	flows, err := otx.DumpFlows()
 	otx.EndTransaction()
 	if err != nil {
@@ -70,11 +160,15 @@ func TestDumpFlows(t *testing.T) {
 	if len(flows) != 7 {
 		t.Fatalf("Unexpected number of flows (%d)", len(flows))
 	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
 }
 
 func TestOVSMissing(t *testing.T) {
-	missingSetup()
-	otx := NewTransaction("br0")
+	fexec := missingSetup()
+	otx := NewTransaction(fexec, "br0")
 	otx.AddFlow("flow1")
 	otx.AddFlow("flow2")
 	err := otx.EndTransaction()
@@ -85,3 +179,330 @@ func TestOVSMissing(t *testing.T) {
 		t.Fatalf("Got wrong error: %v", err)
 	}
 }
+
+func ovsdbSetup(t *testing.T) *ovstest.FakeOVSDBServer {
+	server, err := ovstest.NewFakeOVSDBServer()
+	if err != nil {
+		t.Fatalf("Could not start fake OVSDB server: %v", err)
+	}
+	SetOVSDBSocket(server.SocketPath())
+	return server
+}
+
+// mapPairs returns the key/value pairs of a decoded OVSDB map
+func mapPairs(value interface{}) []interface{} {
+	if arr, ok := value.([]interface{}); ok && len(arr) == 2 && arr[0] == "map" {
+		pairs, _ := arr[1].([]interface{})
+		return pairs
+	}
+	return []interface{}{}
+}
+
+func TestAddDeleteBridge(t *testing.T) {
+	server := ovsdbSetup(t)
+	defer server.Close()
+	fexec := exec.NewFakeExecutor()
+
+	otx := NewTransaction(fexec, "br0")
+	otx.AddBridge("fail-mode=secure", "protocols=OpenFlow13")
+	err := otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from AddBridge: %v", err)
+	}
+	if bridges := server.Names("Bridge"); !reflect.DeepEqual(bridges, []string{"br0"}) {
+		t.Fatalf("Unexpected bridges after AddBridge: %v", bridges)
+	}
+	if ports := server.PortNames("br0"); !reflect.DeepEqual(ports, []string{"br0"}) {
+		t.Fatalf("Unexpected ports after AddBridge: %v", ports)
+	}
+	br := server.Lookup("Bridge", "br0")
+	if br["fail_mode"] != "secure" {
+		t.Fatalf("Bridge has wrong fail_mode: %v", br["fail_mode"])
+	}
+	if !reflect.DeepEqual(ovsdbproto.SetElements(br["protocols"]), []interface{}{"OpenFlow13"}) {
+		t.Fatalf("Bridge has wrong protocols: %v", br["protocols"])
+	}
+
+	// Re-adding the bridge replaces it
+	otx = NewTransaction(fexec, "br0")
+	otx.AddPort("tun0", 2, "type=internal")
+	otx.AddBridge()
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from AddBridge: %v", err)
+	}
+	if ports := server.PortNames("br0"); !reflect.DeepEqual(ports, []string{"br0"}) {
+		t.Fatalf("Unexpected ports after re-adding bridge: %v", ports)
+	}
+	if ifaces := server.Names("Interface"); !reflect.DeepEqual(ifaces, []string{"br0"}) {
+		t.Fatalf("Old interfaces were not cleaned up: %v", ifaces)
+	}
+	if br := server.Lookup("Bridge", "br0"); br["fail_mode"] != nil {
+		t.Fatalf("Old bridge properties were not cleaned up: %v", br)
+	}
+
+	otx = NewTransaction(fexec, "br0")
+	otx.DeleteBridge()
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from DeleteBridge: %v", err)
+	}
+	if bridges := server.Names("Bridge"); len(bridges) != 0 {
+		t.Fatalf("Unexpected bridges after DeleteBridge: %v", bridges)
+	}
+
+	otx = NewTransaction(fexec, "br0")
+	otx.DeleteBridge()
+	err = otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Unexpectedly succeeded in deleting non-existent bridge")
+	}
+}
+
+func TestAddDeletePort(t *testing.T) {
+	server := ovsdbSetup(t)
+	defer server.Close()
+	fexec := exec.NewFakeExecutor()
+
+	otx := NewTransaction(fexec, "br0")
+	otx.AddBridge()
+	otx.AddPort("vxlan0", 1, "type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`)
+	otx.AddPort("tun0", 2, "type=internal")
+	err := otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from AddPort: %v", err)
+	}
+	if ports := server.PortNames("br0"); !reflect.DeepEqual(ports, []string{"br0", "tun0", "vxlan0"}) {
+		t.Fatalf("Unexpected ports after AddPort: %v", ports)
+	}
+	vxlan := server.Lookup("Interface", "vxlan0")
+	if vxlan["type"] != "vxlan" || vxlan["ofport_request"] != float64(1) || vxlan["ofport"] != float64(1) {
+		t.Fatalf("vxlan0 interface has wrong properties: %v", vxlan)
+	}
+	options := map[string]interface{}{}
+	for _, pair := range mapPairs(vxlan["options"]) {
+		options[pair.([]interface{})[0].(string)] = pair.([]interface{})[1]
+	}
+	if !reflect.DeepEqual(options, map[string]interface{}{"remote_ip": "flow", "key": "flow"}) {
+		t.Fatalf("vxlan0 interface has wrong options: %v", vxlan["options"])
+	}
+
+	// Re-adding a port replaces it
+	otx = NewTransaction(fexec, "br0")
+	otx.AddPort("tun0", 3)
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from AddPort: %v", err)
+	}
+	if tun := server.Lookup("Interface", "tun0"); tun["ofport_request"] != float64(3) || tun["type"] != nil {
+		t.Fatalf("tun0 interface was not replaced: %v", tun)
+	}
+
+	otx = NewTransaction(fexec, "br0")
+	otx.DeletePort("vxlan0")
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from DeletePort: %v", err)
+	}
+	if ports := server.PortNames("br0"); !reflect.DeepEqual(ports, []string{"br0", "tun0"}) {
+		t.Fatalf("Unexpected ports after DeletePort: %v", ports)
+	}
+
+	// Errors are latched until EndTransaction
+	otx = NewTransaction(fexec, "br0")
+	otx.DeletePort("vxlan0")
+	otx.DeletePort("tun0")
+	err = otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Unexpectedly succeeded in deleting non-existent port")
+	}
+	if ports := server.PortNames("br0"); !reflect.DeepEqual(ports, []string{"br0", "tun0"}) {
+		t.Fatalf("Port was deleted after an earlier error: %v", ports)
+	}
+
+	otx = NewTransaction(fexec, "br1")
+	otx.AddPort("vxlan0", 1)
+	err = otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Unexpectedly succeeded in adding port to non-existent bridge")
+	}
+}
+
+func TestEnsureBridgeAndPort(t *testing.T) {
+	server := ovsdbSetup(t)
+	defer server.Close()
+	fexec := exec.NewFakeExecutor()
+
+	otx := NewTransaction(fexec, "br0")
+	otx.EnsureBridge("fail-mode=secure")
+	otx.EnsurePort("vxlan0", 1, "type=vxlan")
+	otx.EnsurePort("tun0", 2, "type=internal")
+	err := otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from EnsureBridge/EnsurePort: %v", err)
+	}
+	if ports := server.PortNames("br0"); !reflect.DeepEqual(ports, []string{"br0", "tun0", "vxlan0"}) {
+		t.Fatalf("Unexpected ports after EnsurePort: %v", ports)
+	}
+	br := server.Lookup("Bridge", "br0")
+	vxlan := server.Lookup("Interface", "vxlan0")
+
+	// Ensuring again updates properties without recreating anything
+	otx = NewTransaction(fexec, "br0")
+	otx.EnsureBridge("fail-mode=standalone")
+	otx.EnsurePort("vxlan0", 1, "type=vxlan", `options:key="flow"`)
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from EnsureBridge/EnsurePort: %v", err)
+	}
+	newBr := server.Lookup("Bridge", "br0")
+	if !reflect.DeepEqual(newBr["_uuid"], br["_uuid"]) || newBr["fail_mode"] != "standalone" {
+		t.Fatalf("Bridge was not updated in place: %v", newBr)
+	}
+	newVxlan := server.Lookup("Interface", "vxlan0")
+	if !reflect.DeepEqual(newVxlan["_uuid"], vxlan["_uuid"]) || len(mapPairs(newVxlan["options"])) != 1 {
+		t.Fatalf("Interface was not updated in place: %v", newVxlan)
+	}
+
+	// Ensuring a port with a different number replaces it
+	otx = NewTransaction(fexec, "br0")
+	otx.EnsurePort("tun0", 3)
+	err = otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error from EnsurePort: %v", err)
+	}
+	if tun := server.Lookup("Interface", "tun0"); tun["ofport"] != float64(3) || tun["type"] != nil {
+		t.Fatalf("tun0 interface was not replaced: %v", tun)
+	}
+
+	otx = NewTransaction(fexec, "br1")
+	otx.EnsurePort("vxlan0", 1)
+	err = otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Unexpectedly succeeded in ensuring port on non-existent bridge")
+	}
+}
+
+func TestOVSDBMissing(t *testing.T) {
+	SetOVSDBSocket("/nonexistent/db.sock")
+	fexec := exec.NewFakeExecutor()
+	otx := NewTransaction(fexec, "br0")
+	otx.AddBridge()
+	err := otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Unexpectedly did not get error")
+	}
+	if !strings.Contains(err.Error(), "could not connect to ovsdb-server") {
+		t.Fatalf("Got wrong error: %v", err)
+	}
+}
+
+func TestOVSDBHung(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hung-ovsdb")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen on %s: %v", path, err)
+	}
+	defer listener.Close()
+	// Accept connections but never answer
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	oldTimeout := ovsdbTimeout
+	ovsdbTimeout = 100 * time.Millisecond
+	defer func() { ovsdbTimeout = oldTimeout }()
+	SetOVSDBSocket(path)
+
+	otx := NewTransaction(exec.NewFakeExecutor(), "br0")
+	otx.AddBridge()
+	err = otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Unexpectedly did not get error")
+	}
+	if !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Got wrong error: %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	server := ovsdbSetup(t)
+	defer server.Close()
+	fexec := normalSetup()
+
+	// A new bridge is deleted, without undoing the changes made to it first
+	otx := NewTransaction(fexec, "br0")
+	otx.EnsureBridge("fail-mode=secure")
+	otx.EnsurePort("vxlan0", 1, "type=vxlan")
+	otx.AddFlows(NewFlow(0, 0).Do(Drop()))
+	if err := otx.Rollback(); err != nil {
+		t.Fatalf("Unexpected error from Rollback: %v", err)
+	}
+	if bridges := server.Names("Bridge"); len(bridges) != 0 {
+		t.Fatalf("Unexpected bridges after Rollback: %v", bridges)
+	}
+	if ifaces := server.Names("Interface"); len(ifaces) != 0 {
+		t.Fatalf("Unexpected interfaces after Rollback: %v", ifaces)
+	}
+
+	otx = NewTransaction(fexec, "br0")
+	otx.AddBridge("fail-mode=secure")
+	otx.AddPort("vxlan0", 1, "type=vxlan")
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Changes to an existing bridge are undone individually
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "add table=0, priority=0, actions=drop\ndelete table=1\n", "", nil)
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "delete_strict table=0, priority=0\n", "", nil)
+	otx = NewTransaction(fexec, "br0")
+	otx.EnsureBridge("fail-mode=standalone", "protocols=OpenFlow13")
+	otx.EnsurePort("vxlan0", 1, `options:key="flow"`)
+	otx.EnsurePort("tun0", 2, "type=internal")
+	otx.AddFlows(NewFlow(0, 0).Do(Drop()))
+	otx.DeleteFlows("table=1")
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Flows queued after EndTransaction() are discarded
+	otx.AddFlows(NewFlow(1, 0).Do(Drop()))
+	if err := otx.Rollback(); err != nil {
+		t.Fatalf("Unexpected error from Rollback: %v", err)
+	}
+	if ports := server.PortNames("br0"); !reflect.DeepEqual(ports, []string{"br0", "vxlan0"}) {
+		t.Fatalf("Unexpected ports after Rollback: %v", ports)
+	}
+	if br := server.Lookup("Bridge", "br0"); br["fail_mode"] != "secure" || len(ovsdbproto.SetElements(br["protocols"])) != 0 {
+		t.Fatalf("Bridge properties were not restored: %v", br)
+	}
+	if vxlan := server.Lookup("Interface", "vxlan0"); vxlan["type"] != "vxlan" || len(mapPairs(vxlan["options"])) != 0 {
+		t.Fatalf("Interface properties were not restored: %v", vxlan)
+	}
+
+	// Errors while rolling back are returned
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "add table=0, priority=0, actions=drop\n", "", nil)
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", "delete_strict table=0, priority=0\n", "", fmt.Errorf("Something bad happened"))
+	otx = NewTransaction(fexec, "br0")
+	otx.AddFlow("table=0, priority=0, actions=drop")
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := otx.Rollback(); err == nil {
+		t.Fatalf("Failed to get expected error")
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
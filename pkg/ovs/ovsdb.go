@@ -0,0 +1,278 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/openshift/openshift-sdn/pkg/ovs/ovsdbproto"
+)
+
+// This file implements a minimal client for the OVSDB management protocol
+// (RFC 7047), which is spoken by ovsdb-server over its unix socket.
+
+// How long to wait for ovsdb-server to answer a request before giving up on it
+var ovsdbTimeout = 30 * time.Second
+
+var (
+	ovsdbSocket     = "/var/run/openvswitch/db.sock"
+	ovsdbSocketLock sync.Mutex
+)
+
+// SetOVSDBSocket changes the path of the ovsdb-server socket that new
+// transactions will connect to. (The default is
+// "/var/run/openvswitch/db.sock".)
+func SetOVSDBSocket(path string) {
+	ovsdbSocketLock.Lock()
+	defer ovsdbSocketLock.Unlock()
+	ovsdbSocket = path
+}
+
+func getOVSDBSocket() string {
+	ovsdbSocketLock.Lock()
+	defer ovsdbSocketLock.Unlock()
+	return ovsdbSocket
+}
+
+// ovsdbOp is a single operation in a "transact" request
+type ovsdbOp map[string]interface{}
+
+func opInsert(table string, row map[string]interface{}, uuidName string) ovsdbOp {
+	op := ovsdbOp{"op": "insert", "table": table, "row": row}
+	if uuidName != "" {
+		op["uuid-name"] = uuidName
+	}
+	return op
+}
+
+func opSelect(table string, where []interface{}, columns ...string) ovsdbOp {
+	op := ovsdbOp{"op": "select", "table": table, "where": where}
+	if len(columns) > 0 {
+		op["columns"] = columns
+	}
+	return op
+}
+
+func opUpdate(table string, where []interface{}, row map[string]interface{}) ovsdbOp {
+	return ovsdbOp{"op": "update", "table": table, "where": where, "row": row}
+}
+
+func opMutate(table string, where []interface{}, mutations ...interface{}) ovsdbOp {
+	return ovsdbOp{"op": "mutate", "table": table, "where": where, "mutations": mutations}
+}
+
+func opDelete(table string, where []interface{}) ovsdbOp {
+	return ovsdbOp{"op": "delete", "table": table, "where": where}
+}
+
+// cond returns a single condition for use in a "where" clause
+func cond(column, function string, value interface{}) []interface{} {
+	return []interface{}{column, function, value}
+}
+
+// where builds a "where" clause from zero or more conditions
+func where(conds ...[]interface{}) []interface{} {
+	w := make([]interface{}, 0, len(conds))
+	for _, c := range conds {
+		w = append(w, c)
+	}
+	return w
+}
+
+// mutation returns a single mutation for use in opMutate()
+func mutation(column, mutator string, value interface{}) []interface{} {
+	return []interface{}{column, mutator, value}
+}
+
+// OVSDB atom and datum encodings
+
+type ovsdbUUID string
+
+func (u ovsdbUUID) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]string{"uuid", string(u)})
+}
+
+func (u *ovsdbUUID) UnmarshalJSON(data []byte) error {
+	var pair []string
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 || pair[0] != "uuid" {
+		return fmt.Errorf("invalid OVSDB uuid %s", string(data))
+	}
+	*u = ovsdbUUID(pair[1])
+	return nil
+}
+
+type ovsdbNamedUUID string
+
+func (u ovsdbNamedUUID) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]string{"named-uuid", string(u)})
+}
+
+// ovsdbRow is a row as returned by "select". Values are left in their
+// generic JSON-decoded form; use the helper methods to interpret them.
+type ovsdbRow map[string]interface{}
+
+// UUID returns the row's "_uuid" column
+func (row ovsdbRow) UUID() ovsdbUUID {
+	if pair, ok := row["_uuid"].([]interface{}); ok && len(pair) == 2 {
+		if s, ok := pair[1].(string); ok {
+			return ovsdbUUID(s)
+		}
+	}
+	return ""
+}
+
+// String returns the value of a string-valued column
+func (row ovsdbRow) String(column string) string {
+	s, _ := row[column].(string)
+	return s
+}
+
+// Int returns the value of an integer-valued column
+func (row ovsdbRow) Int(column string) int {
+	f, _ := row[column].(float64)
+	return int(f)
+}
+
+// UUIDs returns the value of a column containing a set of UUIDs
+func (row ovsdbRow) UUIDs(column string) []ovsdbUUID {
+	var uuids []ovsdbUUID
+	for _, elem := range ovsdbproto.SetElements(row[column]) {
+		if pair, ok := elem.([]interface{}); ok && len(pair) == 2 && pair[0] == "uuid" {
+			uuids = append(uuids, ovsdbUUID(pair[1].(string)))
+		}
+	}
+	return uuids
+}
+
+type ovsdbResult struct {
+	Count   int        `json:"count,omitempty"`
+	UUID    *ovsdbUUID `json:"uuid,omitempty"`
+	Rows    []ovsdbRow `json:"rows,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Details string     `json:"details,omitempty"`
+}
+
+type ovsdbClient struct {
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	nextID uint64
+}
+
+func dialOVSDB(path string) (*ovsdbClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to ovsdb-server at %s: %v", path, err)
+	}
+	return &ovsdbClient{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}, nil
+}
+
+func (c *ovsdbClient) close() {
+	c.conn.Close()
+}
+
+// call sends a JSON-RPC request and waits for the matching response, replying
+// to any "echo" requests from the server in the meantime. It fails if the
+// response does not arrive within ovsdbTimeout.
+func (c *ovsdbClient) call(method string, params []interface{}, result interface{}) error {
+	if err := c.conn.SetDeadline(time.Now().Add(ovsdbTimeout)); err != nil {
+		return fmt.Errorf("error sending %s request to ovsdb-server: %v", method, err)
+	}
+	c.nextID++
+	id := c.nextID
+	if glog.V(5) {
+		data, _ := json.Marshal(params)
+		glog.Infof("[ovsdb] %s %s", method, string(data))
+	}
+	if err := c.enc.Encode(&ovsdbproto.Request{Method: method, Params: params, ID: id}); err != nil {
+		return fmt.Errorf("error sending %s request to ovsdb-server: %v", method, err)
+	}
+
+	for {
+		var msg ovsdbproto.Message
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("error reading %s reply from ovsdb-server: %v", method, err)
+		}
+		if msg.Method == "echo" {
+			var params []interface{}
+			json.Unmarshal(msg.Params, &params)
+			if params == nil {
+				params = []interface{}{}
+			}
+			reply := map[string]interface{}{"result": params, "error": nil, "id": msg.ID}
+			if err := c.enc.Encode(reply); err != nil {
+				return fmt.Errorf("error replying to echo from ovsdb-server: %v", err)
+			}
+			continue
+		} else if msg.Method != "" {
+			// Ignore notifications; we don't register any monitors here
+			continue
+		}
+
+		if msgID, ok := msg.ID.(float64); !ok || uint64(msgID) != id {
+			continue
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("ovsdb-server returned error for %s: %v", method, msg.Error)
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Result, result); err != nil {
+				return fmt.Errorf("could not parse %s reply from ovsdb-server: %v", method, err)
+			}
+		}
+		return nil
+	}
+}
+
+// transact performs a set of operations as a single atomic OVSDB
+// transaction, returning an error if any operation failed.
+func (c *ovsdbClient) transact(ops ...ovsdbOp) ([]ovsdbResult, error) {
+	params := make([]interface{}, 0, len(ops)+1)
+	params = append(params, ovsdbproto.Database)
+	for _, op := range ops {
+		params = append(params, op)
+	}
+
+	var results []*ovsdbResult
+	if err := c.call("transact", params, &results); err != nil {
+		return nil, err
+	}
+
+	errs := []string{}
+	for i, res := range results {
+		if res == nil || res.Error == "" {
+			continue
+		}
+		msg := res.Error
+		if res.Details != "" {
+			msg += ": " + res.Details
+		}
+		if i < len(ops) {
+			msg = fmt.Sprintf("%s (in %s on %s)", msg, ops[i]["op"], ops[i]["table"])
+		}
+		errs = append(errs, msg)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("OVSDB transaction failed: %s", strings.Join(errs, "; "))
+	}
+
+	ret := make([]ovsdbResult, len(ops))
+	for i := range ops {
+		if i < len(results) && results[i] != nil {
+			ret[i] = *results[i]
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,61 @@
+// Package ovsdbproto holds the parts of the OVSDB management protocol (RFC
+// 7047) that are shared by the client in package ovs and the fake server in
+// package ovstest, so that the two can't disagree about the wire format.
+package ovsdbproto
+
+import (
+	"encoding/json"
+)
+
+// Database is the name of the Open vSwitch database
+const Database = "Open_vSwitch"
+
+// Request is a JSON-RPC request
+type Request struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     interface{}   `json:"id"`
+}
+
+// Message can hold any message: request, response, or notification
+type Message struct {
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  interface{}     `json:"error,omitempty"`
+	ID     interface{}     `json:"id"`
+}
+
+// Set returns the OVSDB encoding of a set containing elems
+func Set(elems ...interface{}) []interface{} {
+	if elems == nil {
+		elems = []interface{}{}
+	}
+	return []interface{}{"set", elems}
+}
+
+// Map returns the OVSDB encoding of a map with string keys and values
+func Map(m map[string]string) []interface{} {
+	pairs := make([]interface{}, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, []interface{}{k, v})
+	}
+	return []interface{}{"map", pairs}
+}
+
+// SetElements returns the elements of a decoded OVSDB set, which may be
+// represented either as a bare atom or as ["set", [...]].
+func SetElements(value interface{}) []interface{} {
+	if arr, ok := value.([]interface{}); ok && len(arr) == 2 {
+		if arr[0] == "set" {
+			elems, _ := arr[1].([]interface{})
+			return elems
+		} else if arr[0] == "map" {
+			return nil
+		}
+	}
+	if value == nil {
+		return nil
+	}
+	return []interface{}{value}
+}
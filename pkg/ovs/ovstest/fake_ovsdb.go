@@ -0,0 +1,695 @@
+// Package ovstest provides test helpers for code that uses package ovs
+package ovstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/openshift/openshift-sdn/pkg/ovs/ovsdbproto"
+)
+
+// FakeOVSDBServer is an in-process stand-in for ovsdb-server (and, to a
+// limited extent, ovs-vswitchd), for use in tests on hosts that do not have
+// Open vSwitch installed. It implements the subset of RFC 7047 that this
+// package uses, on a cut-down version of the Open_vSwitch schema.
+type FakeOVSDBServer struct {
+	dir      string
+	path     string
+	listener net.Listener
+
+	lock     sync.Mutex
+	tables   map[string]map[string]fakeRow
+	nextUUID int
+}
+
+type fakeRow map[string]interface{}
+
+type fakeTableSchema struct {
+	// root tables are not garbage collected when unreferenced
+	root bool
+	// refs maps reference columns to the table they refer to
+	refs map[string]string
+	// indexed tables must have a unique "name"
+	indexed bool
+}
+
+var fakeOVSDBSchema = map[string]fakeTableSchema{
+	"Open_vSwitch": {root: true, refs: map[string]string{"bridges": "Bridge"}},
+	"Bridge":       {refs: map[string]string{"ports": "Port"}, indexed: true},
+	"Port":         {refs: map[string]string{"interfaces": "Interface", "qos": "QoS"}, indexed: true},
+	"Interface":    {indexed: true},
+	"QoS":          {root: true},
+}
+
+// NewFakeOVSDBServer creates a fake OVSDB server listening on a unix socket in
+// a new temporary directory, containing an empty Open_vSwitch database.
+func NewFakeOVSDBServer() (*FakeOVSDBServer, error) {
+	dir, err := ioutil.TempDir("", "fake-ovsdb")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "db.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &FakeOVSDBServer{
+		dir:      dir,
+		path:     path,
+		listener: listener,
+		tables:   make(map[string]map[string]fakeRow),
+	}
+	for table := range fakeOVSDBSchema {
+		s.tables[table] = make(map[string]fakeRow)
+	}
+	uuid := s.newUUID()
+	s.tables["Open_vSwitch"][uuid] = fakeRow{
+		"_uuid":    []interface{}{"uuid", uuid},
+		"bridges":  ovsdbproto.Set(),
+		"next_cfg": float64(0),
+		"cur_cfg":  float64(0),
+	}
+
+	go s.serve()
+	return s, nil
+}
+
+// SocketPath returns the path of the server's unix socket
+func (s *FakeOVSDBServer) SocketPath() string {
+	return s.path
+}
+
+// Close shuts down the server and removes its socket
+func (s *FakeOVSDBServer) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Names returns the sorted names of all rows in table
+func (s *FakeOVSDBServer) Names(table string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := []string{}
+	for _, row := range s.tables[table] {
+		if name, ok := row["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns a copy of the row in table with the given name, or nil
+func (s *FakeOVSDBServer) Lookup(table, name string) map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, row := range s.tables[table] {
+		if row["name"] == name {
+			return copyValue(map[string]interface{}(row)).(map[string]interface{})
+		}
+	}
+	return nil
+}
+
+// PortNames returns the sorted names of the ports on bridge
+func (s *FakeOVSDBServer) PortNames(bridge string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := []string{}
+	for _, br := range s.tables["Bridge"] {
+		if br["name"] != bridge {
+			continue
+		}
+		for _, ref := range ovsdbproto.SetElements(br["ports"]) {
+			if port, ok := s.tables["Port"][uuidOf(ref)]; ok {
+				names = append(names, port["name"].(string))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *FakeOVSDBServer) newUUID() string {
+	s.nextUUID++
+	return fmt.Sprintf("00000000-0000-0000-0000-%012x", s.nextUUID)
+}
+
+func (s *FakeOVSDBServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *FakeOVSDBServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	for {
+		var msg ovsdbproto.Message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Method == "" {
+			// a reply to something we sent; we never send anything
+			continue
+		}
+
+		var params []interface{}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			enc.Encode(map[string]interface{}{"result": nil, "error": "invalid params", "id": msg.ID})
+			continue
+		}
+
+		var result interface{}
+		var rpcErr interface{}
+		switch msg.Method {
+		case "echo":
+			result = params
+		case "list_dbs":
+			result = []string{ovsdbproto.Database}
+		case "transact":
+			if len(params) < 1 || params[0] != ovsdbproto.Database {
+				rpcErr = "unknown database"
+			} else {
+				result = s.transact(params[1:])
+			}
+		default:
+			rpcErr = fmt.Sprintf("unknown method %q", msg.Method)
+		}
+		if err := enc.Encode(map[string]interface{}{"result": result, "error": rpcErr, "id": msg.ID}); err != nil {
+			return
+		}
+	}
+}
+
+type fakeOpError struct {
+	err     string
+	details string
+}
+
+func fakeErrorf(err, format string, args ...interface{}) *fakeOpError {
+	return &fakeOpError{err: err, details: fmt.Sprintf(format, args...)}
+}
+
+func (s *FakeOVSDBServer) transact(ops []interface{}) []interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Work on a copy of the database so that a failure anywhere aborts the
+	// whole transaction.
+	tables := copyValue(s.tables).(map[string]map[string]fakeRow)
+	results := make([]interface{}, len(ops))
+
+	// Assign UUIDs to all named rows up front, so that operations can refer
+	// to rows that are inserted later in the transaction.
+	named := make(map[string]string)
+	for _, o := range ops {
+		if op, ok := o.(map[string]interface{}); ok && op["op"] == "insert" {
+			if name, ok := op["uuid-name"].(string); ok {
+				named[name] = s.newUUID()
+			}
+		}
+	}
+
+	for i, o := range ops {
+		op, ok := o.(map[string]interface{})
+		if !ok {
+			results[i] = map[string]interface{}{"error": "syntax error", "details": "operation is not an object"}
+			return results
+		}
+		op = resolveNamedUUIDs(op, named).(map[string]interface{})
+
+		result, opErr := s.doOp(tables, op, named)
+		if opErr != nil {
+			results[i] = map[string]interface{}{"error": opErr.err, "details": opErr.details}
+			return results
+		}
+		results[i] = result
+	}
+
+	if opErr := s.commit(tables); opErr != nil {
+		results = append(results, map[string]interface{}{"error": opErr.err, "details": opErr.details})
+		return results
+	}
+	s.tables = tables
+	return results
+}
+
+func (s *FakeOVSDBServer) doOp(tables map[string]map[string]fakeRow, op map[string]interface{}, named map[string]string) (map[string]interface{}, *fakeOpError) {
+	opName, _ := op["op"].(string)
+	if opName == "comment" {
+		return map[string]interface{}{}, nil
+	}
+
+	tableName, _ := op["table"].(string)
+	table, ok := tables[tableName]
+	if !ok {
+		return nil, fakeErrorf("unknown table", "no table named %q", tableName)
+	}
+
+	switch opName {
+	case "insert":
+		var uuid string
+		if name, ok := op["uuid-name"].(string); ok {
+			uuid = named[name]
+		} else {
+			uuid = s.newUUID()
+		}
+		row := fakeRow{"_uuid": []interface{}{"uuid", uuid}}
+		for col := range fakeOVSDBSchema[tableName].refs {
+			row[col] = ovsdbproto.Set()
+		}
+		if values, ok := op["row"].(map[string]interface{}); ok {
+			for col, val := range values {
+				row[col] = val
+			}
+		}
+		table[uuid] = row
+		return map[string]interface{}{"uuid": []interface{}{"uuid", uuid}}, nil
+
+	case "select":
+		rows, opErr := matchRows(table, op["where"])
+		if opErr != nil {
+			return nil, opErr
+		}
+		columns, _ := op["columns"].([]interface{})
+		out := []interface{}{}
+		for _, row := range rows {
+			if columns == nil {
+				out = append(out, copyValue(map[string]interface{}(row)))
+				continue
+			}
+			selected := map[string]interface{}{}
+			for _, col := range columns {
+				if name, ok := col.(string); ok {
+					if val, ok := row[name]; ok {
+						selected[name] = copyValue(val)
+					}
+				}
+			}
+			out = append(out, selected)
+		}
+		return map[string]interface{}{"rows": out}, nil
+
+	case "update":
+		rows, opErr := matchRows(table, op["where"])
+		if opErr != nil {
+			return nil, opErr
+		}
+		values, _ := op["row"].(map[string]interface{})
+		for _, row := range rows {
+			for col, val := range values {
+				row[col] = copyValue(val)
+			}
+		}
+		return map[string]interface{}{"count": len(rows)}, nil
+
+	case "mutate":
+		rows, opErr := matchRows(table, op["where"])
+		if opErr != nil {
+			return nil, opErr
+		}
+		mutations, _ := op["mutations"].([]interface{})
+		for _, row := range rows {
+			for _, m := range mutations {
+				if opErr := applyMutation(row, m); opErr != nil {
+					return nil, opErr
+				}
+			}
+		}
+		return map[string]interface{}{"count": len(rows)}, nil
+
+	case "delete":
+		rows, opErr := matchRows(table, op["where"])
+		if opErr != nil {
+			return nil, opErr
+		}
+		for _, row := range rows {
+			delete(table, uuidOf(row["_uuid"]))
+		}
+		return map[string]interface{}{"count": len(rows)}, nil
+	}
+
+	return nil, fakeErrorf("unknown operation", "operation %q is not supported", opName)
+}
+
+// commit garbage-collects unreferenced rows, checks referential integrity
+// and indexes, and then simulates ovs-vswitchd applying the configuration.
+func (s *FakeOVSDBServer) commit(tables map[string]map[string]fakeRow) *fakeOpError {
+	reachable := make(map[string]bool)
+	var mark func(tableName, uuid string)
+	mark = func(tableName, uuid string) {
+		if reachable[uuid] {
+			return
+		}
+		reachable[uuid] = true
+		row := tables[tableName][uuid]
+		for col, refTable := range fakeOVSDBSchema[tableName].refs {
+			for _, ref := range ovsdbproto.SetElements(row[col]) {
+				mark(refTable, uuidOf(ref))
+			}
+		}
+	}
+	for tableName, schema := range fakeOVSDBSchema {
+		if schema.root {
+			for uuid := range tables[tableName] {
+				mark(tableName, uuid)
+			}
+		}
+	}
+	for tableName, schema := range fakeOVSDBSchema {
+		if !schema.root {
+			for uuid := range tables[tableName] {
+				if !reachable[uuid] {
+					delete(tables[tableName], uuid)
+				}
+			}
+		}
+	}
+
+	for tableName, schema := range fakeOVSDBSchema {
+		names := make(map[string]bool)
+		for _, row := range tables[tableName] {
+			for col, refTable := range schema.refs {
+				for _, ref := range ovsdbproto.SetElements(row[col]) {
+					if _, ok := tables[refTable][uuidOf(ref)]; !ok {
+						return fakeErrorf("referential integrity violation", "%s column %q refers to nonexistent %s row %s", tableName, col, refTable, uuidOf(ref))
+					}
+				}
+			}
+			if schema.indexed {
+				name, _ := row["name"].(string)
+				if names[name] {
+					return fakeErrorf("constraint violation", "transaction causes multiple rows in %q table to have identical values (%q) for index on column \"name\"", tableName, name)
+				}
+				names[name] = true
+			}
+		}
+	}
+
+	// Fake ovs-vswitchd: assign OpenFlow port numbers and acknowledge the
+	// new configuration.
+	used := make(map[int]bool)
+	for _, iface := range tables["Interface"] {
+		if ofport, ok := iface["ofport"].(float64); ok {
+			used[int(ofport)] = true
+		}
+	}
+	bridges := make(map[interface{}]bool)
+	for _, br := range tables["Bridge"] {
+		bridges[br["name"]] = true
+	}
+	for _, iface := range tables["Interface"] {
+		if _, ok := iface["ofport"]; ok {
+			continue
+		}
+		if bridges[iface["name"]] {
+			// OFPP_LOCAL
+			iface["ofport"] = float64(65534)
+			continue
+		}
+		if req, ok := iface["ofport_request"].(float64); ok && !used[int(req)] {
+			iface["ofport"] = req
+			used[int(req)] = true
+			continue
+		}
+		ofport := 1
+		for used[ofport] {
+			ofport++
+		}
+		iface["ofport"] = float64(ofport)
+		used[ofport] = true
+	}
+	for _, ovs := range tables["Open_vSwitch"] {
+		ovs["cur_cfg"] = ovs["next_cfg"]
+	}
+	return nil
+}
+
+func matchRows(table map[string]fakeRow, w interface{}) ([]fakeRow, *fakeOpError) {
+	conds, ok := w.([]interface{})
+	if !ok {
+		return nil, fakeErrorf("syntax error", "missing or invalid \"where\"")
+	}
+
+	uuids := make([]string, 0, len(table))
+	for uuid := range table {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	rows := []fakeRow{}
+	for _, uuid := range uuids {
+		row := table[uuid]
+		matched := true
+		for _, c := range conds {
+			cond, ok := c.([]interface{})
+			if !ok || len(cond) != 3 {
+				return nil, fakeErrorf("syntax error", "invalid condition %v", c)
+			}
+			column, _ := cond[0].(string)
+			function, _ := cond[1].(string)
+			have := normalizeDatum(row[column])
+			want := normalizeDatum(cond[2])
+			switch function {
+			case "==":
+				matched = reflect.DeepEqual(have, want)
+			case "!=":
+				matched = !reflect.DeepEqual(have, want)
+			case "includes":
+				matched = includesAll(have, want)
+			case "excludes":
+				matched = excludesAll(have, want)
+			default:
+				return nil, fakeErrorf("syntax error", "unsupported condition function %q", function)
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func applyMutation(row fakeRow, m interface{}) *fakeOpError {
+	mut, ok := m.([]interface{})
+	if !ok || len(mut) != 3 {
+		return fakeErrorf("syntax error", "invalid mutation %v", m)
+	}
+	column, _ := mut[0].(string)
+	mutator, _ := mut[1].(string)
+	arg := mut[2]
+
+	switch mutator {
+	case "+=", "-=":
+		cur, _ := row[column].(float64)
+		delta, ok := arg.(float64)
+		if !ok {
+			return fakeErrorf("domain error", "non-integer argument to %s", mutator)
+		}
+		if mutator == "+=" {
+			row[column] = cur + delta
+		} else {
+			row[column] = cur - delta
+		}
+
+	case "insert", "delete":
+		if isMap(arg) {
+			cur := mapPairs(row[column])
+			for _, pair := range mapPairs(arg) {
+				key := pair.([]interface{})[0]
+				found := -1
+				for i, p := range cur {
+					if reflect.DeepEqual(p.([]interface{})[0], key) {
+						found = i
+						break
+					}
+				}
+				if mutator == "insert" && found == -1 {
+					cur = append(cur, pair)
+				} else if mutator == "delete" && found != -1 {
+					cur = append(cur[:found], cur[found+1:]...)
+				}
+			}
+			row[column] = []interface{}{"map", cur}
+			break
+		}
+
+		cur := ovsdbproto.SetElements(row[column])
+		for _, elem := range ovsdbproto.SetElements(arg) {
+			found := -1
+			for i, e := range cur {
+				if reflect.DeepEqual(e, elem) {
+					found = i
+					break
+				}
+			}
+			if mutator == "insert" && found == -1 {
+				cur = append(cur, elem)
+			} else if mutator == "delete" && found != -1 {
+				cur = append(cur[:found], cur[found+1:]...)
+			}
+		}
+		row[column] = ovsdbproto.Set(cur...)
+
+	default:
+		return fakeErrorf("syntax error", "unsupported mutator %q", mutator)
+	}
+	return nil
+}
+
+func isMap(value interface{}) bool {
+	arr, ok := value.([]interface{})
+	return ok && len(arr) == 2 && arr[0] == "map"
+}
+
+func mapPairs(value interface{}) []interface{} {
+	if isMap(value) {
+		pairs, _ := value.([]interface{})[1].([]interface{})
+		return append([]interface{}{}, pairs...)
+	}
+	return []interface{}{}
+}
+
+// normalizeDatum converts a datum to a canonical form for comparison: sets
+// become sorted slices of atoms (so a 1-element set equals the bare atom).
+func normalizeDatum(value interface{}) interface{} {
+	if isMap(value) {
+		return value
+	}
+	elems := ovsdbproto.SetElements(value)
+	if len(elems) == 1 {
+		return elems[0]
+	}
+	sorted := append(datumsByJSON{}, elems...)
+	sort.Sort(sorted)
+	return []interface{}(sorted)
+}
+
+type datumsByJSON []interface{}
+
+func (d datumsByJSON) Len() int      { return len(d) }
+func (d datumsByJSON) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d datumsByJSON) Less(i, j int) bool {
+	a, _ := json.Marshal(d[i])
+	b, _ := json.Marshal(d[j])
+	return string(a) < string(b)
+}
+
+func asElements(value interface{}) []interface{} {
+	if elems, ok := value.([]interface{}); ok && !(len(elems) == 2 && (elems[0] == "uuid" || elems[0] == "named-uuid")) {
+		return elems
+	}
+	return []interface{}{value}
+}
+
+func includesAll(have, want interface{}) bool {
+	haveElems := asElements(have)
+	for _, w := range asElements(want) {
+		found := false
+		for _, h := range haveElems {
+			if reflect.DeepEqual(h, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func excludesAll(have, want interface{}) bool {
+	haveElems := asElements(have)
+	for _, w := range asElements(want) {
+		for _, h := range haveElems {
+			if reflect.DeepEqual(h, w) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// uuidOf returns the UUID string from a ["uuid", "..."] atom
+func uuidOf(value interface{}) string {
+	if pair, ok := value.([]interface{}); ok && len(pair) == 2 && pair[0] == "uuid" {
+		s, _ := pair[1].(string)
+		return s
+	}
+	return ""
+}
+
+func resolveNamedUUIDs(value interface{}, named map[string]string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			out[k] = resolveNamedUUIDs(elem, named)
+		}
+		return out
+	case []interface{}:
+		if len(v) == 2 && v[0] == "named-uuid" {
+			if name, ok := v[1].(string); ok {
+				if uuid, ok := named[name]; ok {
+					return []interface{}{"uuid", uuid}
+				}
+			}
+		}
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = resolveNamedUUIDs(elem, named)
+		}
+		return out
+	}
+	return value
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]map[string]fakeRow:
+		out := make(map[string]map[string]fakeRow, len(v))
+		for k, table := range v {
+			out[k] = make(map[string]fakeRow, len(table))
+			for uuid, row := range table {
+				out[k][uuid] = fakeRow(copyValue(map[string]interface{}(row)).(map[string]interface{}))
+			}
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			out[k] = copyValue(elem)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = copyValue(elem)
+		}
+		return out
+	}
+	return value
+}
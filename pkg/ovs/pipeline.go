@@ -0,0 +1,257 @@
+package ovs
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pipeline describes an OpenFlow pipeline as data: its tables, the static flows
+// that are installed when the bridge is set up, and templates for the flows
+// that are added and removed later for particular objects (such as pods).
+//
+// Flow templates use the syntax accepted by "ovs-ofctl add-flow", with ${name}
+// placeholders that are filled in from a PipelineVars when the flows are
+// rendered. If a variable has several values, the template is rendered once
+// for each of them (and if it has none, the template is not rendered at all).
+// A match field whose value is empty after substitution is left out.
+type Pipeline struct {
+	Tables []PipelineTable
+}
+
+// PipelineTable is a table of a Pipeline
+type PipelineTable struct {
+	Number  int
+	Name    string
+	Purpose string
+	// Standalone tables are not used for packet processing (eg, a table
+	// that only holds a note), and so are not expected to be reachable or to
+	// have a default flow
+	Standalone bool
+	Flows      []FlowTemplate
+}
+
+// FlowTemplate is a template for flows in a PipelineTable
+type FlowTemplate struct {
+	// Kind is "" for static flows, and otherwise names the kind of object
+	// (eg, "pod") that the flow is rendered for
+	Kind     string
+	Priority int
+	Match    string
+	Actions  string
+}
+
+// PipelineVars holds the values of the variables used in flow templates
+type PipelineVars map[string][]string
+
+var (
+	pipelineVarRE  = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+	pipelineGotoRE = regexp.MustCompile(`(goto_table:|resubmit\(,)([0-9]+)`)
+)
+
+// Table returns the table with the given number, or nil
+func (p *Pipeline) Table(number int) *PipelineTable {
+	for i := range p.Tables {
+		if p.Tables[i].Number == number {
+			return &p.Tables[i]
+		}
+	}
+	return nil
+}
+
+// Render returns the flows of the given kind ("" for the static flows), with
+// the given cookie
+func (p *Pipeline) Render(kind string, cookie uint64, vars PipelineVars) ([]*Flow, error) {
+	var flows []*Flow
+	for _, table := range p.Tables {
+		for _, tmpl := range table.Flows {
+			if tmpl.Kind != kind {
+				continue
+			}
+			rendered, err := tmpl.render(table.Number, cookie, vars)
+			if err != nil {
+				return nil, err
+			}
+			flows = append(flows, rendered...)
+		}
+	}
+	return flows, nil
+}
+
+func (tmpl *FlowTemplate) String() string {
+	if tmpl.Match == "" {
+		return fmt.Sprintf("priority=%d, actions=%s", tmpl.Priority, tmpl.Actions)
+	}
+	return fmt.Sprintf("priority=%d, %s, actions=%s", tmpl.Priority, tmpl.Match, tmpl.Actions)
+}
+
+// render returns the flows that tmpl expands to
+func (tmpl *FlowTemplate) render(table int, cookie uint64, vars PipelineVars) ([]*Flow, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range pipelineVarRE.FindAllStringSubmatch(tmpl.Match+" "+tmpl.Actions, -1) {
+		if !seen[m[1]] {
+			if _, ok := vars[m[1]]; !ok {
+				return nil, fmt.Errorf("undefined variable %q in flow template %q", m[1], tmpl.String())
+			}
+			names = append(names, m[1])
+			seen[m[1]] = true
+		}
+	}
+
+	var flows []*Flow
+	binding := make(map[string]string)
+	var expand func(i int) error
+	expand = func(i int) error {
+		if i < len(names) {
+			for _, value := range vars[names[i]] {
+				binding[names[i]] = value
+				if err := expand(i + 1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		substitute := func(s string) string {
+			return pipelineVarRE.ReplaceAllStringFunc(s, func(v string) string {
+				return binding[v[2:len(v)-1]]
+			})
+		}
+		parts := []string{fmt.Sprintf("table=%d", table), fmt.Sprintf("priority=%d", tmpl.Priority)}
+		for _, field := range strings.Split(substitute(tmpl.Match), ",") {
+			field = strings.TrimSpace(field)
+			if field != "" && !strings.HasSuffix(field, "=") {
+				parts = append(parts, field)
+			}
+		}
+		flow, err := ParseFlow(strings.Join(parts, ", ") + ", actions=" + substitute(tmpl.Actions))
+		if err != nil {
+			return fmt.Errorf("bad flow template %q: %v", tmpl.String(), err)
+		}
+		flow.Cookie = cookie
+		flows = append(flows, flow)
+		return nil
+	}
+	if err := expand(0); err != nil {
+		return nil, err
+	}
+	return flows, nil
+}
+
+// targets returns the tables that tmpl's flows can send packets on to, and
+// whether they do so with goto_table (rather than resubmit)
+func (tmpl *FlowTemplate) targets() ([]int, []bool) {
+	var tables []int
+	var isGoto []bool
+	for _, m := range pipelineGotoRE.FindAllStringSubmatch(tmpl.Actions, -1) {
+		table, _ := strconv.Atoi(m[2])
+		tables = append(tables, table)
+		isGoto = append(isGoto, m[1] == "goto_table:")
+	}
+	return tables, isGoto
+}
+
+// Validate checks that the pipeline's tables are unique, that its flow
+// templates are valid, and that they only send packets on to tables that are
+// part of the pipeline. (It does not check for unreachable tables or tables
+// without default flows.)
+func (p *Pipeline) Validate() error {
+	numbers := make(map[int]bool)
+	for _, table := range p.Tables {
+		if numbers[table.Number] {
+			return fmt.Errorf("duplicate table %d", table.Number)
+		}
+		numbers[table.Number] = true
+	}
+
+	for _, table := range p.Tables {
+		for _, tmpl := range table.Flows {
+			// Fill in every variable with a placeholder value, to check the
+			// syntax of the rest of the template. ("ip" is used because it
+			// is also valid for variables that give the protocol.)
+			vars := PipelineVars{}
+			for _, m := range pipelineVarRE.FindAllStringSubmatch(tmpl.Match+" "+tmpl.Actions, -1) {
+				vars[m[1]] = []string{"ip"}
+			}
+			flows, err := tmpl.render(table.Number, 0, vars)
+			if err != nil {
+				return fmt.Errorf("table %d (%s): %v", table.Number, table.Name, err)
+			}
+			if err := flows[0].Validate(); err != nil {
+				return fmt.Errorf("table %d (%s): %v", table.Number, table.Name, err)
+			}
+			targets, isGoto := tmpl.targets()
+			for i, target := range targets {
+				if !numbers[target] {
+					return fmt.Errorf("table %d (%s): flow template %q goes to undefined table %d", table.Number, table.Name, tmpl.String(), target)
+				}
+				// OpenFlow only allows goto_table to later tables
+				if isGoto[i] && target <= table.Number {
+					return fmt.Errorf("table %d (%s): flow template %q goes back to table %d", table.Number, table.Name, tmpl.String(), target)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// UnreachableTables returns the numbers of the tables (other than standalone
+// tables) that no flow template, static or dynamic, sends packets to from
+// table 0, where packets enter the pipeline
+func (p *Pipeline) UnreachableTables() []int {
+	reached := map[int]bool{0: true}
+	queue := []int{0}
+	for len(queue) > 0 {
+		table := p.Table(queue[0])
+		queue = queue[1:]
+		if table == nil {
+			continue
+		}
+		for _, tmpl := range table.Flows {
+			targets, _ := tmpl.targets()
+			for _, target := range targets {
+				if !reached[target] {
+					reached[target] = true
+					queue = append(queue, target)
+				}
+			}
+		}
+	}
+
+	var unreachable []int
+	for _, table := range p.Tables {
+		if !table.Standalone && !reached[table.Number] {
+			unreachable = append(unreachable, table.Number)
+		}
+	}
+	sort.Ints(unreachable)
+	return unreachable
+}
+
+// TablesWithoutDefaultFlow returns the numbers of the tables (other than
+// standalone tables) that have no static priority 0 flow matching every packet,
+// and so leave it to OVS to decide what happens to packets that don't match any
+// of their other flows
+func (p *Pipeline) TablesWithoutDefaultFlow() []int {
+	var missing []int
+	for _, table := range p.Tables {
+		if table.Standalone {
+			continue
+		}
+		found := false
+		for _, tmpl := range table.Flows {
+			if tmpl.Kind == "" && tmpl.Priority == 0 && strings.TrimSpace(tmpl.Match) == "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, table.Number)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
@@ -0,0 +1,210 @@
+package ovs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestPipeline() *Pipeline {
+	return &Pipeline{
+		Tables: []PipelineTable{
+			{
+				Number: 0, Name: "classifier",
+				Flows: []FlowTemplate{
+					{Priority: 200, Match: "in_port=1, ip, nw_src=${cluster_network}", Actions: "goto_table:1"},
+					{Priority: 100, Match: "ip", Actions: "goto_table:2"},
+					{Priority: 0, Actions: "drop"},
+				},
+			},
+			{
+				Number: 1, Name: "vxlan",
+				Flows: []FlowTemplate{
+					{Kind: "node", Priority: 100, Match: "tun_src=${node_ip}", Actions: "goto_table:2"},
+					{Priority: 0, Actions: "drop"},
+				},
+			},
+			{
+				Number: 2, Name: "local",
+				Flows: []FlowTemplate{
+					{Kind: "pod", Priority: 100, Match: "reg0=${vnid}, ip, nw_dst=${pod_ip}", Actions: "output:${ofport}"},
+					{Priority: 0, Actions: "drop"},
+				},
+			},
+			{
+				Number: 253, Name: "version", Standalone: true,
+				Flows: []FlowTemplate{
+					{Kind: "version", Priority: 0, Actions: "note:${version}"},
+				},
+			},
+		},
+	}
+}
+
+func TestPipelineRender(t *testing.T) {
+	p := newTestPipeline()
+	if err := p.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+
+	tests := []struct {
+		kind     string
+		vars     PipelineVars
+		expected []string
+	}{
+		{
+			kind: "",
+			vars: PipelineVars{"cluster_network": {"10.1.0.0/16", "10.2.0.0/16"}},
+			expected: []string{
+				"table=0, priority=200, cookie=0x10, in_port=1, ip, nw_src=10.1.0.0/16, actions=goto_table:1",
+				"table=0, priority=200, cookie=0x10, in_port=1, ip, nw_src=10.2.0.0/16, actions=goto_table:1",
+				"table=0, priority=100, cookie=0x10, ip, actions=goto_table:2",
+				"table=0, priority=0, cookie=0x10, actions=drop",
+				"table=1, priority=0, cookie=0x10, actions=drop",
+				"table=2, priority=0, cookie=0x10, actions=drop",
+			},
+		},
+		{
+			kind: "",
+			vars: PipelineVars{"cluster_network": {}},
+			expected: []string{
+				"table=0, priority=100, cookie=0x10, ip, actions=goto_table:2",
+				"table=0, priority=0, cookie=0x10, actions=drop",
+				"table=1, priority=0, cookie=0x10, actions=drop",
+				"table=2, priority=0, cookie=0x10, actions=drop",
+			},
+		},
+		{
+			kind: "pod",
+			vars: PipelineVars{"vnid": {"0", "12"}, "pod_ip": {"10.1.2.3"}, "ofport": {"5"}},
+			expected: []string{
+				"table=2, priority=100, cookie=0x10, reg0=0, ip, nw_dst=10.1.2.3, actions=output:5",
+				"table=2, priority=100, cookie=0x10, reg0=12, ip, nw_dst=10.1.2.3, actions=output:5",
+			},
+		},
+		{
+			// Empty match fields are left out
+			kind: "pod",
+			vars: PipelineVars{"vnid": {""}, "pod_ip": {"10.1.2.3"}, "ofport": {"5"}},
+			expected: []string{
+				"table=2, priority=100, cookie=0x10, ip, nw_dst=10.1.2.3, actions=output:5",
+			},
+		},
+		{
+			kind: "version",
+			vars: PipelineVars{"version": {"01.02"}},
+			expected: []string{
+				"table=253, priority=0, cookie=0x10, actions=note:01.02",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		flows, err := p.Render(test.kind, 0x10, test.vars)
+		if err != nil {
+			t.Fatalf("(%d) unexpected error rendering flows: %v", i, err)
+		}
+		strs := []string{}
+		for _, flow := range flows {
+			strs = append(strs, flow.String())
+		}
+		if !reflect.DeepEqual(strs, test.expected) {
+			t.Fatalf("(%d) wrong flows:\nexpected %s\ngot      %s", i, strings.Join(test.expected, "\n         "), strings.Join(strs, "\n         "))
+		}
+	}
+
+	if _, err := p.Render("pod", 0, PipelineVars{"vnid": {"0"}, "ofport": {"5"}}); err == nil || !strings.Contains(err.Error(), "pod_ip") {
+		t.Fatalf("Expected error about undefined variable, got %v", err)
+	}
+}
+
+func TestPipelineValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		tmpl  FlowTemplate
+		table int
+		err   string
+	}{
+		{
+			name:  "undefined table",
+			tmpl:  FlowTemplate{Priority: 100, Actions: "goto_table:7"},
+			table: 1,
+			err:   "undefined table 7",
+		},
+		{
+			name:  "backwards goto_table",
+			tmpl:  FlowTemplate{Priority: 100, Actions: "goto_table:1"},
+			table: 2,
+			err:   "goes back to table 1",
+		},
+		{
+			name:  "unknown action",
+			tmpl:  FlowTemplate{Priority: 100, Match: "ip", Actions: "frobnicate:${x}"},
+			table: 2,
+			err:   "unknown action",
+		},
+		{
+			name:  "unknown match field",
+			tmpl:  FlowTemplate{Kind: "pod", Priority: 100, Match: "ip, color=${x}", Actions: "drop"},
+			table: 2,
+			err:   "unknown match field",
+		},
+	}
+
+	for _, test := range tests {
+		p := newTestPipeline()
+		table := p.Table(test.table)
+		table.Flows = append(table.Flows, test.tmpl)
+		if err := p.Validate(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("(%s) expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	p := newTestPipeline()
+	p.Tables = append(p.Tables, PipelineTable{Number: 2, Name: "duplicate"})
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "duplicate table 2") {
+		t.Fatalf("Expected duplicate table error, got %v", err)
+	}
+
+	// Resubmitting to an earlier table is allowed
+	p = newTestPipeline()
+	table := p.Table(2)
+	table.Flows = append(table.Flows, FlowTemplate{Priority: 50, Match: "arp", Actions: "resubmit(,1)"})
+	if err := p.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+}
+
+func TestPipelineChecks(t *testing.T) {
+	p := newTestPipeline()
+	if unreachable := p.UnreachableTables(); len(unreachable) != 0 {
+		t.Fatalf("Unexpected unreachable tables %v", unreachable)
+	}
+	if missing := p.TablesWithoutDefaultFlow(); len(missing) != 0 {
+		t.Fatalf("Unexpected tables without default flows %v", missing)
+	}
+
+	// Table 1 is only reachable via table 0's first flow; table 3 is only
+	// reachable from table 1
+	p.Tables = append(p.Tables, PipelineTable{
+		Number: 3, Name: "unreachable",
+		Flows: []FlowTemplate{
+			{Priority: 100, Match: "ip", Actions: "output:2"},
+		},
+	})
+	p.Table(1).Flows = append(p.Table(1).Flows, FlowTemplate{Kind: "node", Priority: 50, Match: "tun_src=${node_ip}", Actions: "goto_table:3"})
+	if unreachable := p.UnreachableTables(); len(unreachable) != 0 {
+		t.Fatalf("Unexpected unreachable tables %v", unreachable)
+	}
+	p.Table(0).Flows = p.Table(0).Flows[1:]
+	if unreachable := p.UnreachableTables(); !reflect.DeepEqual(unreachable, []int{1, 3}) {
+		t.Fatalf("Expected tables [1 3] to be unreachable, got %v", unreachable)
+	}
+
+	// Dynamic flows and flows with matches don't count as default flows
+	p.Table(2).Flows = p.Table(2).Flows[:1]
+	p.Table(2).Flows = append(p.Table(2).Flows, FlowTemplate{Kind: "pod", Priority: 0, Actions: "drop"})
+	if missing := p.TablesWithoutDefaultFlow(); !reflect.DeepEqual(missing, []int{2, 3}) {
+		t.Fatalf("Expected tables [2 3] to be missing default flows, got %v", missing)
+	}
+}
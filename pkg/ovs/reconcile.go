@@ -0,0 +1,183 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// SyncFlows makes the bridge's flow table match desired, by comparing it
+// against the bridge's current flows and queueing only the changes that are
+// needed: flows that are missing or whose actions or cookie differ are
+// (re-)added, and flows that are not in desired are deleted. Existing flows
+// for which keep returns true are left alone even if they are not in desired;
+// this lets the caller preserve flows that are managed elsewhere. (keep may be
+// nil.)
+//
+// Like the other flow operations, the changes are not applied until
+// EndTransaction(), and if the bridge supports bundles they are applied
+// atomically, so traffic matching flows that have not changed is never
+// interrupted. Rollback() will restore the flows that were replaced or
+// deleted, and delete the ones that were added.
+func (tx *Transaction) SyncFlows(desired []*Flow, keep func(*Flow) bool) {
+	if tx.err != nil {
+		return
+	}
+	for _, flow := range desired {
+		if tx.err = flow.Validate(); tx.err != nil {
+			return
+		}
+	}
+
+	existing, err := tx.ListFlows()
+	if err != nil {
+		return
+	}
+
+	add, del := diffFlows(existing, desired, keep)
+	glog.V(5).Infof("Syncing flows on %s: %d to add, %d to delete", tx.bridge, len(add), len(del))
+	current := make(map[string]*Flow, len(existing))
+	for _, flow := range existing {
+		current[flowKey(flow)] = flow
+	}
+	for _, flow := range del {
+		tx.queueFlowMod("delete_strict "+flow.strictMatchString(), "add "+flow.String())
+	}
+	for _, flow := range add {
+		inverse := "delete_strict " + flow.strictMatchString()
+		if old, ok := current[flowKey(flow)]; ok {
+			inverse = "add " + old.String()
+		}
+		tx.queueFlowMod("add "+flow.String(), inverse)
+	}
+}
+
+// diffFlows returns the flows in desired that need to be added to existing
+// and the flows in existing that need to be deleted, so that existing will
+// end up matching desired (ignoring flows that keep returns true for).
+func diffFlows(existing, desired []*Flow, keep func(*Flow) bool) (add, del []*Flow) {
+	current := make(map[string]*Flow, len(existing))
+	for _, flow := range existing {
+		current[flowKey(flow)] = flow
+	}
+
+	wanted := make(map[string]bool, len(desired))
+	for _, flow := range desired {
+		key := flowKey(flow)
+		wanted[key] = true
+		if old, ok := current[key]; ok && old.Cookie == flow.Cookie && actionsKey(old) == actionsKey(flow) {
+			continue
+		}
+		add = append(add, flow)
+	}
+
+	for _, flow := range existing {
+		if wanted[flowKey(flow)] || (keep != nil && keep(flow)) {
+			continue
+		}
+		del = append(del, flow)
+	}
+	return add, del
+}
+
+// strictMatchString returns the table, priority, and match fields of the flow,
+// in the syntax accepted by "ovs-ofctl del-flows --strict".
+func (f *Flow) strictMatchString() string {
+	parts := []string{fmt.Sprintf("table=%d", f.Table), fmt.Sprintf("priority=%d", f.Priority)}
+	for _, m := range f.Match {
+		parts = append(parts, m.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// flowKey returns a string identifying the flow's table, priority, and match,
+// normalized so that a flow as passed to AddFlows() has the same key as the
+// same flow as returned by ListFlows(). (OpenFlow allows only a single flow
+// with any given key.)
+func flowKey(f *Flow) string {
+	arp := false
+	for _, m := range f.Match {
+		if m.Value == "" && (m.Name == string(ProtocolARP) || m.Name == "rarp") {
+			arp = true
+		}
+	}
+
+	fields := make([]string, 0, len(f.Match))
+	for _, m := range f.Match {
+		name := m.Name
+		if alias, ok := matchAliases[name]; ok {
+			name = alias
+		}
+		if arp {
+			if alias, ok := arpMatchAliases[name]; ok {
+				name = alias
+			}
+		}
+		fields = append(fields, MatchField{Name: name, Value: normalizeValue(m.Value)}.String())
+	}
+	sort.Strings(fields)
+	return fmt.Sprintf("table=%d, priority=%d, %s", f.Table, f.Priority, strings.Join(fields, ", "))
+}
+
+// Match fields that ovs-ofctl prints under a different name than the one we
+// might have used when adding the flow
+var (
+	matchAliases = map[string]string{
+		"eth_src":  "dl_src",
+		"eth_dst":  "dl_dst",
+		"eth_type": "dl_type",
+		"ip_src":   "nw_src",
+		"ip_dst":   "nw_dst",
+		"ip_proto": "nw_proto",
+	}
+	arpMatchAliases = map[string]string{
+		"nw_src": "arp_spa",
+		"nw_dst": "arp_tpa",
+	}
+)
+
+// actionsKey returns the flow's actions, normalized like flowKey()
+func actionsKey(f *Flow) string {
+	actions := make([]string, 0, len(f.Actions))
+	for _, a := range f.Actions {
+		switch a.Name {
+		case "load":
+			if arrow := strings.Index(a.Arg, "->"); arrow != -1 {
+				a.Arg = normalizeValue(a.Arg[:arrow]) + a.Arg[arrow:]
+			}
+		case "note":
+			// dump-flows pads notes with 0s
+			a.Arg = strings.ToLower(a.Arg)
+			for strings.HasSuffix(a.Arg, ".00") {
+				a.Arg = strings.TrimSuffix(a.Arg, ".00")
+			}
+		}
+		actions = append(actions, a.String())
+	}
+	if len(actions) == 0 {
+		actions = []string{"drop"}
+	}
+	return strings.Join(actions, ",")
+}
+
+// normalizeValue converts numeric values to decimal and CIDRs to the form
+// that ovs-ofctl prints them in.
+func normalizeValue(value string) string {
+	if value == "" {
+		return value
+	}
+	if n, err := strconv.ParseUint(value, 0, 64); err == nil {
+		return strconv.FormatUint(n, 10)
+	}
+	if _, ipnet, err := net.ParseCIDR(value); err == nil {
+		if ones, bits := ipnet.Mask.Size(); ones == bits {
+			return ipnet.IP.String()
+		}
+		return ipnet.String()
+	}
+	return value
+}
@@ -0,0 +1,145 @@
+package ovs
+
+import (
+	"fmt"
+	"testing"
+)
+
+const syncDump = `OFPST_FLOW reply (OF1.3) (xid=0x2):
+ cookie=0x0, duration=20.1s, table=0, n_packets=0, n_bytes=0, priority=200,arp,in_port=1,arp_spa=10.1.0.0/16,arp_tpa=10.1.2.0/24 actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1
+ cookie=0x0, duration=20.1s, table=0, n_packets=0, n_bytes=0, priority=0 actions=drop
+ cookie=0x0, duration=20.1s, table=2, n_packets=0, n_bytes=0, priority=100,ip,in_port=5,nw_src=10.1.2.3 actions=load:0xc->NXM_NX_REG0[],goto_table:3
+ cookie=0x0, duration=20.1s, table=3, n_packets=0, n_bytes=0, priority=100,ip,nw_dst=172.30.0.0/16 actions=goto_table:5
+ cookie=0x0, duration=20.1s, table=3, n_packets=0, n_bytes=0, priority=50,ip actions=drop
+ cookie=0x0, duration=20.1s, table=253, n_packets=0, n_bytes=0, actions=note:01.01.00.00.00.00
+`
+
+func syncDesired() []*Flow {
+	return []*Flow{
+		NewFlow(0, 200).InPort(1).Protocol(ProtocolARP).NwSrc("10.1.0.0/16").NwDst("10.1.2.1/24").Do(Move(FieldTunID, FieldReg0), GotoTable(1)),
+		NewFlow(0, 0).Do(Drop()),
+		NewFlow(2, 100).InPort(5).Protocol(ProtocolIP).NwSrc("10.1.2.3/32").Do(Load(12, FieldReg0), GotoTable(3)),
+		NewFlow(3, 100).Protocol(ProtocolIP).NwDst("172.30.0.0/16").Do(GotoTable(4)),
+		NewFlow(3, 0).Do(GotoTable(5)),
+		NewFlow(253, DefaultPriority).Do(Note(0x01, 0x01)),
+	}
+}
+
+func TestDiffFlows(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", syncDump, nil)
+	otx := NewTransaction(fexec, "br0")
+	existing, err := otx.ListFlows()
+	otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	add, del := diffFlows(existing, syncDesired(), nil)
+	if len(add) != 2 || add[0].String() != "table=3, priority=100, ip, nw_dst=172.30.0.0/16, actions=goto_table:4" || add[1].String() != "table=3, priority=0, actions=goto_table:5" {
+		t.Fatalf("Wrong flows to add: %v", add)
+	}
+	if len(del) != 1 || del[0].strictMatchString() != "table=3, priority=50, ip" {
+		t.Fatalf("Wrong flows to delete: %v", del)
+	}
+
+	// Nothing to do if the flows already match
+	add, del = diffFlows(syncDesired(), syncDesired(), nil)
+	if len(add) != 0 || len(del) != 0 {
+		t.Fatalf("Unexpected changes: %v, %v", add, del)
+	}
+
+	// keep preserves flows that aren't desired
+	add, del = diffFlows(existing, syncDesired()[:1], func(flow *Flow) bool { return flow.Table != 0 })
+	if len(add) != 0 || len(del) != 1 || del[0].strictMatchString() != "table=0, priority=0" {
+		t.Fatalf("Wrong changes with keep: %v, %v", add, del)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestSyncFlows(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", syncDump, nil)
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -",
+		"delete_strict table=3, priority=50, ip\n"+
+			"add table=3, priority=100, ip, nw_dst=172.30.0.0/16, actions=goto_table:4\n"+
+			"add table=3, priority=0, actions=goto_table:5\n", "", nil)
+
+	otx := NewTransaction(fexec, "br0")
+	otx.SyncFlows(syncDesired(), nil)
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Without bundles, the changes are applied one by one
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+
+	fexec = normalSetup()
+	bundlesUnsupported["br0"] = true
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", syncDump, nil)
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 del-flows --strict br0 table=3, priority=50, ip", "", nil)
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 table=3, priority=100, ip, nw_dst=172.30.0.0/16, actions=goto_table:4", "", nil)
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 table=3, priority=0, actions=goto_table:5", "", nil)
+
+	otx = NewTransaction(fexec, "br0")
+	otx.SyncFlows(syncDesired(), nil)
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestSyncFlowsRollback(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", syncDump, nil)
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -",
+		"delete_strict table=3, priority=50, ip\n"+
+			"add table=3, priority=100, ip, nw_dst=172.30.0.0/16, actions=goto_table:4\n"+
+			"add table=3, priority=0, actions=goto_table:5\n", "", nil)
+	fexec.AddResultWithInput("/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -",
+		"delete_strict table=3, priority=0\n"+
+			"add table=3, priority=100, ip, nw_dst=172.30.0.0/16, actions=goto_table:5\n"+
+			"add table=3, priority=50, ip, actions=drop\n", "", nil)
+
+	otx := NewTransaction(fexec, "br0")
+	otx.SyncFlows(syncDesired(), nil)
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := otx.Rollback(); err != nil {
+		t.Fatalf("Unexpected error from Rollback: %v", err)
+	}
+
+	// Without bundles, only the changes that were applied are undone
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+
+	fexec = normalSetup()
+	bundlesUnsupported["br0"] = true
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", syncDump, nil)
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 del-flows --strict br0 table=3, priority=50, ip", "", nil)
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 table=3, priority=100, ip, nw_dst=172.30.0.0/16, actions=goto_table:4", "", fmt.Errorf("Something bad happened"))
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 add-flow br0 table=3, priority=50, ip, actions=drop", "", nil)
+
+	otx = NewTransaction(fexec, "br0")
+	otx.SyncFlows(syncDesired(), nil)
+	if err := otx.EndTransaction(); err == nil {
+		t.Fatalf("Failed to get expected error")
+	}
+	if err := otx.Rollback(); err != nil {
+		t.Fatalf("Unexpected error from Rollback: %v", err)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Simulator is an in-memory model of an OVS bridge's OpenFlow pipeline, for
+// use in tests. It understands the subset of match fields and actions that
+// openshift-sdn uses, and is not a complete OpenFlow implementation.
+type Simulator struct {
+	flows []*Flow
+}
+
+// SimPacket is a packet to be processed by a Simulator. Zero-valued fields
+// are considered to be unset.
+type SimPacket struct {
+	InPort   uint
+	Protocol Protocol // defaults to ProtocolIP
+	Src      string   // source IP (or ARP sender IP)
+	Dst      string   // destination IP (or ARP target IP)
+	ArpSha   string   // ARP sender MAC
+	DstPort  int      // TCP/UDP destination port
+	TunID    uint32
+	TunSrc   string
+	TunDst   string
+	Reg0     uint32
+}
+
+// SimOutput is a packet that was output by the Simulator
+type SimOutput struct {
+	Port uint
+	// Packet is the state of the packet (including the tunnel metadata
+	// and registers) at the time it was output
+	Packet SimPacket
+}
+
+// SimResult is the result of running a packet through a Simulator
+type SimResult struct {
+	// Steps holds the tables visited by the packet, in order, as with
+	// Trace().
+	Steps []TraceStep
+	// Outputs holds the packets that were output
+	Outputs []SimOutput
+}
+
+// Dropped returns true if the packet was not output to any port
+func (r *SimResult) Dropped() bool {
+	return len(r.Outputs) == 0
+}
+
+// OutputTo returns true if the packet was output to port
+func (r *SimResult) OutputTo(port uint) bool {
+	for _, out := range r.Outputs {
+		if out.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+var simMatchFields = map[string]bool{
+	"in_port": true, "nw_src": true, "nw_dst": true, "arp_spa": true, "arp_tpa": true,
+	"arp_sha": true, "tp_dst": true, "tun_id": true, "tun_src": true, "tun_dst": true, "reg0": true,
+}
+
+var simActions = map[string]bool{
+	"goto_table": true, "output": true, "drop": true, "move": true, "load": true,
+	"set_field": true, "note": true,
+}
+
+// NewSimulator returns a new Simulator with no flows. (Like a real bridge in
+// "secure" fail mode, it drops all packets until flows are added.)
+func NewSimulator() *Simulator {
+	return &Simulator{}
+}
+
+// AddFlows adds flows to the simulated bridge, replacing any existing flows
+// with the same table, priority, and match. It is an error if any of the
+// flows fails Validate() or uses a feature the simulator doesn't implement.
+func (s *Simulator) AddFlows(flows ...*Flow) error {
+	for _, flow := range flows {
+		if err := flow.Validate(); err != nil {
+			return err
+		}
+		for _, m := range flow.Match {
+			if m.Value != "" && !simMatchFields[m.Name] {
+				return fmt.Errorf("simulator does not support match field %q in flow %q", m.Name, flow.String())
+			}
+		}
+		for _, a := range flow.Actions {
+			if !simActions[a.Name] {
+				return fmt.Errorf("simulator does not support action %q in flow %q", a.Name, flow.String())
+			}
+		}
+	}
+
+	for _, flow := range flows {
+		key := flowKey(flow)
+		replaced := false
+		for i, old := range s.flows {
+			if flowKey(old) == key {
+				s.flows[i] = flow
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.flows = append(s.flows, flow)
+		}
+	}
+	// Stable, so that among flows with equal priority, the first one
+	// added wins
+	sort.Stable(flowsByPriority(s.flows))
+	return nil
+}
+
+// DeleteFlowsByCookie deletes the flows whose cookies match cookie in the bits
+// selected by mask, like Transaction.DeleteFlowsByCookie().
+func (s *Simulator) DeleteFlowsByCookie(cookie, mask uint64) {
+	flows := s.flows[:0]
+	for _, flow := range s.flows {
+		if flow.Cookie&mask != cookie&mask {
+			flows = append(flows, flow)
+		}
+	}
+	s.flows = flows
+}
+
+// Flows returns the simulator's flows, sorted by table and then priority
+func (s *Simulator) Flows() []*Flow {
+	return append([]*Flow(nil), s.flows...)
+}
+
+type flowsByPriority []*Flow
+
+func (f flowsByPriority) Len() int      { return len(f) }
+func (f flowsByPriority) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f flowsByPriority) Less(i, j int) bool {
+	if f[i].Table != f[j].Table {
+		return f[i].Table < f[j].Table
+	}
+	return f[i].Priority > f[j].Priority
+}
+
+// Run processes a packet through the pipeline, starting at table 0
+func (s *Simulator) Run(packet SimPacket) (*SimResult, error) {
+	if packet.Protocol == "" {
+		packet.Protocol = ProtocolIP
+	}
+	result := &SimResult{}
+
+	table := 0
+	for {
+		step := TraceStep{Table: table, Registers: map[string]uint64{}}
+		if packet.Reg0 != 0 {
+			step.Registers["reg0"] = uint64(packet.Reg0)
+		}
+		for _, flow := range s.flows {
+			if flow.Table == table && simMatches(flow, &packet) {
+				step.Flow = flow
+				break
+			}
+		}
+		result.Steps = append(result.Steps, step)
+		if step.Flow == nil {
+			// Table miss; OpenFlow 1.3 drops the packet
+			return result, nil
+		}
+
+		next := -1
+		for _, action := range step.Flow.Actions {
+			var err error
+			switch action.Name {
+			case "goto_table":
+				next, err = strconv.Atoi(action.Arg)
+				if err == nil && next <= table {
+					err = fmt.Errorf("goto_table must go to a later table")
+				}
+			case "output":
+				var port uint64
+				port, err = strconv.ParseUint(action.Arg, 10, 32)
+				// OVS won't output a packet to the port it came in on
+				if err == nil && uint(port) != packet.InPort {
+					result.Outputs = append(result.Outputs, SimOutput{Port: uint(port), Packet: packet})
+				}
+			case "move":
+				err = simMove(action.Arg, &packet)
+			case "load":
+				err = simLoad(action.Arg, &packet)
+			case "set_field":
+				err = simSetField(action.Arg, &packet)
+			case "drop", "note":
+				// nothing to do
+			}
+			if err != nil {
+				return nil, fmt.Errorf("bad action %q in flow %q: %v", action.String(), step.Flow.String(), err)
+			}
+		}
+		if next == -1 {
+			return result, nil
+		}
+		table = next
+	}
+}
+
+func simMatches(flow *Flow, packet *SimPacket) bool {
+	for _, m := range flow.Match {
+		if m.Value == "" {
+			if !simProtocolMatches(Protocol(m.Name), packet.Protocol) {
+				return false
+			}
+			continue
+		}
+
+		var ok bool
+		switch m.Name {
+		case "in_port":
+			ok = m.Value == strconv.FormatUint(uint64(packet.InPort), 10)
+		case "nw_src", "arp_spa":
+			ok = simAddressMatches(m.Value, packet.Src)
+		case "nw_dst", "arp_tpa":
+			ok = simAddressMatches(m.Value, packet.Dst)
+		case "arp_sha":
+			ok = strings.EqualFold(m.Value, packet.ArpSha)
+		case "tp_dst":
+			ok = m.Value == strconv.Itoa(packet.DstPort)
+		case "tun_src":
+			ok = simAddressMatches(m.Value, packet.TunSrc)
+		case "tun_dst":
+			ok = simAddressMatches(m.Value, packet.TunDst)
+		case "tun_id":
+			ok = simNumberMatches(m.Value, uint64(packet.TunID))
+		case "reg0":
+			ok = simNumberMatches(m.Value, uint64(packet.Reg0))
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func simProtocolMatches(match, proto Protocol) bool {
+	if match == proto {
+		return true
+	}
+	return match == ProtocolIP && (proto == ProtocolTCP || proto == ProtocolUDP || proto == ProtocolICMP)
+}
+
+// simAddressMatches checks if addr matches the IP address or CIDR match
+func simAddressMatches(match, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if strings.Contains(match, "/") {
+		_, ipnet, err := net.ParseCIDR(match)
+		return err == nil && ipnet.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(match))
+}
+
+func simNumberMatches(match string, value uint64) bool {
+	n, err := strconv.ParseUint(match, 0, 64)
+	return err == nil && n == value
+}
+
+func simMove(arg string, packet *SimPacket) error {
+	switch arg {
+	case FieldTunID + "->" + FieldReg0:
+		packet.Reg0 = packet.TunID
+	case FieldReg0 + "->" + FieldTunID:
+		packet.TunID = packet.Reg0
+	default:
+		return fmt.Errorf("unsupported move")
+	}
+	return nil
+}
+
+func simLoad(arg string, packet *SimPacket) error {
+	parts := strings.SplitN(arg, "->", 2)
+	if len(parts) != 2 || parts[1] != FieldReg0 {
+		return fmt.Errorf("unsupported load")
+	}
+	value, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return err
+	}
+	packet.Reg0 = uint32(value)
+	return nil
+}
+
+func simSetField(arg string, packet *SimPacket) error {
+	parts := strings.SplitN(arg, "->", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("unsupported set_field")
+	}
+	switch parts[1] {
+	case FieldTunDst:
+		packet.TunDst = parts[0]
+	case "tun_id":
+		value, err := strconv.ParseUint(parts[0], 0, 32)
+		if err != nil {
+			return err
+		}
+		packet.TunID = uint32(value)
+	default:
+		return fmt.Errorf("unsupported set_field")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package ovs
+
+import (
+	"testing"
+)
+
+// newTestSimulator returns a Simulator with a small pipeline: packets from
+// port 1 are tagged with reg0=7 and those from port 2 with reg0=8, and then
+// packets to 10.1.0.2 go to port 3 (if reg0 is 7) and those to 10.1.1.0/24
+// are tunneled out of port 4 to 192.168.1.5 (with the tunnel ID from reg0).
+func newTestSimulator(t *testing.T) *Simulator {
+	sim := NewSimulator()
+	err := sim.AddFlows(
+		NewFlow(0, 100).InPort(1).Do(Load(7, FieldReg0), GotoTable(1)),
+		NewFlow(0, 100).InPort(2).Do(Load(8, FieldReg0), GotoTable(1)),
+		NewFlow(0, 0).Do(Drop()),
+		NewFlow(1, 100).Reg0(7).Protocol(ProtocolIP).NwDst("10.1.0.2").Do(Output(3)),
+		NewFlow(1, 100).WithCookie(simNodeCookie).Protocol(ProtocolIP).NwDst("10.1.1.0/24").Do(Move(FieldReg0, FieldTunID), SetField("192.168.1.5", FieldTunDst), Output(4)),
+		NewFlow(1, 0).Do(Drop()),
+	)
+	if err != nil {
+		t.Fatalf("Could not add flows: %v", err)
+	}
+	return sim
+}
+
+var simNodeCookie = NewCookie(OwnerHostSubnet, "node2")
+
+func simRun(t *testing.T, sim *Simulator, packet SimPacket) *SimResult {
+	result, err := sim.Run(packet)
+	if err != nil {
+		t.Fatalf("Unexpected error running %#v: %v", packet, err)
+	}
+	return result
+}
+
+func TestSimulator(t *testing.T) {
+	sim := newTestSimulator(t)
+
+	result := simRun(t, sim, SimPacket{InPort: 1, Src: "10.1.0.3", Dst: "10.1.0.2"})
+	if !result.OutputTo(3) || len(result.Outputs) != 1 || len(result.Steps) != 2 {
+		t.Fatalf("Packet was not delivered: %#v", result)
+	}
+	if result.Steps[1].Registers["reg0"] != 7 || result.Outputs[0].Packet.Reg0 != 7 {
+		t.Fatalf("reg0 was not loaded: %#v", result)
+	}
+
+	// The flow in table 1 matches on reg0
+	result = simRun(t, sim, SimPacket{InPort: 2, Src: "10.1.0.3", Dst: "10.1.0.2"})
+	if !result.Dropped() || !result.Steps[1].Flow.IsDefaultDrop() {
+		t.Fatalf("Packet with wrong reg0 was not dropped: %#v", result)
+	}
+
+	// Protocol matches
+	result = simRun(t, sim, SimPacket{InPort: 1, Protocol: ProtocolARP, Src: "10.1.0.3", Dst: "10.1.0.2"})
+	if !result.Dropped() {
+		t.Fatalf("ARP packet unexpectedly matched ip flow: %#v", result)
+	}
+	result = simRun(t, sim, SimPacket{InPort: 1, Protocol: ProtocolTCP, Src: "10.1.0.3", Dst: "10.1.0.2", DstPort: 80})
+	if !result.OutputTo(3) {
+		t.Fatalf("TCP packet did not match ip flow: %#v", result)
+	}
+
+	// OVS never outputs a packet to its input port
+	result = simRun(t, sim, SimPacket{InPort: 3, Reg0: 7, Dst: "10.1.0.2"})
+	if !result.Dropped() {
+		t.Fatalf("Packet was output to its input port: %#v", result)
+	}
+
+	// move and set_field set up the tunnel
+	result = simRun(t, sim, SimPacket{InPort: 2, Src: "10.1.0.3", Dst: "10.1.1.7"})
+	if len(result.Outputs) != 1 {
+		t.Fatalf("Wrong outputs %#v", result.Outputs)
+	}
+	if out := result.Outputs[0]; out.Port != 4 || out.Packet.TunID != 8 || out.Packet.TunDst != "192.168.1.5" {
+		t.Fatalf("Wrong tunnel output %#v", out)
+	}
+
+	sim.DeleteFlowsByCookie(simNodeCookie, CookieExactMask)
+	if len(sim.Flows()) != 5 {
+		t.Fatalf("Wrong flows after DeleteFlowsByCookie: %v", sim.Flows())
+	}
+	result = simRun(t, sim, SimPacket{InPort: 2, Src: "10.1.0.3", Dst: "10.1.1.7"})
+	if !result.Dropped() {
+		t.Fatalf("Packet matched deleted flow: %#v", result)
+	}
+}
+
+func TestSimulatorErrors(t *testing.T) {
+	sim := NewSimulator()
+	if err := sim.AddFlows(NewFlow(0, 100).MatchOn("metadata", "1").Do(Drop())); err == nil {
+		t.Fatalf("Unexpectedly accepted unsupported match field")
+	}
+	if err := sim.AddFlows(NewFlow(0, 100).Do(Action{Name: "learn", Arg: "(table=1)"})); err == nil {
+		t.Fatalf("Unexpectedly accepted unsupported action")
+	}
+
+	if err := sim.AddFlows(NewFlow(1, 100).Do(GotoTable(0))); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result := simRun(t, sim, SimPacket{}); !result.Dropped() || len(result.Steps) != 1 || result.Steps[0].Flow != nil {
+		t.Fatalf("Packet was not dropped by table miss: %#v", result)
+	}
+	if err := sim.AddFlows(NewFlow(0, 0).Do(GotoTable(1))); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := sim.Run(SimPacket{}); err == nil {
+		t.Fatalf("Unexpectedly allowed goto_table to an earlier table")
+	}
+}
@@ -0,0 +1,116 @@
+package ovs
+
+import (
+	"strconv"
+)
+
+// Counters holds packet and byte counters
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+func (c *Counters) add(flow *Flow) {
+	c.Packets += flow.NPackets
+	c.Bytes += flow.NBytes
+}
+
+// Stats holds the packet and byte counters for a bridge, as returned by
+// GetStats().
+type Stats struct {
+	// Flows holds every flow on the bridge, with its counters
+	Flows []*Flow
+
+	// Tables holds the total counters of the flows in each table
+	Tables map[int]Counters
+
+	// Drops holds the counters of the packets dropped by each table (that
+	// is, the total counters of the flows in the table for which
+	// IsDrop() is true).
+	Drops map[int]Counters
+
+	// DefaultDrops holds the counters of each table's default drop flow
+	// (the flow for which IsDefaultDrop() is true), which counts the
+	// packets that the table dropped because no other flow accepted them.
+	DefaultDrops map[int]Counters
+
+	// VNIDs holds the total counters of the flows that match on each
+	// value of reg0.
+	VNIDs map[uint32]Counters
+}
+
+// IsDrop returns true if the flow drops all packets that it matches
+func (f *Flow) IsDrop() bool {
+	for _, action := range f.Actions {
+		if action.Name != "drop" {
+			return false
+		}
+	}
+	return true
+}
+
+// IsDefaultDrop returns true if the flow is a table's default flow (with
+// priority 0 and no match fields) and drops all packets that it matches,
+// meaning that it counts the packets that no other flow in the table
+// accepted.
+func (f *Flow) IsDefaultDrop() bool {
+	return f.Priority == 0 && len(f.Match) == 0 && f.IsDrop()
+}
+
+// VNID returns the value of reg0 that the flow matches on, and whether it
+// matches on reg0 at all.
+func (f *Flow) VNID() (uint32, bool) {
+	value, ok := f.FindMatch("reg0")
+	if !ok {
+		return 0, false
+	}
+	vnid, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(vnid), true
+}
+
+// GetStats dumps the bridge's flows and returns their counters, along with
+// totals for each table and VNID. Since this function has a return value, it
+// also returns an error immediately if an error occurs.
+func (tx *Transaction) GetStats() (*Stats, error) {
+	flows, err := tx.ListFlows()
+	if err != nil {
+		return nil, err
+	}
+	return computeStats(flows), nil
+}
+
+func computeStats(flows []*Flow) *Stats {
+	stats := &Stats{
+		Flows:        flows,
+		Tables:       make(map[int]Counters),
+		Drops:        make(map[int]Counters),
+		DefaultDrops: make(map[int]Counters),
+		VNIDs:        make(map[uint32]Counters),
+	}
+	for _, flow := range flows {
+		counters := stats.Tables[flow.Table]
+		counters.add(flow)
+		stats.Tables[flow.Table] = counters
+
+		if flow.IsDrop() {
+			counters = stats.Drops[flow.Table]
+			counters.add(flow)
+			stats.Drops[flow.Table] = counters
+		}
+		if flow.IsDefaultDrop() {
+			counters = stats.DefaultDrops[flow.Table]
+			counters.add(flow)
+			stats.DefaultDrops[flow.Table] = counters
+		}
+
+		if vnid, ok := flow.VNID(); ok {
+			counters = stats.VNIDs[vnid]
+			counters.add(flow)
+			stats.VNIDs[vnid] = counters
+		}
+	}
+	return stats
+}
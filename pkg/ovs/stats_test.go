@@ -0,0 +1,50 @@
+package ovs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetStats(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddResult("/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", `OFPST_FLOW reply (OF1.3) (xid=0x2):
+ cookie=0x0, duration=20.1s, table=0, n_packets=10, n_bytes=1000, priority=100,ip actions=goto_table:2
+ cookie=0x0, duration=20.1s, table=0, n_packets=1, n_bytes=60, priority=150,in_port=1 actions=drop
+ cookie=0x0, duration=20.1s, table=0, n_packets=2, n_bytes=120, priority=0 actions=drop
+ cookie=0x0, duration=20.1s, table=4, n_packets=5, n_bytes=500, priority=100,tcp,reg0=0xc,nw_dst=172.30.0.1,tp_dst=443 actions=output:2
+ cookie=0x0, duration=20.1s, table=4, n_packets=3, n_bytes=300, priority=100,udp,reg0=0xc,nw_dst=172.30.0.10,tp_dst=53 actions=output:2
+ cookie=0x0, duration=20.1s, table=4, n_packets=7, n_bytes=700, priority=200,reg0=0 actions=output:2
+ cookie=0x0, duration=20.1s, table=4, n_packets=4, n_bytes=400, priority=0 actions=drop
+`, nil)
+
+	otx := NewTransaction(fexec, "br0")
+	stats, err := otx.GetStats()
+	otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(stats.Flows) != 7 {
+		t.Fatalf("Wrong number of flows %d", len(stats.Flows))
+	}
+	if !reflect.DeepEqual(stats.Tables, map[int]Counters{0: {13, 1180}, 4: {19, 1900}}) {
+		t.Fatalf("Wrong table stats %v", stats.Tables)
+	}
+	if !reflect.DeepEqual(stats.Drops, map[int]Counters{0: {3, 180}, 4: {4, 400}}) {
+		t.Fatalf("Wrong drop stats %v", stats.Drops)
+	}
+	if !reflect.DeepEqual(stats.DefaultDrops, map[int]Counters{0: {2, 120}, 4: {4, 400}}) {
+		t.Fatalf("Wrong default drop stats %v", stats.DefaultDrops)
+	}
+	if !reflect.DeepEqual(stats.VNIDs, map[uint32]Counters{0: {7, 700}, 12: {8, 800}}) {
+		t.Fatalf("Wrong VNID stats %v", stats.VNIDs)
+	}
+
+	if stats.Flows[1].IsDefaultDrop() || !stats.Flows[2].IsDefaultDrop() || !stats.Flows[6].IsDefaultDrop() {
+		t.Fatalf("Default drop flows not identified correctly")
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
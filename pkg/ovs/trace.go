@@ -0,0 +1,286 @@
+package ovs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TracePacket describes a synthetic packet to pass to Trace(). Zero-valued
+// fields are left out of the packet.
+type TracePacket struct {
+	InPort   uint
+	Protocol Protocol // defaults to ProtocolTCP if DstPort is set, else ProtocolIP
+	Src      string   // source IP
+	Dst      string   // destination IP
+	DstPort  int      // TCP/UDP destination port
+	TunID    uint32   // VXLAN VNI, for packets arriving from vxlan0
+	TunSrc   string   // VXLAN tunnel source IP
+}
+
+// protocol returns the packet's protocol, filling in the default
+func (p *TracePacket) protocol() Protocol {
+	switch {
+	case p.Protocol != "":
+		return p.Protocol
+	case p.DstPort != 0:
+		return ProtocolTCP
+	default:
+		return ProtocolIP
+	}
+}
+
+// Validate checks that the packet can be traced; ofproto/trace rejects a
+// destination port unless the protocol is TCP or UDP.
+func (p *TracePacket) Validate() error {
+	if proto := p.protocol(); p.DstPort != 0 && proto != ProtocolTCP && proto != ProtocolUDP {
+		return fmt.Errorf("cannot trace a %s packet with a destination port", proto)
+	}
+	return nil
+}
+
+// String returns the packet in the flow syntax accepted by ofproto/trace
+func (p *TracePacket) String() string {
+	parts := []string{string(p.protocol())}
+	if p.InPort != 0 {
+		parts = append(parts, fmt.Sprintf("in_port=%d", p.InPort))
+	}
+	if p.TunID != 0 {
+		parts = append(parts, fmt.Sprintf("tun_id=0x%x", p.TunID))
+	}
+	if p.TunSrc != "" {
+		parts = append(parts, "tun_src="+p.TunSrc)
+	}
+	if p.Src != "" {
+		parts = append(parts, "nw_src="+p.Src)
+	}
+	if p.Dst != "" {
+		parts = append(parts, "nw_dst="+p.Dst)
+	}
+	if p.DstPort != 0 {
+		parts = append(parts, fmt.Sprintf("tp_dst=%d", p.DstPort))
+	}
+	return strings.Join(parts, ",")
+}
+
+// TraceStep is a single table lookup in a packet trace
+type TraceStep struct {
+	Table int
+
+	// Flow is the flow that matched in the table (including its cookie,
+	// priority, match, and actions), or nil if nothing matched.
+	Flow *Flow
+
+	// Registers holds the values of the registers when the packet
+	// entered the table, if the trace output included them.
+	Registers map[string]uint64
+}
+
+// TraceResult is the parsed output of ofproto/trace
+type TraceResult struct {
+	// Steps holds the tables visited by the packet, in order
+	Steps []TraceStep
+
+	// Registers holds the final (non-zero) values of the registers
+	Registers map[string]uint64
+
+	// DatapathActions is the final action taken on the packet, as
+	// reported by the datapath (eg "drop", or "3" for output to port 3)
+	DatapathActions string
+
+	// Output is the unparsed output of ofproto/trace
+	Output string
+}
+
+// Dropped returns true if the packet was dropped
+func (r *TraceResult) Dropped() bool {
+	return r.DatapathActions == "drop" || r.DatapathActions == ""
+}
+
+// Trace runs a synthetic packet through the bridge's flows with "ovs-appctl
+// ofproto/trace" and returns the parsed result. Since this function has a
+// return value, it also returns an error immediately if an error occurs.
+// Flow changes that are still queued in the transaction are not reflected in
+// the result.
+func (tx *Transaction) Trace(packet *TracePacket) (*TraceResult, error) {
+	if err := packet.Validate(); err != nil {
+		return nil, err
+	}
+	out, err := tx.exec("", "ovs-appctl", "ofproto/trace", tx.bridge, packet.String())
+	if err != nil {
+		return nil, err
+	}
+	return ParseTrace(out)
+}
+
+var (
+	// "Rule: table=2 cookie=0x1a2b priority=100,ip,in_port=3"
+	traceRuleRE = regexp.MustCompile(`^Rule: table=(\d+) cookie=(\S+)(?: (.*))?$`)
+	// " 2. ip,in_port=3, priority 100, cookie 0x1a2b" (OVS 2.7 and later)
+	traceStepRE = regexp.MustCompile(`^(\d+)\. (?:(.*), )?priority (\d+)(?:, cookie (0x[0-9a-f]+))?$`)
+	// " 4. No match." (OVS 2.7 and later)
+	traceNoMatchRE = regexp.MustCompile(`^(\d+)\. No match`)
+	// "reg0=0xc"
+	traceRegRE = regexp.MustCompile(`\b(reg\d+)=(0x[0-9a-f]+|\d+)`)
+)
+
+// traceParser holds the state of ParseTrace()
+type traceParser struct {
+	result *TraceResult
+
+	// registers from the most recent "Resubmitted regs" line
+	regs map[string]uint64
+
+	// the step currently being parsed
+	step    *TraceStep
+	match   string
+	actions []string
+}
+
+// startStep finishes the current step and starts a new one. If match is
+// non-nil, the step matched a flow with the given cookie and match fields
+// (including the priority).
+func (p *traceParser) startStep(table int, cookie uint64, match *string) error {
+	if err := p.finishStep(); err != nil {
+		return err
+	}
+	p.step = &TraceStep{Table: table, Registers: p.regs}
+	p.regs = nil
+	if match != nil {
+		p.step.Flow = &Flow{Cookie: cookie}
+		p.match = *match
+	}
+	return nil
+}
+
+func (p *traceParser) finishStep() error {
+	step := p.step
+	if step == nil {
+		return nil
+	}
+	if step.Flow != nil {
+		actions := p.actions
+		if len(actions) == 0 {
+			actions = []string{"drop"}
+		}
+		flow, err := ParseFlow(fmt.Sprintf("table=%d, %s, actions=%s", step.Table, p.match, strings.Join(actions, ",")))
+		if err != nil {
+			return err
+		}
+		flow.Cookie = step.Flow.Cookie
+		step.Flow = flow
+	}
+	p.result.Steps = append(p.result.Steps, *step)
+	p.step = nil
+	p.match = ""
+	p.actions = nil
+	return nil
+}
+
+// gotoTable returns the table that the last step's flow sent the packet to
+func (p *traceParser) gotoTable() int {
+	steps := p.result.Steps
+	if len(steps) == 0 || steps[len(steps)-1].Flow == nil {
+		return 0
+	}
+	for _, action := range steps[len(steps)-1].Flow.Actions {
+		if action.Name == "goto_table" {
+			table, _ := strconv.Atoi(action.Arg)
+			return table
+		}
+	}
+	return 0
+}
+
+// ParseTrace parses the output of "ovs-appctl ofproto/trace". Both the
+// original output format and the one used by OVS 2.7 and later are accepted.
+func ParseTrace(output string) (*TraceResult, error) {
+	p := &traceParser{result: &TraceResult{Output: output}}
+	newFormat := false
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "Resubmitted regs:"):
+			p.regs = parseTraceRegisters(line)
+
+		case traceRuleRE.MatchString(line):
+			m := traceRuleRE.FindStringSubmatch(line)
+			table, _ := strconv.Atoi(m[1])
+			cookie, perr := strconv.ParseUint(m[2], 0, 64)
+			if perr != nil {
+				return nil, fmt.Errorf("invalid cookie in trace line %q", line)
+			}
+			err = p.startStep(table, cookie, &m[3])
+
+		case strings.HasPrefix(line, "OpenFlow actions="):
+			if p.step != nil && p.step.Flow != nil {
+				p.actions = []string{strings.TrimPrefix(line, "OpenFlow actions=")}
+			}
+
+		case line == "No match":
+			if err = p.finishStep(); err == nil {
+				err = p.startStep(p.gotoTable(), 0, nil)
+			}
+
+		case traceNoMatchRE.MatchString(line):
+			table, _ := strconv.Atoi(traceNoMatchRE.FindStringSubmatch(line)[1])
+			err = p.startStep(table, 0, nil)
+
+		case traceStepRE.MatchString(line):
+			newFormat = true
+			m := traceStepRE.FindStringSubmatch(line)
+			table, _ := strconv.Atoi(m[1])
+			var cookie uint64
+			if m[4] != "" {
+				cookie, _ = strconv.ParseUint(m[4], 0, 64)
+			}
+			match := "priority=" + m[3]
+			if m[2] != "" {
+				match += "," + m[2]
+			}
+			err = p.startStep(table, cookie, &match)
+
+		case strings.HasPrefix(line, "Final flow:"):
+			err = p.finishStep()
+			p.result.Registers = parseTraceRegisters(line)
+
+		case strings.HasPrefix(line, "Datapath actions:"):
+			err = p.finishStep()
+			p.result.DatapathActions = strings.TrimSpace(strings.TrimPrefix(line, "Datapath actions:"))
+
+		case newFormat && line != "" && !strings.HasPrefix(line, "->") && !strings.HasPrefix(line, "Megaflow:"):
+			// In the newer format, each of the flow's actions is
+			// on its own line after the step line.
+			if p.step != nil && p.step.Flow != nil {
+				p.actions = append(p.actions, line)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.finishStep(); err != nil {
+		return nil, err
+	}
+
+	if p.result.DatapathActions == "" {
+		return nil, fmt.Errorf("could not parse ofproto/trace output: no datapath actions")
+	}
+	return p.result, nil
+}
+
+// parseTraceRegisters returns the non-zero register values in line
+func parseTraceRegisters(line string) map[string]uint64 {
+	regs := make(map[string]uint64)
+	for _, m := range traceRegRE.FindAllStringSubmatch(line, -1) {
+		value, err := strconv.ParseUint(m[2], 0, 64)
+		if err == nil && value != 0 {
+			regs[m[1]] = value
+		}
+	}
+	return regs
+}
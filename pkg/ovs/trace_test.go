@@ -0,0 +1,194 @@
+package ovs
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Output from OVS 2.4
+const traceServiceDropped = `Bridge: br0
+Flow: tcp,in_port=3,vlan_tci=0x0000,dl_src=00:00:00:00:00:00,dl_dst=00:00:00:00:00:00,nw_src=10.1.0.2,nw_dst=172.30.0.1,nw_tos=0,nw_ecn=0,nw_ttl=0,tp_src=0,tp_dst=443,tcp_flags=0
+
+Rule: table=0 cookie=0 priority=100,ip
+OpenFlow actions=goto_table:2
+
+	Resubmitted flow: tcp,in_port=3,vlan_tci=0x0000,dl_src=00:00:00:00:00:00,dl_dst=00:00:00:00:00:00,nw_src=10.1.0.2,nw_dst=172.30.0.1,nw_tos=0,nw_ecn=0,nw_ttl=0,tp_src=0,tp_dst=443,tcp_flags=0
+	Resubmitted regs: reg0=0x0 reg1=0x0 reg2=0x0 reg3=0x0 reg4=0x0 reg5=0x0 reg6=0x0 reg7=0x0
+	Resubmitted  odp: drop
+	Resubmitted megaflow: recirc_id=0,ip,in_port=3,nw_frag=no
+	Rule: table=2 cookie=0x100000000001a2b priority=100,ip,in_port=3,nw_src=10.1.0.2
+	OpenFlow actions=load:0xc->NXM_NX_REG0[],goto_table:3
+
+		Resubmitted flow: unchanged
+		Resubmitted regs: reg0=0xc reg1=0x0 reg2=0x0 reg3=0x0 reg4=0x0 reg5=0x0 reg6=0x0 reg7=0x0
+		Resubmitted  odp: drop
+		Resubmitted megaflow: recirc_id=0,ip,in_port=3,nw_src=10.1.0.2,nw_frag=no
+		Rule: table=3 cookie=0 priority=100,ip,nw_dst=172.30.0.0/16
+		OpenFlow actions=goto_table:4
+
+			Resubmitted flow: unchanged
+			Resubmitted regs: reg0=0xc reg1=0x0 reg2=0x0 reg3=0x0 reg4=0x0 reg5=0x0 reg6=0x0 reg7=0x0
+			Resubmitted  odp: drop
+			Resubmitted megaflow: recirc_id=0,ip,in_port=3,nw_src=10.1.0.2,nw_dst=172.30.0.0/16,nw_frag=no
+			Rule: table=4 cookie=0 priority=0
+			OpenFlow actions=drop
+
+Final flow: tcp,reg0=0xc,in_port=3,vlan_tci=0x0000,dl_src=00:00:00:00:00:00,dl_dst=00:00:00:00:00:00,nw_src=10.1.0.2,nw_dst=172.30.0.1,nw_tos=0,nw_ecn=0,nw_ttl=0,tp_src=0,tp_dst=443,tcp_flags=0
+Megaflow: recirc_id=0,tcp,in_port=3,nw_src=10.1.0.2,nw_dst=172.30.0.1,nw_frag=no,tp_dst=443
+Datapath actions: drop
+`
+
+// Output from OVS 2.7
+const traceRemotePod = `Flow: ip,tun_src=192.168.1.5,tun_id=0xc,in_port=1,vlan_tci=0x0000,dl_src=00:00:00:00:00:00,dl_dst=00:00:00:00:00:00,nw_src=10.1.1.2,nw_dst=10.1.0.2,nw_proto=0,nw_tos=0,nw_ecn=0,nw_ttl=0
+
+bridge("br0")
+-------------
+ 0. ip,in_port=1,nw_src=10.1.0.0/16,nw_dst=10.1.0.0/24, priority 200
+    move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[]
+     -> NXM_NX_REG0[] is now 0xc
+    goto_table:1
+ 1. tun_src=192.168.1.5, priority 100, cookie 0x200000000000abc
+    goto_table:5
+ 5. ip,nw_dst=10.1.0.0/24, priority 200
+    goto_table:7
+ 7. reg0=0xc,ip,nw_dst=10.1.0.2, priority 100, cookie 0x100000000001a2b
+    output:4
+
+Final flow: ip,reg0=0xc,tun_src=192.168.1.5,tun_id=0xc,in_port=1,vlan_tci=0x0000,dl_src=00:00:00:00:00:00,dl_dst=00:00:00:00:00:00,nw_src=10.1.1.2,nw_dst=10.1.0.2,nw_proto=0,nw_tos=0,nw_ecn=0,nw_ttl=0
+Megaflow: recirc_id=0,ip,tun_id=0xc,tun_src=192.168.1.5,tun_dst=0.0.0.0,tun_tos=0,tun_ttl=0,tun_flags=-df-csum-key,in_port=1,nw_src=10.1.0.0/24,nw_dst=10.1.0.2,nw_frag=no
+Datapath actions: 4
+`
+
+func TestTrace(t *testing.T) {
+	fexec := normalSetup()
+	fexec.AddProgram("/usr/bin/ovs-appctl")
+	fexec.AddResult("/usr/bin/ovs-appctl ofproto/trace br0 tcp,in_port=3,nw_src=10.1.0.2,nw_dst=172.30.0.1,tp_dst=443", traceServiceDropped, nil)
+
+	otx := NewTransaction(fexec, "br0")
+	result, err := otx.Trace(&TracePacket{InPort: 3, Protocol: ProtocolTCP, Src: "10.1.0.2", Dst: "172.30.0.1", DstPort: 443})
+	otx.EndTransaction()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !result.Dropped() {
+		t.Fatalf("Packet unexpectedly not dropped")
+	}
+	tables := []int{}
+	for _, step := range result.Steps {
+		tables = append(tables, step.Table)
+	}
+	if !reflect.DeepEqual(tables, []int{0, 2, 3, 4}) {
+		t.Fatalf("Wrong tables visited: %v", tables)
+	}
+	expected := NewFlow(2, 100).WithCookie(0x100000000001a2b).Protocol(ProtocolIP).InPort(3).NwSrc("10.1.0.2").Do(Action{Name: "load", Arg: "0xc->NXM_NX_REG0[]"}, GotoTable(3))
+	if !reflect.DeepEqual(result.Steps[1].Flow, expected) {
+		t.Fatalf("Wrong flow for table 2:\nexpected %#v\ngot      %#v", expected, result.Steps[1].Flow)
+	}
+	if len(result.Steps[1].Registers) != 0 || !reflect.DeepEqual(result.Steps[2].Registers, map[string]uint64{"reg0": 12}) {
+		t.Fatalf("Wrong registers in steps: %v, %v", result.Steps[1].Registers, result.Steps[2].Registers)
+	}
+	if !result.Steps[3].Flow.IsDefaultDrop() {
+		t.Fatalf("Packet not dropped by default flow: %v", result.Steps[3].Flow)
+	}
+	if !reflect.DeepEqual(result.Registers, map[string]uint64{"reg0": 12}) {
+		t.Fatalf("Wrong final registers: %v", result.Registers)
+	}
+
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestTracePacket(t *testing.T) {
+	for _, tc := range []struct {
+		packet   TracePacket
+		expected string
+		invalid  bool
+	}{
+		{packet: TracePacket{InPort: 3, Dst: "10.1.0.2"}, expected: "ip,in_port=3,nw_dst=10.1.0.2"},
+		{packet: TracePacket{Dst: "172.30.0.1", DstPort: 443}, expected: "tcp,nw_dst=172.30.0.1,tp_dst=443"},
+		{packet: TracePacket{Protocol: ProtocolUDP, Dst: "172.30.0.10", DstPort: 53}, expected: "udp,nw_dst=172.30.0.10,tp_dst=53"},
+		{packet: TracePacket{Protocol: ProtocolIP, Dst: "172.30.0.1", DstPort: 443}, invalid: true},
+		{packet: TracePacket{Protocol: ProtocolICMP, Dst: "172.30.0.1", DstPort: 443}, invalid: true},
+	} {
+		err := tc.packet.Validate()
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("Unexpectedly valid packet %q", tc.packet.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for packet %q: %v", tc.packet.String(), err)
+		}
+		if str := tc.packet.String(); str != tc.expected {
+			t.Errorf("Wrong packet: expected %q, got %q", tc.expected, str)
+		}
+	}
+
+	// Trace() refuses invalid packets without running ofproto/trace
+	fexec := normalSetup()
+	otx := NewTransaction(fexec, "br0")
+	_, err := otx.Trace(&TracePacket{Protocol: ProtocolIP, Dst: "172.30.0.1", DstPort: 443})
+	otx.EndTransaction()
+	if err == nil {
+		t.Fatalf("Unexpected success tracing invalid packet")
+	}
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("Unexpected commands: %v", err)
+	}
+}
+
+func TestParseTraceNewFormat(t *testing.T) {
+	result, err := ParseTrace(traceRemotePod)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if result.Dropped() || result.DatapathActions != "4" {
+		t.Fatalf("Wrong datapath actions %q", result.DatapathActions)
+	}
+	if len(result.Steps) != 4 {
+		t.Fatalf("Wrong number of steps %d", len(result.Steps))
+	}
+	expected := NewFlow(0, 200).Protocol(ProtocolIP).InPort(1).NwSrc("10.1.0.0/16").NwDst("10.1.0.0/24").Do(Move(FieldTunID, FieldReg0), GotoTable(1))
+	if !reflect.DeepEqual(result.Steps[0].Flow, expected) {
+		t.Fatalf("Wrong flow for table 0:\nexpected %#v\ngot      %#v", expected, result.Steps[0].Flow)
+	}
+	if step := result.Steps[1]; step.Table != 1 || step.Flow.Owner() != OwnerHostSubnet || step.Flow.Actions[0] != GotoTable(5) {
+		t.Fatalf("Wrong step for table 1: %#v", step.Flow)
+	}
+	if vnid, _ := result.Steps[3].Flow.VNID(); vnid != 12 || result.Steps[3].Flow.Actions[0] != Output(4) {
+		t.Fatalf("Wrong flow for table 7: %#v", result.Steps[3].Flow)
+	}
+
+	if _, err = ParseTrace("ovs-appctl: br0: unknown bridge\n"); err == nil {
+		t.Fatalf("Unexpectedly parsed bad trace output")
+	}
+}
+
+func TestParseTraceNoMatch(t *testing.T) {
+	result, err := ParseTrace(`Bridge: br0
+Flow: arp,in_port=5,vlan_tci=0x0000,dl_src=00:00:00:00:00:00,dl_dst=00:00:00:00:00:00,arp_spa=10.1.0.9,arp_tpa=0.0.0.0,arp_op=0,arp_sha=00:00:00:00:00:00,arp_tha=00:00:00:00:00:00
+
+Rule: table=0 cookie=0 priority=100,arp
+OpenFlow actions=goto_table:2
+
+	Resubmitted flow: unchanged
+	Resubmitted regs: reg0=0x0 reg1=0x0 reg2=0x0 reg3=0x0 reg4=0x0 reg5=0x0 reg6=0x0 reg7=0x0
+	Resubmitted  odp: drop
+	Resubmitted megaflow: recirc_id=0,arp,in_port=5
+	No match
+
+Final flow: unchanged
+Megaflow: recirc_id=0,arp,in_port=5
+Datapath actions: drop
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.Steps) != 2 || result.Steps[1].Table != 2 || result.Steps[1].Flow != nil || !result.Dropped() {
+		t.Fatalf("Wrong result %#v", result)
+	}
+}
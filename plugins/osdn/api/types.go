@@ -15,3 +15,69 @@ type FilteringEndpointsConfigHandler interface {
 	pconfig.EndpointsConfigHandler
 	Start(baseHandler pconfig.EndpointsConfigHandler) error
 }
+
+// MasterOptions holds SDN master configuration beyond what is in the master's
+// MasterNetworkConfig
+type MasterOptions struct {
+	// HostSubnetPolicies assign host subnet lengths to nodes based on their
+	// labels. Nodes get the HostSubnetLength of the first policy whose
+	// NodeSelector matches them, or the cluster network's HostSubnetLength
+	// if none do.
+	HostSubnetPolicies []HostSubnetPolicy
+
+	// ExcludedSubnets are blocks of the cluster network(s) that are used
+	// for something else (eg, routed to a legacy VM network) and must
+	// never be allocated to nodes
+	ExcludedSubnets []string
+
+	// ReservedVNIDRanges are ranges of VNIDs that are never allocated to
+	// projects, in addition to VNIDs 1 to 9, which are always reserved
+	ReservedVNIDRanges []VNIDRange
+
+	// RepairInconsistencies makes the master fix the problems found by
+	// the consistency check it runs at start-up, rather than just
+	// reporting them
+	RepairInconsistencies bool
+
+	// NodeIPPolicy, if set, is how the master chooses the IP of each node.
+	// It should be the same as the nodes' NodeIPPolicy.
+	NodeIPPolicy *NodeIPPolicy
+}
+
+// NodeOptions holds SDN node configuration beyond what is passed to
+// NewNodePlugin
+type NodeOptions struct {
+	// NodeIPPolicy, if set, is how the node chooses its IP when it has
+	// not been configured with one
+	NodeIPPolicy *NodeIPPolicy
+}
+
+// NodeIPPolicy describes how to choose the IP address of a node, which other
+// nodes send VXLAN traffic to. Addresses of the preferred AddressTypes are
+// chosen over others, and only addresses that match CIDRs and Interface (when
+// set) are chosen at all.
+type NodeIPPolicy struct {
+	// AddressTypes lists node address types ("InternalIP" or "ExternalIP")
+	// in order of preference
+	AddressTypes []string
+	// CIDRs lists the networks that the node IP must be in
+	CIDRs []string
+	// Interface is the name of the network interface that the node IP must
+	// be assigned to. Only the node can check this, so the node publishes
+	// the address it chose for the master to use.
+	Interface string
+}
+
+// HostSubnetPolicy requests subnets with HostSubnetLength host bits for the
+// nodes whose labels match NodeSelector
+type HostSubnetPolicy struct {
+	NodeSelector     map[string]string
+	HostSubnetLength uint
+}
+
+// VNIDRange is a named range of VNIDs, from Min to Max inclusive
+type VNIDRange struct {
+	Name string
+	Min  uint
+	Max  uint
+}
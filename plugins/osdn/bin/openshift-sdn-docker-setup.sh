@@ -4,8 +4,11 @@ set -ex
 
 bridge=$1
 mtu=$2
+# The part of the node's subnet that docker allocates from; the rest is
+# allocated to pods by openshift-sdn itself
+fixed_cidr=$3
 
-DOCKER_NETWORK_OPTIONS="-b=${bridge} --mtu=${mtu}"
+DOCKER_NETWORK_OPTIONS="-b=${bridge} --mtu=${mtu} --fixed-cidr=${fixed_cidr}"
 conf=/run/openshift-sdn/docker-network
 
 if grep -q -s "DOCKER_NETWORK_OPTIONS='${DOCKER_NETWORK_OPTIONS}'" $conf; then
@@ -2,6 +2,7 @@ package osdn
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
 	osapi "github.com/openshift/origin/pkg/sdn/api"
@@ -19,6 +20,17 @@ func getPodContainerID(pod *kapi.Pod) string {
 	return ""
 }
 
+// getDockerSubnet returns the part of the node's subnet (its upper half) that
+// docker allocates container addresses from. The node's IPAM never allocates
+// pod addresses from it, so the two can't hand out the same address.
+func getDockerSubnet(localSubnet *net.IPNet) *net.IPNet {
+	ones, bits := localSubnet.Mask.Size()
+	ip := make(net.IP, len(localSubnet.IP))
+	copy(ip, localSubnet.IP)
+	ip[ones/8] |= 0x80 >> uint(ones%8)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones+1, bits)}
+}
+
 func hostSubnetToString(subnet *osapi.HostSubnet) string {
 	return fmt.Sprintf("%s (host: %q, ip: %q, subnet: %q)", subnet.Name, subnet.Host, subnet.HostIP, subnet.Subnet)
 }
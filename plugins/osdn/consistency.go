@@ -0,0 +1,324 @@
+package osdn
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/golang/glog"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	osapi "github.com/openshift/origin/pkg/sdn/api"
+)
+
+// ConsistencyProblemKind identifies a kind of problem found by CheckConsistency
+type ConsistencyProblemKind string
+
+const (
+	// A HostSubnet's subnet overlaps the subnet of another HostSubnet
+	OverlappingHostSubnet ConsistencyProblemKind = "OverlappingHostSubnet"
+	// A HostSubnet's subnet is invalid or not part of the cluster network
+	HostSubnetOutsideClusterNetwork ConsistencyProblemKind = "HostSubnetOutsideClusterNetwork"
+	// A HostSubnet's subnet overlaps one of the master's excluded subnets
+	HostSubnetInExcludedSubnet ConsistencyProblemKind = "HostSubnetInExcludedSubnet"
+	// A HostSubnet's node no longer exists
+	OrphanedHostSubnet ConsistencyProblemKind = "OrphanedHostSubnet"
+	// A NetNamespace's namespace no longer exists
+	OrphanedNetNamespace ConsistencyProblemKind = "OrphanedNetNamespace"
+	// A NetNamespace's VNID is outside the range VNIDs are allocated from,
+	// or is reserved
+	InvalidVNID ConsistencyProblemKind = "InvalidVNID"
+)
+
+// ConsistencyProblem is a problem with a HostSubnet or NetNamespace found by
+// CheckConsistency
+type ConsistencyProblem struct {
+	Kind ConsistencyProblemKind
+	// Resource and Name identify the object with the problem
+	Resource ResourceName
+	Name     string
+	Message  string
+
+	// Repaired is true if the problem was fixed. RepairError is the error
+	// from trying to fix it, if that failed.
+	Repaired    bool
+	RepairError error
+
+	hostSubnet *osapi.HostSubnet
+	node       *kapi.Node
+	netns      *osapi.NetNamespace
+}
+
+func (p *ConsistencyProblem) String() string {
+	return fmt.Sprintf("%s (%s %q): %s", p.Kind, p.Resource, p.Name, p.Message)
+}
+
+// CheckConsistency looks for HostSubnets and NetNamespaces that are
+// inconsistent with each other or with the rest of the cluster, and returns the
+// problems it finds. If repair is true it also tries to fix them: HostSubnets
+// of deleted nodes and NetNamespaces of deleted namespaces are deleted, nodes
+// with bad subnets (including ones in an excluded subnet) are given new ones,
+// and NetNamespaces with bad VNIDs are given new VNIDs. The master runs it at
+// start-up, and it can be called again at any time after that.
+func (master *OsdnMaster) CheckConsistency(repair bool) ([]*ConsistencyProblem, error) {
+	master.lock.Lock()
+	defer master.lock.Unlock()
+
+	subnetProblems, err := master.checkHostSubnets()
+	if err != nil {
+		return nil, err
+	}
+	var netnsProblems []*ConsistencyProblem
+	var inUse []uint
+	if IsOpenShiftMultitenantNetworkPlugin(master.networkInfo.PluginName) {
+		netnsProblems, inUse, err = master.checkNetNamespaces()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	problems := append(subnetProblems, netnsProblems...)
+	for _, p := range problems {
+		log.Warningf("Consistency check found %s", p)
+	}
+	if !repair {
+		return problems, nil
+	}
+
+	master.repairHostSubnets(subnetProblems)
+	master.repairNetNamespaces(netnsProblems, inUse)
+	for _, p := range problems {
+		if p.Repaired {
+			log.Infof("Repaired %s", p)
+		} else {
+			log.Errorf("Failed to repair %s: %v", p, p.RepairError)
+		}
+	}
+	return problems, nil
+}
+
+// clusterNetworkContains returns true if ipnet is entirely within one of the
+// cluster networks
+func (master *OsdnMaster) clusterNetworkContains(ipnet *net.IPNet) bool {
+	maskSize, _ := ipnet.Mask.Size()
+	for _, cn := range master.networkInfo.ClusterNetworks {
+		cnMaskSize, _ := cn.CIDR.Mask.Size()
+		if cn.CIDR.Contains(ipnet.IP) && maskSize >= cnMaskSize {
+			return true
+		}
+	}
+	return false
+}
+
+// subnetsOverlap returns true if a and b have any addresses in common
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func (master *OsdnMaster) checkHostSubnets() ([]*ConsistencyProblem, error) {
+	subnets, err := master.registry.GetSubnets()
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching HostSubnets: %v", err)
+	}
+	nodes, err := master.registry.GetNodes()
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching nodes: %v", err)
+	}
+	return master.findHostSubnetProblems(subnets, nodes), nil
+}
+
+// findHostSubnetProblems returns the problems with subnets, given the existing
+// nodes
+func (master *OsdnMaster) findHostSubnetProblems(subnets []osapi.HostSubnet, nodes []kapi.Node) []*ConsistencyProblem {
+	// The excluded subnets were validated when the master started
+	var excluded []*net.IPNet
+	for _, cidr := range master.excludedSubnets {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			excluded = append(excluded, ipnet)
+		}
+	}
+	nodesByName := make(map[string]*kapi.Node, len(nodes))
+	for i := range nodes {
+		nodesByName[nodes[i].Name] = &nodes[i]
+	}
+
+	problems := []*ConsistencyProblem{}
+	// Where HostSubnets overlap, the first one is treated as valid, as it
+	// is by the subnet allocator
+	valid := make(map[string]*net.IPNet)
+	for i := range subnets {
+		sub := &subnets[i]
+		p := &ConsistencyProblem{Resource: HostSubnets, Name: sub.Name, hostSubnet: sub, node: nodesByName[sub.Host]}
+
+		_, ipnet, err := net.ParseCIDR(sub.Subnet)
+		switch {
+		case p.node == nil:
+			p.Kind = OrphanedHostSubnet
+			p.Message = fmt.Sprintf("node %q does not exist", sub.Host)
+		case err != nil:
+			p.Kind = HostSubnetOutsideClusterNetwork
+			p.Message = fmt.Sprintf("failed to parse subnet %q", sub.Subnet)
+		case !master.clusterNetworkContains(ipnet):
+			p.Kind = HostSubnetOutsideClusterNetwork
+			p.Message = fmt.Sprintf("subnet %s is not part of cluster network %s", ipnet, formatClusterNetworks(master.networkInfo.ClusterNetworks))
+		default:
+			for _, ex := range excluded {
+				if subnetsOverlap(ipnet, ex) {
+					p.Kind = HostSubnetInExcludedSubnet
+					p.Message = fmt.Sprintf("subnet %s overlaps excluded subnet %s", ipnet, ex)
+					break
+				}
+			}
+			if p.Kind != "" {
+				break
+			}
+			for name, other := range valid {
+				if subnetsOverlap(ipnet, other) {
+					p.Kind = OverlappingHostSubnet
+					p.Message = fmt.Sprintf("subnet %s overlaps subnet %s of HostSubnet %q", ipnet, other, name)
+					break
+				}
+			}
+			if p.Kind == "" {
+				valid[sub.Name] = ipnet
+			}
+		}
+		if p.Kind != "" {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// checkNetNamespaces returns the problems with NetNamespaces, and the VNIDs of
+// the NetNamespaces without problems
+func (master *OsdnMaster) checkNetNamespaces() ([]*ConsistencyProblem, []uint, error) {
+	netnsList, err := master.registry.GetNetNamespaces()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error fetching NetNamespaces: %v", err)
+	}
+	namespaces, err := master.registry.GetNamespaces()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error fetching namespaces: %v", err)
+	}
+	problems, inUse := master.findNetNamespaceProblems(netnsList, namespaces)
+	return problems, inUse, nil
+}
+
+// findNetNamespaceProblems returns the problems with netnsList, given the
+// existing namespaces, and the VNIDs of the NetNamespaces without problems
+func (master *OsdnMaster) findNetNamespaceProblems(netnsList []osapi.NetNamespace, namespaces []kapi.Namespace) ([]*ConsistencyProblem, []uint) {
+	exists := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		exists[ns.Name] = true
+	}
+
+	problems := []*ConsistencyProblem{}
+	inUse := []uint{}
+	for i := range netnsList {
+		netns := &netnsList[i]
+		p := &ConsistencyProblem{Resource: NetNamespaces, Name: netns.Name, netns: netns}
+		switch {
+		case !exists[netns.NetName]:
+			p.Kind = OrphanedNetNamespace
+			p.Message = fmt.Sprintf("namespace %q does not exist", netns.NetName)
+			problems = append(problems, p)
+		case !master.isValidVNID(netns.NetID):
+			p.Kind = InvalidVNID
+			p.Message = fmt.Sprintf("VNID %d is reserved or out of range", netns.NetID)
+			problems = append(problems, p)
+		case netns.NetID != AdminVNID:
+			inUse = append(inUse, netns.NetID)
+		}
+	}
+	return problems, inUse
+}
+
+func (master *OsdnMaster) repairHostSubnets(problems []*ConsistencyProblem) {
+	if len(problems) == 0 {
+		return
+	}
+
+	for _, p := range problems {
+		p.RepairError = master.registry.DeleteSubnet(p.Name)
+		p.Repaired = (p.RepairError == nil)
+	}
+
+	// If the master isn't running yet, the node watcher will allocate new
+	// subnets when it starts. Otherwise, rebuild the allocator without the
+	// deleted subnets and allocate them now.
+	if master.subnetAllocator == nil {
+		return
+	}
+	allocator, err := master.newSubnetAllocator(master.networkInfo.ClusterNetworks)
+	if err != nil {
+		for _, p := range problems {
+			if p.Repaired && p.node != nil {
+				p.Repaired, p.RepairError = false, err
+			}
+		}
+		return
+	}
+	master.subnetAllocator = allocator
+
+	for _, p := range problems {
+		if !p.Repaired || p.node == nil {
+			continue
+		}
+		hostSubnetLength, err := master.getHostSubnetLength(p.node)
+		if err == nil {
+			err = master.addNode(p.node.Name, p.hostSubnet.HostIP, hostSubnetLength)
+		}
+		if err != nil {
+			p.Repaired, p.RepairError = false, err
+		}
+	}
+}
+
+// repairNetNamespaces repairs problems, given the VNIDs in use by NetNamespaces
+// without problems
+func (master *OsdnMaster) repairNetNamespaces(problems []*ConsistencyProblem, inUse []uint) {
+	if len(problems) == 0 {
+		return
+	}
+
+	allocator, err := master.newNetIDAllocator(inUse)
+	if err != nil {
+		for _, p := range problems {
+			p.RepairError = err
+		}
+		return
+	}
+
+	// NetNamespaces that shared an invalid VNID share its replacement
+	replacements := make(map[uint]uint)
+	for _, p := range problems {
+		switch p.Kind {
+		case OrphanedNetNamespace:
+			p.RepairError = master.registry.DeleteNetNamespace(p.Name)
+			if p.RepairError == nil {
+				master.vnids.UnsetVNID(p.netns.NetName)
+			}
+
+		case InvalidVNID:
+			netid, ok := replacements[p.netns.NetID]
+			if !ok {
+				netid, p.RepairError = allocator.GetNetID()
+				if p.RepairError != nil {
+					break
+				}
+				replacements[p.netns.NetID] = netid
+			}
+			p.netns.NetID = netid
+			if _, p.RepairError = master.registry.UpdateNetNamespace(p.netns); p.RepairError == nil {
+				master.vnids.SetVNID(p.netns.NetName, netid)
+			}
+		}
+		p.Repaired = (p.RepairError == nil)
+	}
+
+	// If the master is running, replace its allocator with the repaired one
+	if master.netIDManager != nil {
+		master.netIDManager = allocator
+	}
+}
@@ -0,0 +1,129 @@
+package osdn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/openshift/openshift-sdn/plugins/osdn/api"
+
+	osapi "github.com/openshift/origin/pkg/sdn/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func newConsistencyTestMaster() *OsdnMaster {
+	_, clusterNetwork, _ := net.ParseCIDR("10.1.0.0/16")
+	return &OsdnMaster{
+		networkInfo: &NetworkInfo{
+			ClusterNetworks: []ClusterNetworkEntry{{CIDR: clusterNetwork, HostSubnetLength: 8}},
+		},
+		excludedSubnets: []string{"10.1.128.0/20"},
+		reservedVNIDs:   []api.VNIDRange{{Name: "test", Min: 100, Max: 199}},
+		vnids:           newVnidMap(),
+	}
+}
+
+func newHostSubnet(host, subnet string) osapi.HostSubnet {
+	sub := osapi.HostSubnet{Host: host, HostIP: "192.168.1.1", Subnet: subnet}
+	sub.Name = host
+	return sub
+}
+
+func TestCheckHostSubnets(t *testing.T) {
+	master := newConsistencyTestMaster()
+	var nodes []kapi.Node
+	for _, name := range []string{"node1", "node2"} {
+		node := kapi.Node{}
+		node.Name = name
+		nodes = append(nodes, node)
+	}
+	// node1's subnet is always checked first, so it is the valid one
+	node1Subnet := newHostSubnet("node1", "10.1.0.0/24")
+
+	for _, tc := range []struct {
+		name   string
+		subnet osapi.HostSubnet
+		kind   ConsistencyProblemKind
+	}{
+		{"valid", newHostSubnet("node2", "10.1.1.0/24"), ""},
+		{"overlapping", newHostSubnet("node2", "10.1.0.128/25"), OverlappingHostSubnet},
+		{"containing", newHostSubnet("node2", "10.1.0.0/23"), OverlappingHostSubnet},
+		{"outside cluster network", newHostSubnet("node2", "10.2.0.0/24"), HostSubnetOutsideClusterNetwork},
+		{"larger than cluster network", newHostSubnet("node2", "10.0.0.0/15"), HostSubnetOutsideClusterNetwork},
+		{"unparseable", newHostSubnet("node2", "10.1.1.0"), HostSubnetOutsideClusterNetwork},
+		{"in excluded subnet", newHostSubnet("node2", "10.1.130.0/24"), HostSubnetInExcludedSubnet},
+		{"containing excluded subnet", newHostSubnet("node2", "10.1.128.0/17"), HostSubnetInExcludedSubnet},
+		{"orphaned", newHostSubnet("node3", "10.1.1.0/24"), OrphanedHostSubnet},
+		// A missing node takes precedence over a bad subnet
+		{"orphaned and outside cluster network", newHostSubnet("node3", "10.2.0.0/24"), OrphanedHostSubnet},
+	} {
+		problems := master.findHostSubnetProblems([]osapi.HostSubnet{node1Subnet, tc.subnet}, nodes)
+		if tc.kind == "" {
+			if len(problems) != 0 {
+				t.Errorf("%s: unexpected problems %v", tc.name, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 {
+			t.Errorf("%s: expected 1 problem, got %v", tc.name, problems)
+			continue
+		}
+		p := problems[0]
+		if p.Kind != tc.kind || p.Resource != HostSubnets || p.Name != tc.subnet.Name {
+			t.Errorf("%s: expected %s problem with HostSubnet %q, got %s", tc.name, tc.kind, tc.subnet.Name, p)
+		}
+		if (p.node != nil) != (tc.kind != OrphanedHostSubnet) {
+			t.Errorf("%s: wrong node %v for %s problem", tc.name, p.node, p.Kind)
+		}
+	}
+}
+
+func TestCheckNetNamespaces(t *testing.T) {
+	master := newConsistencyTestMaster()
+	var namespaces []kapi.Namespace
+	for _, name := range []string{"default", "ns1", "ns2"} {
+		ns := kapi.Namespace{}
+		ns.Name = name
+		namespaces = append(namespaces, ns)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		vnid      uint
+		kind      ConsistencyProblemKind
+	}{
+		{"valid", "ns1", 10, ""},
+		{"admin", "default", AdminVNID, ""},
+		{"internally reserved", "ns1", 1, InvalidVNID},
+		{"reserved by options", "ns1", 150, InvalidVNID},
+		{"out of range", "ns1", MaxVNID + 1, InvalidVNID},
+		{"orphaned", "ns3", 10, OrphanedNetNamespace},
+		// A missing namespace takes precedence over a bad VNID
+		{"orphaned and reserved", "ns3", 1, OrphanedNetNamespace},
+	} {
+		netns := osapi.NetNamespace{NetName: tc.namespace, NetID: tc.vnid}
+		netns.Name = tc.namespace
+		valid := osapi.NetNamespace{NetName: "ns2", NetID: 11}
+		valid.Name = "ns2"
+
+		problems, inUse := master.findNetNamespaceProblems([]osapi.NetNamespace{netns, valid}, namespaces)
+		expectedInUse := []uint{11}
+		if tc.kind == "" {
+			if len(problems) != 0 {
+				t.Errorf("%s: unexpected problems %v", tc.name, problems)
+			}
+			if tc.vnid != AdminVNID {
+				expectedInUse = []uint{tc.vnid, 11}
+			}
+		} else if len(problems) != 1 {
+			t.Errorf("%s: expected 1 problem, got %v", tc.name, problems)
+		} else if p := problems[0]; p.Kind != tc.kind || p.Resource != NetNamespaces || p.Name != tc.namespace {
+			t.Errorf("%s: expected %s problem with NetNamespace %q, got %s", tc.name, tc.kind, tc.namespace, p)
+		}
+		if !reflect.DeepEqual(inUse, expectedInUse) {
+			t.Errorf("%s: expected VNIDs in use %v, got %v", tc.name, expectedInUse, inUse)
+		}
+	}
+}
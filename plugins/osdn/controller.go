@@ -1,15 +1,16 @@
 package osdn
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net"
-	"os/exec"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/openshift/openshift-sdn/pkg/exec"
 	"github.com/openshift/openshift-sdn/pkg/ipcmd"
 	"github.com/openshift/openshift-sdn/pkg/netutils"
 	"github.com/openshift/openshift-sdn/pkg/ovs"
@@ -21,9 +22,8 @@ import (
 
 const (
 	// rule versioning; increment each time flow rules change
-	VERSION        = 1
-	VERSION_TABLE  = "table=253"
-	VERSION_ACTION = "actions=note:"
+	VERSION       = 3
+	VERSION_TABLE = 253
 
 	BR       = "br0"
 	LBR      = "lbr0"
@@ -33,95 +33,91 @@ const (
 	VXLAN    = "vxlan0"
 
 	VXLAN_PORT = "4789"
+
+	VXLAN_OFPORT  = 1
+	TUN_OFPORT    = 2
+	VOVSBR_OFPORT = 3
 )
 
-func getPluginVersion(multitenant bool) []string {
+// brProperties are the properties of br0. (OpenFlow 1.4 is needed for bundles.)
+var brProperties = []string{"fail-mode=secure", "protocols=OpenFlow13,OpenFlow14"}
+
+// configFile is the config file read by openshift-sdn-ovs
+var configFile = "/run/openshift-sdn/config.env"
+
+// setSysctl sets a sysctl; it can be overridden for testing
+var setSysctl = sysctl.SetSysctl
+
+// getPluginVersion returns the contents of the version note in table 253: the
+// first byte is the plugin type (multi-tenant/single-tenant) and the second
+// byte is the flow rule version.
+func getPluginVersion(multitenant bool) []byte {
 	if VERSION > 254 {
 		panic("Version too large!")
 	}
-	version := fmt.Sprintf("%02X", VERSION)
 	if multitenant {
-		return []string{"01", version}
+		return []byte{0x01, VERSION}
 	}
 	// single-tenant
-	return []string{"00", version}
+	return []byte{0x00, VERSION}
 }
 
-func alreadySetUp(multitenant bool, localSubnetGatewayCIDR string) bool {
-	var found bool
-
-	itx := ipcmd.NewTransaction(LBR)
-	addrs, err := itx.GetAddresses()
+func alreadySetUp(execer exec.Executor, multitenant bool, localSubnetGatewayCIDR string) bool {
+	itx := ipcmd.NewTransaction(execer, LBR)
+	addr, err := itx.FindAddress(localSubnetGatewayCIDR)
 	itx.EndTransaction()
-	if err != nil {
-		return false
-	}
-	found = false
-	for _, addr := range addrs {
-		if addr == localSubnetGatewayCIDR {
-			found = true
-			break
-		}
-	}
-	if !found {
+	if err != nil || addr == nil {
 		return false
 	}
 
-	otx := ovs.NewTransaction(BR)
-	flows, err := otx.DumpFlows()
+	return versionFlowPresent(execer, multitenant)
+}
+
+// versionFlowPresent returns true if br0 has the version flow for the current
+// flow rule version and plugin type. If it does not, then either SetupSDN has
+// not yet completed, or br0's flows have been lost (eg, because ovs-vswitchd
+// was restarted or someone deleted them by hand).
+func versionFlowPresent(execer exec.Executor, multitenant bool) bool {
+	otx := ovs.NewTransaction(execer, BR)
+	flows, err := otx.ListFlows()
 	otx.EndTransaction()
 	if err != nil {
 		return false
 	}
-	found = false
+	expected := getPluginVersion(multitenant)
 	for _, flow := range flows {
-		if !strings.Contains(flow, VERSION_TABLE) {
+		if flow.Table != VERSION_TABLE {
 			continue
 		}
-		idx := strings.Index(flow, VERSION_ACTION)
-		if idx < 0 {
-			continue
+		// OVS pads the note with 0s, so only compare the start
+		existing := flow.NoteBytes()
+		if len(existing) >= len(expected) && bytes.Equal(existing[:len(expected)], expected) {
+			return true
 		}
-
-		// OVS note action format hex bytes separated by '.'; first
-		// byte is plugin type (multi-tenant/single-tenant) and second
-		// byte is flow rule version
-		expected := getPluginVersion(multitenant)
-		existing := strings.Split(flow[idx+len(VERSION_ACTION):], ".")
-		if len(existing) >= 2 && existing[0] == expected[0] && existing[1] == expected[1] {
-			found = true
-			break
-		}
-	}
-	if !found {
-		return false
 	}
-
-	return true
+	return false
 }
 
-func deleteLocalSubnetRoute(device, localSubnetCIDR string) {
+func deleteLocalSubnetRoute(execer exec.Executor, device, localSubnetCIDR string) {
 	const (
 		timeInterval = 100 * time.Millisecond
 		maxIntervals = 20
 	)
 
 	for i := 0; i < maxIntervals; i++ {
-		itx := ipcmd.NewTransaction(device)
-		routes, err := itx.GetRoutes()
+		itx := ipcmd.NewTransaction(execer, device)
+		routes, err := itx.FindRoutes(localSubnetCIDR)
 		if err != nil {
 			glog.Errorf("Could not get routes for dev %s: %v", device, err)
 			return
 		}
-		for _, route := range routes {
-			if strings.Contains(route, localSubnetCIDR) {
-				itx.DeleteRoute(localSubnetCIDR)
-				err = itx.EndTransaction()
-				if err != nil {
-					glog.Errorf("Could not delete subnet route %s from dev %s: %v", localSubnetCIDR, device, err)
-				}
-				return
+		if len(routes) > 0 {
+			itx.DeleteRoute(localSubnetCIDR)
+			err = itx.EndTransaction()
+			if err != nil {
+				glog.Errorf("Could not delete subnet route %s from dev %s: %v", localSubnetCIDR, device, err)
 			}
+			return
 		}
 
 		time.Sleep(timeInterval)
@@ -130,23 +126,122 @@ func deleteLocalSubnetRoute(device, localSubnetCIDR string) {
 	glog.Errorf("Timed out looking for %s route for dev %s; if it appears later it will not be deleted.", localSubnetCIDR, device)
 }
 
-func (plugin *OsdnNode) SetupSDN(localSubnetCIDR, clusterNetworkCIDR, servicesNetworkCIDR string, mtu uint) (bool, error) {
+// getBaseFlows returns the flows that SetupSDN installs on br0: the static
+// flows of sdnPipeline. (The dynamic flows, which are added later, are not
+// included.)
+func getBaseFlows(localSubnetCIDR, localSubnetGateway string, clusterNetworkCIDRs []string, servicesNetworkCIDR string) ([]*ovs.Flow, error) {
+	return renderFlows("", 0, ovs.PipelineVars{
+		"local_subnet":    {localSubnetCIDR},
+		"local_gateway":   {localSubnetGateway},
+		"cluster_network": clusterNetworkCIDRs,
+		"service_network": {servicesNetworkCIDR},
+	})
+}
+
+// isDynamicFlow returns true for flows that are not created by getBaseFlows():
+// those that are owned by pods, HostSubnets, or services (as recorded in
+// their cookies), and the version flow, which SetupSDN only adds once
+// everything else has been set up.
+func isDynamicFlow(flow *ovs.Flow) bool {
+	return flow.Owner() != ovs.OwnerUnknown || flow.Table == VERSION_TABLE
+}
+
+// writeConfig writes the config file read by openshift-sdn-ovs
+func writeConfig(clusterNetworkCIDRs []string) error {
+	config := fmt.Sprintf("export OPENSHIFT_CLUSTER_SUBNET=%q", strings.Join(clusterNetworkCIDRs, " "))
+	return ioutil.WriteFile(configFile, []byte(config), 0644)
+}
+
+// ensureAddress adds cidr to itx's interface unless it already has it, and
+// returns true if it was added
+func ensureAddress(itx *ipcmd.Transaction, cidr string) bool {
+	addr, err := itx.FindAddress(cidr)
+	if err != nil || addr != nil {
+		return false
+	}
+	itx.AddAddress(cidr)
+	return true
+}
+
+// ensureRoute adds a route for cidr to itx's interface unless it already has
+// one
+func ensureRoute(itx *ipcmd.Transaction, cidr string, args ...string) {
+	routes, err := itx.FindRoutes(cidr)
+	if err == nil && len(routes) == 0 {
+		itx.AddRoute(cidr, args...)
+	}
+}
+
+// ensureClusterNetworkRoutes adds routes to tun0 for any of clusterNetworkCIDRs
+// that it doesn't have a route for
+func ensureClusterNetworkRoutes(execer exec.Executor, clusterNetworkCIDRs []string) error {
+	itx := ipcmd.NewTransaction(execer, TUN)
+	for _, clusterNetworkCIDR := range clusterNetworkCIDRs {
+		ensureRoute(itx, clusterNetworkCIDR, "proto", "kernel", "scope", "link")
+	}
+	return itx.EndTransaction()
+}
+
+// rollbacker is implemented by ipcmd.Transaction and ovs.Transaction
+type rollbacker interface {
+	Rollback() error
+}
+
+func (plugin *OsdnNode) SetupSDN(localSubnetCIDR string, clusterNetworkCIDRs []string, servicesNetworkCIDR string, mtu uint) (bool, error) {
 	_, ipnet, err := net.ParseCIDR(localSubnetCIDR)
 	localSubnetMaskLength, _ := ipnet.Mask.Size()
 	localSubnetGateway := netutils.GenerateDefaultGateway(ipnet).String()
 
 	glog.V(5).Infof("[SDN setup] node pod subnet %s gateway %s", ipnet.String(), localSubnetGateway)
 
+	baseFlows, err := getBaseFlows(localSubnetCIDR, localSubnetGateway, clusterNetworkCIDRs, servicesNetworkCIDR)
+	if err != nil {
+		return false, err
+	}
+
 	gwCIDR := fmt.Sprintf("%s/%d", localSubnetGateway, localSubnetMaskLength)
-	if alreadySetUp(plugin.multitenant, gwCIDR) {
-		glog.V(5).Infof("[SDN setup] no SDN setup required")
+	if alreadySetUp(plugin.execer, plugin.multitenant, gwCIDR) {
+		// Even so, make sure that br0 is configured as we expect (it
+		// may have been created by an older version), and that no flows
+		// have gone missing or been modified by hand
+		glog.V(5).Infof("[SDN setup] no SDN setup required; syncing flows")
+		otx := ovs.NewTransaction(plugin.execer, BR)
+		otx.EnsureBridge(brProperties...)
+		otx.SyncFlows(baseFlows, isDynamicFlow)
+		err = otx.EndTransaction()
+		if err != nil {
+			return false, err
+		}
+		// and that any cluster networks added since then are routed
+		if err = ensureClusterNetworkRoutes(plugin.execer, clusterNetworkCIDRs); err != nil {
+			return false, err
+		}
+		if err = writeConfig(clusterNetworkCIDRs); err != nil {
+			return false, err
+		}
 		return false, nil
 	}
 	glog.V(5).Infof("[SDN setup] full SDN setup required")
 
 	mtuStr := fmt.Sprint(mtu)
 
-	itx := ipcmd.NewTransaction(LBR)
+	// If setup fails partway through, undo the changes made so far so
+	// that the node is left as we found it
+	var undo []rollbacker
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i].Rollback(); err != nil {
+				glog.Warningf("[SDN setup] could not roll back partial setup: %v", err)
+			}
+		}
+	}()
+
+	itx := ipcmd.NewTransaction(plugin.execer, LBR)
+	undo = append(undo, itx)
 	itx.SetLink("down")
 	itx.IgnoreError()
 	itx.DeleteLink()
@@ -159,10 +254,11 @@ func (plugin *OsdnNode) SetupSDN(localSubnetCIDR, clusterNetworkCIDR, servicesNe
 		glog.Errorf("Failed to configure docker bridge: %v", err)
 		return false, err
 	}
-	defer deleteLocalSubnetRoute(LBR, localSubnetCIDR)
+	defer deleteLocalSubnetRoute(plugin.execer, LBR, localSubnetCIDR)
 
-	glog.V(5).Infof("[SDN setup] docker setup %s mtu %s", LBR, mtuStr)
-	out, err := exec.Command("openshift-sdn-docker-setup.sh", LBR, mtuStr).CombinedOutput()
+	dockerSubnet := getDockerSubnet(ipnet).String()
+	glog.V(5).Infof("[SDN setup] docker setup %s mtu %s subnet %s", LBR, mtuStr, dockerSubnet)
+	out, err := plugin.execer.Exec("openshift-sdn-docker-setup.sh", LBR, mtuStr, dockerSubnet)
 	if err != nil {
 		glog.Errorf("Failed to configure docker networking: %v\n%s", err, out)
 		return false, err
@@ -170,13 +266,13 @@ func (plugin *OsdnNode) SetupSDN(localSubnetCIDR, clusterNetworkCIDR, servicesNe
 		glog.V(5).Infof("[SDN setup] docker setup success:\n%s", out)
 	}
 
-	config := fmt.Sprintf("export OPENSHIFT_CLUSTER_SUBNET=%s", clusterNetworkCIDR)
-	err = ioutil.WriteFile("/run/openshift-sdn/config.env", []byte(config), 0644)
+	err = writeConfig(clusterNetworkCIDRs)
 	if err != nil {
 		return false, err
 	}
 
-	itx = ipcmd.NewTransaction(VLINUXBR)
+	itx = ipcmd.NewTransaction(plugin.execer, VLINUXBR)
+	undo = append(undo, itx)
 	itx.DeleteLink()
 	itx.IgnoreError()
 	itx.AddLink("mtu", mtuStr, "type", "veth", "peer", "name", VOVSBR, "mtu", mtuStr)
@@ -187,7 +283,8 @@ func (plugin *OsdnNode) SetupSDN(localSubnetCIDR, clusterNetworkCIDR, servicesNe
 		return false, err
 	}
 
-	itx = ipcmd.NewTransaction(VOVSBR)
+	itx = ipcmd.NewTransaction(plugin.execer, VOVSBR)
+	undo = append(undo, itx)
 	itx.SetLink("up")
 	itx.SetLink("txqueuelen", "0")
 	err = itx.EndTransaction()
@@ -195,99 +292,36 @@ func (plugin *OsdnNode) SetupSDN(localSubnetCIDR, clusterNetworkCIDR, servicesNe
 		return false, err
 	}
 
-	itx = ipcmd.NewTransaction(LBR)
+	itx = ipcmd.NewTransaction(plugin.execer, LBR)
+	undo = append(undo, itx)
 	itx.AddSlave(VLINUXBR)
 	err = itx.EndTransaction()
 	if err != nil {
 		return false, err
 	}
 
-	otx := ovs.NewTransaction(BR)
-	otx.AddBridge("fail-mode=secure", "protocols=OpenFlow13")
-	otx.AddPort(VXLAN, 1, "type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`)
-	otx.AddPort(TUN, 2, "type=internal")
-	otx.AddPort(VOVSBR, 3)
-
-	// Table 0: initial dispatch based on in_port
-	// vxlan0
-	otx.AddFlow("table=0, priority=200, in_port=1, arp, nw_src=%s, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1", clusterNetworkCIDR, localSubnetCIDR)
-	otx.AddFlow("table=0, priority=200, in_port=1, ip, nw_src=%s, nw_dst=%s, actions=move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[],goto_table:1", clusterNetworkCIDR, localSubnetCIDR)
-	otx.AddFlow("table=0, priority=150, in_port=1, actions=drop")
-	// tun0
-	otx.AddFlow("table=0, priority=200, in_port=2, arp, nw_src=%s, nw_dst=%s, actions=goto_table:5", localSubnetGateway, clusterNetworkCIDR)
-	otx.AddFlow("table=0, priority=200, in_port=2, ip, actions=goto_table:5")
-	otx.AddFlow("table=0, priority=150, in_port=2, actions=drop")
-	// vovsbr
-	otx.AddFlow("table=0, priority=200, in_port=3, arp, nw_src=%s, actions=goto_table:5", localSubnetCIDR)
-	otx.AddFlow("table=0, priority=200, in_port=3, ip, nw_src=%s, actions=goto_table:5", localSubnetCIDR)
-	otx.AddFlow("table=0, priority=150, in_port=3, actions=drop")
-	// else, from a container
-	otx.AddFlow("table=0, priority=100, arp, actions=goto_table:2")
-	otx.AddFlow("table=0, priority=100, ip, actions=goto_table:2")
-	otx.AddFlow("table=0, priority=0, actions=drop")
-
-	// Table 1: VXLAN ingress filtering; filled in by AddHostSubnetRules()
-	// eg, "table=1, priority=100, tun_src=${remote_node_ip}, actions=goto_table:5"
-	otx.AddFlow("table=1, priority=0, actions=drop")
-
-	// Table 2: from OpenShift container; validate IP/MAC, assign tenant-id; filled in by openshift-sdn-ovs
-	// eg, "table=2, priority=100, in_port=${ovs_port}, arp, nw_src=${ipaddr}, arp_sha=${macaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:5"
-	//     "table=2, priority=100, in_port=${ovs_port}, ip, nw_src=${ipaddr}, actions=load:${tenant_id}->NXM_NX_REG0[], goto_table:3"
-	// (${tenant_id} is always 0 for single-tenant)
-	otx.AddFlow("table=2, priority=0, actions=drop")
-
-	// Table 3: from OpenShift container; service vs non-service
-	otx.AddFlow("table=3, priority=100, ip, nw_dst=%s, actions=goto_table:4", servicesNetworkCIDR)
-	otx.AddFlow("table=3, priority=0, actions=goto_table:5")
-
-	// Table 4: from OpenShift container; service dispatch; filled in by AddServiceRules()
-	otx.AddFlow("table=4, priority=200, reg0=0, actions=output:2")
-	// eg, "table=4, priority=100, reg0=${tenant_id}, ${service_proto}, nw_dst=${service_ip}, tp_dst=${service_port}, actions=output:2"
-	otx.AddFlow("table=4, priority=0, actions=drop")
-
-	// Table 5: general routing
-	otx.AddFlow("table=5, priority=300, arp, nw_dst=%s, actions=output:2", localSubnetGateway)
-	otx.AddFlow("table=5, priority=300, ip, nw_dst=%s, actions=output:2", localSubnetGateway)
-	otx.AddFlow("table=5, priority=200, arp, nw_dst=%s, actions=goto_table:6", localSubnetCIDR)
-	otx.AddFlow("table=5, priority=200, ip, nw_dst=%s, actions=goto_table:7", localSubnetCIDR)
-	otx.AddFlow("table=5, priority=100, arp, nw_dst=%s, actions=goto_table:8", clusterNetworkCIDR)
-	otx.AddFlow("table=5, priority=100, ip, nw_dst=%s, actions=goto_table:8", clusterNetworkCIDR)
-	otx.AddFlow("table=5, priority=0, ip, actions=output:2")
-	otx.AddFlow("table=5, priority=0, arp, actions=drop")
-
-	// Table 6: ARP to container, filled in by openshift-sdn-ovs
-	// eg, "table=6, priority=100, arp, nw_dst=${container_ip}, actions=output:${ovs_port}"
-	otx.AddFlow("table=6, priority=0, actions=output:3")
-
-	// Table 7: IP to container; filled in by openshift-sdn-ovs
-	// eg, "table=7, priority=100, reg0=0, ip, nw_dst=${ipaddr}, actions=output:${ovs_port}"
-	// eg, "table=7, priority=100, reg0=${tenant_id}, ip, nw_dst=${ipaddr}, actions=output:${ovs_port}"
-	otx.AddFlow("table=7, priority=0, actions=output:3")
-
-	// Table 8: to remote container; filled in by AddHostSubnetRules()
-	// eg, "table=8, priority=100, arp, nw_dst=${remote_subnet_cidr}, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${remote_node_ip}->tun_dst,output:1"
-	// eg, "table=8, priority=100, ip, nw_dst=${remote_subnet_cidr}, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${remote_node_ip}->tun_dst,output:1"
-	otx.AddFlow("table=8, priority=0, actions=drop")
-
+	otx := ovs.NewTransaction(plugin.execer, BR)
+	undo = append(undo, otx)
+	setupBridge(otx, baseFlows)
 	err = otx.EndTransaction()
 	if err != nil {
 		return false, err
 	}
 
-	itx = ipcmd.NewTransaction(TUN)
-	itx.AddAddress(gwCIDR)
-	defer deleteLocalSubnetRoute(TUN, localSubnetCIDR)
-	itx.SetLink("mtu", mtuStr)
-	itx.SetLink("up")
-	itx.AddRoute(clusterNetworkCIDR, "proto", "kernel", "scope", "link")
-	itx.AddRoute(servicesNetworkCIDR)
+	// tun0 is kept along with br0, so it may still be configured from
+	// an earlier setup
+	itx = ipcmd.NewTransaction(plugin.execer, TUN)
+	undo = append(undo, itx)
+	if setupTun0(itx, gwCIDR, clusterNetworkCIDRs, servicesNetworkCIDR, mtuStr) {
+		defer deleteLocalSubnetRoute(plugin.execer, TUN, localSubnetCIDR)
+	}
 	err = itx.EndTransaction()
 	if err != nil {
 		return false, err
 	}
 
 	// Clean up docker0 since docker won't
-	itx = ipcmd.NewTransaction("docker0")
+	itx = ipcmd.NewTransaction(plugin.execer, "docker0")
 	itx.SetLink("down")
 	itx.IgnoreError()
 	itx.DeleteLink()
@@ -297,8 +331,8 @@ func (plugin *OsdnNode) SetupSDN(localSubnetCIDR, clusterNetworkCIDR, servicesNe
 	// Disable iptables for linux bridges (and in particular lbr0), ignoring errors.
 	// (This has to have been performed in advance for docker-in-docker deployments,
 	// since this will fail there).
-	_, _ = exec.Command("modprobe", "br_netfilter").CombinedOutput()
-	err = sysctl.SetSysctl("net/bridge/bridge-nf-call-iptables", 0)
+	_, _ = plugin.execer.Exec("modprobe", "br_netfilter")
+	err = setSysctl("net/bridge/bridge-nf-call-iptables", 0)
 	if err != nil {
 		glog.Warningf("Could not set net.bridge.bridge-nf-call-iptables sysctl: %s", err)
 	} else {
@@ -306,36 +340,86 @@ func (plugin *OsdnNode) SetupSDN(localSubnetCIDR, clusterNetworkCIDR, servicesNe
 	}
 
 	// Enable IP forwarding for ipv4 packets
-	err = sysctl.SetSysctl("net/ipv4/ip_forward", 1)
+	err = setSysctl("net/ipv4/ip_forward", 1)
 	if err != nil {
 		return false, fmt.Errorf("Could not enable IPv4 forwarding: %s", err)
 	}
-	err = sysctl.SetSysctl(fmt.Sprintf("net/ipv4/conf/%s/forwarding", TUN), 1)
+	err = setSysctl(fmt.Sprintf("net/ipv4/conf/%s/forwarding", TUN), 1)
 	if err != nil {
 		return false, fmt.Errorf("Could not enable IPv4 forwarding on %s: %s", TUN, err)
 	}
 
-	// Table 253: rule version; note action is hex bytes separated by '.'
-	otx = ovs.NewTransaction(BR)
-	pluginVersion := getPluginVersion(plugin.multitenant)
-	otx.AddFlow("%s, %s%s.%s", VERSION_TABLE, VERSION_ACTION, pluginVersion[0], pluginVersion[1])
-	err = otx.EndTransaction()
-	if err != nil {
+	if err = addVersionFlow(plugin.execer, plugin.multitenant); err != nil {
 		return false, err
 	}
 
+	succeeded = true
 	return true, nil
 }
 
+// setupBridge queues the operations to create or fix br0, its ports, and its
+// static flows on otx
+func setupBridge(otx *ovs.Transaction, baseFlows []*ovs.Flow) {
+	otx.EnsureBridge(brProperties...)
+	otx.EnsurePort(VXLAN, VXLAN_OFPORT, "type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`)
+	otx.EnsurePort(TUN, TUN_OFPORT, "type=internal")
+	otx.EnsurePort(VOVSBR, VOVSBR_OFPORT)
+	otx.SyncFlows(baseFlows, isDynamicFlow)
+}
+
+// setupTun0 queues the operations to configure tun0 on itx, leaving its
+// address and routes alone if they are already present. It returns true if
+// the address was added.
+func setupTun0(itx *ipcmd.Transaction, gwCIDR string, clusterNetworkCIDRs []string, servicesNetworkCIDR, mtuStr string) bool {
+	added := ensureAddress(itx, gwCIDR)
+	itx.SetLink("mtu", mtuStr)
+	itx.SetLink("up")
+	for _, clusterNetworkCIDR := range clusterNetworkCIDRs {
+		ensureRoute(itx, clusterNetworkCIDR, "proto", "kernel", "scope", "link")
+	}
+	ensureRoute(itx, servicesNetworkCIDR)
+	return added
+}
+
+// addVersionFlow adds the table 253 version flow, which marks br0 as fully
+// set up
+func addVersionFlow(execer exec.Executor, multitenant bool) error {
+	// Table 253: rule version; note action is hex bytes separated by '.'
+	versionFlows, err := renderFlows(versionFlowKind, 0, ovs.PipelineVars{
+		"version": {ovs.Note(getPluginVersion(multitenant)...).Arg},
+	})
+	if err != nil {
+		return err
+	}
+	otx := ovs.NewTransaction(execer, BR)
+	otx.AddFlows(versionFlows...)
+	return otx.EndTransaction()
+}
+
+// getHostSubnetCookie returns the cookie for the flows that direct traffic to
+// the node with the given HostSubnet
+func getHostSubnetCookie(subnet *osapi.HostSubnet) uint64 {
+	return ovs.NewCookie(ovs.OwnerHostSubnet, subnet.Name)
+}
+
 func (plugin *OsdnNode) AddHostSubnetRules(subnet *osapi.HostSubnet) error {
-	glog.Infof("AddHostSubnetRules for %s", hostSubnetToString(subnet))
-	otx := ovs.NewTransaction(BR)
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
 
-	otx.AddFlow("table=1, priority=100, tun_src=%s, actions=goto_table:5", subnet.HostIP)
-	otx.AddFlow("table=8, priority=100, arp, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, subnet.HostIP)
-	otx.AddFlow("table=8, priority=100, ip, nw_dst=%s, actions=move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31],set_field:%s->tun_dst,output:1", subnet.Subnet, subnet.HostIP)
+	return plugin.addHostSubnetRules(subnet)
+}
 
-	err := otx.EndTransaction()
+// addHostSubnetRules is AddHostSubnetRules without the locking
+func (plugin *OsdnNode) addHostSubnetRules(subnet *osapi.HostSubnet) error {
+	glog.Infof("AddHostSubnetRules for %s", hostSubnetToString(subnet))
+	flows, err := getHostSubnetFlows(getHostSubnetCookie(subnet), subnet.HostIP, subnet.Subnet)
+	if err != nil {
+		return err
+	}
+
+	otx := ovs.NewTransaction(plugin.execer, BR)
+	otx.AddFlows(flows...)
+	err = otx.EndTransaction()
 	if err != nil {
 		return fmt.Errorf("Error adding OVS flows for subnet: %v, %v", subnet, err)
 	}
@@ -343,11 +427,13 @@ func (plugin *OsdnNode) AddHostSubnetRules(subnet *osapi.HostSubnet) error {
 }
 
 func (plugin *OsdnNode) DeleteHostSubnetRules(subnet *osapi.HostSubnet) error {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+
 	glog.Infof("DeleteHostSubnetRules for %s", hostSubnetToString(subnet))
 
-	otx := ovs.NewTransaction(BR)
-	otx.DeleteFlows("table=1, tun_src=%s", subnet.HostIP)
-	otx.DeleteFlows("table=8, nw_dst=%s", subnet.Subnet)
+	otx := ovs.NewTransaction(plugin.execer, BR)
+	otx.DeleteFlowsByCookie(getHostSubnetCookie(subnet), ovs.CookieExactMask)
 	err := otx.EndTransaction()
 	if err != nil {
 		return fmt.Errorf("Error deleting OVS flows for subnet: %v, %v", subnet, err)
@@ -355,20 +441,39 @@ func (plugin *OsdnNode) DeleteHostSubnetRules(subnet *osapi.HostSubnet) error {
 	return nil
 }
 
+// getServiceCookie returns the cookie for the flows that direct traffic to
+// the given service
+func getServiceCookie(service *kapi.Service) uint64 {
+	return ovs.NewCookie(ovs.OwnerService, service.Namespace+"/"+service.Name)
+}
+
 func (plugin *OsdnNode) AddServiceRules(service *kapi.Service, netID uint) error {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+
+	return plugin.addServiceRules(service, netID)
+}
+
+// addServiceRules is AddServiceRules without the locking
+func (plugin *OsdnNode) addServiceRules(service *kapi.Service, netID uint) error {
 	if !plugin.multitenant {
 		return nil
 	}
 
 	glog.V(5).Infof("AddServiceRules for %v", service)
 
-	otx := ovs.NewTransaction(BR)
+	otx := ovs.NewTransaction(plugin.execer, BR)
+	cookie := getServiceCookie(service)
 	for _, port := range service.Spec.Ports {
-		otx.AddFlow(generateAddServiceRule(netID, service.Spec.ClusterIP, port.Protocol, int(port.Port)))
-		err := otx.EndTransaction()
+		flows, err := getServiceFlows(cookie, netID, service.Spec.ClusterIP, string(port.Protocol), int(port.Port))
 		if err != nil {
-			return fmt.Errorf("Error adding OVS flows for service: %v, netid: %d, %v", service, netID, err)
+			return err
 		}
+		otx.AddFlows(flows...)
+	}
+	err := otx.EndTransaction()
+	if err != nil {
+		return fmt.Errorf("Error adding OVS flows for service: %v, netid: %d, %v", service, netID, err)
 	}
 	return nil
 }
@@ -378,32 +483,16 @@ func (plugin *OsdnNode) DeleteServiceRules(service *kapi.Service) error {
 		return nil
 	}
 
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+
 	glog.V(5).Infof("DeleteServiceRules for %v", service)
 
-	otx := ovs.NewTransaction(BR)
-	for _, port := range service.Spec.Ports {
-		otx.DeleteFlows(generateDeleteServiceRule(service.Spec.ClusterIP, port.Protocol, int(port.Port)))
-		err := otx.EndTransaction()
-		if err != nil {
-			return fmt.Errorf("Error deleting OVS flows for service: %v, %v", service, err)
-		}
+	otx := ovs.NewTransaction(plugin.execer, BR)
+	otx.DeleteFlowsByCookie(getServiceCookie(service), ovs.CookieExactMask)
+	err := otx.EndTransaction()
+	if err != nil {
+		return fmt.Errorf("Error deleting OVS flows for service: %v, %v", service, err)
 	}
 	return nil
 }
-
-func generateBaseServiceRule(IP string, protocol kapi.Protocol, port int) string {
-	return fmt.Sprintf("table=4, %s, nw_dst=%s, tp_dst=%d", strings.ToLower(string(protocol)), IP, port)
-}
-
-func generateAddServiceRule(netID uint, IP string, protocol kapi.Protocol, port int) string {
-	baseRule := generateBaseServiceRule(IP, protocol, port)
-	if netID == 0 {
-		return fmt.Sprintf("%s, priority=100, actions=output:2", baseRule)
-	} else {
-		return fmt.Sprintf("%s, priority=100, reg0=%d, actions=output:2", baseRule, netID)
-	}
-}
-
-func generateDeleteServiceRule(IP string, protocol kapi.Protocol, port int) string {
-	return generateBaseServiceRule(IP, protocol, port)
-}
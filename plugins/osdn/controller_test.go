@@ -0,0 +1,255 @@
+package osdn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/ipcmd"
+	"github.com/openshift/openshift-sdn/pkg/ovs"
+	"github.com/openshift/openshift-sdn/pkg/ovs/ovstest"
+)
+
+const ofctlPath = "/usr/bin/ovs-ofctl"
+
+// fakeBridge is an exec.Executor that emulates the "ovs-ofctl" commands used
+// on br0, keeping its flows in memory, and passes all other commands to a
+// FakeExecutor.
+type fakeBridge struct {
+	*exec.FakeExecutor
+
+	lock  sync.Mutex
+	flows []*ovs.Flow
+}
+
+func newFakeBridge(programs ...string) *fakeBridge {
+	return &fakeBridge{FakeExecutor: exec.NewFakeExecutor(append(programs, ofctlPath)...)}
+}
+
+func (b *fakeBridge) Exec(cmd string, args ...string) (string, error) {
+	return b.ExecWithTimeout(0, "", cmd, args...)
+}
+
+func (b *fakeBridge) ExecWithInput(input string, cmd string, args ...string) (string, error) {
+	return b.ExecWithTimeout(0, input, cmd, args...)
+}
+
+func (b *fakeBridge) ExecWithTimeout(timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	return b.ExecWithCancel(nil, timeout, input, cmd, args...)
+}
+
+func (b *fakeBridge) ExecWithCancel(cancel <-chan struct{}, timeout time.Duration, input string, cmd string, args ...string) (string, error) {
+	if cmd != ofctlPath {
+		return b.FakeExecutor.ExecWithCancel(cancel, timeout, input, cmd, args...)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch strings.Join(args, " ") {
+	case "-O OpenFlow13 dump-flows br0":
+		out := "NXST_FLOW reply (xid=0x4):\n"
+		for _, flow := range b.flows {
+			dumped := *flow
+			dumped.Cookie = 0
+			out += fmt.Sprintf(" cookie=0x%x, %s\n", flow.Cookie, dumped.String())
+		}
+		return out, nil
+	case "-O OpenFlow14 --bundle add-flows br0 -":
+		for _, line := range strings.Split(strings.TrimSpace(input), "\n") {
+			if err := b.applyFlowMod(line); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("fakeBridge: unexpected command %s %s", cmd, strings.Join(args, " "))
+}
+
+// applyFlowMod applies a flow mod in the syntax used by "ovs-ofctl add-flows"
+func (b *fakeBridge) applyFlowMod(line string) error {
+	space := strings.Index(line, " ")
+	if space == -1 {
+		return fmt.Errorf("fakeBridge: bad flow mod %q", line)
+	}
+	verb, spec := line[:space], line[space+1:]
+
+	switch verb {
+	case "add":
+		flow, err := ovs.ParseFlow(spec)
+		if err != nil {
+			return err
+		}
+		b.deleteMatching(func(f *ovs.Flow) bool { return strictMatch(f, flow) })
+		b.flows = append(b.flows, flow)
+	case "delete_strict":
+		flow, err := ovs.ParseFlow(spec + ", actions=drop")
+		if err != nil {
+			return err
+		}
+		b.deleteMatching(func(f *ovs.Flow) bool { return strictMatch(f, flow) })
+	case "delete":
+		// The plugin only deletes flows loosely by cookie
+		parts := strings.Split(strings.TrimPrefix(spec, "cookie="), "/")
+		if len(parts) != 2 {
+			return fmt.Errorf("fakeBridge: unsupported delete %q", spec)
+		}
+		cookie, err1 := strconv.ParseUint(parts[0], 0, 64)
+		mask, err2 := strconv.ParseUint(parts[1], 0, 64)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("fakeBridge: bad cookie in %q", spec)
+		}
+		b.deleteMatching(func(f *ovs.Flow) bool { return f.Cookie&mask == cookie&mask })
+	default:
+		return fmt.Errorf("fakeBridge: bad flow mod %q", line)
+	}
+	return nil
+}
+
+func strictMatch(a, b *ovs.Flow) bool {
+	return a.Priority == b.Priority && a.MatchString() == b.MatchString()
+}
+
+func (b *fakeBridge) deleteMatching(match func(*ovs.Flow) bool) {
+	flows := b.flows[:0]
+	for _, flow := range b.flows {
+		if !match(flow) {
+			flows = append(flows, flow)
+		}
+	}
+	b.flows = flows
+}
+
+// Flows returns the flows currently on the bridge
+func (b *fakeBridge) Flows() []*ovs.Flow {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]*ovs.Flow(nil), b.flows...)
+}
+
+// DeleteAllFlows deletes the bridge's flows, like "ovs-ofctl del-flows br0"
+func (b *fakeBridge) DeleteAllFlows() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.flows = nil
+}
+
+// testSetup points the plugin at a fake OVSDB server with br0 and its ports
+// already created, a temporary config file, and a fake sysctl, and returns a
+// function that undoes all of that.
+func testSetup(t *testing.T) func() {
+	ipcmd.SetBackend(ipcmd.ExecBackend)
+
+	server, err := ovstest.NewFakeOVSDBServer()
+	if err != nil {
+		t.Fatalf("Could not start fake OVSDB server: %v", err)
+	}
+	ovs.SetOVSDBSocket(server.SocketPath())
+	otx := ovs.NewTransaction(exec.NewFakeExecutor(), BR)
+	otx.AddBridge(brProperties...)
+	otx.AddPort(VXLAN, VXLAN_OFPORT, "type=vxlan", `options:remote_ip="flow"`, `options:key="flow"`)
+	otx.AddPort(TUN, TUN_OFPORT, "type=internal")
+	otx.AddPort(VOVSBR, VOVSBR_OFPORT)
+	if err := otx.EndTransaction(); err != nil {
+		t.Fatalf("Could not create %s: %v", BR, err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "osdn-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	oldConfigFile := configFile
+	configFile = filepath.Join(tmpDir, "config.env")
+
+	oldSetSysctl := setSysctl
+	setSysctl = func(sysctl string, value int) error { return nil }
+
+	return func() {
+		setSysctl = oldSetSysctl
+		configFile = oldConfigFile
+		os.RemoveAll(tmpDir)
+		server.Close()
+	}
+}
+
+// Output of "ip" for the node's interfaces, as left by an earlier SetupSDN
+var ipShowResults = map[string]string{
+	"-o link show dev lbr0":            `4: lbr0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1450 qdisc noqueue state UP mode DEFAULT qlen 1000\    link/ether 0a:58:0a:01:00:01 brd ff:ff:ff:ff:ff:ff`,
+	"-o link show dev vovsbr":          `6: vovsbr: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1450 qdisc pfifo_fast state UP mode DEFAULT qlen 0\    link/ether 1a:2b:3c:4d:5e:6f brd ff:ff:ff:ff:ff:ff`,
+	"-o link show dev tun0":            `7: tun0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1450 qdisc noqueue state UNKNOWN mode DEFAULT qlen 1000\    link/ether 3e:01:02:03:04:05 brd ff:ff:ff:ff:ff:ff`,
+	"-o addr show dev lbr0":            `4: lbr0    inet 10.1.0.1/24 scope global lbr0\       valid_lft forever preferred_lft forever`,
+	"-o addr show dev tun0":            `7: tun0    inet 10.1.0.1/24 scope global tun0\       valid_lft forever preferred_lft forever`,
+	"-4 route show table all dev lbr0": "10.1.0.0/24 proto kernel scope link src 10.1.0.1\n",
+	"-4 route show table all dev tun0": "10.1.0.0/16 proto kernel scope link\n172.30.0.0/16 scope link\n",
+	"-6 route show table all dev lbr0": "",
+	"-6 route show table all dev tun0": "",
+	"-o link show dev docker0":         "",
+}
+
+func addIPShowResults(fexec *exec.FakeExecutor) {
+	for args, out := range ipShowResults {
+		var err error
+		if out == "" && strings.Contains(args, "docker0") {
+			err = fmt.Errorf("Device \"docker0\" does not exist.")
+		}
+		fexec.AddResult("/sbin/ip "+args, out, err).AnyTimes()
+	}
+}
+
+// addFullSetupResults adds the commands that SetupSDN runs when it has to
+// redo the full setup on a node where tun0 is already configured
+func addFullSetupResults(fexec *exec.FakeExecutor) {
+	fexec.AddResult("/sbin/ip link set lbr0 down", "", nil)
+	fexec.AddResult("/sbin/ip link del lbr0", "", nil)
+	fexec.AddResult("/sbin/ip link add lbr0 type bridge", "", nil)
+	fexec.AddResult("/sbin/ip addr add 10.1.0.1/24 dev lbr0", "", nil)
+	fexec.AddResult("/sbin/ip link set lbr0 up", "", nil)
+	fexec.AddResult("openshift-sdn-docker-setup.sh lbr0 1450 10.1.0.128/25", "", nil)
+	fexec.AddResult("/sbin/ip link del vlinuxbr", "", nil)
+	fexec.AddResult("/sbin/ip link add vlinuxbr mtu 1450 type veth peer name vovsbr mtu 1450", "", nil)
+	fexec.AddResult("/sbin/ip link set vlinuxbr up", "", nil)
+	fexec.AddResult("/sbin/ip link set vlinuxbr txqueuelen 0", "", nil)
+	fexec.AddResult("/sbin/ip link set vovsbr up", "", nil)
+	fexec.AddResult("/sbin/ip link set vovsbr txqueuelen 0", "", nil)
+	fexec.AddResult("/sbin/ip link set vlinuxbr master lbr0", "", nil)
+	fexec.AddResult("/sbin/ip link set tun0 mtu 1450", "", nil)
+	fexec.AddResult("/sbin/ip link set tun0 up", "", nil)
+	fexec.AddResult("/sbin/ip link del docker0", "", fmt.Errorf("Cannot find device \"docker0\""))
+	fexec.AddResult("modprobe br_netfilter", "", nil)
+	fexec.AddResult("/sbin/ip route del 10.1.0.0/24 dev lbr0", "", nil)
+}
+
+func TestSetupSDNTun0AlreadyConfigured(t *testing.T) {
+	defer testSetup(t)()
+
+	fexec := newFakeBridge("/sbin/ip")
+	// br0 has flows from an older version, so the full setup is redone,
+	// but tun0 still has its address and routes
+	if err := fexec.applyFlowMod("add table=253, actions=note:01.02"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addIPShowResults(fexec.FakeExecutor)
+	addFullSetupResults(fexec.FakeExecutor)
+
+	node := &OsdnNode{multitenant: true, execer: fexec}
+	changed, err := node.SetupSDN("10.1.0.0/24", []string{"10.1.0.0/16"}, "172.30.0.0/16", 1450)
+	if err != nil {
+		t.Fatalf("unexpected error from SetupSDN: %v", err)
+	}
+	if !changed {
+		t.Fatalf("SetupSDN did not do a full setup")
+	}
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("unexpected commands: %v", err)
+	}
+	if !versionFlowPresent(fexec, true) {
+		t.Fatalf("version flow was not updated: %v", fexec.Flows())
+	}
+}
@@ -3,10 +3,13 @@ package osdn
 import (
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 
 	log "github.com/golang/glog"
 
 	"github.com/openshift/openshift-sdn/pkg/netutils"
+	"github.com/openshift/openshift-sdn/plugins/osdn/api"
 
 	osclient "github.com/openshift/origin/pkg/client"
 	osconfigapi "github.com/openshift/origin/pkg/cmd/server/api"
@@ -16,56 +19,92 @@ import (
 )
 
 type OsdnMaster struct {
-	registry        *Registry
-	subnetAllocator *netutils.SubnetAllocator
-	vnids           vnidMap
-	netIDManager    *netutils.NetIDAllocator
-	adminNamespaces []string
+	registry           *Registry
+	networkInfo        *NetworkInfo
+	subnetAllocator    *netutils.SubnetAllocator
+	hostSubnetPolicies []api.HostSubnetPolicy
+	excludedSubnets    []string
+	reservedVNIDs      []api.VNIDRange
+	nodeIPPolicy       *netutils.NodeIPPolicy
+	vnids              vnidMap
+	netIDManager       *netutils.NetIDAllocator
+	adminNamespaces    []string
+
+	// lock serializes the node and namespace watchers' use of the
+	// allocators with CheckConsistency
+	lock sync.Mutex
 }
 
 func StartMaster(networkConfig osconfigapi.MasterNetworkConfig, osClient *osclient.Client, kClient *kclient.Client) error {
+	_, err := StartMasterWithOptions(networkConfig, api.MasterOptions{}, osClient, kClient)
+	return err
+}
+
+// StartMasterWithOptions is like StartMaster, but with additional options. It
+// returns the started master (or nil if networkConfig is not for an OpenShift
+// SDN plugin), on which CheckConsistency can be called.
+func StartMasterWithOptions(networkConfig osconfigapi.MasterNetworkConfig, options api.MasterOptions, osClient *osclient.Client, kClient *kclient.Client) (*OsdnMaster, error) {
 	if !IsOpenShiftNetworkPlugin(networkConfig.NetworkPluginName) {
-		return nil
+		return nil, nil
 	}
 
 	log.Infof("Initializing SDN master of type %q", networkConfig.NetworkPluginName)
+	nodeIPPolicy, err := newNodeIPPolicy(options.NodeIPPolicy)
+	if err != nil {
+		return nil, err
+	}
 	master := &OsdnMaster{
-		registry:        newRegistry(osClient, kClient),
-		vnids:           newVnidMap(),
-		adminNamespaces: make([]string, 0),
+		registry:           newRegistry(osClient, kClient),
+		hostSubnetPolicies: options.HostSubnetPolicies,
+		excludedSubnets:    options.ExcludedSubnets,
+		reservedVNIDs:      options.ReservedVNIDRanges,
+		nodeIPPolicy:       nodeIPPolicy,
+		vnids:              newVnidMap(),
+		adminNamespaces:    make([]string, 0),
+	}
+
+	for _, policy := range options.HostSubnetPolicies {
+		if policy.HostSubnetLength == 0 {
+			return nil, fmt.Errorf("Invalid HostSubnetLength 0 in host subnet policy for nodes %v", policy.NodeSelector)
+		}
 	}
 
 	// Validate command-line/config parameters
 	ni, err := validateClusterNetwork(networkConfig.ClusterNetworkCIDR, int(networkConfig.HostSubnetLength), networkConfig.ServiceNetworkCIDR, networkConfig.NetworkPluginName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	master.networkInfo = ni
 
 	changed, net_err := master.isClusterNetworkChanged(ni)
 	if changed {
 		if err := master.validateNetworkConfig(ni); err != nil {
-			return err
+			return nil, err
 		}
 		if err := master.registry.UpdateClusterNetwork(ni); err != nil {
-			return err
+			return nil, err
 		}
 	} else if net_err != nil {
 		if err := master.registry.CreateClusterNetwork(ni); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	if err := master.SubnetStartMaster(ni.ClusterNetwork, networkConfig.HostSubnetLength); err != nil {
-		return err
+	if _, err := master.CheckConsistency(options.RepairInconsistencies); err != nil {
+		return nil, err
+	}
+
+	if err := master.SubnetStartMaster(ni.ClusterNetworks); err != nil {
+		return nil, err
 	}
 
 	if IsOpenShiftMultitenantNetworkPlugin(networkConfig.NetworkPluginName) {
 		if err := master.VnidStartMaster(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return master, nil
 }
 
 func (master *OsdnMaster) validateNetworkConfig(ni *NetworkInfo) error {
@@ -78,11 +117,13 @@ func (master *OsdnMaster) validateNetworkConfig(ni *NetworkInfo) error {
 
 	// Ensure cluster and service network don't overlap with host networks
 	for _, ipNet := range hostIPNets {
-		if ipNet.Contains(ni.ClusterNetwork.IP) {
-			errList = append(errList, fmt.Errorf("Error: Cluster IP: %s conflicts with host network: %s", ni.ClusterNetwork.IP.String(), ipNet.String()))
-		}
-		if ni.ClusterNetwork.Contains(ipNet.IP) {
-			errList = append(errList, fmt.Errorf("Error: Host network with IP: %s conflicts with cluster network: %s", ipNet.IP.String(), ni.ClusterNetwork.String()))
+		for _, cn := range ni.ClusterNetworks {
+			if ipNet.Contains(cn.CIDR.IP) {
+				errList = append(errList, fmt.Errorf("Error: Cluster IP: %s conflicts with host network: %s", cn.CIDR.IP.String(), ipNet.String()))
+			}
+			if cn.CIDR.Contains(ipNet.IP) {
+				errList = append(errList, fmt.Errorf("Error: Host network with IP: %s conflicts with cluster network: %s", ipNet.IP.String(), cn.CIDR.String()))
+			}
 		}
 		if ipNet.Contains(ni.ServiceNetwork.IP) {
 			errList = append(errList, fmt.Errorf("Error: Service IP: %s conflicts with host network: %s", ni.ServiceNetwork.String(), ipNet.String()))
@@ -103,8 +144,8 @@ func (master *OsdnMaster) validateNetworkConfig(ni *NetworkInfo) error {
 			errList = append(errList, fmt.Errorf("Failed to parse network address: %s", sub.Subnet))
 			continue
 		}
-		if !ni.ClusterNetwork.Contains(subnetIP) {
-			errList = append(errList, fmt.Errorf("Error: Existing node subnet: %s is not part of cluster network: %s", sub.Subnet, ni.ClusterNetwork.String()))
+		if !ni.ClusterNetworkContains(subnetIP) {
+			errList = append(errList, fmt.Errorf("Error: Existing node subnet: %s is not part of cluster network: %s", sub.Subnet, strings.Join(ni.ClusterNetworkCIDRs(), ",")))
 		}
 	}
 
@@ -128,8 +169,7 @@ func (master *OsdnMaster) isClusterNetworkChanged(curNetwork *NetworkInfo) (bool
 		return false, err
 	}
 
-	if curNetwork.ClusterNetwork.String() != oldNetwork.ClusterNetwork.String() ||
-		curNetwork.HostSubnetLength != oldNetwork.HostSubnetLength ||
+	if formatClusterNetworks(curNetwork.ClusterNetworks) != formatClusterNetworks(oldNetwork.ClusterNetworks) ||
 		curNetwork.ServiceNetwork.String() != oldNetwork.ServiceNetwork.String() {
 		return true, nil
 	}
@@ -0,0 +1,94 @@
+package osdn
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+	// Not vendored in this repository; like the Kubernetes and origin
+	// packages, it comes from the vendor tree of the origin build that
+	// includes this plugin.
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/ovs"
+)
+
+const (
+	metricsNamespace = "openshift_sdn"
+	metricsSubsystem = "ovs"
+)
+
+var (
+	tablePacketsDesc       = newMetricDesc("table_packets_total", "Packets matched by flows in each OpenFlow table of br0", "table")
+	tableBytesDesc         = newMetricDesc("table_bytes_total", "Bytes matched by flows in each OpenFlow table of br0", "table")
+	dropPacketsDesc        = newMetricDesc("dropped_packets_total", "Packets dropped by each OpenFlow table of br0", "table")
+	dropBytesDesc          = newMetricDesc("dropped_bytes_total", "Bytes dropped by each OpenFlow table of br0", "table")
+	defaultDropPacketsDesc = newMetricDesc("default_dropped_packets_total", "Packets dropped by the default flow of each OpenFlow table of br0", "table")
+	defaultDropBytesDesc   = newMetricDesc("default_dropped_bytes_total", "Bytes dropped by the default flow of each OpenFlow table of br0", "table")
+	vnidPacketsDesc        = newMetricDesc("vnid_packets_total", "Packets matched by br0 flows for each VNID", "vnid")
+	vnidBytesDesc          = newMetricDesc("vnid_bytes_total", "Bytes matched by br0 flows for each VNID", "vnid")
+
+	registerMetricsOnce sync.Once
+)
+
+func newMetricDesc(name, help, label string) *prometheus.Desc {
+	return prometheus.NewDesc(metricsNamespace+"_"+metricsSubsystem+"_"+name, help, []string{label}, nil)
+}
+
+// flowStatsCollector exports the flow counters from br0. Since OVS already
+// keeps the counters, they are read fresh on each scrape rather than being
+// tracked in prometheus.Counters.
+type flowStatsCollector struct {
+	execer exec.Executor
+}
+
+func (c flowStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tablePacketsDesc
+	ch <- tableBytesDesc
+	ch <- dropPacketsDesc
+	ch <- dropBytesDesc
+	ch <- defaultDropPacketsDesc
+	ch <- defaultDropBytesDesc
+	ch <- vnidPacketsDesc
+	ch <- vnidBytesDesc
+}
+
+func (c flowStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	otx := ovs.NewTransaction(c.execer, BR)
+	stats, err := otx.GetStats()
+	otx.EndTransaction()
+	if err != nil {
+		glog.Errorf("Could not get OVS flow statistics: %v", err)
+		return
+	}
+
+	for table, counters := range stats.Tables {
+		label := strconv.Itoa(table)
+		ch <- prometheus.MustNewConstMetric(tablePacketsDesc, prometheus.CounterValue, float64(counters.Packets), label)
+		ch <- prometheus.MustNewConstMetric(tableBytesDesc, prometheus.CounterValue, float64(counters.Bytes), label)
+	}
+	for table, counters := range stats.Drops {
+		label := strconv.Itoa(table)
+		ch <- prometheus.MustNewConstMetric(dropPacketsDesc, prometheus.CounterValue, float64(counters.Packets), label)
+		ch <- prometheus.MustNewConstMetric(dropBytesDesc, prometheus.CounterValue, float64(counters.Bytes), label)
+	}
+	for table, counters := range stats.DefaultDrops {
+		label := strconv.Itoa(table)
+		ch <- prometheus.MustNewConstMetric(defaultDropPacketsDesc, prometheus.CounterValue, float64(counters.Packets), label)
+		ch <- prometheus.MustNewConstMetric(defaultDropBytesDesc, prometheus.CounterValue, float64(counters.Bytes), label)
+	}
+	for vnid, counters := range stats.VNIDs {
+		label := strconv.FormatUint(uint64(vnid), 10)
+		ch <- prometheus.MustNewConstMetric(vnidPacketsDesc, prometheus.CounterValue, float64(counters.Packets), label)
+		ch <- prometheus.MustNewConstMetric(vnidBytesDesc, prometheus.CounterValue, float64(counters.Bytes), label)
+	}
+}
+
+// registerMetrics registers the node's metrics with prometheus. (It is safe
+// to call more than once.)
+func registerMetrics(execer exec.Executor) {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(flowStatsCollector{execer: execer})
+	})
+}
@@ -2,11 +2,17 @@ package osdn
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
 
+	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/ipcmd"
 	"github.com/openshift/openshift-sdn/pkg/netutils"
 	"github.com/openshift/openshift-sdn/plugins/osdn/api"
 
@@ -18,25 +24,53 @@ import (
 	kubeletTypes "k8s.io/kubernetes/pkg/kubelet/container"
 	kexec "k8s.io/kubernetes/pkg/util/exec"
 	kubeutilnet "k8s.io/kubernetes/pkg/util/net"
+	utilwait "k8s.io/kubernetes/pkg/util/wait"
 )
 
+// RecordCommandsEnv names an environment variable which, if set, gives the path
+// of a file to record every command run by the node to, for later replay with
+// exec.NewReplayer(). Recording switches ipcmd to the "ip" command backend, so
+// that interface changes are recorded too. Bridge and port changes are made
+// over OVSDB rather than by running commands, and are not recorded.
+const RecordCommandsEnv = "OPENSHIFT_SDN_RECORD_COMMANDS"
+
+// ipamDir is where the node records the pod IP addresses it has allocated
+const ipamDir = "/var/lib/openshift-sdn/ipam"
+
 type OsdnNode struct {
 	multitenant        bool
 	registry           *Registry
 	localIP            string
 	localSubnet        *osapi.HostSubnet
+	ipam               *netutils.HostLocalIPAM
 	hostName           string
 	podNetworkReady    chan struct{}
 	vnids              vnidMap
 	iptablesSyncPeriod time.Duration
 	mtu                uint
+	execer             exec.Executor
+
+	// lock serializes changes to br0 and the local pods between the
+	// kubelet, the HostSubnet, NetNamespace, and service watchers, and
+	// checkOVS
+	lock sync.Mutex
 }
 
 // Called by higher layers to create the plugin SDN node instance
 func NewNodePlugin(pluginName string, osClient *osclient.Client, kClient *kclient.Client, hostname string, selfIP string, iptablesSyncPeriod time.Duration, mtu uint) (api.OsdnNodePlugin, error) {
+	return NewNodePluginWithOptions(pluginName, osClient, kClient, hostname, selfIP, iptablesSyncPeriod, mtu, api.NodeOptions{})
+}
+
+// NewNodePluginWithOptions is like NewNodePlugin, but with additional options
+func NewNodePluginWithOptions(pluginName string, osClient *osclient.Client, kClient *kclient.Client, hostname string, selfIP string, iptablesSyncPeriod time.Duration, mtu uint, options api.NodeOptions) (api.OsdnNodePlugin, error) {
 	if !IsOpenShiftNetworkPlugin(pluginName) {
 		return nil, nil
 	}
+	nodeIPPolicy, err := newNodeIPPolicy(options.NodeIPPolicy)
+	if err != nil {
+		return nil, err
+	}
+	registry := newRegistry(osClient, kClient)
 
 	log.Infof("Initializing SDN node of type %q with configured hostname %q (IP %q), iptables sync period %q", pluginName, hostname, selfIP, iptablesSyncPeriod.String())
 	if hostname == "" {
@@ -47,8 +81,13 @@ func NewNodePlugin(pluginName string, osClient *osclient.Client, kClient *kclien
 		hostname = strings.TrimSpace(string(output))
 		log.Infof("Resolved hostname to %q", hostname)
 	}
-	if selfIP == "" {
-		var err error
+	if selfIP == "" && nodeIPPolicy != nil {
+		selfIP, err = chooseLocalIP(registry, hostname, nodeIPPolicy)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Resolved IP address to %q", selfIP)
+	} else if selfIP == "" {
 		selfIP, err = netutils.GetNodeIP(hostname)
 		if err != nil {
 			log.V(5).Infof("Failed to determine node address from hostname %s; using default interface (%v)", hostname, err)
@@ -61,26 +100,62 @@ func NewNodePlugin(pluginName string, osClient *osclient.Client, kClient *kclien
 		}
 	}
 
+	execer := exec.New()
+	if path := os.Getenv(RecordCommandsEnv); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open command recording %q: %v", path, err)
+		}
+		log.Infof("Recording commands to %q", path)
+		execer = exec.NewRecorder(execer, f)
+		// Netlink operations would bypass the recorder
+		if err := ipcmd.SetBackend(ipcmd.ExecBackend); err != nil {
+			return nil, err
+		}
+	}
+	execer = exec.WithPolicy(execer, commandPolicy)
+
 	plugin := &OsdnNode{
 		multitenant:        IsOpenShiftMultitenantNetworkPlugin(pluginName),
-		registry:           newRegistry(osClient, kClient),
+		registry:           registry,
 		localIP:            selfIP,
 		hostName:           hostname,
 		vnids:              newVnidMap(),
 		podNetworkReady:    make(chan struct{}),
 		iptablesSyncPeriod: iptablesSyncPeriod,
 		mtu:                mtu,
+		execer:             execer,
 	}
 	return plugin, nil
 }
 
+// commandPolicy returns the exec.Policy for a command run by the node. Only
+// commands that are safe to kill and re-run get a timeout and retries; in
+// particular, "ip" commands that add or change things, and the setup
+// scripts, are run once (though runPodScript passes its own timeout).
+func commandPolicy(cmd string, args []string) exec.Policy {
+	switch filepath.Base(cmd) {
+	case "ovs-ofctl":
+		// The plugin only queries flows, or modifies them in ways that
+		// give the same result if repeated
+		return exec.IdempotentPolicy
+	case "ip", "nsenter":
+		for _, arg := range args {
+			if arg == "show" {
+				return exec.IdempotentPolicy
+			}
+		}
+	}
+	return exec.Policy{}
+}
+
 func (node *OsdnNode) Start() error {
 	ni, err := node.registry.GetNetworkInfo()
 	if err != nil {
 		return fmt.Errorf("Failed to get network information: %v", err)
 	}
 
-	nodeIPTables := newNodeIPTables(ni.ClusterNetwork.String(), node.iptablesSyncPeriod)
+	nodeIPTables := newNodeIPTables(ni.ClusterNetworkCIDRs(), node.iptablesSyncPeriod)
 	if err := nodeIPTables.Setup(); err != nil {
 		return fmt.Errorf("Failed to set up iptables: %v", err)
 	}
@@ -90,28 +165,103 @@ func (node *OsdnNode) Start() error {
 		return err
 	}
 
+	registerMetrics(node.execer)
+
 	if node.multitenant {
 		if err := node.VnidStartNode(); err != nil {
 			return err
 		}
 	}
 
+	if err := node.syncPodIPs(); err != nil {
+		log.Warningf("Could not reconcile pod IP allocations: %v", err)
+	}
+
 	if networkChanged {
-		pods, err := node.GetLocalPods(kapi.NamespaceAll)
+		node.lock.Lock()
+		err := node.updateLocalPods()
+		node.lock.Unlock()
 		if err != nil {
 			return err
 		}
-		for _, p := range pods {
-			containerID := getPodContainerID(&p)
-			err = node.UpdatePod(p.Namespace, p.Name, kubeletTypes.DockerID(containerID))
-			if err != nil {
-				log.Warningf("Could not update pod %q (%s): %s", p.Name, containerID, err)
-			}
-		}
 	}
 
 	node.markPodNetworkReady()
 
+	go utilwait.Forever(node.checkOVS, ovsCheckInterval)
+
+	return nil
+}
+
+// updateLocalPods re-runs the network setup for every pod on this node. The
+// caller must hold node.lock.
+func (node *OsdnNode) updateLocalPods() error {
+	pods, err := node.GetLocalPods(kapi.NamespaceAll)
+	if err != nil {
+		return err
+	}
+	node.updatePods(pods)
+	return nil
+}
+
+// updatePods re-runs the network setup for each of pods. The caller must hold
+// node.lock.
+func (node *OsdnNode) updatePods(pods []kapi.Pod) {
+	for _, p := range pods {
+		containerID := getPodContainerID(&p)
+		err := node.updatePod(p.Namespace, p.Name, kubeletTypes.DockerID(containerID))
+		if err != nil {
+			log.Warningf("Could not update pod %q (%s): %s", p.Name, containerID, err)
+		}
+	}
+}
+
+// syncPodIPs reconciles the recorded pod IP allocations with the pods on this
+// node. Allocations of pods that no longer exist are released, and the
+// addresses of running pods that have no allocation (because they were set up
+// before the node allocated pod IPs itself) are recorded, so that they won't be
+// given to other pods.
+func (node *OsdnNode) syncPodIPs() error {
+	pods, err := node.registry.GetNodePods(node.hostName, kapi.NamespaceAll)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(pods))
+	for _, p := range pods {
+		exists[getPodIPOwnerPrefix(p.Namespace, p.Name)] = true
+	}
+
+	allocated := make(map[string]bool)
+	for owner, ip := range node.ipam.Allocations() {
+		prefix := owner[:strings.LastIndex(owner, "/")+1]
+		if exists[prefix] {
+			allocated[prefix] = true
+			continue
+		}
+		log.Infof("Releasing IP %s of deleted pod %s", ip, owner)
+		if err := node.ipam.Release(owner); err != nil {
+			log.Warningf("Could not release IP %s of pod %s: %v", ip, owner, err)
+		}
+	}
+
+	// Addresses in the docker subnet were allocated by docker, and the IPAM
+	// never hands them out
+	dockerSubnet := getDockerSubnet(node.ipam.Network())
+	for _, p := range pods {
+		// The pod's infra container ID isn't known here
+		owner := getPodIPOwner(p.Namespace, p.Name, "")
+		ip := net.ParseIP(p.Status.PodIP)
+		if p.Status.Phase != kapi.PodRunning || ip == nil || !node.ipam.Network().Contains(ip) || dockerSubnet.Contains(ip) {
+			continue
+		}
+		if allocated[getPodIPOwnerPrefix(p.Namespace, p.Name)] {
+			continue
+		}
+		log.Infof("Recording existing IP %s of pod %s", ip, owner)
+		if err := node.ipam.AllocateIP(owner, ip); err != nil {
+			log.Warningf("Could not record IP %s of pod %s: %v", ip, owner, err)
+		}
+	}
 	return nil
 }
 
@@ -19,19 +19,23 @@ type FirewallRule struct {
 	args  []string
 }
 
+// MASQUERADE_CHAIN is the chain that traffic from the cluster networks is
+// sent to, to decide whether to masquerade it
+const MASQUERADE_CHAIN = "OPENSHIFT-MASQUERADE"
+
 type NodeIPTables struct {
-	ipt                iptables.Interface
-	clusterNetworkCIDR string
-	syncPeriod         time.Duration
+	ipt                 iptables.Interface
+	clusterNetworkCIDRs []string
+	syncPeriod          time.Duration
 
 	mu sync.Mutex // Protects concurrent access to syncIPTableRules()
 }
 
-func newNodeIPTables(clusterNetworkCIDR string, syncPeriod time.Duration) *NodeIPTables {
+func newNodeIPTables(clusterNetworkCIDRs []string, syncPeriod time.Duration) *NodeIPTables {
 	return &NodeIPTables{
-		ipt:                iptables.New(kexec.New(), utildbus.New(), iptables.ProtocolIpv4),
-		clusterNetworkCIDR: clusterNetworkCIDR,
-		syncPeriod:         syncPeriod,
+		ipt:                 iptables.New(kexec.New(), utildbus.New(), iptables.ProtocolIpv4),
+		clusterNetworkCIDRs: clusterNetworkCIDRs,
+		syncPeriod:          syncPeriod,
 	}
 }
 
@@ -80,6 +84,15 @@ func (n *NodeIPTables) syncIPTableRules() error {
 	}()
 	glog.V(3).Infof("Syncing openshift iptables rules")
 
+	if _, err := n.ipt.EnsureChain(iptables.Table("nat"), iptables.Chain(MASQUERADE_CHAIN)); err != nil {
+		return fmt.Errorf("Failed to ensure chain %s exists: %v", MASQUERADE_CHAIN, err)
+	}
+	for _, rule := range n.getObsoleteNodeIPTablesRules() {
+		if err := n.ipt.DeleteRule(iptables.Table(rule.table), iptables.Chain(rule.chain), rule.args...); err != nil {
+			return fmt.Errorf("Failed to delete obsolete rule %v: %v", rule, err)
+		}
+	}
+
 	rules := n.getStaticNodeIPTablesRules()
 	for _, rule := range rules {
 		_, err := n.ipt.EnsureRule(iptables.Prepend, iptables.Table(rule.table), iptables.Chain(rule.chain), rule.args...)
@@ -90,13 +103,39 @@ func (n *NodeIPTables) syncIPTableRules() error {
 	return nil
 }
 
-// Get openshift iptables rules
+// Get openshift iptables rules. Since each rule is prepended to its chain, a
+// rule ends up before the rules listed ahead of it.
 func (n *NodeIPTables) getStaticNodeIPTablesRules() []FirewallRule {
-	return []FirewallRule{
-		{"nat", "POSTROUTING", []string{"-s", n.clusterNetworkCIDR, "!", "-d", n.clusterNetworkCIDR, "-j", "MASQUERADE"}},
-		{"filter", "INPUT", []string{"-p", "udp", "-m", "multiport", "--dports", VXLAN_PORT, "-m", "comment", "--comment", "001 vxlan incoming", "-j", "ACCEPT"}},
-		{"filter", "INPUT", []string{"-i", TUN, "-m", "comment", "--comment", "traffic from docker for internet", "-j", "ACCEPT"}},
-		{"filter", "FORWARD", []string{"-d", n.clusterNetworkCIDR, "-j", "ACCEPT"}},
-		{"filter", "FORWARD", []string{"-s", n.clusterNetworkCIDR, "-j", "ACCEPT"}},
+	rules := []FirewallRule{
+		// Traffic from the cluster networks is masqueraded unless it is
+		// going to one of the cluster networks
+		{"nat", MASQUERADE_CHAIN, []string{"-j", "MASQUERADE"}},
+	}
+	for _, cidr := range n.clusterNetworkCIDRs {
+		rules = append(rules,
+			FirewallRule{"nat", MASQUERADE_CHAIN, []string{"-d", cidr, "-j", "RETURN"}},
+			FirewallRule{"nat", "POSTROUTING", []string{"-s", cidr, "-j", MASQUERADE_CHAIN}},
+		)
+	}
+	rules = append(rules,
+		FirewallRule{"filter", "INPUT", []string{"-p", "udp", "-m", "multiport", "--dports", VXLAN_PORT, "-m", "comment", "--comment", "001 vxlan incoming", "-j", "ACCEPT"}},
+		FirewallRule{"filter", "INPUT", []string{"-i", TUN, "-m", "comment", "--comment", "traffic from docker for internet", "-j", "ACCEPT"}},
+	)
+	for _, cidr := range n.clusterNetworkCIDRs {
+		rules = append(rules,
+			FirewallRule{"filter", "FORWARD", []string{"-d", cidr, "-j", "ACCEPT"}},
+			FirewallRule{"filter", "FORWARD", []string{"-s", cidr, "-j", "ACCEPT"}},
+		)
+	}
+	return rules
+}
+
+// Get the rules that older versions of openshift-sdn created, which would
+// interfere with the current rules
+func (n *NodeIPTables) getObsoleteNodeIPTablesRules() []FirewallRule {
+	var rules []FirewallRule
+	for _, cidr := range n.clusterNetworkCIDRs {
+		rules = append(rules, FirewallRule{"nat", "POSTROUTING", []string{"-s", cidr, "!", "-d", cidr, "-j", "MASQUERADE"}})
 	}
+	return rules
 }
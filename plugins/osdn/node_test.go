@@ -0,0 +1,79 @@
+package osdn
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/netutils"
+)
+
+func TestReplayUpgrade(t *testing.T) {
+	defer testSetup(t)()
+
+	f, err := os.Open("testdata/upgrade.rec")
+	if err != nil {
+		t.Fatalf("could not open recording: %v", err)
+	}
+	defer f.Close()
+	fexec, err := exec.NewReplayer(f)
+	if err != nil {
+		t.Fatalf("could not load recording: %v", err)
+	}
+
+	ipamDir, err := ioutil.TempDir("", "osdn-ipam")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(ipamDir)
+	ipam, err := netutils.NewHostLocalIPAM("10.1.0.0/24", ipamDir)
+	if err != nil {
+		t.Fatalf("could not create IPAM: %v", err)
+	}
+	if err := ipam.AllocateIP(getPodIPOwner("ns1", "pod1", "0123456789ab"), net.ParseIP("10.1.0.2")); err != nil {
+		t.Fatalf("could not allocate pod IP: %v", err)
+	}
+
+	node := &OsdnNode{multitenant: true, execer: fexec, vnids: newVnidMap(), ipam: ipam}
+	node.vnids.SetVNID("ns1", 5)
+
+	changed, err := node.SetupSDN("10.1.0.0/24", []string{"10.1.0.0/16"}, "172.30.0.0/16", 1450)
+	if err != nil {
+		t.Fatalf("unexpected error from SetupSDN: %v", err)
+	}
+	if !changed {
+		t.Fatalf("SetupSDN did not do a full setup")
+	}
+	if err := node.UpdatePod("ns1", "pod1", "0123456789ab"); err != nil {
+		t.Fatalf("unexpected error from UpdatePod: %v", err)
+	}
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("commands did not match the recording: %v", err)
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		command    string
+		idempotent bool
+	}{
+		{"/usr/bin/ovs-ofctl -O OpenFlow13 dump-flows br0", true},
+		{"/usr/bin/ovs-ofctl -O OpenFlow14 --bundle add-flows br0 -", true},
+		{"/sbin/ip -o link show dev tun0", true},
+		{"/usr/bin/nsenter --net=/proc/1/ns/net -- /sbin/ip -o addr show dev eth0", true},
+		{"/sbin/ip link add lbr0 type bridge", false},
+		{"/sbin/ip addr add 10.1.0.1/24 dev lbr0", false},
+		{"openshift-sdn-docker-setup.sh lbr0 1450 10.1.0.128/25", false},
+		{"openshift-sdn-ovs setup 0123456789ab 10.1.0.2", false},
+		{"modprobe br_netfilter", false},
+	} {
+		words := strings.Split(tc.command, " ")
+		policy := commandPolicy(words[0], words[1:])
+		if idempotent := policy.Retries > 0; idempotent != tc.idempotent {
+			t.Errorf("expected %q to be idempotent=%v, got %#v", tc.command, tc.idempotent, policy)
+		}
+	}
+}
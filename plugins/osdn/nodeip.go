@@ -0,0 +1,104 @@
+package osdn
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/golang/glog"
+
+	"github.com/openshift/openshift-sdn/pkg/netutils"
+	"github.com/openshift/openshift-sdn/plugins/osdn/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+// NodeIPAnnotation is the node annotation in which a node that chose its IP
+// with a node IP policy publishes it, so that the master uses the same IP
+const NodeIPAnnotation = "network.openshift.io/node-ip"
+
+func newNodeIPPolicy(policy *api.NodeIPPolicy) (*netutils.NodeIPPolicy, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	return netutils.NewNodeIPPolicy(policy.AddressTypes, policy.CIDRs, policy.Interface)
+}
+
+func nodeAddresses(node *kapi.Node) []netutils.NodeAddress {
+	addresses := make([]netutils.NodeAddress, 0, len(node.Status.Addresses))
+	for _, addr := range node.Status.Addresses {
+		addresses = append(addresses, netutils.NodeAddress{Type: string(addr.Type), Address: addr.Address})
+	}
+	return addresses
+}
+
+// getNodeIP returns the IP to use for node
+func (master *OsdnMaster) getNodeIP(node *kapi.Node) (string, error) {
+	// The IP the node published takes precedence, since the node may have
+	// checked things that the master can't
+	addresses := nodeAddresses(node)
+	if nodeIP := node.Annotations[NodeIPAnnotation]; nodeIP != "" {
+		addresses = []netutils.NodeAddress{{Address: nodeIP}}
+	}
+
+	if master.nodeIPPolicy == nil {
+		if len(addresses) > 0 && addresses[0].Address != "" {
+			return addresses[0].Address, nil
+		} else {
+			return netutils.GetNodeIP(node.Name)
+		}
+	}
+
+	nodeIP, err := master.nodeIPPolicy.ChooseNodeIP(addresses, nil)
+	if err != nil {
+		return "", fmt.Errorf("Failed to choose IP for node %s: %v", node.Name, err)
+	}
+	return nodeIP, nil
+}
+
+// chooseLocalIP returns the IP of the node hostname according to policy, after
+// checking that it is reachable from the node's interfaces, and publishes it in
+// the node's NodeIPAnnotation.
+func chooseLocalIP(registry *Registry, hostname string, policy *netutils.NodeIPPolicy) (string, error) {
+	var addresses []netutils.NodeAddress
+	kNode, err := registry.GetNode(hostname)
+	if err != nil {
+		log.Warningf("Failed to get node %s; choosing node IP from local interfaces only: %v", hostname, err)
+		kNode = nil
+	} else {
+		addresses = nodeAddresses(kNode)
+	}
+
+	var interfaceIPs []net.IP
+	if iface := policy.Interface(); iface != "" {
+		interfaceIPs, err = netutils.GetInterfaceIPs(iface)
+		if err != nil {
+			return "", err
+		}
+		for _, ip := range interfaceIPs {
+			addresses = append(addresses, netutils.NodeAddress{Address: ip.String()})
+		}
+	}
+
+	nodeIP, err := policy.ChooseNodeIP(addresses, interfaceIPs)
+	if err != nil {
+		return "", fmt.Errorf("Failed to choose IP for node %s: %v", hostname, err)
+	}
+	hostIPNets, err := netutils.GetHostIPNetworks([]string{TUN, LBR})
+	if len(hostIPNets) == 0 {
+		return "", fmt.Errorf("Failed to get node networks: %v", err)
+	}
+	if err := netutils.ValidateLocalIP(nodeIP, hostIPNets); err != nil {
+		return "", err
+	}
+
+	if kNode != nil && kNode.Annotations[NodeIPAnnotation] != nodeIP {
+		if kNode.Annotations == nil {
+			kNode.Annotations = make(map[string]string)
+		}
+		kNode.Annotations[NodeIPAnnotation] = nodeIP
+		if _, err := registry.UpdateNode(kNode); err != nil {
+			log.Warningf("Failed to publish IP of node %s; the master may choose a different one: %v", hostname, err)
+		}
+	}
+	return nodeIP, nil
+}
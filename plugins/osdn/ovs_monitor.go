@@ -0,0 +1,132 @@
+package osdn
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/openshift/openshift-sdn/pkg/ipcmd"
+	"github.com/openshift/openshift-sdn/pkg/netutils"
+	"github.com/openshift/openshift-sdn/pkg/ovs"
+
+	osapi "github.com/openshift/origin/pkg/sdn/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+// How often to check that br0 still has our flows
+const ovsCheckInterval = 10 * time.Second
+
+// checkOVS checks whether br0's flows have been lost since SetupSDN was run
+// (because ovs-vswitchd or ovsdb-server was restarted, or someone ran
+// "ovs-ofctl del-flows br0"), and if so, reprograms everything.
+func (node *OsdnNode) checkOVS() {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if versionFlowPresent(node.execer, node.multitenant) {
+		return
+	}
+
+	log.Warningf("SDN flows on %s are missing; ovs-vswitchd may have been restarted. Reprogramming %s.", BR, BR)
+	if err := node.reprogramOVS(); err != nil {
+		log.Errorf("Could not reprogram %s: %v", BR, err)
+	}
+}
+
+// reprogramOVS fetches the current network state and passes it to
+// programOVS. The caller must hold node.lock.
+func (node *OsdnNode) reprogramOVS() error {
+	ni, err := node.registry.GetNetworkInfo()
+	if err != nil {
+		return fmt.Errorf("Failed to get network information: %v", err)
+	}
+	subnets, err := node.registry.GetSubnets()
+	if err != nil {
+		return fmt.Errorf("Could not get HostSubnets: %v", err)
+	}
+	var services []kapi.Service
+	if node.multitenant {
+		services, err = node.registry.GetServices()
+		if err != nil {
+			return fmt.Errorf("Could not get services: %v", err)
+		}
+	}
+	pods, err := node.GetLocalPods(kapi.NamespaceAll)
+	if err != nil {
+		return err
+	}
+
+	return node.programOVS(ni, subnets, services, pods)
+}
+
+// programOVS restores br0 (its ports and static flows) and tun0's
+// configuration, and then re-adds the flows for every HostSubnet, service, and
+// local pod. Unlike SetupSDN, it leaves lbr0, vlinuxbr and docker alone, so
+// that containers attached to lbr0 keep working while br0 is repaired. The
+// caller must hold node.lock.
+func (node *OsdnNode) programOVS(ni *NetworkInfo, subnets []osapi.HostSubnet, services []kapi.Service, pods []kapi.Pod) error {
+	_, ipnet, err := net.ParseCIDR(node.localSubnet.Subnet)
+	if err != nil {
+		return fmt.Errorf("Invalid local subnet %q: %v", node.localSubnet.Subnet, err)
+	}
+	localSubnetMaskLength, _ := ipnet.Mask.Size()
+	localSubnetGateway := netutils.GenerateDefaultGateway(ipnet).String()
+	gwCIDR := fmt.Sprintf("%s/%d", localSubnetGateway, localSubnetMaskLength)
+	clusterNetworkCIDRs := ni.ClusterNetworkCIDRs()
+	servicesNetworkCIDR := ni.ServiceNetwork.String()
+
+	baseFlows, err := getBaseFlows(node.localSubnet.Subnet, localSubnetGateway, clusterNetworkCIDRs, servicesNetworkCIDR)
+	if err != nil {
+		return err
+	}
+	otx := ovs.NewTransaction(node.execer, BR)
+	setupBridge(otx, baseFlows)
+	if err := otx.EndTransaction(); err != nil {
+		return err
+	}
+
+	// If ovs-vswitchd restarted, then tun0 was recreated without its
+	// address and routes
+	itx := ipcmd.NewTransaction(node.execer, TUN)
+	if setupTun0(itx, gwCIDR, clusterNetworkCIDRs, servicesNetworkCIDR, fmt.Sprint(node.mtu)) {
+		defer deleteLocalSubnetRoute(node.execer, TUN, node.localSubnet.Subnet)
+	}
+	if err := itx.EndTransaction(); err != nil {
+		return err
+	}
+	if err := setSysctl(fmt.Sprintf("net/ipv4/conf/%s/forwarding", TUN), 1); err != nil {
+		return fmt.Errorf("Could not enable IPv4 forwarding on %s: %s", TUN, err)
+	}
+
+	for i := range subnets {
+		if subnets[i].HostIP == node.localIP {
+			continue
+		}
+		if err := node.addHostSubnetRules(&subnets[i]); err != nil {
+			log.Error(err)
+		}
+	}
+
+	for i := range services {
+		svc := &services[i]
+		if !kapi.IsServiceIPSet(svc) {
+			continue
+		}
+		netID, err := node.vnids.GetVNID(svc.Namespace)
+		if err != nil {
+			log.Errorf("Could not add rules for service %s/%s: %v", svc.Namespace, svc.Name, err)
+			continue
+		}
+		if err := node.addServiceRules(svc, netID); err != nil {
+			log.Error(err)
+		}
+	}
+
+	node.updatePods(pods)
+
+	// Only mark br0 as set up once everything else has been restored
+	return addVersionFlow(node.execer, node.multitenant)
+}
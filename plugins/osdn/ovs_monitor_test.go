@@ -0,0 +1,98 @@
+package osdn
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openshift/openshift-sdn/pkg/ovs"
+
+	osapi "github.com/openshift/origin/pkg/sdn/api"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func flowStrings(flows []*ovs.Flow) []string {
+	strs := make([]string, len(flows))
+	for i, flow := range flows {
+		strs[i] = flow.String()
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func TestReprogramOVS(t *testing.T) {
+	defer testSetup(t)()
+
+	fexec := newFakeBridge("/sbin/ip")
+	addIPShowResults(fexec.FakeExecutor)
+	addFullSetupResults(fexec.FakeExecutor)
+
+	_, clusterNetwork, _ := net.ParseCIDR("10.1.0.0/16")
+	_, serviceNetwork, _ := net.ParseCIDR("172.30.0.0/16")
+	ni := &NetworkInfo{
+		ClusterNetworks: []ClusterNetworkEntry{{CIDR: clusterNetwork, HostSubnetLength: 8}},
+		ServiceNetwork:  serviceNetwork,
+	}
+	localSubnet := osapi.HostSubnet{HostIP: "192.168.1.1", Subnet: "10.1.0.0/24"}
+	localSubnet.Name = "node1"
+	remoteSubnet := osapi.HostSubnet{HostIP: "192.168.1.2", Subnet: "10.1.1.0/24"}
+	remoteSubnet.Name = "node2"
+	service := kapi.Service{Spec: kapi.ServiceSpec{
+		ClusterIP: "172.30.0.10",
+		Ports:     []kapi.ServicePort{{Protocol: kapi.ProtocolTCP, Port: 80}},
+	}}
+	service.Namespace = "ns1"
+	service.Name = "svc1"
+
+	node := &OsdnNode{
+		multitenant: true,
+		localIP:     localSubnet.HostIP,
+		localSubnet: &localSubnet,
+		vnids:       newVnidMap(),
+		mtu:         1450,
+		execer:      fexec,
+	}
+	node.vnids.SetVNID("ns1", 5)
+
+	// The flows as set up when the node started and then watched the
+	// HostSubnets and services
+	if _, err := node.SetupSDN(localSubnet.Subnet, ni.ClusterNetworkCIDRs(), ni.ServiceNetwork.String(), node.mtu); err != nil {
+		t.Fatalf("unexpected error from SetupSDN: %v", err)
+	}
+	if err := node.AddHostSubnetRules(&remoteSubnet); err != nil {
+		t.Fatalf("unexpected error from AddHostSubnetRules: %v", err)
+	}
+	if err := node.AddServiceRules(&service, 5); err != nil {
+		t.Fatalf("unexpected error from AddServiceRules: %v", err)
+	}
+	expected := flowStrings(fexec.Flows())
+
+	// ovs-vswitchd restarts, losing the flows
+	fexec.DeleteAllFlows()
+	if versionFlowPresent(fexec, true) {
+		t.Fatalf("version flow unexpectedly present after deleting flows")
+	}
+
+	// Only br0 and tun0 are reconfigured; lbr0, vlinuxbr and docker are
+	// left alone
+	fexec.AddResult("/sbin/ip link set tun0 mtu 1450", "", nil)
+	fexec.AddResult("/sbin/ip link set tun0 up", "", nil)
+	node.lock.Lock()
+	err := node.programOVS(ni, []osapi.HostSubnet{localSubnet, remoteSubnet}, []kapi.Service{service}, nil)
+	node.lock.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected error from programOVS: %v", err)
+	}
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("unexpected commands: %v", err)
+	}
+
+	if !versionFlowPresent(fexec, true) {
+		t.Fatalf("version flow not restored")
+	}
+	if flows := flowStrings(fexec.Flows()); !reflect.DeepEqual(flows, expected) {
+		t.Fatalf("flows not rebuilt:\nexpected %v\ngot      %v", expected, flows)
+	}
+}
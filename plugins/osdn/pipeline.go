@@ -0,0 +1,204 @@
+package osdn
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openshift/openshift-sdn/pkg/ovs"
+)
+
+// Kinds of dynamic flows in sdnPipeline
+const (
+	podFlowKind        = "pod"
+	hostSubnetFlowKind = "hostsubnet"
+	serviceFlowKind    = "service"
+	versionFlowKind    = "version"
+)
+
+// sdnPipeline is the OpenFlow pipeline on br0. SetupSDN installs its static
+// flows; the pod flows are added by SetUpPod and UpdatePod, the HostSubnet
+// flows by AddHostSubnetRules, and the service flows by AddServiceRules. The
+// ofport variables (vxlan_ofport, tun_ofport and vovsbr_ofport) are always
+// defined.
+//
+// reg0 holds the VNID of the packet's source (which is always 0 for
+// single-tenant).
+var sdnPipeline = &ovs.Pipeline{
+	Tables: []ovs.PipelineTable{
+		{
+			Number:  0,
+			Name:    "classifier",
+			Purpose: "initial dispatch based on in_port",
+			Flows: []ovs.FlowTemplate{
+				// vxlan0
+				{Priority: 200, Match: "in_port=${vxlan_ofport}, arp, nw_src=${cluster_network}, nw_dst=${local_subnet}", Actions: "move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[], goto_table:1"},
+				{Priority: 200, Match: "in_port=${vxlan_ofport}, ip, nw_src=${cluster_network}, nw_dst=${local_subnet}", Actions: "move:NXM_NX_TUN_ID[0..31]->NXM_NX_REG0[], goto_table:1"},
+				{Priority: 150, Match: "in_port=${vxlan_ofport}", Actions: "drop"},
+				// tun0
+				{Priority: 200, Match: "in_port=${tun_ofport}, arp, nw_src=${local_gateway}, nw_dst=${cluster_network}", Actions: "goto_table:5"},
+				{Priority: 200, Match: "in_port=${tun_ofport}, ip", Actions: "goto_table:5"},
+				{Priority: 150, Match: "in_port=${tun_ofport}", Actions: "drop"},
+				// vovsbr
+				{Priority: 200, Match: "in_port=${vovsbr_ofport}, arp, nw_src=${local_subnet}", Actions: "goto_table:5"},
+				{Priority: 200, Match: "in_port=${vovsbr_ofport}, ip, nw_src=${local_subnet}", Actions: "goto_table:5"},
+				{Priority: 150, Match: "in_port=${vovsbr_ofport}", Actions: "drop"},
+				// else, from a container
+				{Priority: 100, Match: "arp", Actions: "goto_table:2"},
+				{Priority: 100, Match: "ip", Actions: "goto_table:2"},
+				{Priority: 0, Actions: "drop"},
+			},
+		},
+		{
+			Number:  1,
+			Name:    "vxlan-ingress",
+			Purpose: "VXLAN ingress filtering; accepts traffic from the nodes of known HostSubnets",
+			Flows: []ovs.FlowTemplate{
+				{Kind: hostSubnetFlowKind, Priority: 100, Match: "tun_src=${node_ip}", Actions: "goto_table:5"},
+				{Priority: 0, Actions: "drop"},
+			},
+		},
+		{
+			Number:  2,
+			Name:    "pod-ingress",
+			Purpose: "from OpenShift container; validate IP/MAC, assign VNID",
+			Flows: []ovs.FlowTemplate{
+				{Kind: podFlowKind, Priority: 100, Match: "in_port=${ovs_port}, arp, nw_src=${pod_ip}, arp_sha=${pod_mac}", Actions: "load:${vnid}->NXM_NX_REG0[], goto_table:5"},
+				{Kind: podFlowKind, Priority: 100, Match: "in_port=${ovs_port}, ip, nw_src=${pod_ip}", Actions: "load:${vnid}->NXM_NX_REG0[], goto_table:3"},
+				{Priority: 0, Actions: "drop"},
+			},
+		},
+		{
+			Number:  3,
+			Name:    "service-classifier",
+			Purpose: "from OpenShift container; service vs non-service",
+			Flows: []ovs.FlowTemplate{
+				{Priority: 100, Match: "ip, nw_dst=${service_network}", Actions: "goto_table:4"},
+				{Priority: 0, Actions: "goto_table:5"},
+			},
+		},
+		{
+			Number:  4,
+			Name:    "service-dispatch",
+			Purpose: "from OpenShift container; service dispatch, allowing access to services in the source's VNID",
+			Flows: []ovs.FlowTemplate{
+				{Priority: 200, Match: "reg0=0", Actions: "output:${tun_ofport}"},
+				{Kind: serviceFlowKind, Priority: 100, Match: "reg0=${vnid}, ${service_protocol}, nw_dst=${service_ip}, tp_dst=${service_port}", Actions: "output:${tun_ofport}"},
+				{Priority: 0, Actions: "drop"},
+			},
+		},
+		{
+			Number:  5,
+			Name:    "routing",
+			Purpose: "general routing",
+			Flows: []ovs.FlowTemplate{
+				{Priority: 300, Match: "arp, nw_dst=${local_gateway}", Actions: "output:${tun_ofport}"},
+				{Priority: 300, Match: "ip, nw_dst=${local_gateway}", Actions: "output:${tun_ofport}"},
+				{Priority: 200, Match: "arp, nw_dst=${local_subnet}", Actions: "goto_table:6"},
+				{Priority: 200, Match: "ip, nw_dst=${local_subnet}", Actions: "goto_table:7"},
+				{Priority: 100, Match: "arp, nw_dst=${cluster_network}", Actions: "goto_table:8"},
+				{Priority: 100, Match: "ip, nw_dst=${cluster_network}", Actions: "goto_table:8"},
+				// else, IP leaves the cluster network via tun0, and
+				// anything else (ARP) is dropped
+				{Priority: 50, Match: "ip", Actions: "output:${tun_ofport}"},
+				{Priority: 0, Actions: "drop"},
+			},
+		},
+		{
+			Number:  6,
+			Name:    "arp-to-pod",
+			Purpose: "ARP to container (not isolated)",
+			Flows: []ovs.FlowTemplate{
+				{Kind: podFlowKind, Priority: 100, Match: "arp, nw_dst=${pod_ip}", Actions: "output:${ovs_port}"},
+				{Priority: 0, Actions: "output:${vovsbr_ofport}"},
+			},
+		},
+		{
+			Number:  7,
+			Name:    "ip-to-pod",
+			Purpose: "IP to container; from any VNID to VNID 0 containers, and otherwise from VNID 0 or the container's own VNID",
+			Flows: []ovs.FlowTemplate{
+				{Kind: podFlowKind, Priority: 100, Match: "reg0=${pod_source_vnids}, ip, nw_dst=${pod_ip}", Actions: "output:${ovs_port}"},
+				{Priority: 0, Actions: "output:${vovsbr_ofport}"},
+			},
+		},
+		{
+			Number:  8,
+			Name:    "to-remote-pod",
+			Purpose: "to remote container; tunnels traffic to the node of the destination's HostSubnet",
+			Flows: []ovs.FlowTemplate{
+				{Kind: hostSubnetFlowKind, Priority: 100, Match: "arp, nw_dst=${subnet}", Actions: "move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${node_ip}->tun_dst, output:${vxlan_ofport}"},
+				{Kind: hostSubnetFlowKind, Priority: 100, Match: "ip, nw_dst=${subnet}", Actions: "move:NXM_NX_REG0[]->NXM_NX_TUN_ID[0..31], set_field:${node_ip}->tun_dst, output:${vxlan_ofport}"},
+				{Priority: 0, Actions: "drop"},
+			},
+		},
+		{
+			Number:     VERSION_TABLE,
+			Name:       "version",
+			Purpose:    "rule version; the note is the plugin type and VERSION (see getPluginVersion)",
+			Standalone: true,
+			Flows: []ovs.FlowTemplate{
+				{Kind: versionFlowKind, Priority: ovs.DefaultPriority, Actions: "note:${version}"},
+			},
+		},
+	},
+}
+
+// renderFlows renders the flows of the given kind from sdnPipeline
+func renderFlows(kind string, cookie uint64, vars ovs.PipelineVars) ([]*ovs.Flow, error) {
+	allVars := ovs.PipelineVars{
+		"vxlan_ofport":  {fmt.Sprint(VXLAN_OFPORT)},
+		"tun_ofport":    {fmt.Sprint(TUN_OFPORT)},
+		"vovsbr_ofport": {fmt.Sprint(VOVSBR_OFPORT)},
+	}
+	for name, values := range vars {
+		allVars[name] = values
+	}
+	flows, err := sdnPipeline.Render(kind, cookie, allVars)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering %q flows: %v", kind, err)
+	}
+	return flows, nil
+}
+
+// getPodFlows returns the flows for a pod with the given OVS port, address and
+// VNID
+func getPodFlows(cookie uint64, ofport uint, ip, mac string, vnid uint) ([]*ovs.Flow, error) {
+	// VNID 0 pods (which includes all pods for single-tenant) accept IP
+	// traffic from any VNID; other pods only accept it from VNID 0 and from
+	// their own VNID
+	sourceVNIDs := []string{""}
+	if vnid != 0 {
+		sourceVNIDs = []string{"0", fmt.Sprint(vnid)}
+	}
+	return renderFlows(podFlowKind, cookie, ovs.PipelineVars{
+		"ovs_port":         {fmt.Sprint(ofport)},
+		"pod_ip":           {ip},
+		"pod_mac":          {mac},
+		"vnid":             {fmt.Sprint(vnid)},
+		"pod_source_vnids": sourceVNIDs,
+	})
+}
+
+// getHostSubnetFlows returns the flows for the node with the given IP and pod
+// subnet
+func getHostSubnetFlows(cookie uint64, nodeIP, subnet string) ([]*ovs.Flow, error) {
+	return renderFlows(hostSubnetFlowKind, cookie, ovs.PipelineVars{
+		"node_ip": {nodeIP},
+		"subnet":  {subnet},
+	})
+}
+
+// getServiceFlows returns the flows for a service port in the given VNID. (VNID
+// 0 services are accessible from every VNID.)
+func getServiceFlows(cookie uint64, netID uint, ip string, protocol string, port int) ([]*ovs.Flow, error) {
+	vnid := ""
+	if netID != 0 {
+		vnid = fmt.Sprint(netID)
+	}
+	return renderFlows(serviceFlowKind, cookie, ovs.PipelineVars{
+		"vnid":             {vnid},
+		"service_protocol": {strings.ToLower(protocol)},
+		"service_ip":       {ip},
+		"service_port":     {fmt.Sprint(port)},
+	})
+}
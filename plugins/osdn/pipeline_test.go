@@ -0,0 +1,273 @@
+package osdn
+
+import (
+	"testing"
+
+	"github.com/openshift/openshift-sdn/pkg/ovs"
+)
+
+// Pods on the simulated node
+const (
+	simPod12Port = 4 // 10.1.0.2, VNID 12
+	simPod13Port = 5 // 10.1.0.3, VNID 13
+	simPod0Port  = 6 // 10.1.0.4, VNID 0
+)
+
+var simNodeCookie = ovs.NewCookie(ovs.OwnerHostSubnet, "node2")
+
+// newSDNSimulator returns an ovs.Simulator with the flows that the plugin
+// would install on br0 for a node with subnet 10.1.0.0/24, another node
+// 192.168.1.5 with subnet 10.1.1.0/24, a service 172.30.0.10:80/TCP in VNID
+// 12, and three local pods.
+func newSDNSimulator(t *testing.T) *ovs.Simulator {
+	flows, err := getBaseFlows("10.1.0.0/24", "10.1.0.1", []string{"10.1.0.0/16"}, "172.30.0.0/16")
+	if err != nil {
+		t.Fatalf("unexpected error rendering base flows: %v", err)
+	}
+	hostSubnetFlows, err := getHostSubnetFlows(simNodeCookie, "192.168.1.5", "10.1.1.0/24")
+	if err != nil {
+		t.Fatalf("unexpected error rendering HostSubnet flows: %v", err)
+	}
+	flows = append(flows, hostSubnetFlows...)
+	serviceFlows, err := getServiceFlows(2, 12, "172.30.0.10", "TCP", 80)
+	if err != nil {
+		t.Fatalf("unexpected error rendering service flows: %v", err)
+	}
+	flows = append(flows, serviceFlows...)
+	for _, pod := range []struct {
+		ofport  uint
+		ip, mac string
+		vnid    uint
+	}{
+		{simPod12Port, "10.1.0.2", "0a:58:0a:01:00:02", 12},
+		{simPod13Port, "10.1.0.3", "0a:58:0a:01:00:03", 13},
+		{simPod0Port, "10.1.0.4", "0a:58:0a:01:00:04", 0},
+	} {
+		podFlows, err := getPodFlows(uint64(10+pod.ofport), pod.ofport, pod.ip, pod.mac, pod.vnid)
+		if err != nil {
+			t.Fatalf("unexpected error rendering pod flows: %v", err)
+		}
+		flows = append(flows, podFlows...)
+	}
+
+	sim := ovs.NewSimulator()
+	if err := sim.AddFlows(flows...); err != nil {
+		t.Fatalf("could not simulate flows: %v", err)
+	}
+	return sim
+}
+
+func simRun(t *testing.T, sim *ovs.Simulator, packet ovs.SimPacket) *ovs.SimResult {
+	result, err := sim.Run(packet)
+	if err != nil {
+		t.Fatalf("unexpected error running %#v: %v", packet, err)
+	}
+	return result
+}
+
+func TestSDNPipeline(t *testing.T) {
+	if err := sdnPipeline.Validate(); err != nil {
+		t.Fatalf("invalid pipeline: %v", err)
+	}
+	if unreachable := sdnPipeline.UnreachableTables(); len(unreachable) != 0 {
+		t.Errorf("unreachable tables: %v", unreachable)
+	}
+	if missing := sdnPipeline.TablesWithoutDefaultFlow(); len(missing) != 0 {
+		t.Errorf("tables without a default flow: %v", missing)
+	}
+}
+
+func TestSDNPipelineRender(t *testing.T) {
+	baseFlows, err := renderFlows("", 0, ovs.PipelineVars{
+		"local_subnet":    {"10.1.0.0/24"},
+		"local_gateway":   {"10.1.0.1"},
+		"cluster_network": {"10.1.0.0/16"},
+		"service_network": {"172.30.0.0/16"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error rendering base flows: %v", err)
+	}
+	if len(baseFlows) == 0 {
+		t.Fatalf("no base flows rendered")
+	}
+
+	for _, tc := range []struct {
+		vnid  uint
+		flows int
+	}{
+		// table 2 arp and ip, table 6, and table 7 (without reg0)
+		{0, 4},
+		// table 7 once from VNID 0 and once from the pod's own VNID
+		{5, 5},
+	} {
+		flows, err := getPodFlows(1, 3, "10.1.0.2", "aa:bb:cc:dd:ee:ff", tc.vnid)
+		if err != nil {
+			t.Fatalf("unexpected error rendering pod flows for VNID %d: %v", tc.vnid, err)
+		}
+		if len(flows) != tc.flows {
+			t.Fatalf("expected %d pod flows for VNID %d, got %d: %v", tc.flows, tc.vnid, len(flows), flows)
+		}
+		for _, flow := range flows {
+			if flow.Cookie != 1 {
+				t.Errorf("pod flow %v has wrong cookie", flow)
+			}
+			if err := flow.Validate(); err != nil {
+				t.Errorf("invalid pod flow %v: %v", flow, err)
+			}
+		}
+	}
+
+	flows, err := getServiceFlows(2, 0, "172.30.0.10", "TCP", 80)
+	if err != nil {
+		t.Fatalf("unexpected error rendering service flows: %v", err)
+	}
+	if len(flows) != 1 {
+		t.Fatalf("expected 1 service flow, got %d: %v", len(flows), flows)
+	}
+}
+
+func TestSDNPipelineIsolation(t *testing.T) {
+	sim := newSDNSimulator(t)
+
+	// VNID 12 pod cannot reach VNID 13 pod...
+	result := simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.2", Dst: "10.1.0.3"})
+	if result.OutputTo(simPod13Port) {
+		t.Fatalf("VNID 12 pod reached VNID 13 pod")
+	}
+	// ...but can reach the VNID 0 pod
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.2", Dst: "10.1.0.4"})
+	if !result.OutputTo(simPod0Port) || len(result.Outputs) != 1 {
+		t.Fatalf("VNID 12 pod could not reach VNID 0 pod: %#v", result.Outputs)
+	}
+	// and the VNID 0 pod can reach everyone
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod0Port, Src: "10.1.0.4", Dst: "10.1.0.3"})
+	if !result.OutputTo(simPod13Port) {
+		t.Fatalf("VNID 0 pod could not reach VNID 13 pod")
+	}
+
+	// Spoofed source addresses are dropped
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.3", Dst: "10.1.0.4"})
+	if !result.Dropped() || !result.Steps[len(result.Steps)-1].Flow.IsDefaultDrop() {
+		t.Fatalf("spoofed packet was not dropped: %#v", result.Outputs)
+	}
+
+	// ARP is not isolated, but the sender MAC must match
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Protocol: ovs.ProtocolARP, Src: "10.1.0.2", Dst: "10.1.0.3", ArpSha: "0a:58:0a:01:00:02"})
+	if !result.OutputTo(simPod13Port) {
+		t.Fatalf("ARP was not delivered")
+	}
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Protocol: ovs.ProtocolARP, Src: "10.1.0.2", Dst: "10.1.0.3", ArpSha: "0a:58:0a:01:00:99"})
+	if !result.Dropped() {
+		t.Fatalf("ARP with wrong MAC was not dropped")
+	}
+
+	// Services are only reachable from the same VNID, or from VNID 0
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Protocol: ovs.ProtocolTCP, Src: "10.1.0.2", Dst: "172.30.0.10", DstPort: 80})
+	if !result.OutputTo(TUN_OFPORT) {
+		t.Fatalf("VNID 12 pod could not reach VNID 12 service")
+	}
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod13Port, Protocol: ovs.ProtocolTCP, Src: "10.1.0.3", Dst: "172.30.0.10", DstPort: 80})
+	if !result.Dropped() {
+		t.Fatalf("VNID 13 pod reached VNID 12 service")
+	}
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod0Port, Protocol: ovs.ProtocolTCP, Src: "10.1.0.4", Dst: "172.30.0.10", DstPort: 80})
+	if !result.OutputTo(TUN_OFPORT) {
+		t.Fatalf("VNID 0 pod could not reach VNID 12 service")
+	}
+}
+
+func TestSDNPipelineVXLAN(t *testing.T) {
+	sim := newSDNSimulator(t)
+
+	// Traffic to a remote pod carries the VNID in the tunnel ID
+	result := simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.2", Dst: "10.1.1.7"})
+	if len(result.Outputs) != 1 {
+		t.Fatalf("wrong outputs %#v", result.Outputs)
+	}
+	out := result.Outputs[0]
+	if out.Port != VXLAN_OFPORT || out.Packet.TunID != 12 || out.Packet.TunDst != "192.168.1.5" {
+		t.Fatalf("wrong VXLAN output %#v", out)
+	}
+
+	// Incoming VXLAN traffic is delivered only within the VNID
+	result = simRun(t, sim, ovs.SimPacket{InPort: VXLAN_OFPORT, TunSrc: "192.168.1.5", TunID: 12, Src: "10.1.1.7", Dst: "10.1.0.2"})
+	if !result.OutputTo(simPod12Port) {
+		t.Fatalf("VXLAN traffic for VNID 12 was not delivered: %#v", result.Steps)
+	}
+	result = simRun(t, sim, ovs.SimPacket{InPort: VXLAN_OFPORT, TunSrc: "192.168.1.5", TunID: 13, Src: "10.1.1.7", Dst: "10.1.0.2"})
+	if result.OutputTo(simPod12Port) {
+		t.Fatalf("VXLAN traffic for VNID 13 was delivered to VNID 12 pod")
+	}
+
+	// ...and only from known nodes
+	result = simRun(t, sim, ovs.SimPacket{InPort: VXLAN_OFPORT, TunSrc: "192.168.1.99", TunID: 12, Src: "10.1.1.7", Dst: "10.1.0.2"})
+	if !result.Dropped() {
+		t.Fatalf("VXLAN traffic from unknown node was not dropped")
+	}
+
+	// Removing the HostSubnet's flows makes the node unreachable
+	sim.DeleteFlowsByCookie(simNodeCookie, ovs.CookieExactMask)
+	result = simRun(t, sim, ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.2", Dst: "10.1.1.7"})
+	if !result.Dropped() {
+		t.Fatalf("traffic to deleted node was not dropped")
+	}
+	result = simRun(t, sim, ovs.SimPacket{InPort: VXLAN_OFPORT, TunSrc: "192.168.1.5", TunID: 12, Src: "10.1.1.7", Dst: "10.1.0.2"})
+	if !result.Dropped() {
+		t.Fatalf("traffic from deleted node was not dropped")
+	}
+}
+
+// simFinalFlow returns the table and priority of the last flow that matched
+// the packet (or -1 as the priority if nothing matched in the last table)
+func simFinalFlow(result *ovs.SimResult) (int, int) {
+	step := result.Steps[len(result.Steps)-1]
+	if step.Flow == nil {
+		return step.Table, -1
+	}
+	return step.Table, step.Flow.Priority
+}
+
+func TestSDNPipelineRouting(t *testing.T) {
+	sim := newSDNSimulator(t)
+
+	for _, tc := range []struct {
+		name     string
+		packet   ovs.SimPacket
+		output   uint // 0 if dropped
+		table    int
+		priority int
+	}{
+		// IP to anywhere outside the cluster network goes to tun0 via
+		// table 5's priority 50 fallback, whichever port it came from
+		{"pod IP to external", ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.2", Dst: "8.8.8.8"}, TUN_OFPORT, 5, 50},
+		{"docker IP to external", ovs.SimPacket{InPort: VOVSBR_OFPORT, Src: "10.1.0.50", Dst: "8.8.8.8"}, TUN_OFPORT, 5, 50},
+		{"pod TCP to external", ovs.SimPacket{InPort: simPod12Port, Protocol: ovs.ProtocolTCP, Src: "10.1.0.2", Dst: "8.8.8.8", DstPort: 53}, TUN_OFPORT, 5, 50},
+		// ARP for anything outside the cluster network hits table 5's
+		// priority 0 drop
+		{"pod ARP to external", ovs.SimPacket{InPort: simPod12Port, Protocol: ovs.ProtocolARP, Src: "10.1.0.2", Dst: "8.8.8.8", ArpSha: "0a:58:0a:01:00:02"}, 0, 5, 0},
+		{"docker ARP to external", ovs.SimPacket{InPort: VOVSBR_OFPORT, Protocol: ovs.ProtocolARP, Src: "10.1.0.50", Dst: "8.8.8.8"}, 0, 5, 0},
+		// The local gateway is reachable by both
+		{"pod IP to gateway", ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.2", Dst: "10.1.0.1"}, TUN_OFPORT, 5, 300},
+		{"pod ARP to gateway", ovs.SimPacket{InPort: simPod12Port, Protocol: ovs.ProtocolARP, Src: "10.1.0.2", Dst: "10.1.0.1", ArpSha: "0a:58:0a:01:00:02"}, TUN_OFPORT, 5, 300},
+		// Cluster network traffic never falls back to tun0, even when
+		// there is no HostSubnet for the destination
+		{"pod IP to unassigned subnet", ovs.SimPacket{InPort: simPod12Port, Src: "10.1.0.2", Dst: "10.1.5.5"}, 0, 8, 0},
+		{"pod ARP to unassigned subnet", ovs.SimPacket{InPort: simPod12Port, Protocol: ovs.ProtocolARP, Src: "10.1.0.2", Dst: "10.1.5.5", ArpSha: "0a:58:0a:01:00:02"}, 0, 8, 0},
+		// Traffic from the host reaches local pods, and docker containers
+		{"host IP to pod", ovs.SimPacket{InPort: TUN_OFPORT, Src: "10.1.0.1", Dst: "10.1.0.3"}, simPod13Port, 7, 100},
+		{"host IP to docker", ovs.SimPacket{InPort: TUN_OFPORT, Src: "10.1.0.1", Dst: "10.1.0.50"}, VOVSBR_OFPORT, 7, 0},
+		{"host ARP to docker", ovs.SimPacket{InPort: TUN_OFPORT, Protocol: ovs.ProtocolARP, Src: "10.1.0.1", Dst: "10.1.0.50"}, VOVSBR_OFPORT, 6, 0},
+	} {
+		result := simRun(t, sim, tc.packet)
+		if tc.output == 0 {
+			if !result.Dropped() {
+				t.Errorf("%s: expected drop, got %#v", tc.name, result.Outputs)
+			}
+		} else if !result.OutputTo(tc.output) || len(result.Outputs) != 1 {
+			t.Errorf("%s: expected output to port %d, got %#v", tc.name, tc.output, result.Outputs)
+		}
+		if table, priority := simFinalFlow(result); table != tc.table || priority != tc.priority {
+			t.Errorf("%s: expected to end at table %d priority %d, ended at table %d priority %d", tc.name, tc.table, tc.priority, table, priority)
+		}
+	}
+}
@@ -2,12 +2,18 @@ package osdn
 
 import (
 	"fmt"
-	"os/exec"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/netutils"
+	"github.com/openshift/openshift-sdn/pkg/ovs"
+
 	kapi "k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/api/resource"
 	kubeletTypes "k8s.io/kubernetes/pkg/kubelet/container"
@@ -46,12 +52,21 @@ const (
 	tearDownCmd = "teardown"
 	statusCmd   = "status"
 	updateCmd   = "update"
+
+	// podScriptTimeout is how long to let openshift-sdn-ovs run before
+	// giving up on it
+	podScriptTimeout = 2 * time.Minute
 )
 
 func (plugin *OsdnNode) getExecutable() string {
 	return "openshift-sdn-ovs"
 }
 
+// runPodScript runs openshift-sdn-ovs with the given arguments
+func (plugin *OsdnNode) runPodScript(args ...string) (string, error) {
+	return plugin.execer.ExecWithTimeout(podScriptTimeout, "", plugin.getExecutable(), args...)
+}
+
 func (plugin *OsdnNode) Init(host knetwork.Host) error {
 	return nil
 }
@@ -137,8 +152,8 @@ func isScriptError(err error) bool {
 // Get the last command (which is prefixed with "+" because of "set -x") and its output
 // (Unless the script ended with "echo ...; exit", in which case we just return the
 // echoed text.)
-func getScriptError(output []byte) string {
-	lines := strings.Split(string(output), "\n")
+func getScriptError(output string) string {
+	lines := strings.Split(output, "\n")
 	last := len(lines)
 	for n := last - 1; n >= 0; n-- {
 		if strings.HasPrefix(lines[n], "+ exit") {
@@ -149,7 +164,94 @@ func getScriptError(output []byte) string {
 			return strings.Join(lines[n:], "\n")
 		}
 	}
-	return string(output)
+	return output
+}
+
+// getPodCookie returns the cookie for the pod's flows
+func getPodCookie(namespace, name string) uint64 {
+	return ovs.NewCookie(ovs.OwnerPod, namespace+"/"+name)
+}
+
+// podInfoRE matches the line that openshift-sdn-ovs prints with the details
+// needed for the pod's flows
+var podInfoRE = regexp.MustCompile(`(?m)^pod_info: ovs_port=([0-9]+) pod_mac=(\S+) pod_ip=(\S+)$`)
+
+// setPodFlows replaces the pod's flows with ones for the OVS port, MAC and IP
+// that openshift-sdn-ovs reported in out
+func (plugin *OsdnNode) setPodFlows(namespace, name, vnidstr, out string) error {
+	match := podInfoRE.FindStringSubmatch(out)
+	if match == nil {
+		// The script exits early for pods that aren't on the pod network
+		return nil
+	}
+	ofport, err := strconv.ParseUint(match[1], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid OVS port %q for pod %s/%s", match[1], namespace, name)
+	}
+	vnid, err := strconv.ParseUint(vnidstr, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid VNID %q for pod %s/%s", vnidstr, namespace, name)
+	}
+
+	cookie := getPodCookie(namespace, name)
+	flows, err := getPodFlows(cookie, uint(ofport), match[3], match[2], uint(vnid))
+	if err != nil {
+		return err
+	}
+	otx := ovs.NewTransaction(plugin.execer, BR)
+	otx.DeleteFlowsByCookie(cookie, ovs.CookieExactMask)
+	otx.AddFlows(flows...)
+	if err := otx.EndTransaction(); err != nil {
+		return fmt.Errorf("Error adding OVS flows for pod %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// getPodIPOwner returns the owner of the IP address of the pod with infra
+// container id in the node's IPAM. The owner includes the infra container ID so
+// that tearing down a deleted pod can't release the IP of a new pod with the
+// same name. (The IPs that syncPodIPs records for pods set up before the node
+// allocated pod IPs itself have an empty id.)
+func getPodIPOwner(namespace, name, id string) string {
+	return getPodIPOwnerPrefix(namespace, name) + id
+}
+
+// getPodIPOwnerPrefix returns the part of getPodIPOwner's result that is the
+// same for all of the pod's infra containers
+func getPodIPOwnerPrefix(namespace, name string) string {
+	return namespace + "/" + name + "/"
+}
+
+// getPodIP returns the IP address of the pod with infra container id, or if
+// there is none (eg, because id is not an infra container ID), the pod's only
+// IP address. It returns nil if the pod doesn't have exactly one address.
+func (plugin *OsdnNode) getPodIP(namespace, name, id string) net.IP {
+	if ip, ok := plugin.ipam.Get(getPodIPOwner(namespace, name, id)); ok {
+		return ip
+	}
+	var podIP net.IP
+	prefix := getPodIPOwnerPrefix(namespace, name)
+	for owner, ip := range plugin.ipam.Allocations() {
+		if strings.HasPrefix(owner, prefix) {
+			if podIP != nil {
+				return nil
+			}
+			podIP = ip
+		}
+	}
+	return podIP
+}
+
+// getPodIPArgs returns the openshift-sdn-ovs arguments giving the pod's address
+// (in CIDR form) and its gateway, or empty arguments if ip is nil, in which case
+// the script uses the address docker assigned to the pod
+func (plugin *OsdnNode) getPodIPArgs(ip net.IP) []string {
+	if ip == nil {
+		return []string{"", ""}
+	}
+	network := plugin.ipam.Network()
+	prefixLength, _ := network.Mask.Size()
+	return []string{fmt.Sprintf("%s/%d", ip, prefixLength), netutils.GenerateDefaultGateway(network).String()}
 }
 
 func (plugin *OsdnNode) SetUpPod(namespace string, name string, id kubeletTypes.ContainerID) error {
@@ -158,6 +260,9 @@ func (plugin *OsdnNode) SetUpPod(namespace string, name string, id kubeletTypes.
 		return err
 	}
 
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+
 	pod, err := plugin.registry.GetPod(plugin.hostName, namespace, name)
 	if err != nil {
 		return err
@@ -187,26 +292,58 @@ func (plugin *OsdnNode) SetUpPod(namespace string, name string, id kubeletTypes.
 		return err
 	}
 
-	out, err := exec.Command(plugin.getExecutable(), setUpCmd, id.ID, vnidstr, ingressStr, egressStr, fmt.Sprintf("%t", macvlan)).CombinedOutput()
-	glog.V(5).Infof("SetUpPod network plugin output: %s, %v", string(out), err)
+	ip, err := plugin.ipam.Allocate(getPodIPOwner(namespace, name, id.ID))
+	if err != nil {
+		return fmt.Errorf("failed to allocate IP for pod %s/%s: %v", namespace, name, err)
+	}
+
+	args := []string{setUpCmd, id.ID, ingressStr, egressStr, fmt.Sprintf("%t", macvlan)}
+	out, err := plugin.runPodScript(append(args, plugin.getPodIPArgs(ip)...)...)
+	glog.V(5).Infof("SetUpPod network plugin output: %s, %v", out, err)
 
+	// If setup fails, kubelet tears the pod down, which releases the IP
 	if isScriptError(err) {
 		return fmt.Errorf("Error running network setup script: %s", getScriptError(out))
-	} else {
+	} else if err != nil {
 		return err
 	}
+	return plugin.setPodFlows(namespace, name, vnidstr, out)
 }
 
 func (plugin *OsdnNode) TearDownPod(namespace string, name string, id kubeletTypes.ContainerID) error {
-	// The script's teardown functionality doesn't need the VNID
-	out, err := exec.Command(plugin.getExecutable(), tearDownCmd, id.ID, "-1", "-1", "-1").CombinedOutput()
-	glog.V(5).Infof("TearDownPod network plugin output: %s, %v", string(out), err)
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+
+	otx := ovs.NewTransaction(plugin.execer, BR)
+	otx.DeleteFlowsByCookie(getPodCookie(namespace, name), ovs.CookieExactMask)
+	if err := otx.EndTransaction(); err != nil {
+		return fmt.Errorf("Error deleting OVS flows for pod %s/%s: %v", namespace, name, err)
+	}
+
+	out, err := plugin.runPodScript(tearDownCmd, id.ID, "-1", "-1", "false", "", "")
+	glog.V(5).Infof("TearDownPod network plugin output: %s, %v", out, err)
+
+	// Release the IP whether or not the script succeeded: it is only unsafe
+	// to release it while the pod's flows could still match traffic for
+	// another pod that is given the IP, and they are gone. (If the node
+	// hasn't started yet, syncPodIPs will release it when it does.)
+	var ipErr error
+	if plugin.ipam != nil {
+		ipErr = plugin.ipam.Release(getPodIPOwner(namespace, name, id.ID))
+		if ipErr == nil {
+			ipErr = plugin.ipam.Release(getPodIPOwner(namespace, name, ""))
+		}
+		if ipErr != nil && err != nil {
+			glog.Errorf("Error releasing IP of pod %s/%s: %v", namespace, name, ipErr)
+		}
+	}
 
 	if isScriptError(err) {
 		return fmt.Errorf("Error running network teardown script: %s", getScriptError(out))
-	} else {
+	} else if err != nil {
 		return err
 	}
+	return ipErr
 }
 
 func (plugin *OsdnNode) Status() error {
@@ -214,23 +351,46 @@ func (plugin *OsdnNode) Status() error {
 }
 
 func (plugin *OsdnNode) GetPodNetworkStatus(namespace string, name string, podInfraContainerID kubeletTypes.ContainerID) (*knetwork.PodNetworkStatus, error) {
+	if plugin.ipam == nil {
+		return nil, nil
+	}
+	if ip, ok := plugin.ipam.Get(getPodIPOwner(namespace, name, podInfraContainerID.ID)); ok {
+		return &knetwork.PodNetworkStatus{IP: ip}, nil
+	}
+	// Let kubelet use the IP docker assigned to the pod
 	return nil, nil
 }
 
 func (plugin *OsdnNode) UpdatePod(namespace string, name string, id kubeletTypes.DockerID) error {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+
+	return plugin.updatePod(namespace, name, id)
+}
+
+// updatePod is UpdatePod without the locking
+func (plugin *OsdnNode) updatePod(namespace string, name string, id kubeletTypes.DockerID) error {
 	vnidstr, err := plugin.getVNID(namespace)
 	if err != nil {
 		return err
 	}
 
-	out, err := exec.Command(plugin.getExecutable(), updateCmd, string(id), vnidstr).CombinedOutput()
-	glog.V(5).Infof("UpdatePod network plugin output: %s, %v", string(out), err)
+	// If the node hasn't started yet, the script falls back to the address
+	// docker assigned to the pod
+	var ip net.IP
+	if plugin.ipam != nil {
+		ip = plugin.getPodIP(namespace, name, string(id))
+	}
+	args := []string{updateCmd, string(id), "", "", "false"}
+	out, err := plugin.runPodScript(append(args, plugin.getPodIPArgs(ip)...)...)
+	glog.V(5).Infof("UpdatePod network plugin output: %s, %v", out, err)
 
 	if isScriptError(err) {
 		return fmt.Errorf("Error running network update script: %s", getScriptError(out))
-	} else {
+	} else if err != nil {
 		return err
 	}
+	return plugin.setPodFlows(namespace, name, vnidstr, out)
 }
 
 func (plugin *OsdnNode) Event(name string, details map[string]interface{}) {
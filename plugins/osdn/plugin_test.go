@@ -0,0 +1,74 @@
+package osdn
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/openshift/openshift-sdn/pkg/exec"
+	"github.com/openshift/openshift-sdn/pkg/netutils"
+
+	kubeletTypes "k8s.io/kubernetes/pkg/kubelet/container"
+)
+
+func TestUpdatePodBeforeStart(t *testing.T) {
+	fexec := exec.NewFakeExecutor()
+	fexec.AddResult("openshift-sdn-ovs update 0123456789ab   false  ", "", nil)
+
+	// The node has no IPAM until Start() runs
+	node := &OsdnNode{execer: fexec, vnids: newVnidMap()}
+	if err := node.UpdatePod("ns1", "pod1", "0123456789ab"); err != nil {
+		t.Fatalf("unexpected error from UpdatePod: %v", err)
+	}
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("unexpected commands: %v", err)
+	}
+}
+
+func TestTearDownPodReleasesIP(t *testing.T) {
+	defer testSetup(t)()
+
+	ipamDir, err := ioutil.TempDir("", "osdn-ipam")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(ipamDir)
+	ipam, err := netutils.NewHostLocalIPAM("10.1.0.0/24", ipamDir)
+	if err != nil {
+		t.Fatalf("could not create IPAM: %v", err)
+	}
+	// pod1 was deleted and recreated; the old pod hasn't been torn down yet
+	oldOwner := getPodIPOwner("ns1", "pod1", "0123456789ab")
+	newOwner := getPodIPOwner("ns1", "pod1", "ba9876543210")
+	if err := ipam.AllocateIP(oldOwner, net.ParseIP("10.1.0.2")); err != nil {
+		t.Fatalf("could not allocate pod IP: %v", err)
+	}
+	if err := ipam.AllocateIP(newOwner, net.ParseIP("10.1.0.3")); err != nil {
+		t.Fatalf("could not allocate pod IP: %v", err)
+	}
+
+	fexec := newFakeBridge("openshift-sdn-ovs")
+	fexec.AddResult("openshift-sdn-ovs teardown 0123456789ab -1 -1 false  ", "+ ovs-vsctl del-port veth1\nfailed\n", &exec.ExitError{Cmd: "openshift-sdn-ovs", Status: 1})
+	node := &OsdnNode{execer: fexec, vnids: newVnidMap(), ipam: ipam}
+
+	// With two IPs, the pod's IP is ambiguous without the infra container ID
+	if ip := node.getPodIP("ns1", "pod1", "abcdef"); ip != nil {
+		t.Fatalf("unexpectedly found IP %s", ip)
+	}
+
+	// The old pod's IP is released even though the script failed, and the
+	// new pod's IP is left alone
+	if err := node.TearDownPod("ns1", "pod1", kubeletTypes.ContainerID{Type: "docker", ID: "0123456789ab"}); err == nil {
+		t.Fatalf("unexpected success from TearDownPod")
+	}
+	if ip, ok := ipam.Get(oldOwner); ok {
+		t.Fatalf("IP %s of torn down pod was not released", ip)
+	}
+	if ip := node.getPodIP("ns1", "pod1", "abcdef"); ip == nil || ip.String() != "10.1.0.3" {
+		t.Fatalf("expected recreated pod to have IP 10.1.0.3, got %v", ip)
+	}
+	if err := fexec.Verify(); err != nil {
+		t.Fatalf("unexpected commands: %v", err)
+	}
+}
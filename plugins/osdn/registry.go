@@ -3,6 +3,7 @@ package osdn
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,11 +21,90 @@ import (
 	osapi "github.com/openshift/origin/pkg/sdn/api"
 )
 
-type NetworkInfo struct {
-	ClusterNetwork   *net.IPNet
-	ServiceNetwork   *net.IPNet
+// ClusterNetworkEntry is one of the networks that pod IPs are allocated from,
+// along with the number of host bits in each node's subnet of it
+type ClusterNetworkEntry struct {
+	CIDR             *net.IPNet
 	HostSubnetLength int
-	PluginName       string
+}
+
+type NetworkInfo struct {
+	ClusterNetworks []ClusterNetworkEntry
+	ServiceNetwork  *net.IPNet
+	PluginName      string
+}
+
+// AdditionalClusterNetworksAnnotation is the annotation on the ClusterNetwork
+// object that stores any cluster networks after the first (which is stored in
+// its Network and HostSubnetLength fields), in the same "CIDR:length,..."
+// format as the ClusterNetworkCIDR config option.
+const AdditionalClusterNetworksAnnotation = "network.openshift.io/additional-cluster-networks"
+
+// ClusterNetworkContains returns true if ip is in one of ni's cluster networks
+func (ni *NetworkInfo) ClusterNetworkContains(ip net.IP) bool {
+	for _, cn := range ni.ClusterNetworks {
+		if cn.CIDR.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClusterNetworkCIDRs returns the CIDRs of ni's cluster networks
+func (ni *NetworkInfo) ClusterNetworkCIDRs() []string {
+	cidrs := make([]string, 0, len(ni.ClusterNetworks))
+	for _, cn := range ni.ClusterNetworks {
+		cidrs = append(cidrs, cn.CIDR.String())
+	}
+	return cidrs
+}
+
+// formatClusterNetworks returns entries in the format parsed by
+// parseClusterNetworks, with explicit host subnet lengths
+func formatClusterNetworks(entries []ClusterNetworkEntry) string {
+	networks := make([]string, 0, len(entries))
+	for _, cn := range entries {
+		networks = append(networks, fmt.Sprintf("%s:%d", cn.CIDR.String(), cn.HostSubnetLength))
+	}
+	return strings.Join(networks, ",")
+}
+
+// parseClusterNetworks parses a comma-separated list of cluster network CIDRs,
+// each optionally followed by ":" and the host subnet length to use for that
+// network (eg, "10.128.0.0/14:9,10.1.0.0/16"). Networks without a host subnet
+// length use defaultHostSubnetLength.
+func parseClusterNetworks(networks string, defaultHostSubnetLength int) ([]ClusterNetworkEntry, error) {
+	var entries []ClusterNetworkEntry
+	for _, network := range strings.Split(networks, ",") {
+		network = strings.TrimSpace(network)
+		hostSubnetLength := defaultHostSubnetLength
+		if slash := strings.Index(network, "/"); slash != -1 {
+			if colon := strings.Index(network[slash:], ":"); colon != -1 {
+				length, err := strconv.Atoi(network[slash+colon+1:])
+				if err != nil {
+					return nil, fmt.Errorf("Failed to parse HostSubnetLength in ClusterNetwork %s: %v", network, err)
+				}
+				hostSubnetLength = length
+				network = network[:slash+colon]
+			}
+		}
+
+		_, cidr, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse ClusterNetwork CIDR %s: %v", network, err)
+		}
+		maskSize, addrBits := cidr.Mask.Size()
+		if hostSubnetLength <= 0 || hostSubnetLength > addrBits-maskSize {
+			return nil, fmt.Errorf("Invalid HostSubnetLength %d for ClusterNetwork %s (not between 1 and %d)", hostSubnetLength, network, addrBits-maskSize)
+		}
+		for _, other := range entries {
+			if other.CIDR.Contains(cidr.IP) || cidr.Contains(other.CIDR.IP) {
+				return nil, fmt.Errorf("ClusterNetwork %s overlaps ClusterNetwork %s", cidr.String(), other.CIDR.String())
+			}
+		}
+		entries = append(entries, ClusterNetworkEntry{CIDR: cidr, HostSubnetLength: hostSubnetLength})
+	}
+	return entries, nil
 }
 
 type Registry struct {
@@ -84,6 +164,30 @@ func (registry *Registry) UpdateSubnet(hs *osapi.HostSubnet) (*osapi.HostSubnet,
 	return registry.oClient.HostSubnets().Update(hs)
 }
 
+func (registry *Registry) GetNodes() ([]kapi.Node, error) {
+	nodeList, err := registry.kClient.Nodes().List(kapi.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return nodeList.Items, nil
+}
+
+func (registry *Registry) GetNode(name string) (*kapi.Node, error) {
+	return registry.kClient.Nodes().Get(name)
+}
+
+func (registry *Registry) UpdateNode(node *kapi.Node) (*kapi.Node, error) {
+	return registry.kClient.Nodes().Update(node)
+}
+
+func (registry *Registry) GetNamespaces() ([]kapi.Namespace, error) {
+	namespaceList, err := registry.kClient.Namespaces().List(kapi.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return namespaceList.Items, nil
+}
+
 func (registry *Registry) GetAllPods() ([]kapi.Pod, error) {
 	podList, err := registry.kClient.Pods(kapi.NamespaceAll).List(kapi.ListOptions{})
 	if err != nil {
@@ -93,7 +197,8 @@ func (registry *Registry) GetAllPods() ([]kapi.Pod, error) {
 	return podList.Items, nil
 }
 
-func (registry *Registry) GetRunningPods(nodeName, namespace string) ([]kapi.Pod, error) {
+// GetNodePods returns the pods on nodeName, whatever their phase
+func (registry *Registry) GetNodePods(nodeName, namespace string) ([]kapi.Pod, error) {
 	fieldSelector := fields.Set{"spec.host": nodeName}.AsSelector()
 	opts := kapi.ListOptions{
 		LabelSelector: labels.Everything(),
@@ -103,10 +208,18 @@ func (registry *Registry) GetRunningPods(nodeName, namespace string) ([]kapi.Pod
 	if err != nil {
 		return nil, err
 	}
+	return podList.Items, nil
+}
+
+func (registry *Registry) GetRunningPods(nodeName, namespace string) ([]kapi.Pod, error) {
+	nodePods, err := registry.GetNodePods(nodeName, namespace)
+	if err != nil {
+		return nil, err
+	}
 
 	// Filter running pods
-	pods := make([]kapi.Pod, 0, len(podList.Items))
-	for _, pod := range podList.Items {
+	pods := make([]kapi.Pod, 0, len(nodePods))
+	for _, pod := range nodePods {
 		if pod.Status.Phase == kapi.PodRunning {
 			pods = append(pods, pod)
 		}
@@ -138,8 +251,7 @@ func (registry *Registry) UpdateClusterNetwork(ni *NetworkInfo) error {
 	if err != nil {
 		return err
 	}
-	cn.Network = ni.ClusterNetwork.String()
-	cn.HostSubnetLength = ni.HostSubnetLength
+	setClusterNetworks(cn, ni.ClusterNetworks)
 	cn.ServiceNetwork = ni.ServiceNetwork.String()
 	cn.PluginName = ni.PluginName
 	updatedNetwork, err := registry.oClient.ClusterNetwork().Update(cn)
@@ -152,13 +264,12 @@ func (registry *Registry) UpdateClusterNetwork(ni *NetworkInfo) error {
 
 func (registry *Registry) CreateClusterNetwork(ni *NetworkInfo) error {
 	cn := &osapi.ClusterNetwork{
-		TypeMeta:         unversioned.TypeMeta{Kind: "ClusterNetwork"},
-		ObjectMeta:       kapi.ObjectMeta{Name: osapi.ClusterNetworkDefault},
-		Network:          ni.ClusterNetwork.String(),
-		HostSubnetLength: ni.HostSubnetLength,
-		ServiceNetwork:   ni.ServiceNetwork.String(),
-		PluginName:       ni.PluginName,
+		TypeMeta:       unversioned.TypeMeta{Kind: "ClusterNetwork"},
+		ObjectMeta:     kapi.ObjectMeta{Name: osapi.ClusterNetworkDefault},
+		ServiceNetwork: ni.ServiceNetwork.String(),
+		PluginName:     ni.PluginName,
 	}
+	setClusterNetworks(cn, ni.ClusterNetworks)
 	updatedNetwork, err := registry.oClient.ClusterNetwork().Create(cn)
 	if err != nil {
 		return err
@@ -167,10 +278,25 @@ func (registry *Registry) CreateClusterNetwork(ni *NetworkInfo) error {
 	return err
 }
 
+// setClusterNetworks stores entries in cn's Network and HostSubnetLength fields
+// and its AdditionalClusterNetworksAnnotation
+func setClusterNetworks(cn *osapi.ClusterNetwork, entries []ClusterNetworkEntry) {
+	cn.Network = entries[0].CIDR.String()
+	cn.HostSubnetLength = entries[0].HostSubnetLength
+	if len(entries) > 1 {
+		if cn.Annotations == nil {
+			cn.Annotations = make(map[string]string)
+		}
+		cn.Annotations[AdditionalClusterNetworksAnnotation] = formatClusterNetworks(entries[1:])
+	} else {
+		delete(cn.Annotations, AdditionalClusterNetworksAnnotation)
+	}
+}
+
 func validateClusterNetwork(network string, hostSubnetLength int, serviceNetwork string, pluginName string) (*NetworkInfo, error) {
-	_, cn, err := net.ParseCIDR(network)
+	cns, err := parseClusterNetworks(network, hostSubnetLength)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse ClusterNetwork CIDR %s: %v", network, err)
+		return nil, err
 	}
 
 	_, sn, err := net.ParseCIDR(serviceNetwork)
@@ -178,15 +304,10 @@ func validateClusterNetwork(network string, hostSubnetLength int, serviceNetwork
 		return nil, fmt.Errorf("Failed to parse ServiceNetwork CIDR %s: %v", serviceNetwork, err)
 	}
 
-	if hostSubnetLength <= 0 || hostSubnetLength > 32 {
-		return nil, fmt.Errorf("Invalid HostSubnetLength %d (not between 1 and 32)", hostSubnetLength)
-	}
-
 	return &NetworkInfo{
-		ClusterNetwork:   cn,
-		ServiceNetwork:   sn,
-		HostSubnetLength: hostSubnetLength,
-		PluginName:       pluginName,
+		ClusterNetworks: cns,
+		ServiceNetwork:  sn,
+		PluginName:      pluginName,
 	}, nil
 }
 
@@ -201,7 +322,11 @@ func (registry *Registry) GetNetworkInfo() (*NetworkInfo, error) {
 		return nil, err
 	}
 
-	registry.NetworkInfo, err = validateClusterNetwork(cn.Network, cn.HostSubnetLength, cn.ServiceNetwork, cn.PluginName)
+	network := cn.Network
+	if additional := cn.Annotations[AdditionalClusterNetworksAnnotation]; additional != "" {
+		network += "," + additional
+	}
+	registry.NetworkInfo, err = validateClusterNetwork(network, cn.HostSubnetLength, cn.ServiceNetwork, cn.PluginName)
 	if err != nil {
 		return nil, err
 	}
@@ -231,6 +356,10 @@ func (registry *Registry) WriteNetNamespace(name string, id uint) error {
 	return err
 }
 
+func (registry *Registry) UpdateNetNamespace(netns *osapi.NetNamespace) (*osapi.NetNamespace, error) {
+	return registry.oClient.NetNamespaces().Update(netns)
+}
+
 func (registry *Registry) DeleteNetNamespace(name string) error {
 	return registry.oClient.NetNamespaces().Delete(name)
 }
@@ -312,13 +441,17 @@ func (registry *Registry) ValidateNodeIP(nodeIP string) error {
 		return fmt.Errorf("Failed to parse node IP %s", nodeIP)
 	}
 
-	if ni.ClusterNetwork.Contains(ipaddr) {
-		return fmt.Errorf("Node IP %s conflicts with cluster network %s", nodeIP, ni.ClusterNetwork.String())
+	if ni.ClusterNetworkContains(ipaddr) {
+		return fmt.Errorf("Node IP %s conflicts with cluster network %s", nodeIP, strings.Join(ni.ClusterNetworkCIDRs(), ","))
 	}
 
 	return nil
 }
 
 func clusterNetworkToString(n *osapi.ClusterNetwork) string {
-	return fmt.Sprintf("%s (network: %q, hostSubnetBits: %d, serviceNetwork: %q, pluginName: %q)", n.Name, n.Network, n.HostSubnetLength, n.ServiceNetwork, n.PluginName)
+	var additional string
+	if networks := n.Annotations[AdditionalClusterNetworksAnnotation]; networks != "" {
+		additional = fmt.Sprintf(", additionalNetworks: %q", networks)
+	}
+	return fmt.Sprintf("%s (network: %q, hostSubnetBits: %d%s, serviceNetwork: %q, pluginName: %q)", n.Name, n.Network, n.HostSubnetLength, additional, n.ServiceNetwork, n.PluginName)
 }
@@ -3,6 +3,7 @@ package osdn
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,12 +19,25 @@ import (
 	osapi "github.com/openshift/origin/pkg/sdn/api"
 )
 
-func (master *OsdnMaster) SubnetStartMaster(clusterNetwork *net.IPNet, hostSubnetLength uint) error {
+func (master *OsdnMaster) SubnetStartMaster(clusterNetworks []ClusterNetworkEntry) error {
+	var err error
+	master.subnetAllocator, err = master.newSubnetAllocator(clusterNetworks)
+	if err != nil {
+		return err
+	}
+
+	go utilwait.Forever(master.watchNodes, 0)
+	return nil
+}
+
+// newSubnetAllocator returns a SubnetAllocator for clusterNetworks, with the
+// subnets of the existing HostSubnets allocated
+func (master *OsdnMaster) newSubnetAllocator(clusterNetworks []ClusterNetworkEntry) (*netutils.SubnetAllocator, error) {
 	subrange := make([]string, 0)
 	subnets, err := master.registry.GetSubnets()
 	if err != nil {
 		log.Errorf("Error in initializing/fetching subnets: %v", err)
-		return err
+		return nil, err
 	}
 	for _, sub := range subnets {
 		subrange = append(subrange, sub.Subnet)
@@ -35,16 +49,66 @@ func (master *OsdnMaster) SubnetStartMaster(clusterNetwork *net.IPNet, hostSubne
 		}
 	}
 
-	master.subnetAllocator, err = netutils.NewSubnetAllocator(clusterNetwork.String(), hostSubnetLength, subrange)
-	if err != nil {
-		return err
+	var ranges []netutils.SubnetRange
+	for _, cn := range clusterNetworks {
+		ranges = append(ranges, netutils.SubnetRange{Network: cn.CIDR.String(), HostBits: uint(cn.HostSubnetLength)})
 	}
+	for _, excluded := range master.excludedSubnets {
+		_, ipnet, err := net.ParseCIDR(excluded)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse excluded subnet %q: %v", excluded, err)
+		}
+		i := 0
+		for ; i < len(clusterNetworks); i++ {
+			if clusterNetworks[i].CIDR.Contains(ipnet.IP) {
+				break
+			}
+		}
+		if i == len(clusterNetworks) {
+			return nil, fmt.Errorf("Excluded subnet %s is not part of cluster network %s", ipnet, formatClusterNetworks(clusterNetworks))
+		}
+		ranges[i].Excluded = append(ranges[i].Excluded, ipnet.String())
+	}
+	return netutils.NewMultiSubnetAllocator(ranges, subrange)
+}
 
-	go utilwait.Forever(master.watchNodes, 0)
-	return nil
+// HostSubnetLengthAnnotation is the node annotation (or label) with which a node
+// can request a particular number of host bits for its subnet. It overrides the
+// master's host subnet policies, and only affects nodes that don't have a subnet
+// yet.
+const HostSubnetLengthAnnotation = "network.openshift.io/host-subnet-length"
+
+// getHostSubnetLength returns the number of host bits requested for the subnet
+// of node, or 0 if it should get the default for its cluster network
+func (master *OsdnMaster) getHostSubnetLength(node *kapi.Node) (uint, error) {
+	for _, values := range []map[string]string{node.Annotations, node.Labels} {
+		if value, ok := values[HostSubnetLengthAnnotation]; ok {
+			length, err := strconv.ParseUint(value, 10, 8)
+			if err != nil || length == 0 {
+				return 0, fmt.Errorf("Invalid %s %q", HostSubnetLengthAnnotation, value)
+			}
+			return uint(length), nil
+		}
+	}
+
+	for _, policy := range master.hostSubnetPolicies {
+		if matchesNodeSelector(policy.NodeSelector, node.Labels) {
+			return policy.HostSubnetLength, nil
+		}
+	}
+	return 0, nil
+}
+
+func matchesNodeSelector(selector, nodeLabels map[string]string) bool {
+	for key, value := range selector {
+		if nodeLabels[key] != value {
+			return false
+		}
+	}
+	return true
 }
 
-func (master *OsdnMaster) addNode(nodeName string, nodeIP string) error {
+func (master *OsdnMaster) addNode(nodeName string, nodeIP string, hostSubnetLength uint) error {
 	// Validate node IP before proceeding
 	if err := master.registry.ValidateNodeIP(nodeIP); err != nil {
 		return err
@@ -68,7 +132,12 @@ func (master *OsdnMaster) addNode(nodeName string, nodeIP string) error {
 	}
 
 	// Create new subnet
-	sn, err := master.subnetAllocator.GetNetwork()
+	var sn *net.IPNet
+	if hostSubnetLength == 0 {
+		sn, err = master.subnetAllocator.GetNetwork()
+	} else {
+		sn, err = master.subnetAllocator.GetNetworkWithHostBits(hostSubnetLength)
+	}
 	if err != nil {
 		return fmt.Errorf("Error allocating network for node %s: %v", nodeName, err)
 	}
@@ -101,14 +170,6 @@ func (master *OsdnMaster) deleteNode(nodeName string) error {
 	return nil
 }
 
-func getNodeIP(node *kapi.Node) (string, error) {
-	if len(node.Status.Addresses) > 0 && node.Status.Addresses[0].Address != "" {
-		return node.Status.Addresses[0].Address, nil
-	} else {
-		return netutils.GetNodeIP(node.Name)
-	}
-}
-
 func (master *OsdnMaster) watchNodes() {
 	eventQueue := master.registry.RunEventQueue(Nodes)
 	nodeAddressMap := map[types.UID]string{}
@@ -123,7 +184,7 @@ func (master *OsdnMaster) watchNodes() {
 		name := node.ObjectMeta.Name
 		uid := node.ObjectMeta.UID
 
-		nodeIP, err := getNodeIP(node)
+		nodeIP, err := master.getNodeIP(node)
 		if err != nil {
 			log.Errorf("Failed to get node IP for %s, skipping event: %v, node: %v", name, eventType, node)
 			continue
@@ -137,7 +198,14 @@ func (master *OsdnMaster) watchNodes() {
 			// Node status is frequently updated by kubelet, so log only if the above condition is not met
 			log.V(5).Infof("Watch %s event for Node %q", strings.Title(string(eventType)), name)
 
-			err = master.addNode(name, nodeIP)
+			hostSubnetLength, err := master.getHostSubnetLength(node)
+			if err != nil {
+				log.Errorf("Error creating subnet for node %s, ip %s: %v", name, nodeIP, err)
+				continue
+			}
+			master.lock.Lock()
+			err = master.addNode(name, nodeIP, hostSubnetLength)
+			master.lock.Unlock()
 			if err != nil {
 				log.Errorf("Error creating subnet for node %s, ip %s: %v", name, nodeIP, err)
 				continue
@@ -147,7 +215,9 @@ func (master *OsdnMaster) watchNodes() {
 			log.V(5).Infof("Watch %s event for Node %q", strings.Title(string(eventType)), name)
 			delete(nodeAddressMap, uid)
 
+			master.lock.Lock()
 			err := master.deleteNode(name)
+			master.lock.Unlock()
 			if err != nil {
 				log.Errorf("Error deleting node %s: %v", name, err)
 			}
@@ -160,13 +230,22 @@ func (node *OsdnNode) SubnetStartNode(mtu uint) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	_, localSubnet, err := net.ParseCIDR(node.localSubnet.Subnet)
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse local subnet %q: %v", node.localSubnet.Subnet, err)
+	}
+	dockerSubnet := getDockerSubnet(localSubnet).String()
+	node.ipam, err = netutils.NewHostLocalIPAMWithReserved(node.localSubnet.Subnet, []string{dockerSubnet}, ipamDir)
+	if err != nil {
+		return false, fmt.Errorf("Failed to initialize pod IP allocation: %v", err)
+	}
 
 	// Assume we are working with IPv4
 	ni, err := node.registry.GetNetworkInfo()
 	if err != nil {
 		return false, err
 	}
-	networkChanged, err := node.SetupSDN(node.localSubnet.Subnet, ni.ClusterNetwork.String(), ni.ServiceNetwork.String(), mtu)
+	networkChanged, err := node.SetupSDN(node.localSubnet.Subnet, ni.ClusterNetworkCIDRs(), ni.ServiceNetwork.String(), mtu)
 	if err != nil {
 		return false, err
 	}
@@ -200,6 +279,10 @@ func (node *OsdnNode) initSelfSubnet() error {
 		return fmt.Errorf("Failed to validate own HostSubnet: %v", err)
 	}
 
+	if subnet.HostIP != node.localIP {
+		log.Warningf("Local HostSubnet has HostIP %s but this node's IP is %s; check that the master and node choose node IPs the same way", subnet.HostIP, node.localIP)
+	}
+
 	log.Infof("Found local HostSubnet %s", hostSubnetToString(subnet))
 	node.localSubnet = subnet
 	return nil
@@ -137,9 +137,7 @@ func (master *OsdnMaster) VnidStartMaster() error {
 		return err
 	}
 
-	// VNID: 0 reserved for default namespace and can reach any network in the cluster
-	// VNID: 1 to 9 are internally reserved for any special cases in the future
-	master.netIDManager, err = netutils.NewNetIDAllocator(10, MaxVNID, master.vnids.GetAllocatedVNIDs())
+	master.netIDManager, err = master.newNetIDAllocator(master.vnids.GetAllocatedVNIDs())
 	if err != nil {
 		return err
 	}
@@ -151,6 +149,38 @@ func (master *OsdnMaster) VnidStartMaster() error {
 	return nil
 }
 
+// reservedVNIDRanges returns the ranges of VNIDs that are never allocated
+func (master *OsdnMaster) reservedVNIDRanges() []netutils.NetIDRange {
+	// VNID: 0 reserved for default namespace and can reach any network in the cluster
+	// VNID: 1 to 9 are internally reserved for any special cases in the future
+	reserved := []netutils.NetIDRange{{Name: "internal", Min: 1, Max: 9}}
+	for _, r := range master.reservedVNIDs {
+		reserved = append(reserved, netutils.NetIDRange{Name: r.Name, Min: r.Min, Max: r.Max})
+	}
+	return reserved
+}
+
+// newNetIDAllocator returns a NetIDAllocator for VNIDs, with inUse allocated
+func (master *OsdnMaster) newNetIDAllocator(inUse []uint) (*netutils.NetIDAllocator, error) {
+	return netutils.NewNetIDAllocatorWithReserved(1, MaxVNID, master.reservedVNIDRanges(), inUse)
+}
+
+// isValidVNID returns true if netid can be assigned to a NetNamespace
+func (master *OsdnMaster) isValidVNID(netid uint) bool {
+	if netid == AdminVNID {
+		return true
+	}
+	if netid > MaxVNID {
+		return false
+	}
+	for _, r := range master.reservedVNIDRanges() {
+		if netid >= r.Min && netid <= r.Max {
+			return false
+		}
+	}
+	return true
+}
+
 func (master *OsdnMaster) isAdminNamespace(nsName string) bool {
 	for _, name := range master.adminNamespaces {
 		if name == nsName {
@@ -215,8 +245,9 @@ func (master *OsdnMaster) revokeVNID(namespaceName string) error {
 
 	// Skip NetID release if
 	// - Value matches AdminVNID as it is not part of NetID allocation or
+	// - NetID is in a reserved range, which the allocator doesn't track or
 	// - NetID is not found in the vnid map
-	if (netid == AdminVNID) || !netid_found {
+	if (netid == AdminVNID) || !master.isValidVNID(netid) || !netid_found {
 		return nil
 	}
 
@@ -249,13 +280,17 @@ func (master *OsdnMaster) watchNamespaces() {
 		log.V(5).Infof("Watch %s event for Namespace %q", strings.Title(string(eventType)), name)
 		switch eventType {
 		case watch.Added, watch.Modified:
+			master.lock.Lock()
 			err := master.assignVNID(name)
+			master.lock.Unlock()
 			if err != nil {
 				log.Errorf("Error assigning netid: %v", err)
 				continue
 			}
 		case watch.Deleted:
+			master.lock.Lock()
 			err := master.revokeVNID(name)
+			master.lock.Unlock()
 			if err != nil {
 				log.Errorf("Error revoking netid: %v", err)
 				continue